@@ -96,7 +96,7 @@ export class RoomConnectionManager {
 
       this.ws.onmessage = this.handleWsMessage;
     
-      const namePayload: Join = { name: this.userName };
+      const namePayload: Join = { name: this.userName, rollback: true };
       this.sendMessage("join", namePayload);
     } catch (err) {
       console.error("Error during connection setup:", err);
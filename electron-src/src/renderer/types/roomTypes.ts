@@ -45,6 +45,8 @@ export interface PeerExit {
 
 export interface Join {
   name: string;
+  // Chromium rolls our offer back when the SFU's collides with it, so the SFU may ignore ours
+  rollback?: boolean;
 }
 
 // Used to request a screen share from the server
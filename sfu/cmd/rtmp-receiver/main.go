@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sfu/internal/egress"
+	"time"
+)
+
+// rtmp-receiver stands in for a streaming platform's ingest: it accepts RTMP streams, e.g. from the
+// SFU's egress, and writes each to an FLV file that ffprobe or a player can open.
+func main() {
+	addr := flag.String("addr", ":1935", "address to accept RTMP connections on")
+	out := flag.String("out", ".", "directory to write the FLV files to")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalf("failed to create %s: %v", *out, err)
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	receiver := &egress.Receiver{
+		OnPublish: func(app string, streamKey string) (egress.TagHandler, error) {
+			if streamKey == "" || filepath.Base(streamKey) != streamKey {
+				return nil, errors.New("invalid stream key")
+			}
+			path := filepath.Join(*out, fmt.Sprintf("%s-%s-%s.flv", filepath.Base(app), streamKey, time.Now().Format("20060102-150405")))
+			file, err := os.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			writer, err := egress.NewFLVWriter(file)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			log.Printf("Writing %s/%s to %s", app, streamKey, path)
+			return writer, nil
+		},
+	}
+	fmt.Println("RTMP receiver listening on", listener.Addr())
+	if err := receiver.Serve(listener); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
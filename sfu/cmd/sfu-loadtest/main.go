@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type config struct {
+	url        string
+	video      string
+	audio      string
+	fps        int
+	noVideo    bool
+	noAudio    bool
+	keyFrameIn time.Duration
+	// Signs the participants' join tokens, nil when the SFU doesn't require any
+	signer      auth.Signer
+	joinTimeout time.Duration
+}
+
+// sources returns what a participant publishes, the files when given and generated media otherwise
+func (c *config) sources(id string) ([]client.Source, error) {
+	var sources []client.Source
+	if !c.noVideo {
+		var source client.Source
+		var err error
+		if c.video != "" {
+			source, err = client.NewIVFSource(c.video, "video", id, true)
+		} else {
+			source, err = client.NewGeneratedVideo("video", id, c.fps, c.keyFrameIn)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if !c.noAudio {
+		var source client.Source
+		var err error
+		if c.audio != "" {
+			source, err = client.NewOggSource(c.audio, "audio", id, true)
+		} else {
+			source, err = client.NewGeneratedAudio("audio", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// token signs the participant's join token, it only needs to outlive the join
+func (c *config) token(roomId string, id string) (string, error) {
+	if c.signer == nil {
+		return "", nil
+	}
+	return c.signer.Sign(&auth.Claims{
+		UserID:    auth.ID(id),
+		RoomID:    roomId,
+		Role:      string(sfu.RolePanelist),
+		ExpiresAt: time.Now().Add(c.joinTimeout).Unix() + 1,
+	})
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.url, "url", "ws://localhost:50051/ws", "signaling URL of the SFU under test")
+	participants := flag.Int("participants", 10, "number of synthetic participants")
+	roomSize := flag.Int("room-size", 10, "participants per room, they are spread over as many rooms as needed")
+	roomPrefix := flag.String("room-prefix", "loadtest", "prefix of the room ids")
+	rampUp := flag.Duration("ramp-up", 100*time.Millisecond, "delay between two participants joining")
+	duration := flag.Duration("duration", time.Minute, "how long to keep everyone in the rooms once all joined")
+	flag.DurationVar(&cfg.joinTimeout, "join-timeout", 20*time.Second, "how long a participant may take to connect")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "secret the SFU verifies join tokens with, participants join without tokens when empty")
+	flag.StringVar(&cfg.video, "video", "", "IVF file every participant publishes in a loop, generated VP8 when empty")
+	flag.StringVar(&cfg.audio, "audio", "", "Ogg Opus file every participant publishes in a loop, generated silence when empty")
+	flag.IntVar(&cfg.fps, "fps", 30, "frame rate of the generated video")
+	flag.DurationVar(&cfg.keyFrameIn, "key-frame-interval", 2*time.Second, "key frame interval of the generated video")
+	flag.BoolVar(&cfg.noVideo, "no-video", false, "publish no video")
+	flag.BoolVar(&cfg.noAudio, "no-audio", false, "publish no audio")
+	sfuPid := flag.Int("sfu-pid", 0, "pid of the SFU under test, its CPU usage is reported when it runs on this machine")
+	flag.Parse()
+	if *roomSize < 1 {
+		log.Fatalf("invalid room size %d", *roomSize)
+	}
+	if *jwtSecret != "" {
+		cfg.signer = auth.NewSigner([]byte(*jwtSecret))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var cpu *cpuSampler
+	if *sfuPid != 0 {
+		cpu = newCPUSampler(*sfuPid)
+		go cpu.run(ctx)
+	}
+
+	var (
+		joined []*participant
+		failed int
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Printf("Joining %d participants to %s", *participants, cfg.url)
+	for i := 0; i < *participants && ctx.Err() == nil; i++ {
+		roomId := fmt.Sprintf("%s-%d", *roomPrefix, i / *roomSize)
+		p, sources, err := newParticipant(&cfg, roomId, i)
+		if err != nil {
+			log.Fatalf("Failed to create participant: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			joinCtx, cancelJoin := context.WithTimeout(runCtx, cfg.joinTimeout)
+			defer cancelJoin()
+			if err := p.join(joinCtx); err != nil {
+				log.Printf("%s failed to join: %v", p.id, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			for _, source := range sources {
+				go source.Run(runCtx)
+			}
+			mu.Lock()
+			joined = append(joined, p)
+			mu.Unlock()
+		}()
+
+		select {
+		case <-time.After(*rampUp):
+		case <-ctx.Done():
+		}
+	}
+	wg.Wait()
+	log.Printf("%d participants joined, %d failed", len(joined), failed)
+
+	// Measure from here on, the ramp-up skews the bitrate
+	_, _, startBytes := sum(joined)
+	if cpu != nil {
+		cpu.reset()
+	}
+	start := time.Now()
+	ticker := time.NewTicker(5 * time.Second)
+	deadline := time.After(*duration)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			received, expected, bytes := sum(joined)
+			line := fmt.Sprintf("forwarded %.2f Mbit/s, loss %.2f%%", mbps(bytes-startBytes, time.Since(start)), loss(received, expected))
+			if cpu != nil {
+				line += fmt.Sprintf(", SFU CPU %.1f%%", cpu.current())
+			}
+			log.Println(line)
+		case <-deadline:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+
+	report(joined, failed, startBytes, elapsed, cpu)
+	cancel()
+	for _, p := range joined {
+		p.client.Close()
+	}
+}
+
+func sum(participants []*participant) (received uint64, expected uint64, bytes uint64) {
+	for _, p := range participants {
+		r, e, b := p.totals()
+		received += r
+		expected += e
+		bytes += b
+	}
+	return received, expected, bytes
+}
+
+func mbps(bytes uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+}
+
+func loss(received uint64, expected uint64) float64 {
+	if expected == 0 || received >= expected {
+		return 0
+	}
+	return float64(expected-received) / float64(expected) * 100
+}
+
+func report(joined []*participant, failed int, startBytes uint64, elapsed time.Duration, cpu *cpuSampler) {
+	var joinLatencies, firstFrames []time.Duration
+	noFrame := 0
+	for _, p := range joined {
+		p.mu.Lock()
+		joinLatencies = append(joinLatencies, p.joinLatency)
+		if p.firstFrame > 0 {
+			firstFrames = append(firstFrames, p.firstFrame)
+		} else {
+			noFrame++
+		}
+		p.mu.Unlock()
+	}
+	received, expected, bytes := sum(joined)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nParticipants      %d joined, %d failed\n", len(joined), failed)
+	fmt.Fprintf(&b, "Join latency      %s\n", percentiles(joinLatencies))
+	fmt.Fprintf(&b, "First frame       %s, %d never got one\n", percentiles(firstFrames), noFrame)
+	fmt.Fprintf(&b, "Packet loss       %.2f%% (%d of %d packets)\n", loss(received, expected), expected-min(received, expected), expected)
+	fmt.Fprintf(&b, "Forwarded bitrate %.2f Mbit/s over %s\n", mbps(bytes-startBytes, elapsed), elapsed.Round(time.Second))
+	if cpu != nil {
+		average, peak := cpu.summary()
+		fmt.Fprintf(&b, "SFU CPU           %.1f%% average, %.1f%% peak (100%% is one core)\n", average, peak)
+	}
+	fmt.Print(b.String())
+}
+
+func percentiles(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "n/a"
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	at := func(q float64) time.Duration {
+		return durations[int(q*float64(len(durations)-1))].Round(time.Millisecond)
+	}
+	return "p50 " + at(0.5).String() + ", p95 " + at(0.95).String() + ", max " + at(1).String()
+}
+
+// cpuSampler reads the CPU time of a local process from /proc
+type cpuSampler struct {
+	pid     int
+	samples []float64
+	last    float64
+	lastAt  time.Time
+	mu      sync.Mutex
+}
+
+// Linux reports process times in clock ticks, 100 per second on every architecture we deploy to
+const clockTicks = 100
+
+func newCPUSampler(pid int) *cpuSampler {
+	return &cpuSampler{pid: pid}
+}
+
+func (c *cpuSampler) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.sample()
+		}
+	}
+}
+
+func (c *cpuSampler) sample() {
+	seconds, err := processCPUSeconds(c.pid)
+	if err != nil {
+		log.Printf("Failed to read CPU usage of %d: %v", c.pid, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if !c.lastAt.IsZero() {
+		c.samples = append(c.samples, (seconds-c.last)/now.Sub(c.lastAt).Seconds()*100)
+	}
+	c.last = seconds
+	c.lastAt = now
+}
+
+// reset drops the samples taken so far, e.g. during the ramp-up
+func (c *cpuSampler) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = nil
+}
+
+func (c *cpuSampler) current() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return 0
+	}
+	return c.samples[len(c.samples)-1]
+}
+
+func (c *cpuSampler) summary() (average float64, peak float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return 0, 0
+	}
+	total := 0.0
+	for _, sample := range c.samples {
+		total += sample
+		peak = max(peak, sample)
+	}
+	return total / float64(len(c.samples)), peak
+}
+
+// processCPUSeconds returns the user and system time the process used so far
+func processCPUSeconds(pid int) (float64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, the fields after it don't
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	// utime and stime are fields 14 and 15 of the whole line
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return 0, err
+	}
+	return (utime + stime) / clockTicks, nil
+}
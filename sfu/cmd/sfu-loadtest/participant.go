@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sfu/pkg/client"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// participant joins the room through the client package and measures what it receives
+type participant struct {
+	id     string
+	client client.Client
+	// Set once Join returned
+	joinLatency time.Duration
+	joinStart   time.Time
+	firstFrame  time.Duration
+	tracks      []*trackStats
+	mu          sync.Mutex
+}
+
+// trackStats counts what a subscriber received of one remote track
+type trackStats struct {
+	received uint64
+	bytes    uint64
+	// Extended sequence numbers, so that wraparound doesn't count as loss
+	firstSeq uint64
+	maxSeq   uint64
+	lastSeq  uint16
+	cycles   uint64
+	started  bool
+}
+
+func (t *trackStats) add(seq uint16, size int) {
+	t.received++
+	t.bytes += uint64(size)
+	if !t.started {
+		t.started = true
+		t.lastSeq = seq
+		t.firstSeq = uint64(seq)
+		t.maxSeq = uint64(seq)
+		return
+	}
+	if seq < t.lastSeq && t.lastSeq-seq > 1<<15 {
+		t.cycles += 1 << 16
+	}
+	t.lastSeq = seq
+	if extended := t.cycles + uint64(seq); extended > t.maxSeq {
+		t.maxSeq = extended
+	}
+}
+
+func (t *trackStats) expected() uint64 {
+	if !t.started {
+		return 0
+	}
+	return t.maxSeq - t.firstSeq + 1
+}
+
+func newParticipant(cfg *config, roomId string, index int) (*participant, []client.Source, error) {
+	id := fmt.Sprintf("load-%d", index)
+	token, err := cfg.token(roomId, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &participant{
+		id: id,
+		client: client.NewClient(client.Config{
+			URL:      cfg.url,
+			RoomID:   roomId,
+			ClientID: id,
+			Name:     id,
+			Token:    token,
+		}),
+	}
+
+	sources, err := cfg.sources(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, source := range sources {
+		if err := p.client.Publish(source.Track()); err != nil {
+			return nil, nil, err
+		}
+	}
+	p.client.OnTrack(p.subscribe)
+	return p, sources, nil
+}
+
+func (p *participant) join(ctx context.Context) error {
+	p.mu.Lock()
+	p.joinStart = time.Now()
+	p.mu.Unlock()
+	if err := p.client.Join(ctx); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.joinLatency = time.Since(p.joinStart)
+	p.mu.Unlock()
+	return nil
+}
+
+// subscribe reads the remote track until it ends
+func (p *participant) subscribe(remote *client.RemoteTrack) {
+	stats := &trackStats{}
+	p.mu.Lock()
+	p.tracks = append(p.tracks, stats)
+	p.mu.Unlock()
+
+	isVideo := remote.Track.Kind() == webrtc.RTPCodecTypeVideo
+	go func() {
+		for {
+			packet, _, err := remote.Track.ReadRTP()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			if isVideo && p.firstFrame == 0 {
+				p.firstFrame = time.Since(p.joinStart)
+			}
+			stats.add(packet.SequenceNumber, packet.MarshalSize())
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// totals sums what the participant received so far
+func (p *participant) totals() (received uint64, expected uint64, bytes uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, track := range p.tracks {
+		received += track.received
+		expected += track.expected()
+		bytes += track.bytes
+	}
+	return received, expected, bytes
+}
@@ -1,21 +1,115 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"sfu/internal/auth"
 	"sfu/internal/webrtc"
 )
 
 func main() {
+	addr := flag.String("addr", ":50051", "address to listen on")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "how long to wait for rooms to empty on shutdown")
+	reconnectDelay := flag.Duration("reconnect-delay", 5*time.Second, "reconnect delay suggested to clients while draining")
+	nodeID := flag.String("node-id", "", "identifies this node to the SFU nodes it relays with, unique among them. Random when empty.")
+	relayURL := flag.String("relay-url", "", "signaling URL of an upstream SFU node to relay rooms with, e.g. ws://localhost:50051/ws")
+	codecPolicy := flag.String("codec-policy", "", "JSON file with the default and per-room codec policies")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "secret the backend signs join tokens with, moderator actions are disabled without it")
+	eventLimits := webrtc.DefaultEventLimits()
+	flag.IntVar(&eventLimits.MaxMessageSize, "event-max-size", eventLimits.MaxMessageSize, "largest data channel event in bytes a client can send")
+	flag.Float64Var(&eventLimits.MessagesPerSecond, "event-rate", eventLimits.MessagesPerSecond, "data channel events per second a client can send")
+	flag.IntVar(&eventLimits.Burst, "event-burst", eventLimits.Burst, "data channel events a client can send at once")
+	keepalive := webrtc.DefaultKeepalive()
+	flag.DurationVar(&keepalive.PingInterval, "ping-interval", keepalive.PingInterval, "how often signaling connections are pinged")
+	flag.DurationVar(&keepalive.PongTimeout, "pong-timeout", keepalive.PongTimeout, "how long a silent signaling connection is kept before it is considered dead")
+	flag.DurationVar(&keepalive.WriteTimeout, "write-timeout", keepalive.WriteTimeout, "how long a signaling write may block before the connection is dropped")
+	statsInterval := flag.Duration("stats-interval", 5*time.Second, "how often clients are sent the stats of their connection, never when 0")
+	mediaDir := flag.String("media-dir", "", "directory of the IVF, Ogg and WebM files playback bots play, playback is disabled without it")
+	playbackURL := flag.String("playback-url", "", "signaling URL playback bots join through, this server's own on localhost by default")
+	audioTapURL := flag.String("audio-tap-url", "", "websocket endpoint, e.g. of a transcription service, that receives every room's audio")
+	flag.Parse()
 
-	// Create Router instance to handle connections
-	//router := sfu.NewRouter()
+	if *playbackURL == "" {
+		_, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			log.Fatalf("invalid address %s: %v", *addr, err)
+		}
+		*playbackURL = "ws://localhost:" + port + "/ws"
+	}
 
-	// Start the websocket server
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		webrtc.HandleSession(w, r)
+	codecs := webrtc.CodecPolicies{Default: webrtc.DefaultCodecPolicy()}
+	if *codecPolicy != "" {
+		var err error
+		if codecs, err = webrtc.LoadCodecPolicies(*codecPolicy); err != nil {
+			log.Fatalf("failed to load codec policy: %v", err)
+		}
+	}
+
+	var tokens auth.Verifier
+	var signer auth.Signer
+	if *jwtSecret != "" {
+		tokens = auth.NewVerifier([]byte(*jwtSecret))
+		signer = auth.NewSigner([]byte(*jwtSecret))
+	} else {
+		log.Println("No JWT secret configured, join tokens are ignored")
+	}
+
+	// Create the signaling server to handle connections
+	server := webrtc.NewServer(webrtc.Config{
+		ReconnectDelay: *reconnectDelay,
+		NodeID:         *nodeID,
+		RelayURL:       *relayURL,
+		Codecs:         codecs,
+		Tokens:         tokens,
+		Signer:         signer,
+		Events:         eventLimits,
+		Keepalive:      keepalive,
+		StatsInterval:  *statsInterval,
+		MediaDir:       *mediaDir,
+		PlaybackURL:    *playbackURL,
+		AudioTapURL:    *audioTapURL,
 	})
-	fmt.Println("Server listening on port 50051")
-	http.ListenAndServe(":50051", nil)
+
+	// Start the websocket server
+	http.HandleFunc("/ws", server.HandleSession)
+	http.HandleFunc("/debug/writers", server.HandleWriterStats)
+	http.HandleFunc("/playback", server.HandlePlayback)
+	http.HandleFunc("/egress", server.HandleEgress)
+	http.HandleFunc("/hls/", server.HandleHLS)
+	http.HandleFunc("/thumbnails/", server.HandleThumbnails)
+	httpServer := &http.Server{Addr: *addr}
+	go func() {
+		fmt.Println("Server listening on", *addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	// Wait for the deploy to ask us to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	<-ctx.Done()
+	stop()
+
+	// Stop accepting new signaling connections, existing websockets are hijacked and stay open
+	log.Println("Shutting down, draining rooms")
+	if err := httpServer.Shutdown(context.Background()); err != nil {
+		log.Printf("Failed to shut down HTTP server: %v", err)
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.Printf("Drain incomplete: %v", err)
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformed = errors.New("malformed token")
+	errSignature = errors.New("invalid token signature")
+	errExpired   = errors.New("token expired")
+)
+
+// Claims are what the backend vouches for about a client in the token it joins with
+type Claims struct {
+	UserID ID `json:"userId"`
+	// The room the token is valid for, tokens without one are valid for every room
+	RoomID string `json:"roomId,omitempty"`
+	// Moderators can mute, stop and remove the other participants and lock the room
+	Moderator bool `json:"moderator,omitempty"`
+	// host, panelist or attendee, hosts are moderators as well
+	Role string `json:"role,omitempty"`
+	// The SFU node the token lets relay rooms, only set in the tokens the nodes sign for each other
+	NodeID    string `json:"nodeId,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// ID is a claim the backend may encode as a number or a string
+type ID string
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = ID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = ID(n.String())
+	return nil
+}
+
+type Verifier interface {
+	Verify(token string) (*Claims, error)
+}
+
+type hmacVerifier struct {
+	secret []byte
+}
+
+// NewVerifier checks HS256 tokens signed with the secret the backend signs its tokens with
+func NewVerifier(secret []byte) Verifier {
+	return &hmacVerifier{secret: secret}
+}
+
+func (v *hmacVerifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+	header, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, errMalformed
+	}
+	// Only accept the algorithm we sign with, a token can't pick a weaker one
+	if h.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", h.Alg)
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errSignature
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errMalformed
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errExpired
+	}
+	return &claims, nil
+}
+
+type Signer interface {
+	Sign(claims *Claims) (string, error)
+}
+
+type hmacSigner struct {
+	secret []byte
+}
+
+// NewSigner signs HS256 tokens like the backend does, for the clients the SFU joins to rooms itself
+func NewSigner(secret []byte) Signer {
+	return &hmacSigner{secret: secret}
+}
+
+func (s *hmacSigner) Sign(claims *Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode(payload)
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil)), nil
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil, errMalformed
+	}
+	return data, nil
+}
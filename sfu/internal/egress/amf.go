@@ -0,0 +1,193 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers, only the ones RTMP commands and stream metadata use
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+)
+
+// amfObjectValue is an AMF0 object, its keys are written in sorted order
+type amfObjectValue map[string]any
+
+// amfECMAArrayValue is an AMF0 associative array, e.g. the onMetaData of a stream
+type amfECMAArrayValue map[string]any
+
+// amfEncode writes the values in AMF0: float64, int, bool, string, nil, objects, arrays and string slices
+func amfEncode(values ...any) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, value := range values {
+		if err := amfWrite(&buf, value); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func amfWrite(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(amfNull)
+	case float64:
+		buf.WriteByte(amfNumber)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int:
+		return amfWrite(buf, float64(v))
+	case bool:
+		buf.WriteByte(amfBoolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		buf.WriteByte(amfString)
+		amfWriteKey(buf, v)
+	case []string:
+		buf.WriteByte(amfStrictArray)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for _, s := range v {
+			amfWrite(buf, s)
+		}
+	case amfObjectValue:
+		buf.WriteByte(amfObject)
+		return amfWriteProperties(buf, v)
+	case amfECMAArrayValue:
+		buf.WriteByte(amfECMAArray)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		return amfWriteProperties(buf, v)
+	default:
+		return fmt.Errorf("can't encode %T in AMF0", value)
+	}
+	return nil
+}
+
+func amfWriteKey(buf *bytes.Buffer, key string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+	buf.WriteString(key)
+}
+
+func amfWriteProperties(buf *bytes.Buffer, properties map[string]any) error {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		amfWriteKey(buf, key)
+		if err := amfWrite(buf, properties[key]); err != nil {
+			return err
+		}
+	}
+	buf.Write([]byte{0, 0, amfObjectEnd})
+	return nil
+}
+
+var errShortAMF = errors.New("truncated AMF0 value")
+
+// amfDecode reads every value of an AMF0 message. Objects and ECMA arrays are decoded to amfObjectValue,
+// strict arrays to []any.
+func amfDecode(data []byte) ([]any, error) {
+	var values []any
+	for len(data) > 0 {
+		value, rest, err := amfRead(data)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+		data = rest
+	}
+	return values, nil
+}
+
+func amfRead(data []byte) (any, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errShortAMF
+	}
+	marker, data := data[0], data[1:]
+	switch marker {
+	case amfNumber:
+		if len(data) < 8 {
+			return nil, nil, errShortAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	case amfBoolean:
+		if len(data) < 1 {
+			return nil, nil, errShortAMF
+		}
+		return data[0] != 0, data[1:], nil
+	case amfString:
+		return amfReadKey(data)
+	case amfNull, amfUndefined:
+		return nil, data, nil
+	case amfObject:
+		return amfReadProperties(data)
+	case amfECMAArray:
+		if len(data) < 4 {
+			return nil, nil, errShortAMF
+		}
+		return amfReadProperties(data[4:])
+	case amfStrictArray:
+		if len(data) < 4 {
+			return nil, nil, errShortAMF
+		}
+		count := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		values := []any{}
+		for i := uint32(0); i < count; i++ {
+			value, rest, err := amfRead(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			values = append(values, value)
+			data = rest
+		}
+		return values, data, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported AMF0 type %#x", marker)
+}
+
+func amfReadKey(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errShortAMF
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, errShortAMF
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+func amfReadProperties(data []byte) (any, []byte, error) {
+	properties := amfObjectValue{}
+	for {
+		key, rest, err := amfReadKey(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key == "" && len(rest) > 0 && rest[0] == amfObjectEnd {
+			return properties, rest[1:], nil
+		}
+		value, rest, err := amfRead(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		properties[key] = value
+		data = rest
+	}
+}
@@ -0,0 +1,98 @@
+package egress
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAMFRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		// What amfDecode returns for the value
+		decoded any
+	}{
+		{"number", 1.5, 1.5},
+		{"int", 3, 3.0},
+		{"true", true, true},
+		{"false", false, false},
+		{"string", "connect", "connect"},
+		{"empty string", "", ""},
+		{"null", nil, nil},
+		{"object", amfObjectValue{"app": "live", "tcUrl": "rtmp://host/live"}, amfObjectValue{"app": "live", "tcUrl": "rtmp://host/live"}},
+		{"empty object", amfObjectValue{}, amfObjectValue{}},
+		{
+			"nested object",
+			amfObjectValue{"level": "status", "info": amfObjectValue{"code": 200, "ok": true}},
+			amfObjectValue{"level": "status", "info": amfObjectValue{"code": 200.0, "ok": true}},
+		},
+		{"ECMA array", amfECMAArrayValue{"duration": 0, "encoder": "sfu"}, amfObjectValue{"duration": 0.0, "encoder": "sfu"}},
+		{"strict array", []string{"a", "b"}, []any{"a", "b"}},
+		{"empty strict array", []string{}, []any{}},
+	}
+	for _, tt := range tests {
+		data, err := amfEncode(tt.value)
+		if err != nil {
+			t.Errorf("%s: failed to encode: %v", tt.name, err)
+			continue
+		}
+		values, err := amfDecode(data)
+		if err != nil {
+			t.Errorf("%s: failed to decode % x: %v", tt.name, data, err)
+			continue
+		}
+		if len(values) != 1 || !reflect.DeepEqual(values[0], tt.decoded) {
+			t.Errorf("%s: decoded %#v, want %#v", tt.name, values, tt.decoded)
+		}
+		// Any value cut short is an error, not a shorter value
+		for n := 1; n < len(data); n++ {
+			if _, err := amfDecode(data[:n]); err == nil {
+				t.Errorf("%s: decoded the first %d of %d bytes", tt.name, n, len(data))
+				break
+			}
+		}
+	}
+}
+
+func TestAMFCommand(t *testing.T) {
+	data, err := amfEncode("connect", 1, amfObjectValue{"app": "live"}, nil)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	values, err := amfDecode(data)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	want := []any{"connect", 1.0, amfObjectValue{"app": "live"}, nil}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("decoded %#v, want %#v", values, want)
+	}
+}
+
+func TestAMFKeysSorted(t *testing.T) {
+	data, err := amfEncode(amfObjectValue{"b": 1, "a": 2})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	want, _ := amfEncode(amfObjectValue{"a": 2, "b": 1})
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("encoded % x, want % x", data, want)
+	}
+	if data[1] != 0 || data[2] != 1 || data[3] != 'a' {
+		t.Fatalf("object starts with % x, want key a", data[1:4])
+	}
+}
+
+func TestAMFUnsupported(t *testing.T) {
+	if _, err := amfEncode(struct{}{}); err == nil {
+		t.Error("encoded a struct")
+	}
+	// A date
+	if _, err := amfDecode([]byte{0x0b, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("decoded an unsupported type")
+	}
+	values, err := amfDecode([]byte{amfUndefined})
+	if err != nil || len(values) != 1 || values[0] != nil {
+		t.Errorf("decoded undefined as %v, %v, want nil", values, err)
+	}
+}
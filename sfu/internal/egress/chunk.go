@@ -0,0 +1,262 @@
+package egress
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RTMP message types
+const (
+	rtmpSetChunkSize     = 1
+	rtmpAbort            = 2
+	rtmpAcknowledgement  = 3
+	rtmpUserControl      = 4
+	rtmpWindowAckSize    = 5
+	rtmpSetPeerBandwidth = 6
+	rtmpAudio            = 8
+	rtmpVideo            = 9
+	rtmpDataAMF0         = 18
+	rtmpCommandAMF0      = 20
+)
+
+// Chunk stream ids the messages are sent on, as other RTMP encoders do
+const (
+	csidControl = 2
+	csidCommand = 3
+	csidAudio   = 4
+	csidData    = 5
+	csidVideo   = 6
+)
+
+const (
+	rtmpDefaultChunkSize = 128
+	// The chunk size this side sends with, most frames fit one chunk
+	rtmpChunkSize     = 4096
+	rtmpHandshakeSize = 1536
+	// Larger messages are refused, nobody sends video frames this big
+	rtmpMaxMessageSize = 16 << 20
+	// Timestamps from here on are sent as an extended timestamp
+	rtmpExtendedTimestamp = 0xffffff
+)
+
+// rtmpMessage is a complete message of the chunk stream
+type rtmpMessage struct {
+	csid      uint32
+	typeId    uint8
+	streamId  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkReader reassembles messages from the chunks of the peer
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize int
+	// Chunk stream id -> the header of its last chunk and the message being reassembled
+	streams map[uint32]*chunkStream
+}
+
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    int
+	typeId    uint8
+	streamId  uint32
+	extended  bool
+	payload   []byte
+}
+
+func newChunkReader(r *bufio.Reader) *chunkReader {
+	return &chunkReader{r: r, chunkSize: rtmpDefaultChunkSize, streams: make(map[uint32]*chunkStream)}
+}
+
+// readMessage reads chunks until a message is complete, chunk size changes are applied on the way
+func (c *chunkReader) readMessage() (*rtmpMessage, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.typeId == rtmpSetChunkSize {
+			if len(msg.payload) < 4 {
+				return nil, errors.New("malformed set chunk size")
+			}
+			size := int(binary.BigEndian.Uint32(msg.payload) & 0x7fffffff)
+			if size < 1 || size > rtmpMaxMessageSize {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.chunkSize = size
+		}
+		return msg, nil
+	}
+}
+
+// readChunk reads one chunk and returns the message it completes, nil when more chunks follow
+func (c *chunkReader) readChunk() (*rtmpMessage, error) {
+	first, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	format := first >> 6
+	csid := uint32(first & 0x3f)
+	switch csid {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	stream, exists := c.streams[csid]
+	if !exists {
+		if format != 0 {
+			return nil, fmt.Errorf("chunk stream %d starts without a full header", csid)
+		}
+		stream = &chunkStream{}
+		c.streams[csid] = stream
+	}
+	headerLength := [4]int{11, 7, 3, 0}[format]
+	var header [11]byte
+	if _, err := io.ReadFull(c.r, header[:headerLength]); err != nil {
+		return nil, err
+	}
+	if format < 3 {
+		field := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		stream.extended = field == rtmpExtendedTimestamp
+		if format == 0 {
+			stream.timestamp = field
+			stream.delta = 0
+		} else {
+			stream.delta = field
+		}
+		if format < 2 {
+			stream.length = int(header[3])<<16 | int(header[4])<<8 | int(header[5])
+			stream.typeId = header[6]
+			if stream.length > rtmpMaxMessageSize {
+				return nil, fmt.Errorf("message of %d bytes is too large", stream.length)
+			}
+		}
+		if format == 0 {
+			stream.streamId = binary.LittleEndian.Uint32(header[7:11])
+		}
+	}
+	if stream.extended {
+		var ext [4]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return nil, err
+		}
+		if format == 0 {
+			stream.timestamp = binary.BigEndian.Uint32(ext[:])
+		} else if format < 3 {
+			stream.delta = binary.BigEndian.Uint32(ext[:])
+		}
+	}
+	// A new message starts unless the stream is in the middle of one
+	if len(stream.payload) == 0 && format != 0 {
+		stream.timestamp += stream.delta
+	}
+
+	n := min(c.chunkSize, stream.length-len(stream.payload))
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		return nil, err
+	}
+	stream.payload = append(stream.payload, chunk...)
+	if len(stream.payload) < stream.length {
+		return nil, nil
+	}
+	msg := &rtmpMessage{
+		csid:      csid,
+		typeId:    stream.typeId,
+		streamId:  stream.streamId,
+		timestamp: stream.timestamp,
+		payload:   stream.payload,
+	}
+	stream.payload = nil
+	return msg, nil
+}
+
+// chunkWriter splits messages into chunks, every message starts with a full header
+type chunkWriter struct {
+	w         *bufio.Writer
+	chunkSize int
+}
+
+func (c *chunkWriter) writeMessage(msg *rtmpMessage) error {
+	timestamp := msg.timestamp
+	extended := timestamp >= rtmpExtendedTimestamp
+	field := timestamp
+	if extended {
+		field = rtmpExtendedTimestamp
+	}
+	header := []byte{
+		byte(msg.csid & 0x3f),
+		byte(field >> 16), byte(field >> 8), byte(field),
+		byte(len(msg.payload) >> 16), byte(len(msg.payload) >> 8), byte(len(msg.payload)),
+		msg.typeId,
+		0, 0, 0, 0,
+	}
+	binary.LittleEndian.PutUint32(header[8:], msg.streamId)
+	if extended {
+		header = binary.BigEndian.AppendUint32(header, timestamp)
+	}
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	payload := msg.payload
+	for {
+		n := min(c.chunkSize, len(payload))
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		continuation := []byte{0xc0 | byte(msg.csid&0x3f)}
+		if extended {
+			continuation = binary.BigEndian.AppendUint32(continuation, timestamp)
+		}
+		if _, err := c.w.Write(continuation); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+func (c *chunkWriter) writeCommand(csid uint32, streamId uint32, values ...any) error {
+	payload, err := amfEncode(values...)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(&rtmpMessage{csid: csid, typeId: rtmpCommandAMF0, streamId: streamId, payload: payload})
+}
+
+func (c *chunkWriter) writeControl(typeId uint8, value uint32, extra ...byte) error {
+	payload := binary.BigEndian.AppendUint32(nil, value)
+	return c.writeMessage(&rtmpMessage{csid: csidControl, typeId: typeId, payload: append(payload, extra...)})
+}
+
+// handshakeChunk is C1 or S1, a time and random bytes. Neither side checks the other's, so the digest of
+// the complex handshake isn't needed.
+func handshakeChunk() []byte {
+	chunk := make([]byte, rtmpHandshakeSize)
+	binary.BigEndian.PutUint32(chunk, uint32(time.Now().Unix()))
+	rand.Read(chunk[8:])
+	return chunk
+}
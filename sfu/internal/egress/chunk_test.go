@@ -0,0 +1,146 @@
+package egress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+func TestChunkWriterSplits(t *testing.T) {
+	tests := []struct {
+		name      string
+		length    int
+		timestamp uint32
+		// Bytes written: the full header, the payload and a header for each chunk after the first
+		size int
+	}{
+		{"empty", 0, 40, 12},
+		{"one byte", 1, 40, 13},
+		{"one short of a chunk", 127, 40, 12 + 127},
+		{"exactly one chunk", 128, 40, 12 + 128},
+		{"one past a chunk", 129, 40, 12 + 129 + 1},
+		{"exactly two chunks", 256, 40, 12 + 256 + 1},
+		{"one past two chunks", 257, 40, 12 + 257 + 2},
+		{"largest plain timestamp", 129, rtmpExtendedTimestamp - 1, 12 + 129 + 1},
+		// Every chunk repeats the extended timestamp
+		{"extended timestamp", 1, rtmpExtendedTimestamp, 12 + 4 + 1},
+		{"extended timestamp over chunks", 257, 0x12345678, 12 + 4 + 257 + 2*5},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		writer := &chunkWriter{w: bufio.NewWriter(&buf), chunkSize: rtmpDefaultChunkSize}
+		sent := &rtmpMessage{csid: csidVideo, typeId: rtmpVideo, streamId: 1, timestamp: tt.timestamp, payload: testPayload(tt.length)}
+		if err := writer.writeMessage(sent); err != nil {
+			t.Fatalf("%s: failed to write: %v", tt.name, err)
+		}
+		if buf.Len() != tt.size {
+			t.Errorf("%s: wrote %d bytes, want %d", tt.name, buf.Len(), tt.size)
+			continue
+		}
+
+		reader := newChunkReader(bufio.NewReader(&buf))
+		msg, err := reader.readMessage()
+		if err != nil {
+			t.Errorf("%s: failed to read: %v", tt.name, err)
+			continue
+		}
+		if msg.csid != sent.csid || msg.typeId != sent.typeId || msg.streamId != sent.streamId || msg.timestamp != sent.timestamp {
+			t.Errorf("%s: read csid %d type %d stream %d at %d, want csid %d type %d stream %d at %d", tt.name,
+				msg.csid, msg.typeId, msg.streamId, msg.timestamp, sent.csid, sent.typeId, sent.streamId, sent.timestamp)
+		}
+		if !bytes.Equal(msg.payload, sent.payload) {
+			t.Errorf("%s: read %d bytes of payload, want %d", tt.name, len(msg.payload), len(sent.payload))
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left unread", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestChunkReaderSetChunkSize(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &chunkWriter{w: bufio.NewWriter(&buf), chunkSize: rtmpDefaultChunkSize}
+	if err := writer.writeControl(rtmpSetChunkSize, rtmpChunkSize); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	writer.chunkSize = rtmpChunkSize
+	payload := testPayload(2*rtmpChunkSize + 1)
+	if err := writer.writeMessage(&rtmpMessage{csid: csidVideo, typeId: rtmpVideo, streamId: 1, payload: payload}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	reader := newChunkReader(bufio.NewReader(&buf))
+	msg, err := reader.readMessage()
+	if err != nil || msg.typeId != rtmpSetChunkSize {
+		t.Fatalf("read %v, %v, want the chunk size", msg, err)
+	}
+	if reader.chunkSize != rtmpChunkSize {
+		t.Fatalf("chunk size %d, want %d", reader.chunkSize, rtmpChunkSize)
+	}
+	// Read with the default chunk size the continuation headers would be taken for payload
+	msg, err = reader.readMessage()
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.Equal(msg.payload, payload) {
+		t.Fatalf("read %d bytes of payload, want %d", len(msg.payload), len(payload))
+	}
+
+	for _, size := range []uint32{0, rtmpMaxMessageSize + 1} {
+		data := []byte{csidControl, 0, 0, 0, 0, 0, 4, rtmpSetChunkSize, 0, 0, 0, 0}
+		data = binary.BigEndian.AppendUint32(data, size)
+		if _, err := newChunkReader(bufio.NewReader(bytes.NewReader(data))).readMessage(); err == nil {
+			t.Errorf("accepted a chunk size of %d", size)
+		}
+	}
+}
+
+func TestChunkReaderHeaderFormats(t *testing.T) {
+	data := []byte{
+		// A full header at 1000 with 3 bytes of payload
+		csidAudio, 0, 0x03, 0xe8, 0, 0, 3, rtmpAudio, 1, 0, 0, 0, 1, 2, 3,
+		// The same stream 20 later with 2 bytes
+		1<<6 | csidAudio, 0, 0, 20, 0, 0, 2, rtmpAudio, 4, 5,
+		// Same length and type, 30 later
+		2<<6 | csidAudio, 0, 0, 30, 6, 7,
+		// Everything repeated, the delta as well
+		3<<6 | csidAudio, 8, 9,
+	}
+	want := []struct {
+		timestamp uint32
+		payload   []byte
+	}{
+		{1000, []byte{1, 2, 3}},
+		{1020, []byte{4, 5}},
+		{1050, []byte{6, 7}},
+		{1080, []byte{8, 9}},
+	}
+	reader := newChunkReader(bufio.NewReader(bytes.NewReader(data)))
+	for i, w := range want {
+		msg, err := reader.readMessage()
+		if err != nil {
+			t.Fatalf("message %d: failed to read: %v", i, err)
+		}
+		if msg.timestamp != w.timestamp || msg.streamId != 1 || msg.typeId != rtmpAudio || !bytes.Equal(msg.payload, w.payload) {
+			t.Errorf("message %d: read stream %d type %d at %d with % x, want stream 1 type %d at %d with % x", i,
+				msg.streamId, msg.typeId, msg.timestamp, msg.payload, rtmpAudio, w.timestamp, w.payload)
+		}
+	}
+
+	if _, err := newChunkReader(bufio.NewReader(bytes.NewReader([]byte{1<<6 | csidAudio, 0, 0, 20, 0, 0, 2, rtmpAudio, 4, 5}))).readMessage(); err == nil {
+		t.Error("accepted a chunk stream that starts without a full header")
+	}
+	tooLarge := []byte{csidVideo, 0, 0, 0, 0xff, 0xff, 0xff, rtmpVideo, 1, 0, 0, 0}
+	if _, err := newChunkReader(bufio.NewReader(bytes.NewReader(tooLarge))).readMessage(); err == nil {
+		t.Error("accepted a message larger than the limit")
+	}
+}
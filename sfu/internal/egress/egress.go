@@ -0,0 +1,317 @@
+// Package egress remuxes the media of a room's participants for live streams, to RTMP servers and HLS
+// playlists. H.264 and Opus are passed through as they arrive, nothing is transcoded.
+package egress
+
+import (
+	"bytes"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// Packets the streams received, and dropped because remuxing fell behind or the codec can't be remuxed
+var streamPackets = expvar.NewMap("sfu_egress_packets")
+
+const (
+	// Packets waiting to be remuxed, a few hundred milliseconds of video and audio
+	streamQueueSize = 512
+	// How many packets the H.264 sample builder waits for a missing one
+	maxLatePackets = 200
+	// Audio waits this long for the first picture, then streams on its own
+	audioHold = 2 * time.Second
+	// Keyframes are requested at most this often while a picture is missing
+	keyframeRetry = time.Second
+	// Opus as WebRTC sends it
+	OpusSampleRate = 48000
+	OpusChannels   = 2
+)
+
+// VideoFrame is an H.264 access unit
+type VideoFrame struct {
+	// NAL units without start codes, SPS and PPS included
+	NALUs    [][]byte
+	PTS      time.Duration
+	Keyframe bool
+}
+
+// AudioFrame is an Opus frame
+type AudioFrame struct {
+	Data []byte
+	PTS  time.Duration
+}
+
+// Output is where a stream's frames go. Its methods are called from one goroutine, video starts with a
+// keyframe and the timestamps of each kind never go back.
+type Output interface {
+	WriteVideo(frame *VideoFrame) error
+	WriteAudio(frame *AudioFrame) error
+	Close() error
+}
+
+type streamPacket struct {
+	video   bool
+	codec   string
+	packet  *rtp.Packet
+	arrival time.Time
+}
+
+// Stream remuxes the packets of one video and one audio source to its outputs. The sources can be
+// switched, e.g. to follow the active speaker, each source starts its own timeline from the time its first
+// packet arrived. An output that fails is dropped, the stream is done once none is left.
+type Stream struct {
+	outputs []Output
+	packets chan streamPacket
+	start   time.Time
+	// Called while the video waits for a keyframe, e.g. to ask the publisher for one
+	requestKeyframe func()
+	lastRequest     time.Time
+
+	video        timeline
+	builder      *samplebuilder.SampleBuilder
+	needKeyframe bool
+	audio        timeline
+	// Set once the first picture went out, audio is held back until then
+	started bool
+	// Codecs already reported as not remuxable
+	unsupported map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+// NewStream starts remuxing to the outputs, requestKeyframe may be nil
+func NewStream(requestKeyframe func(), outputs ...Output) *Stream {
+	s := &Stream{
+		outputs:         outputs,
+		packets:         make(chan streamPacket, streamQueueSize),
+		start:           time.Now(),
+		requestKeyframe: requestKeyframe,
+		unsupported:     make(map[string]bool),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// VideoSink and AudioSink receive the packets of the current sources, they implement sfu.LocalSink
+func (s *Stream) VideoSink() *StreamSink {
+	return &StreamSink{stream: s, video: true}
+}
+
+func (s *Stream) AudioSink() *StreamSink {
+	return &StreamSink{stream: s}
+}
+
+// Done is closed once the stream stopped, Err tells why
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Stream) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Close stops the stream and closes its outputs, HLS playlists are ended
+func (s *Stream) Close() {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// StreamSink queues the packets of a source for the stream, they are dropped when remuxing falls behind
+type StreamSink struct {
+	stream *Stream
+	video  bool
+}
+
+func (k *StreamSink) WriteRTP(codec webrtc.RTPCodecCapability, packet *rtp.Packet) {
+	p := streamPacket{video: k.video, codec: codec.MimeType, packet: packet.Clone(), arrival: time.Now()}
+	select {
+	case k.stream.packets <- p:
+	default:
+		streamPackets.Add("dropped", 1)
+	}
+}
+
+func (s *Stream) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.stop:
+			for _, output := range s.outputs {
+				if err := output.Close(); err != nil {
+					log.Printf("Failed to close egress output: %v", err)
+				}
+			}
+			return
+		case p := <-s.packets:
+			streamPackets.Add("received", 1)
+			if !s.supported(p) {
+				continue
+			}
+			if p.video {
+				s.pushVideo(p)
+			} else {
+				s.pushAudio(p)
+			}
+			if len(s.outputs) == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (s *Stream) supported(p streamPacket) bool {
+	if strings.EqualFold(p.codec, webrtc.MimeTypeH264) || strings.EqualFold(p.codec, webrtc.MimeTypeOpus) {
+		return true
+	}
+	streamPackets.Add("unsupported", 1)
+	if !s.unsupported[p.codec] {
+		s.unsupported[p.codec] = true
+		log.Printf("Egress can't remux %s without transcoding, it isn't streamed", p.codec)
+	}
+	return false
+}
+
+func (s *Stream) pushVideo(p streamPacket) {
+	if s.video.switched(p.packet.SSRC) || s.builder == nil {
+		s.builder = samplebuilder.New(maxLatePackets, &codecs.H264Packet{}, 90000)
+		s.needKeyframe = true
+	}
+	s.builder.Push(p.packet)
+	for sample := s.builder.Pop(); sample != nil; sample = s.builder.Pop() {
+		nalus := splitAnnexB(sample.Data)
+		keyframe := hasNALU(nalus, 5)
+		// A frame after a lost one can't be decoded, wait for the next keyframe
+		if sample.PrevDroppedPackets > 0 && !keyframe {
+			s.needKeyframe = true
+		}
+		if s.needKeyframe && !keyframe {
+			s.askForKeyframe()
+			continue
+		}
+		s.needKeyframe = false
+		frame := &VideoFrame{
+			NALUs:    nalus,
+			PTS:      s.video.pts(p.packet.SSRC, sample.PacketTimestamp, 90000, p.arrival.Sub(s.start)),
+			Keyframe: keyframe,
+		}
+		s.started = true
+		s.write(func(output Output) error { return output.WriteVideo(frame) })
+	}
+}
+
+func (s *Stream) askForKeyframe() {
+	if s.requestKeyframe == nil || time.Since(s.lastRequest) < keyframeRetry {
+		return
+	}
+	s.lastRequest = time.Now()
+	s.requestKeyframe()
+}
+
+func (s *Stream) pushAudio(p streamPacket) {
+	if !s.started && p.arrival.Sub(s.start) < audioHold {
+		return
+	}
+	s.audio.switched(p.packet.SSRC)
+	frame := &AudioFrame{
+		Data: p.packet.Payload,
+		PTS:  s.audio.pts(p.packet.SSRC, p.packet.Timestamp, OpusSampleRate, p.arrival.Sub(s.start)),
+	}
+	s.write(func(output Output) error { return output.WriteAudio(frame) })
+}
+
+// write passes a frame to every output, the ones that fail are closed and dropped
+func (s *Stream) write(f func(output Output) error) {
+	outputs := s.outputs[:0]
+	for _, output := range s.outputs {
+		if err := f(output); err != nil {
+			log.Printf("Egress output failed: %v", err)
+			output.Close()
+			s.err = err
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+	s.outputs = outputs
+}
+
+// timeline maps the RTP timestamps of the current source to the stream's time
+type timeline struct {
+	ssrc uint32
+	// Whether a packet of ssrc was seen
+	known bool
+	// Whether the timeline of ssrc is anchored
+	started bool
+	baseTS  uint32
+	base    time.Duration
+	last    time.Duration
+}
+
+// switched reports whether the packet is from a new source, whose timeline starts with its next packet
+func (t *timeline) switched(ssrc uint32) bool {
+	if t.known && t.ssrc == ssrc {
+		return false
+	}
+	t.ssrc = ssrc
+	t.known = true
+	t.started = false
+	return true
+}
+
+// pts returns the time of a packet that arrived at elapsed, a new source continues where the last one
+// left off at the earliest
+func (t *timeline) pts(ssrc uint32, timestamp uint32, clockRate uint32, elapsed time.Duration) time.Duration {
+	if !t.started {
+		t.started = true
+		t.ssrc = ssrc
+		t.baseTS = timestamp
+		t.base = max(elapsed, t.last)
+	}
+	pts := t.base + time.Duration(int32(timestamp-t.baseTS))*time.Second/time.Duration(clockRate)
+	pts = max(pts, t.last)
+	t.last = pts
+	return pts
+}
+
+// splitAnnexB splits an access unit with start codes into its NAL units
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte{0, 0, 1})
+		if start < 0 {
+			nalus = append(nalus, data)
+			break
+		}
+		if start > 0 {
+			nalus = append(nalus, bytes.TrimRight(data[:start], "\x00"))
+		}
+		data = data[start+3:]
+	}
+	filtered := nalus[:0]
+	for _, nalu := range nalus {
+		if len(nalu) > 0 {
+			filtered = append(filtered, nalu)
+		}
+	}
+	return filtered
+}
+
+func hasNALU(nalus [][]byte, naluType byte) bool {
+	for _, nalu := range nalus {
+		if nalu[0]&0x1f == naluType {
+			return true
+		}
+	}
+	return false
+}
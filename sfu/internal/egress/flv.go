@@ -0,0 +1,126 @@
+package egress
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// FLV tag types, the same as the RTMP message types that carry them
+const (
+	flvTagAudio  = rtmpAudio
+	flvTagVideo  = rtmpVideo
+	flvTagScript = rtmpDataAMF0
+)
+
+const (
+	flvCodecAVC = 7
+	// Enhanced RTMP signals the codec with a FourCC after this sound format
+	flvSoundFormatExHeader = 9
+	flvAVCSequenceHeader   = 0
+	flvAVCNALU             = 1
+	flvAudioSequenceStart  = 0
+	flvAudioCodedFrames    = 1
+)
+
+// flvVideoSequenceHeader is the AVCDecoderConfigurationRecord a decoder needs before the first frame
+func flvVideoSequenceHeader(sps, pps []byte) ([]byte, error) {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil, errors.New("incomplete SPS or PPS")
+	}
+	tag := []byte{0x10 | flvCodecAVC, flvAVCSequenceHeader, 0, 0, 0}
+	// Version, profile, compatibility and level from the SPS, 4 byte NALU lengths, one SPS and one PPS
+	tag = append(tag, 1, sps[1], sps[2], sps[3], 0xff, 0xe1)
+	tag = binary.BigEndian.AppendUint16(tag, uint16(len(sps)))
+	tag = append(tag, sps...)
+	tag = append(tag, 1)
+	tag = binary.BigEndian.AppendUint16(tag, uint16(len(pps)))
+	return append(tag, pps...), nil
+}
+
+// flvVideoFrame carries the NAL units of a frame with their lengths, WebRTC sends no B-frames so the
+// composition time is always 0
+func flvVideoFrame(nalus [][]byte, keyframe bool) []byte {
+	frameType := byte(0x20)
+	if keyframe {
+		frameType = 0x10
+	}
+	tag := []byte{frameType | flvCodecAVC, flvAVCNALU, 0, 0, 0}
+	for _, nalu := range nalus {
+		tag = binary.BigEndian.AppendUint32(tag, uint32(len(nalu)))
+		tag = append(tag, nalu...)
+	}
+	return tag
+}
+
+// flvOpusSequenceStart announces Opus the way Enhanced RTMP does, with the OpusHead of an Ogg stream
+func flvOpusSequenceStart(channels int, sampleRate int) []byte {
+	tag := []byte{flvSoundFormatExHeader<<4 | flvAudioSequenceStart, 'O', 'p', 'u', 's'}
+	tag = append(tag, "OpusHead"...)
+	tag = append(tag, 1, byte(channels))
+	// Pre-skip, the input sample rate, output gain and channel mapping family 0
+	tag = binary.LittleEndian.AppendUint16(tag, 0)
+	tag = binary.LittleEndian.AppendUint32(tag, uint32(sampleRate))
+	tag = binary.LittleEndian.AppendUint16(tag, 0)
+	return append(tag, 0)
+}
+
+func flvOpusFrame(frame []byte) []byte {
+	tag := []byte{flvSoundFormatExHeader<<4 | flvAudioCodedFrames, 'O', 'p', 'u', 's'}
+	return append(tag, frame...)
+}
+
+// flvMetaData describes the stream to the receiver, sent before any media
+func flvMetaData() ([]byte, error) {
+	return amfEncode("onMetaData", amfECMAArrayValue{
+		"videocodecid": flvCodecAVC,
+		"encoder":      "sfu egress",
+	})
+}
+
+// TagHandler receives the FLV tags of a published stream, e.g. to write them to a file
+type TagHandler interface {
+	WriteTag(tagType uint8, timestamp uint32, data []byte) error
+	Close() error
+}
+
+// FLVWriter writes tags to an FLV file
+type FLVWriter struct {
+	w      *bufio.Writer
+	closer io.Closer
+}
+
+func NewFLVWriter(w io.WriteCloser) (*FLVWriter, error) {
+	f := &FLVWriter{w: bufio.NewWriter(w), closer: w}
+	// Version 1 with audio and video, and the size of the first previous tag
+	header := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	if _, err := f.w.Write(header); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FLVWriter) WriteTag(tagType uint8, timestamp uint32, data []byte) error {
+	header := []byte{
+		tagType,
+		byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data)),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24),
+		0, 0, 0,
+	}
+	if _, err := f.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(data); err != nil {
+		return err
+	}
+	return binary.Write(f.w, binary.BigEndian, uint32(len(header)+len(data)))
+}
+
+func (f *FLVWriter) Close() error {
+	if err := f.w.Flush(); err != nil {
+		f.closer.Close()
+		return err
+	}
+	return f.closer.Close()
+}
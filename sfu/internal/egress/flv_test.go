@@ -0,0 +1,73 @@
+package egress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x21}
+	tests := []struct {
+		name  string
+		data  []byte
+		nalus [][]byte
+	}{
+		{"empty", nil, nil},
+		{"no start code", idr, [][]byte{idr}},
+		{"4 byte start codes", bytes.Join([][]byte{nil, sps, pps, idr}, []byte{0, 0, 0, 1}), [][]byte{sps, pps, idr}},
+		{"3 byte start codes", bytes.Join([][]byte{nil, sps, pps, idr}, []byte{0, 0, 1}), [][]byte{sps, pps, idr}},
+		{"mixed start codes", append(append([]byte{0, 0, 1}, sps...), append([]byte{0, 0, 0, 1}, idr...)...), [][]byte{sps, idr}},
+		// NAL units don't end with a zero byte, the ones ahead of a start code are padding
+		{"zeros ahead of a start code", bytes.Join([][]byte{nil, append(idr, 0, 0), sps}, []byte{0, 0, 0, 1}), [][]byte{idr, sps}},
+		{"empty NAL units", []byte{0, 0, 1, 0, 0, 1, 0x09, 0xf0, 0, 0, 1}, [][]byte{{0x09, 0xf0}}},
+	}
+	for _, tt := range tests {
+		nalus := splitAnnexB(tt.data)
+		if len(nalus) != len(tt.nalus) {
+			t.Errorf("%s: split into %d NAL units, want %d", tt.name, len(nalus), len(tt.nalus))
+			continue
+		}
+		for i := range nalus {
+			if !bytes.Equal(nalus[i], tt.nalus[i]) {
+				t.Errorf("%s: NAL unit %d is % x, want % x", tt.name, i, nalus[i], tt.nalus[i])
+			}
+		}
+	}
+}
+
+func TestAnnexBToAVCC(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	slice := append([]byte{0x65}, testPayload(300)...)
+	nalus := splitAnnexB(bytes.Join([][]byte{nil, sps, pps, slice}, []byte{0, 0, 0, 1}))
+
+	header, err := flvVideoSequenceHeader(nalus[0], nalus[1])
+	if err != nil {
+		t.Fatalf("failed to build the sequence header: %v", err)
+	}
+	want := []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x1f, 0xff, 0xe1, 0, 5}
+	want = append(want, sps...)
+	want = append(want, 1, 0, 4)
+	want = append(want, pps...)
+	if !bytes.Equal(header, want) {
+		t.Fatalf("sequence header % x, want % x", header, want)
+	}
+
+	// Each NAL unit is prefixed with its 4 byte length instead of a start code
+	frame := flvVideoFrame(nalus[2:], true)
+	want = append([]byte{0x17, 1, 0, 0, 0, 0, 0, 0x01, 0x2d}, slice...)
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("keyframe starts with % x, want % x", frame[:min(len(frame), 12)], want[:12])
+	}
+	frame = flvVideoFrame([][]byte{{0x41, 1}, {0x41, 2, 3}}, false)
+	want = []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x41, 1, 0, 0, 0, 3, 0x41, 2, 3}
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("delta frame % x, want % x", frame, want)
+	}
+
+	if _, err := flvVideoSequenceHeader(sps[:3], pps); err == nil {
+		t.Fatal("built a sequence header from a truncated SPS")
+	}
+}
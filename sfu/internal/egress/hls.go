@@ -0,0 +1,165 @@
+package egress
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Segments are cut at the first keyframe after this long
+	hlsTargetDuration = 2 * time.Second
+	// Segments listed in the live playlist, older ones are dropped
+	hlsPlaylistSize = 6
+)
+
+// HLS writes the stream as a live HLS playlist of MPEG-TS segments, kept in memory and served by ServeHTTP
+// as index.m3u8 and seg<n>.ts
+type HLS struct {
+	// Completed segments, oldest first
+	segments []*hlsSegment
+	current  *hlsSegment
+	next     int
+	muxer    *tsMuxer
+	// Set once a picture was written, segments are cut at keyframes from then on
+	video bool
+	// The latest timestamp written, where the last segment ends
+	last  time.Duration
+	ended bool
+	mu    sync.Mutex
+}
+
+type hlsSegment struct {
+	number int
+	start  time.Duration
+	end    time.Duration
+	data   bytes.Buffer
+}
+
+func NewHLS() *HLS {
+	return &HLS{}
+}
+
+func (h *HLS) WriteVideo(frame *VideoFrame) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if frame.Keyframe && (h.current == nil || frame.PTS-h.current.start >= hlsTargetDuration || !h.video) {
+		h.video = true
+		h.cut(frame.PTS, tsPIDVideo)
+	}
+	if h.current == nil || !h.video {
+		return nil
+	}
+	h.last = max(h.last, frame.PTS)
+	return h.muxer.writeVideo(frame)
+}
+
+func (h *HLS) WriteAudio(frame *AudioFrame) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Without video the segments are cut by time alone
+	if !h.video && (h.current == nil || frame.PTS-h.current.start >= hlsTargetDuration) {
+		h.cut(frame.PTS, tsPIDAudio)
+	}
+	if h.current == nil {
+		return nil
+	}
+	h.last = max(h.last, frame.PTS)
+	return h.muxer.writeAudio(frame)
+}
+
+// cut completes the current segment and starts the next one at pts. h.mu must be held.
+func (h *HLS) cut(pts time.Duration, pcrPID uint16) {
+	if h.current != nil {
+		h.current.end = pts
+		h.segments = append(h.segments, h.current)
+		if len(h.segments) > hlsPlaylistSize {
+			h.segments = h.segments[1:]
+		}
+	}
+	h.current = &hlsSegment{number: h.next, start: pts}
+	h.next++
+	h.muxer = newTSMuxer(&h.current.data)
+	h.muxer.writeTables(pcrPID)
+}
+
+// Close completes the last segment and ends the playlist, it stays available until the HLS is dropped
+func (h *HLS) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.current != nil && !h.ended {
+		h.current.end = max(h.last, h.current.start)
+		h.segments = append(h.segments, h.current)
+		h.current = nil
+	}
+	h.ended = true
+	return nil
+}
+
+func (h *HLS) playlist() ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.segments) == 0 {
+		return nil, false
+	}
+	target := hlsTargetDuration
+	for _, segment := range h.segments {
+		target = max(target, segment.end-segment.start)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.segments[0].number)
+	for _, segment := range h.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.ts\n", (segment.end - segment.start).Seconds(), segment.number)
+	}
+	if h.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(b.String()), true
+}
+
+func (h *HLS) segment(number int) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, segment := range h.segments {
+		if segment.number == number {
+			return segment.data.Bytes(), true
+		}
+	}
+	return nil, false
+}
+
+// ServeHTTP serves the playlist and the segments by the last element of the request path. The playlist
+// isn't found until its first segment is complete.
+func (h *HLS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if name == "index.m3u8" {
+		playlist, ok := h.playlist()
+		if !ok {
+			http.Error(w, "playlist has no segments yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(playlist)
+		return
+	}
+	number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".ts"))
+	if err != nil || !strings.HasSuffix(name, ".ts") {
+		http.NotFound(w, r)
+		return
+	}
+	data, ok := h.segment(number)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}
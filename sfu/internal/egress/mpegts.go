@@ -0,0 +1,208 @@
+package egress
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	tsPacketSize = 188
+	tsPIDPAT     = 0x0000
+	tsPIDPMT     = 0x1000
+	tsPIDVideo   = 0x0100
+	tsPIDAudio   = 0x0101
+	// H.264, and Opus as a private stream the way ffmpeg and VLC carry it
+	tsStreamTypeH264    = 0x1b
+	tsStreamTypePrivate = 0x06
+	tsStreamIDVideo     = 0xe0
+	tsStreamIDPrivate   = 0xbd
+	// Timestamps start here so that the clock reference can run ahead of them
+	tsTimeOffset = time.Second
+	tsPCRLead    = 100 * time.Millisecond
+)
+
+// tsMuxer writes H.264 and Opus as MPEG-TS
+type tsMuxer struct {
+	w io.Writer
+	// Continuity counters by PID
+	counters map[uint16]byte
+	// The PID that carries the clock reference, video unless the stream has none
+	pcrPID uint16
+}
+
+func newTSMuxer(w io.Writer) *tsMuxer {
+	return &tsMuxer{w: w, counters: make(map[uint16]byte), pcrPID: tsPIDVideo}
+}
+
+// writeTables writes the PAT and the PMT, which start every segment
+func (m *tsMuxer) writeTables(pcrPID uint16) error {
+	m.pcrPID = pcrPID
+	pat := []byte{0x00, 0x01, 0xc1, 0x00, 0x00}
+	pat = binary.BigEndian.AppendUint16(pat, 1)
+	pat = binary.BigEndian.AppendUint16(pat, 0xe000|tsPIDPMT)
+	if err := m.writeSection(tsPIDPAT, 0x00, pat); err != nil {
+		return err
+	}
+
+	pmt := []byte{0x00, 0x01, 0xc1, 0x00, 0x00}
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xe000|pcrPID)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xf000)
+	pmt = append(pmt, tsStreamTypeH264)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xe000|tsPIDVideo)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xf000)
+	// The registration descriptor names Opus, the extension descriptor gives its channel configuration
+	opusDescriptors := []byte{0x05, 4, 'O', 'p', 'u', 's', 0x7f, 2, 0x80, OpusChannels}
+	pmt = append(pmt, tsStreamTypePrivate)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xe000|tsPIDAudio)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xf000|uint16(len(opusDescriptors)))
+	pmt = append(pmt, opusDescriptors...)
+	return m.writeSection(tsPIDPMT, 0x02, pmt)
+}
+
+// writeSection writes a PSI table with its header and CRC in one packet
+func (m *tsMuxer) writeSection(pid uint16, tableId byte, body []byte) error {
+	section := []byte{tableId}
+	// Section syntax set, the length counts the body and the CRC
+	section = binary.BigEndian.AppendUint16(section, 0xb000|uint16(len(body)+4))
+	section = append(section, body...)
+	section = binary.BigEndian.AppendUint32(section, crc32MPEG(section))
+	payload := append([]byte{0}, section...)
+	return m.writePackets(pid, payload, -1, false)
+}
+
+func (m *tsMuxer) writeVideo(frame *VideoFrame) error {
+	// Each access unit starts with a delimiter, the NAL units follow with start codes
+	data := []byte{0, 0, 0, 1, 0x09, 0xf0}
+	for _, nalu := range frame.NALUs {
+		if nalu[0]&0x1f == 9 {
+			continue
+		}
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nalu...)
+	}
+	return m.writePES(tsPIDVideo, tsStreamIDVideo, frame.PTS, data, frame.Keyframe)
+}
+
+func (m *tsMuxer) writeAudio(frame *AudioFrame) error {
+	// The control header of Opus in MPEG-TS, its size is coded in bytes of 255 and the rest
+	data := []byte{0x7f, 0xe0}
+	size := len(frame.Data)
+	for ; size >= 255; size -= 255 {
+		data = append(data, 0xff)
+	}
+	data = append(data, byte(size))
+	data = append(data, frame.Data...)
+	return m.writePES(tsPIDAudio, tsStreamIDPrivate, frame.PTS, data, false)
+}
+
+func (m *tsMuxer) writePES(pid uint16, streamId byte, pts time.Duration, data []byte, randomAccess bool) error {
+	ticks := uint64((pts + tsTimeOffset) * 90000 / time.Second)
+	header := []byte{0, 0, 1, streamId, 0, 0, 0x80, 0x80, 5}
+	// Video PES may be longer than the length field allows, 0 leaves it open
+	if length := len(data) + 8; length <= 0xffff && pid != tsPIDVideo {
+		binary.BigEndian.PutUint16(header[4:], uint16(length))
+	}
+	header = append(header,
+		byte(0x21|(ticks>>29)&0x0e),
+		byte(ticks>>22), byte(0x01|(ticks>>14)&0xfe),
+		byte(ticks>>7), byte(0x01|(ticks<<1)&0xfe))
+	pcr := int64(-1)
+	if pid == m.pcrPID {
+		pcr = int64((pts + tsTimeOffset - tsPCRLead) * 90000 / time.Second)
+	}
+	return m.writePackets(pid, append(header, data...), pcr, randomAccess)
+}
+
+// writePackets splits a payload into transport packets, the first one carries the clock reference when
+// pcr isn't negative. The last one is padded with stuffing in its adaptation field.
+func (m *tsMuxer) writePackets(pid uint16, payload []byte, pcr int64, randomAccess bool) error {
+	first := true
+	for len(payload) > 0 {
+		var adaptation []byte
+		if first && (pcr >= 0 || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = []byte{flags}
+			if pcr >= 0 {
+				adaptation[0] |= 0x10
+				base := uint64(pcr)
+				adaptation = append(adaptation, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7e, 0)
+			}
+		}
+		space := tsPacketSize - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		if stuffing := space - len(payload); stuffing > 0 {
+			switch {
+			case adaptation != nil:
+				adaptation = append(adaptation, fill(stuffing)...)
+			case stuffing == 1:
+				// An adaptation field of length 0 is only its length byte
+				adaptation = []byte{}
+			default:
+				adaptation = append([]byte{0}, fill(stuffing-2)...)
+			}
+			space -= stuffing
+		}
+
+		packet := make([]byte, 0, tsPacketSize)
+		pusi := byte(0)
+		if first {
+			pusi = 0x40
+		}
+		control := byte(0x10)
+		if adaptation != nil {
+			control = 0x30
+		}
+		packet = append(packet, 0x47, pusi|byte(pid>>8), byte(pid), control|m.counters[pid])
+		m.counters[pid] = (m.counters[pid] + 1) & 0x0f
+		if adaptation != nil {
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		packet = append(packet, payload[:space]...)
+		if _, err := m.w.Write(packet); err != nil {
+			return err
+		}
+		payload = payload[space:]
+		first = false
+	}
+	return nil
+}
+
+func fill(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 0xff
+	}
+	return b
+}
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG is the CRC of PSI sections, unlike IEEE CRC-32 it isn't reflected
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
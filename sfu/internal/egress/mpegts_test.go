@@ -0,0 +1,195 @@
+package egress
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// tsPacket is a transport packet split into its fields
+type tsPacket struct {
+	pid        uint16
+	start      bool
+	counter    byte
+	adaptation []byte
+	payload    []byte
+}
+
+func parseTS(t *testing.T, data []byte) []tsPacket {
+	t.Helper()
+	if len(data)%tsPacketSize != 0 {
+		t.Fatalf("%d bytes aren't whole TS packets", len(data))
+	}
+	var packets []tsPacket
+	for ; len(data) > 0; data = data[tsPacketSize:] {
+		raw := data[:tsPacketSize]
+		if raw[0] != 0x47 {
+			t.Fatalf("packet %d has no sync byte", len(packets))
+		}
+		packet := tsPacket{
+			pid:     uint16(raw[1]&0x1f)<<8 | uint16(raw[2]),
+			start:   raw[1]&0x40 != 0,
+			counter: raw[3] & 0x0f,
+			payload: raw[4:],
+		}
+		if raw[3]&0x20 != 0 {
+			length := int(raw[4])
+			packet.adaptation = raw[5 : 5+length]
+			packet.payload = raw[5+length:]
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// pcr returns the clock reference of the adaptation field, -1 when it has none
+func (p tsPacket) pcr() int64 {
+	if len(p.adaptation) < 7 || p.adaptation[0]&0x10 == 0 {
+		return -1
+	}
+	a := p.adaptation
+	return int64(a[1])<<25 | int64(a[2])<<17 | int64(a[3])<<9 | int64(a[4])<<1 | int64(a[5])>>7
+}
+
+func (p tsPacket) randomAccess() bool {
+	return len(p.adaptation) > 0 && p.adaptation[0]&0x40 != 0
+}
+
+// pesPTS returns the presentation time of a PES header in 90 kHz ticks
+func pesPTS(pes []byte) uint64 {
+	p := pes[9:14]
+	return uint64(p[0]>>1&0x07)<<30 | uint64(p[1])<<22 | uint64(p[2]>>1)<<15 | uint64(p[3])<<7 | uint64(p[4]>>1)
+}
+
+// tsPES reassembles the PES packets of a PID
+func tsPES(packets []tsPacket, pid uint16) [][]byte {
+	var pes [][]byte
+	for _, packet := range packets {
+		if packet.pid != pid {
+			continue
+		}
+		if packet.start {
+			pes = append(pes, nil)
+		}
+		pes[len(pes)-1] = append(pes[len(pes)-1], packet.payload...)
+	}
+	return pes
+}
+
+func TestTSMuxerTables(t *testing.T) {
+	var buf bytes.Buffer
+	if err := newTSMuxer(&buf).writeTables(tsPIDAudio); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	packets := parseTS(t, buf.Bytes())
+	if len(packets) != 2 || packets[0].pid != tsPIDPAT || packets[1].pid != tsPIDPMT {
+		t.Fatalf("got %d packets, want the PAT and the PMT", len(packets))
+	}
+	for _, packet := range packets {
+		// Past the pointer field, the CRC over a section and its CRC is 0
+		length := int(packet.payload[2]&0x0f)<<8 | int(packet.payload[3])
+		section := packet.payload[1 : 4+length]
+		if crc := crc32MPEG(section); crc != 0 {
+			t.Errorf("section of PID %#x has CRC remainder %#x", packet.pid, crc)
+		}
+		for _, b := range packet.payload[4+length:] {
+			if b != 0xff {
+				t.Errorf("section of PID %#x is followed by % x, want stuffing", packet.pid, packet.payload[4+length:])
+				break
+			}
+		}
+	}
+	pmt := packets[1].payload[1:]
+	if pcrPID := uint16(pmt[8]&0x1f)<<8 | uint16(pmt[9]); pcrPID != tsPIDAudio {
+		t.Fatalf("PMT names PCR PID %#x, want %#x", pcrPID, tsPIDAudio)
+	}
+}
+
+func TestTSMuxerPES(t *testing.T) {
+	var buf bytes.Buffer
+	muxer := newTSMuxer(&buf)
+	if err := muxer.writeTables(tsPIDVideo); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	// Enough frames for the counters to wrap, a keyframe spanning several packets among them
+	var nalus [][]byte
+	for i := 0; i < 20; i++ {
+		nalu := []byte{0x41, byte(i)}
+		if i == 0 {
+			nalu = append([]byte{0x65}, testPayload(1000)...)
+		}
+		nalus = append(nalus, nalu)
+		pts := time.Duration(i) * 33 * time.Millisecond
+		// Delimiters in the frame are replaced by the muxer's own
+		if err := muxer.writeVideo(&VideoFrame{NALUs: [][]byte{{0x09, 0x10}, nalu}, PTS: pts, Keyframe: i == 0}); err != nil {
+			t.Fatalf("failed to write video: %v", err)
+		}
+		if err := muxer.writeAudio(&AudioFrame{Data: testPayload(300), PTS: pts}); err != nil {
+			t.Fatalf("failed to write audio: %v", err)
+		}
+	}
+	packets := parseTS(t, buf.Bytes())
+
+	counters := make(map[uint16]byte)
+	for i, packet := range packets {
+		if last, exists := counters[packet.pid]; exists && packet.counter != (last+1)&0x0f {
+			t.Fatalf("packet %d of PID %#x has counter %d after %d", i, packet.pid, packet.counter, last)
+		}
+		counters[packet.pid] = packet.counter
+		switch {
+		case packet.pid == tsPIDVideo && packet.start:
+			if packet.pcr() < 0 {
+				t.Fatalf("packet %d starts video without a clock reference", i)
+			}
+		case packet.pcr() >= 0:
+			t.Fatalf("packet %d of PID %#x has a clock reference", i, packet.pid)
+		}
+	}
+
+	video := tsPES(packets, tsPIDVideo)
+	if len(video) != 20 {
+		t.Fatalf("got %d video PES packets, want 20", len(video))
+	}
+	var videoPackets []tsPacket
+	for _, packet := range packets {
+		if packet.pid == tsPIDVideo {
+			videoPackets = append(videoPackets, packet)
+		}
+	}
+	if !videoPackets[0].randomAccess() || videoPackets[len(videoPackets)-1].randomAccess() {
+		t.Fatal("only the keyframe should be marked as a random access point")
+	}
+	for i, pes := range video {
+		pts := time.Duration(i) * 33 * time.Millisecond
+		if want := uint64((pts + tsTimeOffset) * 90000 / time.Second); pesPTS(pes) != want {
+			t.Errorf("video %d has PTS %d, want %d", i, pesPTS(pes), want)
+		}
+		if !bytes.Equal(pes[:4], []byte{0, 0, 1, tsStreamIDVideo}) || pes[4] != 0 || pes[5] != 0 {
+			t.Errorf("video %d starts with % x, want an unbounded video PES", i, pes[:6])
+		}
+		want := append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}, nalus[i]...)
+		if !bytes.Equal(pes[14:], want) {
+			t.Errorf("video %d carries % x, want % x", i, pes[14:min(len(pes), 30)], want[:min(len(want), 16)])
+		}
+	}
+	pcr := packets[2].pcr()
+	if want := int64((tsTimeOffset - tsPCRLead) * 90000 / time.Second); pcr != want {
+		t.Fatalf("first clock reference %d, want %d", pcr, want)
+	}
+
+	audio := tsPES(packets, tsPIDAudio)
+	if len(audio) != 20 {
+		t.Fatalf("got %d audio PES packets, want 20", len(audio))
+	}
+	for i, pes := range audio {
+		// The length counts the rest of the PES header, the 4 byte control header and the frame. The control
+		// header codes 300 as 255 and 45.
+		header := []byte{0, 0, 1, tsStreamIDPrivate, 0x01, 0x38}
+		if !bytes.Equal(pes[:6], header) || !bytes.Equal(pes[14:18], []byte{0x7f, 0xe0, 0xff, 45}) {
+			t.Errorf("audio %d starts with % x and % x", i, pes[:6], pes[14:18])
+		}
+		if len(pes) != 6+0x138 || !bytes.Equal(pes[18:], testPayload(300)) {
+			t.Errorf("audio %d has %d bytes, want %d", i, len(pes), 6+0x138)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package egress
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Receiver is a minimal RTMP server that accepts published streams and hands their tags to a handler. It
+// stands in for a streaming platform's ingest when trying egress locally.
+type Receiver struct {
+	// OnPublish is called when a client starts publishing the stream key, an error refuses it
+	OnPublish func(app string, streamKey string) (TagHandler, error)
+}
+
+// Serve accepts connections until the listener is closed
+func (r *Receiver) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := r.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("RTMP client %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (r *Receiver) serveConn(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(rtmpDialTimeout))
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(reader, c0c1); err != nil {
+		return err
+	}
+	// S0, S1 and S2, which echoes C1
+	s0s1s2 := append([]byte{3}, handshakeChunk()...)
+	if _, err := conn.Write(append(s0s1s2, c0c1[1:]...)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(reader, make([]byte, rtmpHandshakeSize)); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	chunks := newChunkReader(reader)
+	writer := &chunkWriter{w: bufio.NewWriter(conn), chunkSize: rtmpDefaultChunkSize}
+	var app string
+	var handler TagHandler
+	defer func() {
+		if handler != nil {
+			handler.Close()
+		}
+	}()
+	for {
+		msg, err := chunks.readMessage()
+		if err != nil {
+			return err
+		}
+		switch msg.typeId {
+		case rtmpAudio, rtmpVideo:
+			if handler != nil {
+				if err := handler.WriteTag(msg.typeId, msg.timestamp, msg.payload); err != nil {
+					return err
+				}
+			}
+			continue
+		case rtmpDataAMF0:
+			if handler != nil {
+				// FLV files keep the metadata without the command that set it
+				payload := msg.payload
+				if values, err := amfDecode(payload); err == nil && len(values) > 0 && values[0] == "@setDataFrame" {
+					payload = payload[3+len("@setDataFrame"):]
+				}
+				if err := handler.WriteTag(flvTagScript, msg.timestamp, payload); err != nil {
+					return err
+				}
+			}
+			continue
+		case rtmpCommandAMF0:
+		default:
+			continue
+		}
+
+		values, err := amfDecode(msg.payload)
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		command, _ := values[0].(string)
+		transaction := values[1]
+		switch command {
+		case "connect":
+			if len(values) > 2 {
+				if properties, ok := values[2].(amfObjectValue); ok {
+					app, _ = properties["app"].(string)
+				}
+			}
+			writer.writeControl(rtmpWindowAckSize, 2500000)
+			writer.writeControl(rtmpSetPeerBandwidth, 2500000, 2)
+			writer.writeControl(rtmpSetChunkSize, rtmpChunkSize)
+			writer.chunkSize = rtmpChunkSize
+			err = writer.writeCommand(csidCommand, 0, "_result", transaction,
+				amfObjectValue{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+				amfObjectValue{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded."})
+		case "createStream":
+			err = writer.writeCommand(csidCommand, 0, "_result", transaction, nil, 1)
+		case "publish":
+			streamKey := ""
+			if len(values) > 3 {
+				streamKey, _ = values[3].(string)
+			}
+			if handler != nil {
+				handler.Close()
+				handler = nil
+			}
+			var refused error
+			handler, refused = r.OnPublish(app, streamKey)
+			if refused != nil {
+				writer.writeCommand(csidCommand, msg.streamId, "onStatus", 0, nil,
+					amfObjectValue{"level": "error", "code": "NetStream.Publish.BadName", "description": refused.Error()})
+				return refused
+			}
+			err = writer.writeCommand(csidCommand, msg.streamId, "onStatus", 0, nil,
+				amfObjectValue{"level": "status", "code": "NetStream.Publish.Start", "description": streamKey + " is now published."})
+		case "FCUnpublish", "deleteStream", "closeStream":
+			if handler != nil {
+				handler.Close()
+				handler = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package egress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rtmpWriteTimeout = 10 * time.Second
+	// How long connecting and publishing may take
+	rtmpDialTimeout = 15 * time.Second
+)
+
+// RTMPOutput publishes a stream to an RTMP server, e.g. a streaming platform's ingest. Video goes out as
+// AVC in FLV, Opus as Enhanced RTMP, which receivers that only know AAC don't play.
+type RTMPOutput struct {
+	url      string
+	conn     net.Conn
+	chunks   *chunkWriter
+	streamId uint32
+	sps, pps []byte
+	// Set once the sequence headers went out
+	videoStarted bool
+	audioStarted bool
+	closed       bool
+	mu           sync.Mutex
+}
+
+// DialRTMP connects to rtmp://host[:port]/app/streamKey, or rtmps://, and starts publishing the stream key
+func DialRTMP(ctx context.Context, rawURL string) (*RTMPOutput, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "rtmp":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1935")
+		}
+	case "rtmps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, use rtmp or rtmps", u.Scheme)
+	}
+	// The last path segment is the stream key, everything before it the application
+	path := strings.Trim(u.Path, "/")
+	split := strings.LastIndex(path, "/")
+	if split <= 0 || split == len(path)-1 {
+		return nil, errors.New("RTMP URL needs an application and a stream key")
+	}
+	app, streamKey := path[:split], path[split+1:]
+	if u.RawQuery != "" {
+		streamKey += "?" + u.RawQuery
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rtmpDialTimeout)
+	defer cancel()
+	var conn net.Conn
+	if u.Scheme == "rtmps" {
+		conn, err = (&tls.Dialer{}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	o := &RTMPOutput{
+		url:    u.Scheme + "://" + u.Host + "/" + app,
+		conn:   conn,
+		chunks: &chunkWriter{w: bufio.NewWriter(conn), chunkSize: rtmpDefaultChunkSize},
+	}
+	reader := bufio.NewReader(conn)
+	if err := o.publish(reader, app, streamKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go o.readLoop(newChunkReader(reader))
+	return o, nil
+}
+
+// publish runs the handshake and the commands up to the start of publishing
+func (o *RTMPOutput) publish(reader *bufio.Reader, app string, streamKey string) error {
+	c1 := handshakeChunk()
+	if _, err := o.conn.Write(append([]byte{3}, c1...)); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	s0s1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(reader, s0s1); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	if s0s1[0] != 3 {
+		return fmt.Errorf("server speaks RTMP version %d", s0s1[0])
+	}
+	if _, err := o.conn.Write(s0s1[1:]); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	s2 := make([]byte, rtmpHandshakeSize)
+	if _, err := io.ReadFull(reader, s2); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	if err := o.chunks.writeControl(rtmpSetChunkSize, rtmpChunkSize); err != nil {
+		return err
+	}
+	o.chunks.chunkSize = rtmpChunkSize
+	chunks := newChunkReader(reader)
+	err := o.chunks.writeCommand(csidCommand, 0, "connect", 1, amfObjectValue{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; sfu)",
+		"tcUrl":    o.url,
+		// Enhanced RTMP, the codecs beyond FLV's own this side sends
+		"fourCcList": []string{"Opus"},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := o.awaitResult(chunks, 1); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	// Some ingests expect these before createStream, their answers aren't needed
+	o.chunks.writeCommand(csidCommand, 0, "releaseStream", 2, nil, streamKey)
+	o.chunks.writeCommand(csidCommand, 0, "FCPublish", 3, nil, streamKey)
+	if err := o.chunks.writeCommand(csidCommand, 0, "createStream", 4, nil); err != nil {
+		return err
+	}
+	result, err := o.awaitResult(chunks, 4)
+	if err != nil {
+		return fmt.Errorf("createStream failed: %w", err)
+	}
+	streamId, ok := result.(float64)
+	if !ok {
+		return errors.New("createStream returned no stream id")
+	}
+	o.streamId = uint32(streamId)
+	if err := o.chunks.writeCommand(csidCommand, o.streamId, "publish", 5, nil, streamKey, "live"); err != nil {
+		return err
+	}
+	if err := o.awaitStatus(chunks, "NetStream.Publish.Start"); err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+
+	metaData, err := flvMetaData()
+	if err != nil {
+		return err
+	}
+	setDataFrame, _ := amfEncode("@setDataFrame")
+	return o.chunks.writeMessage(&rtmpMessage{
+		csid:     csidData,
+		typeId:   rtmpDataAMF0,
+		streamId: o.streamId,
+		payload:  append(setDataFrame, metaData...),
+	})
+}
+
+// awaitResult reads messages until the answer to the transaction and returns its value after the
+// command object
+func (o *RTMPOutput) awaitResult(chunks *chunkReader, transaction float64) (any, error) {
+	for {
+		values, err := o.readCommand(chunks)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 2 || values[1] != transaction {
+			continue
+		}
+		switch values[0] {
+		case "_result":
+			if len(values) < 4 {
+				return nil, nil
+			}
+			return values[3], nil
+		case "_error":
+			return nil, fmt.Errorf("server refused: %s", describeStatus(values))
+		}
+	}
+}
+
+// awaitStatus reads messages until an onStatus, which must have the code
+func (o *RTMPOutput) awaitStatus(chunks *chunkReader, code string) error {
+	for {
+		values, err := o.readCommand(chunks)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 || values[0] != "onStatus" {
+			continue
+		}
+		if status := statusCode(values); status != code {
+			return fmt.Errorf("server answered %s", describeStatus(values))
+		}
+		return nil
+	}
+}
+
+// readCommand returns the values of the next command message, other messages are handled on the way
+func (o *RTMPOutput) readCommand(chunks *chunkReader) ([]any, error) {
+	for {
+		msg, err := chunks.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.typeId == rtmpCommandAMF0 {
+			return amfDecode(msg.payload)
+		}
+		if err := o.handleControl(msg); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handleControl answers pings, the other control messages don't concern a publisher
+func (o *RTMPOutput) handleControl(msg *rtmpMessage) error {
+	const pingRequest, pingResponse = 6, 7
+	if msg.typeId != rtmpUserControl || len(msg.payload) < 6 || msg.payload[1] != pingRequest {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.conn.SetWriteDeadline(time.Now().Add(rtmpWriteTimeout))
+	payload := append([]byte{0, pingResponse}, msg.payload[2:6]...)
+	return o.chunks.writeMessage(&rtmpMessage{csid: csidControl, typeId: rtmpUserControl, payload: payload})
+}
+
+// readLoop keeps reading after publishing started, so that pings are answered and the server's messages
+// don't fill up the connection
+func (o *RTMPOutput) readLoop(chunks *chunkReader) {
+	for {
+		msg, err := chunks.readMessage()
+		if err != nil {
+			return
+		}
+		if msg.typeId == rtmpCommandAMF0 {
+			if values, err := amfDecode(msg.payload); err == nil && len(values) > 0 && values[0] == "onStatus" {
+				log.Printf("RTMP server %s: %s", o.url, describeStatus(values))
+			}
+			continue
+		}
+		if err := o.handleControl(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (o *RTMPOutput) WriteVideo(frame *VideoFrame) error {
+	var nalus [][]byte
+	for _, nalu := range frame.NALUs {
+		switch nalu[0] & 0x1f {
+		case 7:
+			o.videoStarted = o.videoStarted && bytes.Equal(nalu, o.sps)
+			o.sps = nalu
+		case 8:
+			o.videoStarted = o.videoStarted && bytes.Equal(nalu, o.pps)
+			o.pps = nalu
+		case 9:
+			// Access unit delimiters have no place in FLV
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	timestamp := uint32(frame.PTS.Milliseconds())
+	if !o.videoStarted {
+		// A new SPS or PPS, e.g. after switching to another participant, needs a new sequence header
+		if !frame.Keyframe || o.sps == nil || o.pps == nil {
+			return nil
+		}
+		header, err := flvVideoSequenceHeader(o.sps, o.pps)
+		if err != nil {
+			return err
+		}
+		if err := o.write(csidVideo, rtmpVideo, timestamp, header); err != nil {
+			return err
+		}
+		o.videoStarted = true
+	}
+	if len(nalus) == 0 {
+		return nil
+	}
+	return o.write(csidVideo, rtmpVideo, timestamp, flvVideoFrame(nalus, frame.Keyframe))
+}
+
+func (o *RTMPOutput) WriteAudio(frame *AudioFrame) error {
+	timestamp := uint32(frame.PTS.Milliseconds())
+	if !o.audioStarted {
+		if err := o.write(csidAudio, rtmpAudio, timestamp, flvOpusSequenceStart(OpusChannels, OpusSampleRate)); err != nil {
+			return err
+		}
+		o.audioStarted = true
+	}
+	return o.write(csidAudio, rtmpAudio, timestamp, flvOpusFrame(frame.Data))
+}
+
+func (o *RTMPOutput) write(csid uint32, typeId uint8, timestamp uint32, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return errors.New("RTMP connection is closed")
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(rtmpWriteTimeout))
+	err := o.chunks.writeMessage(&rtmpMessage{csid: csid, typeId: typeId, streamId: o.streamId, timestamp: timestamp, payload: payload})
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %w", o.url, err)
+	}
+	return nil
+}
+
+// Close ends the publication, the server sees the stream end rather than a dropped connection
+func (o *RTMPOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	o.conn.SetWriteDeadline(time.Now().Add(rtmpWriteTimeout))
+	o.chunks.writeCommand(csidCommand, o.streamId, "FCUnpublish", 6, nil)
+	o.chunks.writeCommand(csidCommand, 0, "deleteStream", 7, nil, float64(o.streamId))
+	return o.conn.Close()
+}
+
+func statusCode(values []any) string {
+	for _, value := range values {
+		if info, ok := value.(amfObjectValue); ok {
+			if code, ok := info["code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+func describeStatus(values []any) string {
+	for _, value := range values {
+		if info, ok := value.(amfObjectValue); ok {
+			code, _ := info["code"].(string)
+			description, _ := info["description"].(string)
+			if code != "" || description != "" {
+				return strings.TrimSpace(code + " " + description)
+			}
+		}
+	}
+	return "no status"
+}
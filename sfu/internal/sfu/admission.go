@@ -0,0 +1,87 @@
+package sfu
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SetWaitingRoom enables or disables admitting peers. Waiting peers receive the streams of lobbyId, if
+// set, as a preview. Disabling it doesn't admit the peers that are waiting.
+func (r *defaultRouter) SetWaitingRoom(enabled bool, lobbyId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waitingRoom = enabled
+	if lobbyId == r.lobby {
+		return
+	}
+	previous := r.lobby
+	r.lobby = lobbyId
+	for id := range r.waiting {
+		pc := r.connections[id]
+		if broadcaster, exists := r.broadcasters[previous]; exists && previous != "" {
+			broadcaster.RemoveSinks(id)
+			removeSenders(pc, previous)
+		}
+		r.subscribe(lobbyId, id)
+	}
+}
+
+func (r *defaultRouter) WaitingRoomEnabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.waitingRoom
+}
+
+// AddWaitingPeer adds a peer that waits to be admitted, its PeerConnection only receives the lobby
+func (r *defaultRouter) AddWaitingPeer(id string, name string, pc *webrtc.PeerConnection) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waiting[id] = true
+	return r.addPeer(id, name, pc)
+}
+
+// Admit lets a waiting peer into the room, it receives and publishes like everyone else from now on
+func (r *defaultRouter) Admit(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[id]; !exists || !r.waiting[id] {
+		return fmt.Errorf("peer %s is not waiting", id)
+	}
+	delete(r.waiting, id)
+	for bid := range r.broadcasters {
+		r.subscribe(bid, id)
+	}
+	if broadcaster, exists := r.broadcasters[id]; exists {
+		broadcaster.SetAudioTap(r.tapFor(id))
+		for rid, rpc := range r.connections {
+			if r.canSubscribe(id, rid) {
+				broadcaster.AddVideoSink(rid, rpc)
+				broadcaster.AddAudioSink(rid, rpc)
+			}
+		}
+	}
+	r.applyModes()
+	return nil
+}
+
+func (r *defaultRouter) GetWaitingPeerIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.waiting))
+	for id := range r.waiting {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// subscribe adds sinks of broadcaster bid for the peer, sinks it already has are kept. r.mu must be held.
+func (r *defaultRouter) subscribe(bid string, id string) {
+	broadcaster, exists := r.broadcasters[bid]
+	pc := r.connections[id]
+	if !exists || pc == nil || !r.canSubscribe(bid, id) {
+		return
+	}
+	broadcaster.AddVideoSink(id, pc)
+	broadcaster.AddAudioSink(id, pc)
+}
@@ -1,16 +1,14 @@
 package sfu
 
 import (
-	"fmt"
-	"log"
-	"sync"
+	"time"
 
-	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
 type Broadcaster interface {
 	SendAllPublisherPli()
+	RequestKeyFrames(subscriberId string)
 	AddVideoSink(id string, pc *webrtc.PeerConnection)
 	AddAudioSink(id string, pc *webrtc.PeerConnection)
 	RemoveSinks(id string)
@@ -18,286 +16,141 @@ type Broadcaster interface {
 	SetVideoSource(videoSrc *webrtc.TrackRemote)
 	SetAudioSource(audioSrc *webrtc.TrackRemote)
 	SetScreenSource(screenSrc *webrtc.TrackRemote)
+	SetVideoPolicy(subscriberId string, camera, screen SinkPolicy)
+	ScreenShareActive() bool
+	OnScreenShareEnded(f func())
+	SetMuted(stream PublisherStream, muted bool)
+	DetachSinks() []string
+	SetCodecChecker(codecs CodecChecker)
+	// SetAudioTap sends the audio to the tap as well, nil stops it
+	SetAudioTap(tap AudioTap)
+	AddLocalSink(id string, stream PublisherStream, sink LocalSink)
+	RemoveLocalSink(id string)
+	RemoveLocalSinks()
+	AudioLevel() float64
+	LatestKeyframe(maxAge time.Duration) *Keyframe
 }
 
 type defaultBroadcaster struct {
-	id          string
-	pc          *webrtc.PeerConnection
-	videoSrc    *webrtc.TrackRemote
-	videoSinks  map[string]*webrtc.TrackLocalStaticRTP
-	audioSrc    *webrtc.TrackRemote
-	audioSinks  map[string]*webrtc.TrackLocalStaticRTP
-	screenSrc   *webrtc.TrackRemote
-	screenSinks map[string]*webrtc.TrackLocalStaticRTP
-	vstop       chan struct{}
-	vdone       chan struct{}
-	astop       chan struct{}
-	adone       chan struct{}
-	sstop       chan struct{}
-	sdone       chan struct{}
-
-	vmu sync.RWMutex
-	amu sync.RWMutex
-	smu sync.RWMutex
+	id     string
+	pc     *webrtc.PeerConnection
+	video  *source
+	audio  *source
+	screen *source
 }
 
-func InitBroadcaster(id string, pc *webrtc.PeerConnection, videoSrc, audioSrc, screenSrc *webrtc.TrackRemote) Broadcaster {
+func InitBroadcaster(id string, pc *webrtc.PeerConnection, videoSrc, audioSrc, screenSrc *webrtc.TrackRemote, codecs CodecChecker, reports *reportAggregator) Broadcaster {
 	b := &defaultBroadcaster{
-		id:          id,
-		pc:          pc,
-		videoSrc:    videoSrc,
-		videoSinks:  map[string]*webrtc.TrackLocalStaticRTP{},
-		audioSrc:    audioSrc,
-		audioSinks:  map[string]*webrtc.TrackLocalStaticRTP{},
-		screenSrc:   screenSrc,
-		screenSinks: map[string]*webrtc.TrackLocalStaticRTP{},
-		vstop:       make(chan struct{}),
-		vdone:       make(chan struct{}),
-		astop:       make(chan struct{}),
-		adone:       make(chan struct{}),
-		sstop:       make(chan struct{}),
-		sdone:       make(chan struct{}),
+		id:     id,
+		pc:     pc,
+		video:  newSource(id, id, pc, videoSrc, webrtc.RTPCodecTypeVideo, codecs, reports),
+		audio:  newSource(id, id, pc, audioSrc, webrtc.RTPCodecTypeAudio, codecs, reports),
+		screen: newSource(id, id+"-screen", pc, screenSrc, webrtc.RTPCodecTypeVideo, codecs, reports),
 	}
-
-	go b.startVideo()
-	go b.startAudio()
-	go b.startScreenShare()
 	return b
 }
 
 func (b *defaultBroadcaster) SendAllPublisherPli() {
-	if b.videoSrc != nil {
-		b.sendPublisherPli(b.videoSrc)
-	}
-	if b.screenSrc != nil {
-		b.sendPublisherPli(b.screenSrc)
-	}
+	b.video.sendPli()
+	b.screen.sendPli()
 }
 
-func (b *defaultBroadcaster) sendPublisherPli(rtpSource *webrtc.TrackRemote) {
-	if b.pc == nil || rtpSource == nil {
-		log.Printf("Cannot send PLI: publisher PC or video source is nil")
-		return
-	}
-
-	// pc MUST match the id of the broadcaster (sending PLI for this videoSrc through pc)
-	pli := &rtcp.PictureLossIndication{
-		MediaSSRC: uint32(rtpSource.SSRC()),
-	}
-
-	log.Printf("Sending PLI to publisher for MediaSSRC %d", pli.MediaSSRC)
-	if err := b.pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
-		log.Printf("Failed to write PLI: %v", err)
-	}
-}
-
-func (b *defaultBroadcaster) readSubscriberRTCP(rtpSender *webrtc.RTPSender, rtpSource *webrtc.TrackRemote) {
-	for {
-		packets, _, err := rtpSender.ReadRTCP()
-		if err != nil {
-			return // Connection closed?
-		}
-		for _, pkt := range packets {
-			if _, ok := pkt.(*rtcp.PictureLossIndication); ok {
-				log.Println("Received PLI from subscriber")
-				b.sendPublisherPli(rtpSource)
-			}
-		}
-	}
+// RequestKeyFrames asks the publisher for keyframes of the sources the subscriber hasn't been able to decode yet
+func (b *defaultBroadcaster) RequestKeyFrames(subscriberId string) {
+	b.video.requestKeyframe(subscriberId)
+	b.screen.requestKeyframe(subscriberId)
 }
 
 func (b *defaultBroadcaster) SetVideoSource(videoSrc *webrtc.TrackRemote) {
-	b.videoSrc = videoSrc
+	b.video.setTrack(videoSrc)
 }
 
 func (b *defaultBroadcaster) SetAudioSource(audioSrc *webrtc.TrackRemote) {
-	b.audioSrc = audioSrc
+	b.audio.setTrack(audioSrc)
 }
 
 func (b *defaultBroadcaster) SetScreenSource(screenSrc *webrtc.TrackRemote) {
-	b.screenSrc = screenSrc
+	b.screen.setTrack(screenSrc)
 }
 
 func (b *defaultBroadcaster) AddVideoSink(id string, pc *webrtc.PeerConnection) {
-
-	if b.videoSrc == nil {
-		return
-	}
-	// Create new localTrack as a sink for the receiver if sink doesn't already exist
-	// Use the broadcaster's clientID as the streamID
-	if _, exists := b.videoSinks[id]; !exists {
-		localTrack, err := webrtc.NewTrackLocalStaticRTP(b.videoSrc.Codec().RTPCodecCapability, b.videoSrc.ID(), b.id)
-		if err != nil {
-			fmt.Printf("failed to create local track: %s", err)
-		}
-		rtpSender, err := pc.AddTransceiverFromTrack(localTrack, webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionSendonly,
-		})
-		if err != nil {
-			fmt.Printf("failed to add track to PeerConnection: %s", err)
-		}
-		fmt.Println("Track added for id: ", id)
-		fmt.Println("Adding sink", id)
-		b.vmu.Lock()
-		b.videoSinks[id] = localTrack
-		b.vmu.Unlock()
-		go b.readSubscriberRTCP(rtpSender.Sender(), b.videoSrc)
-	}
-
-	// Create a new localTrack as a sink for the receiver if screenSrc is not nil
-	if b.screenSrc == nil {
-		return
-	}
-	if _, exists := b.screenSinks[id]; !exists {
-		localScreenTrack, err := webrtc.NewTrackLocalStaticRTP(b.screenSrc.Codec().RTPCodecCapability, b.screenSrc.ID(), b.id+"-screen")
-		if err != nil {
-			fmt.Printf("failed to create local track: %s", err)
-		}
-		rtpScreenSender, err := pc.AddTransceiverFromTrack(localScreenTrack, webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionSendonly,
-		})
-		if err != nil {
-			fmt.Printf("failed to add track to PeerConnection: %s", err)
-		}
-		fmt.Println("Track added for id: ", id)
-		fmt.Println("Adding screen sink", id)
-		b.smu.Lock()
-		b.screenSinks[id] = localScreenTrack
-		b.smu.Unlock()
-		go b.readSubscriberRTCP(rtpScreenSender.Sender(), b.screenSrc)
-	}
+	b.video.addSink(id, pc)
+	b.screen.addSink(id, pc)
 }
 
 func (b *defaultBroadcaster) AddAudioSink(id string, pc *webrtc.PeerConnection) {
-	if b.audioSrc == nil {
-		return
-	}
-	localTrack, err := webrtc.NewTrackLocalStaticRTP(b.audioSrc.Codec().RTPCodecCapability, b.audioSrc.ID(), b.id)
-	if err != nil {
-		fmt.Printf("failed to create local audio track: %s", err)
-	}
-
-	_, err = pc.AddTransceiverFromTrack(localTrack, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionSendonly,
-	})
-	if err != nil {
-		fmt.Printf("failed to add track to PeerConnection: %s", err)
-	}
-	fmt.Println("Audio track added for id: ", id)
+	b.audio.addSink(id, pc)
+}
 
-	fmt.Println("Adding sink", id)
-	b.amu.Lock()
-	b.audioSinks[id] = localTrack
-	b.amu.Unlock()
+// SetVideoPolicy limits what the subscriber's camera and screen share sinks forward
+func (b *defaultBroadcaster) SetVideoPolicy(subscriberId string, camera, screen SinkPolicy) {
+	b.video.setSinkPolicy(subscriberId, camera)
+	b.screen.setSinkPolicy(subscriberId, screen)
 }
 
-func (b *defaultBroadcaster) RemoveSinks(id string) {
-	b.vmu.Lock()
-	delete(b.videoSinks, id)
-	b.vmu.Unlock()
-	b.amu.Lock()
-	delete(b.audioSinks, id)
-	b.amu.Unlock()
+func (b *defaultBroadcaster) ScreenShareActive() bool {
+	return b.screen.getTrack() != nil
 }
 
-func (b *defaultBroadcaster) Close(closeSubscriber func(id string)) {
-	close(b.vstop)
-	close(b.astop)
-	close(b.sstop)
+// OnScreenShareEnded sets the handler called when the screen share track ends while the peer stays
+func (b *defaultBroadcaster) OnScreenShareEnded(f func()) {
+	b.screen.onEnded(f)
+}
 
-	// Send out the peerClose signal to all subscribers
-	for id := range b.videoSinks {
-		closeSubscriber(id)
-	}
-	for id := range b.audioSinks {
-		closeSubscriber(id)
+// SetMuted stops or resumes forwarding one of the streams to every subscriber
+func (b *defaultBroadcaster) SetMuted(stream PublisherStream, muted bool) {
+	switch stream {
+	case StreamAudio:
+		b.audio.setMuted(muted)
+	case StreamVideo:
+		b.video.setMuted(muted)
+	case StreamScreen:
+		b.screen.setMuted(muted)
 	}
-	//<-b.done
 }
 
-func (b *defaultBroadcaster) startVideo() {
-	defer close(b.vdone)
-	for {
-		select {
-		case <-b.vstop:
-			// Exit the goroutine
-			log.Println("Exiting broadcast goroutine")
-			return
-		default:
-			if b.videoSrc == nil {
-				continue
-			}
-			packet, _, err := b.videoSrc.ReadRTP()
-			if err != nil {
-				log.Printf("broadcaster closed: %v", err)
-				return
-			}
-
-			b.vmu.RLock()
-			for id, sink := range b.videoSinks {
-				if err := sink.WriteRTP(packet); err != nil {
-					log.Printf("sink %s write failed: %v", id, err)
-				}
+// DetachSinks removes the sinks of every subscriber and returns the subscribers, the sources keep reading
+func (b *defaultBroadcaster) DetachSinks() []string {
+	detached := map[string]bool{}
+	ids := []string{}
+	for _, src := range []*source{b.video, b.audio, b.screen} {
+		for _, id := range src.removeAllSinks() {
+			if !detached[id] {
+				detached[id] = true
+				ids = append(ids, id)
 			}
-			b.vmu.RUnlock()
 		}
 	}
+	return ids
 }
 
-func (b *defaultBroadcaster) startAudio() {
-	defer close(b.adone)
-	for {
-		select {
-		case <-b.astop:
-			// Exit the goroutine
-			log.Println("Exiting broadcast goroutine")
-			return
-		default:
-			if b.audioSrc == nil {
-				continue
-			}
-			packet, _, err := b.audioSrc.ReadRTP()
-			if err != nil {
-				log.Printf("broadcaster closed: %v", err)
-				return
-			}
+// SetCodecChecker sets what the sources check new sinks against, the router of the room the peer is in
+func (b *defaultBroadcaster) SetCodecChecker(codecs CodecChecker) {
+	b.video.setCodecChecker(codecs)
+	b.audio.setCodecChecker(codecs)
+	b.screen.setCodecChecker(codecs)
+}
 
-			b.amu.RLock()
-			for id, sink := range b.audioSinks {
-				if err := sink.WriteRTP(packet); err != nil {
-					log.Printf("sink %s write failed: %v", id, err)
-				}
-			}
-			b.amu.RUnlock()
-		}
-	}
+func (b *defaultBroadcaster) RemoveSinks(id string) {
+	b.video.removeSink(id)
+	b.audio.removeSink(id)
+	b.screen.removeSink(id)
 }
 
-func (b *defaultBroadcaster) startScreenShare() {
-	defer close(b.sdone)
-	for {
-		select {
-		case <-b.sstop:
-			// Exit the goroutine
-			log.Println("Exiting broadcast goroutine")
-			return
-		default:
-			if b.screenSrc == nil {
-				continue
-			}
-			packet, _, err := b.screenSrc.ReadRTP()
-			if err != nil {
-				log.Printf("broadcaster closed: %v", err)
-				return
-			}
+func (b *defaultBroadcaster) Close(closeSubscriber func(id string)) {
+	b.video.close()
+	b.audio.close()
+	b.screen.close()
 
-			b.smu.RLock()
-			for id, sink := range b.screenSinks {
-				if err := sink.WriteRTP(packet); err != nil {
-					log.Printf("sink %s write failed: %v", id, err)
-				}
+	// Send out the peerClose signal to all subscribers
+	notified := map[string]bool{}
+	for _, src := range []*source{b.video, b.audio, b.screen} {
+		for _, id := range src.getSinkIDs() {
+			if !notified[id] {
+				notified[id] = true
+				closeSubscriber(id)
 			}
-			b.smu.RUnlock()
 		}
 	}
+	//<-b.done
 }
@@ -0,0 +1,56 @@
+package sfu
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// CodecChecker decides whether a subscriber can decode a source before a sink is added for it
+type CodecChecker interface {
+	CanDecode(subscriberId string, codec webrtc.RTPCodecCapability) bool
+	ReportMismatch(subscriberId, peerId, streamId string, codec webrtc.RTPCodecCapability)
+}
+
+// CodecSupported reports whether a receiver with the given capabilities can decode codec. H.264 and VP9
+// streams also need a matching profile, the other codecs only need the same MIME type.
+func CodecSupported(codec webrtc.RTPCodecCapability, capabilities []webrtc.RTPCodecCapability) bool {
+	for _, capability := range capabilities {
+		if !strings.EqualFold(codec.MimeType, capability.MimeType) {
+			continue
+		}
+		switch strings.ToLower(codec.MimeType) {
+		case strings.ToLower(webrtc.MimeTypeH264):
+			if h264Profile(codec.SDPFmtpLine) != h264Profile(capability.SDPFmtpLine) ||
+				fmtpParam(codec.SDPFmtpLine, "packetization-mode", "0") != fmtpParam(capability.SDPFmtpLine, "packetization-mode", "0") {
+				continue
+			}
+		case strings.ToLower(webrtc.MimeTypeVP9):
+			if fmtpParam(codec.SDPFmtpLine, "profile-id", "0") != fmtpParam(capability.SDPFmtpLine, "profile-id", "0") {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// h264Profile returns the profile_idc of the profile-level-id, the constraint flags and level don't
+// stop a decoder of the same profile from decoding the stream
+func h264Profile(fmtp string) string {
+	profileLevelId := fmtpParam(fmtp, "profile-level-id", "42001f")
+	if len(profileLevelId) < 2 {
+		return ""
+	}
+	return strings.ToLower(profileLevelId[:2])
+}
+
+func fmtpParam(fmtp string, key string, fallback string) string {
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found && strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return fallback
+}
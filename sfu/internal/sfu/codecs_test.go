@@ -0,0 +1,83 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCodecSupported(t *testing.T) {
+	const (
+		h264Baseline   = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"
+		h264ConstBase  = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+		h264High       = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032"
+		h264SingleNALU = "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"
+		vp9Profile0    = "profile-id=0"
+		vp9Profile2    = "profile-id=2"
+	)
+	codec := func(mimeType, fmtp string) webrtc.RTPCodecCapability {
+		return webrtc.RTPCodecCapability{MimeType: mimeType, SDPFmtpLine: fmtp}
+	}
+	tests := []struct {
+		name         string
+		codec        webrtc.RTPCodecCapability
+		capabilities []webrtc.RTPCodecCapability
+		want         bool
+	}{
+		{"same mime type", codec(webrtc.MimeTypeVP8, ""), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeVP8, "")}, true},
+		{"mime type case", codec("video/vp8", ""), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeVP8, "")}, true},
+		{"other codec", codec(webrtc.MimeTypeVP8, ""), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, h264Baseline)}, false},
+		{"no capabilities", codec(webrtc.MimeTypeOpus, ""), nil, false},
+		{"h264 same profile", codec(webrtc.MimeTypeH264, h264Baseline), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, h264Baseline)}, true},
+		{"h264 constraint flags differ", codec(webrtc.MimeTypeH264, h264ConstBase), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, h264Baseline)}, true},
+		{"h264 other profile", codec(webrtc.MimeTypeH264, h264High), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, h264Baseline)}, false},
+		{"h264 second capability matches", codec(webrtc.MimeTypeH264, h264High), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, h264Baseline), codec(webrtc.MimeTypeH264, h264High)}, true},
+		{"h264 packetization mode differs", codec(webrtc.MimeTypeH264, h264SingleNALU), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, h264Baseline)}, false},
+		{"h264 default profile", codec(webrtc.MimeTypeH264, ""), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeH264, "packetization-mode=0;profile-level-id=42001f")}, true},
+		{"vp9 same profile", codec(webrtc.MimeTypeVP9, vp9Profile2), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeVP9, vp9Profile2)}, true},
+		{"vp9 other profile", codec(webrtc.MimeTypeVP9, vp9Profile2), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeVP9, vp9Profile0)}, false},
+		{"vp9 default profile", codec(webrtc.MimeTypeVP9, ""), []webrtc.RTPCodecCapability{codec(webrtc.MimeTypeVP9, vp9Profile0)}, true},
+	}
+	for _, tt := range tests {
+		if got := CodecSupported(tt.codec, tt.capabilities); got != tt.want {
+			t.Errorf("%s: CodecSupported = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFmtpParam(t *testing.T) {
+	tests := []struct {
+		fmtp string
+		key  string
+		want string
+	}{
+		{"minptime=10;useinbandfec=1", "useinbandfec", "1"},
+		{"minptime=10; useinbandfec=1", "useinbandfec", "1"},
+		{"Profile-Level-Id=640032", "profile-level-id", "640032"},
+		{"minptime=10", "useinbandfec", "fallback"},
+		{"useinbandfec", "useinbandfec", "fallback"},
+		{"", "useinbandfec", "fallback"},
+	}
+	for _, tt := range tests {
+		if got := fmtpParam(tt.fmtp, tt.key, "fallback"); got != tt.want {
+			t.Errorf("fmtpParam(%q, %q) = %q, want %q", tt.fmtp, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestH264Profile(t *testing.T) {
+	tests := []struct {
+		fmtp string
+		want string
+	}{
+		{"profile-level-id=42e01f", "42"},
+		{"profile-level-id=4D001F", "4d"},
+		{"packetization-mode=1", "42"},
+		{"profile-level-id=6", ""},
+	}
+	for _, tt := range tests {
+		if got := h264Profile(tt.fmtp); got != tt.want {
+			t.Errorf("h264Profile(%q) = %q, want %q", tt.fmtp, got, tt.want)
+		}
+	}
+}
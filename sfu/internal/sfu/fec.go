@@ -0,0 +1,193 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"expvar"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// Below this loss, NACK alone repairs the stream and FEC would only cost bandwidth
+	fecLossThreshold = 0.02
+	// A level 0 ULPFEC packet with a short mask protects at most 16 media packets
+	maxFecGroup = 16
+	minFecGroup = 2
+	// Weight of the latest receiver report in the smoothed loss
+	fecLossWeight = 0.3
+)
+
+// Counters of the ULPFEC the video sinks generated
+var fecPackets = expvar.NewMap("sfu_video_fec")
+
+// fecEncoder generates RFC 5109 ULPFEC for the video of one sink. The overhead follows the loss the
+// subscriber reports, one FEC packet protects a group of media packets that shrinks as the loss grows.
+type fecEncoder struct {
+	group []*rtp.Packet
+	loss  float64
+	mu    sync.Mutex
+}
+
+// setLoss feeds the fraction lost of a receiver report into the smoothed loss of the subscriber
+func (e *fecEncoder) setLoss(fractionLost float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loss = fecLossWeight*fractionLost + (1-fecLossWeight)*e.loss
+}
+
+// groupSize returns the number of media packets per FEC packet, or 0 while the loss is low enough
+func (e *fecEncoder) groupSize() int {
+	e.mu.Lock()
+	loss := e.loss
+	e.mu.Unlock()
+	if loss < fecLossThreshold {
+		return 0
+	}
+	// Spend about twice the loss on redundancy
+	size := int(1 / (2 * loss))
+	if size > maxFecGroup {
+		size = maxFecGroup
+	}
+	if size < minFecGroup {
+		size = minFecGroup
+	}
+	return size
+}
+
+// active reports whether the sink should protect its packets, once a group is open it is always finished
+func (e *fecEncoder) active() bool {
+	return e.groupSize() > 0 || len(e.group) > 0
+}
+
+// push adds a media packet as it is sent to the subscriber, and returns the payload of the FEC packet
+// protecting the group when the group is complete
+func (e *fecEncoder) push(packet *rtp.Packet) []byte {
+	// The mask can only reach 16 sequence numbers past the first packet of the group
+	if len(e.group) > 0 && packet.SequenceNumber-e.group[0].SequenceNumber >= maxFecGroup {
+		e.group = e.group[:0]
+	}
+	e.group = append(e.group, packet)
+	fecPackets.Add("protected", 1)
+
+	// A group opened before the loss dropped is closed at the smallest size
+	size := e.groupSize()
+	if size == 0 {
+		size = minFecGroup
+	}
+	if len(e.group) < size {
+		return nil
+	}
+	payload, err := ulpfec(e.group)
+	e.group = e.group[:0]
+	if err != nil {
+		return nil
+	}
+	fecPackets.Add("packets", 1)
+	return payload
+}
+
+// ulpfec builds a level 0 ULPFEC payload with a 16 bit mask over the packets, XORing their headers
+// and everything after the fixed RTP header
+func ulpfec(packets []*rtp.Packet) ([]byte, error) {
+	raw := make([][]byte, len(packets))
+	protectionLength := 0
+	for i, packet := range packets {
+		data, err := packet.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = data
+		if len(data)-12 > protectionLength {
+			protectionLength = len(data) - 12
+		}
+	}
+
+	base := packets[0].SequenceNumber
+	payload := make([]byte, 14+protectionLength)
+	var mask uint16
+	var lengthRecovery uint16
+	for i, data := range raw {
+		// P, X, CC, M and PT recovery, the E and L bits stay clear
+		payload[0] ^= data[0] & 0x3f
+		payload[1] ^= data[1]
+		for j := 4; j < 8; j++ {
+			payload[j] ^= data[j]
+		}
+		lengthRecovery ^= uint16(len(data) - 12)
+		mask |= 0x8000 >> (packets[i].SequenceNumber - base)
+		for j, b := range data[12:] {
+			payload[14+j] ^= b
+		}
+	}
+	binary.BigEndian.PutUint16(payload[2:4], base)
+	binary.BigEndian.PutUint16(payload[8:10], lengthRecovery)
+	binary.BigEndian.PutUint16(payload[10:12], uint16(protectionLength))
+	binary.BigEndian.PutUint16(payload[12:14], mask)
+	return payload, nil
+}
+
+// videoRED undoes the RED and ULPFEC a publisher wraps its video in once they are negotiated, so that the
+// source forwards plain media. The publisher's FEC packets are dropped and the sequence numbers after
+// them are closed up, the sinks generate their own FEC.
+type videoRED struct {
+	redPT    uint8
+	ulpfecPT uint8
+	dropped  uint16
+}
+
+// resolveMediaCodec returns the codec the track's media is encoded with. When the track is RED, that is
+// the publisher's first negotiated video codec, which is the one it sends.
+func resolveMediaCodec(pc *webrtc.PeerConnection, track *webrtc.TrackRemote) (webrtc.RTPCodecCapability, *videoRED) {
+	codec := track.Codec().RTPCodecCapability
+	if track.Kind() != webrtc.RTPCodecTypeVideo || pc == nil {
+		return codec, nil
+	}
+	receiver := trackReceiver(pc, track)
+	if receiver == nil {
+		return codec, nil
+	}
+	red := &videoRED{}
+	var media *webrtc.RTPCodecCapability
+	for _, negotiated := range receiver.GetParameters().Codecs {
+		switch strings.ToLower(negotiated.MimeType) {
+		case "video/red":
+			red.redPT = uint8(negotiated.PayloadType)
+		case "video/ulpfec":
+			red.ulpfecPT = uint8(negotiated.PayloadType)
+		case "video/rtx":
+		default:
+			if media == nil {
+				media = &negotiated.RTPCodecCapability
+			}
+		}
+	}
+	if red.redPT == 0 && red.ulpfecPT == 0 {
+		return codec, nil
+	}
+	if strings.EqualFold(codec.MimeType, "video/red") && media != nil {
+		codec = *media
+	}
+	return codec, red
+}
+
+// unwrap turns a RED packet back into the media packet it carries, it reports false for FEC packets
+func (v *videoRED) unwrap(packet *rtp.Packet) bool {
+	switch {
+	case v.ulpfecPT != 0 && packet.PayloadType == v.ulpfecPT:
+		v.dropped++
+		return false
+	case v.redPT != 0 && packet.PayloadType == v.redPT:
+		// WebRTC senders put a single block in video RED, the one byte header of the primary encoding
+		if len(packet.Payload) < 1 || packet.Payload[0]&0x80 != 0 || packet.Payload[0]&0x7f == v.ulpfecPT {
+			v.dropped++
+			return false
+		}
+		packet.PayloadType = packet.Payload[0] & 0x7f
+		packet.Payload = packet.Payload[1:]
+	}
+	packet.SequenceNumber -= v.dropped
+	return true
+}
@@ -0,0 +1,203 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// recoverPacket restores the one packet of the FEC group that is missing from received, the way a
+// subscriber's ULPFEC receiver does
+func recoverPacket(t *testing.T, fec []byte, received []*rtp.Packet, ssrc uint32) []byte {
+	t.Helper()
+	var header [12]byte
+	header[0], header[1] = fec[0], fec[1]
+	copy(header[4:8], fec[4:8])
+	length := binary.BigEndian.Uint16(fec[8:10])
+	payload := append([]byte{}, fec[14:]...)
+	for _, packet := range received {
+		data, err := packet.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		header[0] ^= data[0] & 0x3f
+		header[1] ^= data[1]
+		for j := 4; j < 8; j++ {
+			header[j] ^= data[j]
+		}
+		length ^= uint16(len(data) - 12)
+		for j, b := range data[12:] {
+			payload[j] ^= b
+		}
+	}
+	header[0] |= 0x80
+	// The sequence number is the one bit of the mask no received packet covers
+	base := binary.BigEndian.Uint16(fec[2:4])
+	mask := binary.BigEndian.Uint16(fec[12:14])
+	for _, packet := range received {
+		mask &^= 0x8000 >> (packet.SequenceNumber - base)
+	}
+	offset := uint16(0)
+	for mask != 0x8000>>offset {
+		offset++
+	}
+	binary.BigEndian.PutUint16(header[2:4], base+offset)
+	binary.BigEndian.PutUint32(header[8:12], ssrc)
+	return append(header[:], payload[:length]...)
+}
+
+func TestULPFECRecovers(t *testing.T) {
+	const ssrc = 0x11223344
+	packet := func(seq uint16, ts uint32, marker bool, payload ...byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: ssrc, Marker: marker}, Payload: payload}
+	}
+	tests := []struct {
+		name     string
+		packets  []*rtp.Packet
+		wantMask uint16
+	}{
+		{
+			"consecutive",
+			[]*rtp.Packet{packet(100, 9000, false, 1, 2, 3), packet(101, 9000, true, 4, 5), packet(102, 12000, false, 6, 7, 8, 9)},
+			0xe000,
+		},
+		{
+			"across the wraparound",
+			[]*rtp.Packet{packet(65534, 9000, false, 1), packet(65535, 9000, true, 2, 3), packet(0, 12000, false, 4, 5, 6), packet(1, 12000, true, 7)},
+			0xf000,
+		},
+		{
+			"with a gap",
+			[]*rtp.Packet{packet(10, 9000, false, 1, 2), packet(12, 9000, true, 3), packet(25, 12000, true, 4, 5, 6, 7, 8)},
+			0xa001,
+		},
+	}
+	for _, tt := range tests {
+		fec, err := ulpfec(tt.packets)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if base := binary.BigEndian.Uint16(fec[2:4]); base != tt.packets[0].SequenceNumber {
+			t.Errorf("%s: base sequence number %d, want %d", tt.name, base, tt.packets[0].SequenceNumber)
+		}
+		if mask := binary.BigEndian.Uint16(fec[12:14]); mask != tt.wantMask {
+			t.Errorf("%s: mask %016b, want %016b", tt.name, mask, tt.wantMask)
+		}
+		if fec[0]&0xc0 != 0 {
+			t.Errorf("%s: E or L bit set", tt.name)
+		}
+		// Any one packet of the group can be lost
+		for lost := range tt.packets {
+			var received []*rtp.Packet
+			received = append(received, tt.packets[:lost]...)
+			received = append(received, tt.packets[lost+1:]...)
+			want, _ := tt.packets[lost].Marshal()
+			if got := recoverPacket(t, fec, received, ssrc); !bytes.Equal(got, want) {
+				t.Errorf("%s: recovered packet %d as % x, want % x", tt.name, lost, got, want)
+			}
+		}
+	}
+}
+
+func TestFecEncoderGroupSize(t *testing.T) {
+	tests := []struct {
+		loss float64
+		want int
+	}{
+		{0, 0},
+		{0.019, 0},
+		{0.02, maxFecGroup},
+		{0.05, 10},
+		{0.1, 5},
+		{0.3, minFecGroup},
+		{1, minFecGroup},
+	}
+	for _, tt := range tests {
+		e := &fecEncoder{loss: tt.loss}
+		if got := e.groupSize(); got != tt.want {
+			t.Errorf("group size at loss %v is %d, want %d", tt.loss, got, tt.want)
+		}
+	}
+
+	// Receiver reports are smoothed, a single lossy one doesn't switch FEC on at full strength
+	e := &fecEncoder{}
+	e.setLoss(0.5)
+	if e.loss < 0.149 || e.loss > 0.151 {
+		t.Fatalf("smoothed loss %v, want 0.15", e.loss)
+	}
+	e.setLoss(0)
+	if e.loss < 0.104 || e.loss > 0.106 {
+		t.Fatalf("smoothed loss %v, want 0.105", e.loss)
+	}
+}
+
+func TestFecEncoderPush(t *testing.T) {
+	packet := func(seq uint16) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{byte(seq)}}
+	}
+	e := &fecEncoder{loss: 0.1}
+	for seq := uint16(65533); seq != 1; seq++ {
+		if e.push(packet(seq)) != nil {
+			t.Fatalf("FEC generated before the group of 5 was complete")
+		}
+	}
+	fec := e.push(packet(1))
+	if fec == nil {
+		t.Fatalf("no FEC for a complete group")
+	}
+	if base, mask := binary.BigEndian.Uint16(fec[2:4]), binary.BigEndian.Uint16(fec[12:14]); base != 65533 || mask != 0xf800 {
+		t.Fatalf("FEC protects %d/%016b, want the group across the wraparound", base, mask)
+	}
+
+	// A group the mask can't span anymore starts over, even across the wraparound
+	e.push(packet(65530))
+	e.push(packet(10))
+	if len(e.group) != 1 || e.group[0].SequenceNumber != 10 {
+		t.Fatalf("group kept a packet 16 sequence numbers back")
+	}
+
+	// Once the loss is gone an open group is still finished
+	e.loss = 0
+	if !e.active() {
+		t.Fatalf("encoder with an open group isn't active")
+	}
+	if e.push(packet(11)) == nil || e.active() {
+		t.Fatalf("the open group wasn't closed at the smallest size")
+	}
+}
+
+func TestVideoREDUnwrap(t *testing.T) {
+	v := &videoRED{redPT: 123, ulpfecPT: 122}
+	tests := []struct {
+		name        string
+		payloadType uint8
+		seq         uint16
+		payload     []byte
+		forward     bool
+		wantPT      uint8
+		wantSeq     uint16
+		wantPayload []byte
+	}{
+		{"red", 123, 65534, []byte{96, 1, 2}, true, 96, 65534, []byte{1, 2}},
+		{"ulpfec", 122, 65535, []byte{0, 0}, false, 0, 0, nil},
+		{"red after fec", 123, 0, []byte{96, 3}, true, 96, 65535, []byte{3}},
+		{"ulpfec in red", 123, 1, []byte{122, 0, 0}, false, 0, 0, nil},
+		{"red with redundant blocks", 123, 2, []byte{0x80 | 96, 0, 0, 1, 96, 4}, false, 0, 0, nil},
+		{"empty red", 123, 3, nil, false, 0, 0, nil},
+		{"plain media", 96, 4, []byte{5}, true, 96, 0, []byte{5}},
+	}
+	for _, tt := range tests {
+		packet := &rtp.Packet{Header: rtp.Header{PayloadType: tt.payloadType, SequenceNumber: tt.seq}, Payload: tt.payload}
+		if forward := v.unwrap(packet); forward != tt.forward {
+			t.Fatalf("%s: unwrap reported %v, want %v", tt.name, forward, tt.forward)
+		}
+		if !tt.forward {
+			continue
+		}
+		if packet.PayloadType != tt.wantPT || packet.SequenceNumber != tt.wantSeq || !bytes.Equal(packet.Payload, tt.wantPayload) {
+			t.Errorf("%s: unwrapped to %d/%d/% x, want %d/%d/% x", tt.name, packet.PayloadType, packet.SequenceNumber, packet.Payload, tt.wantPT, tt.wantSeq, tt.wantPayload)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package sfu
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Minimum time between two keyframe requests sent to the publisher of one source
+const keyframeInterval = 500 * time.Millisecond
+
+// keyframeRequests counts what happened to the keyframe requests received from subscribers
+var keyframeRequests = expvar.NewMap("sfu_keyframe_requests")
+
+// keyframeRequester coalesces the keyframe requests for one source. A burst of PLIs and FIRs
+// from subscribers reaches the publisher as at most one PLI per interval, a request that arrives
+// within the interval is deferred to its end so the subscriber still gets its keyframe.
+type keyframeRequester struct {
+	pc      *webrtc.PeerConnection
+	ssrc    uint32
+	last    time.Time
+	pending bool
+	mu      sync.Mutex
+}
+
+func newKeyframeRequester(pc *webrtc.PeerConnection, src *webrtc.TrackRemote) *keyframeRequester {
+	return &keyframeRequester{
+		pc:   pc,
+		ssrc: uint32(src.SSRC()),
+	}
+}
+
+func (k *keyframeRequester) request() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pending {
+		keyframeRequests.Add("suppressed", 1)
+		return
+	}
+	wait := keyframeInterval - time.Since(k.last)
+	if wait <= 0 {
+		k.send()
+		return
+	}
+	k.pending = true
+	keyframeRequests.Add("deferred", 1)
+	time.AfterFunc(wait, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.pending = false
+		k.send()
+	})
+}
+
+// send writes the PLI, k.mu must be held
+func (k *keyframeRequester) send() {
+	k.last = time.Now()
+	keyframeRequests.Add("forwarded", 1)
+
+	// pc MUST match the id of the broadcaster (sending PLI for this source through pc)
+	log.Printf("Sending PLI to publisher for MediaSSRC %d", k.ssrc)
+	if err := k.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: k.ssrc}}); err != nil {
+		log.Printf("Failed to write PLI: %v", err)
+	}
+}
+
+// isKeyframe reports whether the RTP payload starts a keyframe of the given codec
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		return isVP8Keyframe(payload)
+	case webrtc.MimeTypeVP9:
+		return isVP9Keyframe(payload)
+	case webrtc.MimeTypeH264:
+		return isH264Keyframe(payload)
+	case webrtc.MimeTypeAV1:
+		// The N bit of the aggregation header marks the first packet of a coded video sequence
+		return len(payload) > 0 && payload[0]&0x08 != 0
+	}
+	return false
+}
+
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// Only the first partition of a frame carries the frame header (S set, PID 0)
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		offset++
+		if ext&0x80 != 0 {
+			// Picture ID is two bytes long when its M bit is set
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		if ext&0x40 != 0 {
+			offset++
+		}
+		if ext&0x30 != 0 {
+			offset++
+		}
+	}
+	// The P bit of the VP8 frame header is clear for keyframes
+	return len(payload) > offset && payload[offset]&0x01 == 0
+}
+
+func isVP9Keyframe(payload []byte) bool {
+	// Not inter-predicted (P clear) and the beginning of a frame (B set)
+	return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	isKeyNalu := func(naluType byte) bool {
+		// IDR slices, or the SPS that precedes them
+		return naluType == 5 || naluType == 7
+	}
+	naluType := payload[0] & 0x1F
+	switch naluType {
+	case 24:
+		// STAP-A, walk the aggregated NAL units
+		offset := 1
+		for offset+2 < len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if isKeyNalu(payload[offset] & 0x1F) {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case 28:
+		// FU-A, only the start fragment tells the type
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isKeyNalu(payload[1]&0x1F)
+	default:
+		return isKeyNalu(naluType)
+	}
+}
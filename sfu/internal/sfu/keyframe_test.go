@@ -0,0 +1,91 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 later partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"vp8 one byte picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x12, 0x00}, true},
+		{"vp8 two byte picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x00}, true},
+		{"vp8 two byte picture id interframe", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x01}, false},
+		{"vp8 all extensions", webrtc.MimeTypeVP8, []byte{0x90, 0xf0, 0x81, 0x23, 0x05, 0x40, 0x00}, true},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"vp8 truncated extension", webrtc.MimeTypeVP8, []byte{0x90}, false},
+		{"vp8 truncated picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 truncated frame header", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23}, false},
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 inter predicted", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"vp9 not frame start", webrtc.MimeTypeVP9, []byte{0x00}, false},
+		{"vp9 empty", webrtc.MimeTypeVP9, nil, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67, 0x42}, true},
+		{"h264 non idr", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"h264 empty", webrtc.MimeTypeH264, nil, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"h264 stap-a idr second", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x06, 0x00, 0x02, 0x65, 0x88}, true},
+		{"h264 stap-a without key", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x06, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"h264 stap-a truncated", webrtc.MimeTypeH264, []byte{0x78, 0x00}, false},
+		{"h264 stap-a oversized unit", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0xff, 0x06, 0x00}, false},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"h264 fu-a non idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x81, 0x9a}, false},
+		{"h264 fu-a truncated", webrtc.MimeTypeH264, []byte{0x7c}, false},
+		{"av1 new sequence", webrtc.MimeTypeAV1, []byte{0x18}, true},
+		{"av1 continuing sequence", webrtc.MimeTypeAV1, []byte{0x10}, false},
+		{"av1 empty", webrtc.MimeTypeAV1, nil, false},
+		{"audio", webrtc.MimeTypeOpus, []byte{0xff}, false},
+	}
+	for _, tt := range tests {
+		if got := isKeyframe(tt.mimeType, tt.payload); got != tt.want {
+			t.Errorf("%s: isKeyframe(% x) = %v, want %v", tt.name, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestKeyframeRequesterCoalesces(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create a peer connection: %v", err)
+	}
+	defer pc.Close()
+	k := &keyframeRequester{pc: pc, ssrc: 1}
+
+	k.request()
+	k.mu.Lock()
+	first, pending := k.last, k.pending
+	k.mu.Unlock()
+	if first.IsZero() || pending {
+		t.Fatalf("the first request wasn't sent right away")
+	}
+
+	// A burst within the interval is deferred once, then suppressed
+	k.request()
+	k.request()
+	k.mu.Lock()
+	last, pending := k.last, k.pending
+	k.mu.Unlock()
+	if last != first || !pending {
+		t.Fatalf("requests within the interval weren't deferred")
+	}
+
+	time.Sleep(keyframeInterval + 100*time.Millisecond)
+	k.mu.Lock()
+	last, pending = k.last, k.pending
+	k.mu.Unlock()
+	if pending || last.Sub(first) < keyframeInterval {
+		t.Fatalf("the deferred request wasn't sent at the end of the interval (sent %v after the first)", last.Sub(first))
+	}
+}
@@ -0,0 +1,115 @@
+package sfu
+
+import (
+	"fmt"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// LocalSink receives the packets of a source inside the SFU, e.g. to remux them for a live stream. WriteRTP
+// is called from the forwarding loop, it must not block and the packet is only valid during the call.
+// Audio arrives as plain Opus and video without RED.
+type LocalSink interface {
+	WriteRTP(codec webrtc.RTPCodecCapability, packet *rtp.Packet)
+}
+
+// AddLocalSink sends a stream of the peer to the sink under the id, a video sink starts with the next keyframe
+func (r *defaultRouter) AddLocalSink(peerId string, id string, stream PublisherStream, sink LocalSink) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	broadcaster, exists := r.broadcasters[peerId]
+	if !exists || r.waiting[peerId] {
+		return fmt.Errorf("peer %s publishes nothing", peerId)
+	}
+	broadcaster.AddLocalSink(id, stream, sink)
+	return nil
+}
+
+func (r *defaultRouter) RemoveLocalSink(peerId string, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if broadcaster, exists := r.broadcasters[peerId]; exists {
+		broadcaster.RemoveLocalSink(id)
+	}
+}
+
+// RequestLocalKeyframe asks the peer for keyframes of its camera and screen share, e.g. after a local sink
+// lost packets
+func (r *defaultRouter) RequestLocalKeyframe(peerId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if broadcaster, exists := r.broadcasters[peerId]; exists {
+		broadcaster.SendAllPublisherPli()
+	}
+}
+
+// ScreenShareActive reports whether the peer currently shares their screen
+func (r *defaultRouter) ScreenShareActive(peerId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	broadcaster, exists := r.broadcasters[peerId]
+	return exists && broadcaster.ScreenShareActive()
+}
+
+func (b *defaultBroadcaster) AddLocalSink(id string, stream PublisherStream, sink LocalSink) {
+	switch stream {
+	case StreamAudio:
+		b.audio.addLocalSink(id, sink)
+	case StreamVideo:
+		b.video.addLocalSink(id, sink)
+	case StreamScreen:
+		b.screen.addLocalSink(id, sink)
+	}
+}
+
+func (b *defaultBroadcaster) RemoveLocalSink(id string) {
+	for _, src := range []*source{b.video, b.audio, b.screen} {
+		src.removeLocalSink(id)
+	}
+}
+
+// RemoveLocalSinks removes every local sink, e.g. when the peer leaves the room
+func (b *defaultBroadcaster) RemoveLocalSinks() {
+	for _, src := range []*source{b.video, b.audio, b.screen} {
+		src.removeLocalSinks()
+	}
+}
+
+func (s *source) addLocalSink(id string, sink LocalSink) {
+	s.mu.Lock()
+	s.local[id] = sink
+	kfr := s.kfr
+	s.mu.Unlock()
+	if kfr != nil {
+		kfr.request()
+	}
+}
+
+func (s *source) removeLocalSink(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.local, id)
+}
+
+func (s *source) removeLocalSinks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local = map[string]LocalSink{}
+}
+
+// writeLocal passes a packet to the local sinks, RED audio is unwrapped to the Opus frames once for all
+// of them. s.mu must be held.
+func (s *source) writeLocal(packet *rtp.Packet) {
+	codec := s.codec
+	packets := []*rtp.Packet{packet}
+	if isRED(codec) {
+		codec = opusCodec
+		packets = s.localRED.unwrap(packet)
+	}
+	for _, p := range packets {
+		for _, sink := range s.local {
+			sink.WriteRTP(codec, p)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package sfu
+
+import "fmt"
+
+// PublisherStream is one of the streams a peer publishes, which a moderator can stop forwarding
+type PublisherStream string
+
+const (
+	StreamAudio  PublisherStream = "audio"
+	StreamVideo  PublisherStream = "video"
+	StreamScreen PublisherStream = "screen"
+)
+
+// MuteStream stops or resumes forwarding a stream of the peer, whether it publishes it yet or not. The
+// peer's client can't lift it, only another call can.
+func (r *defaultRouter) MuteStream(id string, stream PublisherStream, muted bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[id]; !exists || r.isRelay(id) {
+		return fmt.Errorf("PeerConnection with id %s does not exist", id)
+	}
+	if muted {
+		if r.muted[id] == nil {
+			r.muted[id] = map[PublisherStream]bool{}
+		}
+		r.muted[id][stream] = true
+	} else if r.muted[id] != nil {
+		delete(r.muted[id], stream)
+		if len(r.muted[id]) == 0 {
+			delete(r.muted, id)
+		}
+	}
+	if broadcaster, exists := r.broadcasters[id]; exists {
+		broadcaster.SetMuted(stream, muted)
+	}
+	return nil
+}
+
+// IsMuted reports whether a moderator stopped the stream of the peer
+func (r *defaultRouter) IsMuted(id string, stream PublisherStream) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.muted[id][stream]
+}
+
+// SetLocked locks or unlocks the room, the server turns away new joins while it is locked
+func (r *defaultRouter) SetLocked(locked bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.locked = locked
+}
+
+func (r *defaultRouter) IsLocked() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.locked
+}
+
+// applyMuted mutes the streams of a new broadcaster that were muted before it published. r.mu must be held.
+func (r *defaultRouter) applyMuted(id string, broadcaster Broadcaster) {
+	for stream := range r.muted[id] {
+		broadcaster.SetMuted(stream, true)
+	}
+}
@@ -0,0 +1,93 @@
+package sfu
+
+import (
+	"fmt"
+	"time"
+)
+
+// SubscriberMode limits the video a subscriber receives, e.g. for members on cellular data
+type SubscriberMode string
+
+const (
+	SubscriberModeDefault SubscriberMode = "default"
+	// No video at all
+	SubscriberModeAudioOnly SubscriberMode = "audioOnly"
+	// Video as a slideshow of keyframes, the SFU doesn't receive simulcast layers to pick the lowest from
+	SubscriberModeLowData SubscriberMode = "lowData"
+	// No cameras while someone shares their screen
+	SubscriberModeScreenPriority SubscriberMode = "screenPriority"
+)
+
+// How often a low data subscriber gets a new picture
+const lowDataSlideInterval = 5 * time.Second
+
+// SinkPolicy says what a video sink forwards of its source
+type SinkPolicy struct {
+	Paused bool
+	// Only forward a keyframe this often, zero forwards every frame
+	Slideshow time.Duration
+}
+
+func (m SubscriberMode) valid() bool {
+	switch m {
+	case SubscriberModeDefault, SubscriberModeAudioOnly, SubscriberModeLowData, SubscriberModeScreenPriority:
+		return true
+	}
+	return false
+}
+
+// SetSubscriberMode changes what the subscriber receives without renegotiating its PeerConnection
+func (r *defaultRouter) SetSubscriberMode(id string, mode SubscriberMode) error {
+	if !mode.valid() {
+		return fmt.Errorf("unknown subscriber mode %q", mode)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[id]; !exists {
+		return fmt.Errorf("PeerConnection with id %s does not exist", id)
+	}
+	if mode == SubscriberModeDefault {
+		delete(r.modes, id)
+	} else {
+		r.modes[id] = mode
+	}
+	r.applyMode(id, mode)
+	return nil
+}
+
+// applyModes enforces the modes on the sinks again, after sinks were added or a screen share started or
+// ended. r.mu must be held.
+func (r *defaultRouter) applyModes() {
+	for id, mode := range r.modes {
+		r.applyMode(id, mode)
+	}
+}
+
+func (r *defaultRouter) applyMode(id string, mode SubscriberMode) {
+	var camera, screen SinkPolicy
+	switch mode {
+	case SubscriberModeAudioOnly:
+		camera.Paused = true
+		screen.Paused = true
+	case SubscriberModeLowData:
+		camera.Slideshow = lowDataSlideInterval
+		screen.Slideshow = lowDataSlideInterval
+	case SubscriberModeScreenPriority:
+		camera.Paused = r.presenting(id)
+	}
+	for bid, broadcaster := range r.broadcasters {
+		if r.canSubscribe(bid, id) {
+			broadcaster.SetVideoPolicy(id, camera, screen)
+		}
+	}
+}
+
+// presenting reports whether the subscriber receives a screen share. r.mu must be held.
+func (r *defaultRouter) presenting(id string) bool {
+	for bid, broadcaster := range r.broadcasters {
+		if r.canSubscribe(bid, id) && broadcaster.ScreenShareActive() {
+			return true
+		}
+	}
+	return false
+}
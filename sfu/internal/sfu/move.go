@@ -0,0 +1,141 @@
+package sfu
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Participant is a peer taken out of one router with its PeerConnection and broadcaster, to be inserted
+// into another, e.g. when it is moved into a breakout room
+type Participant struct {
+	id          string
+	name        string
+	pc          *webrtc.PeerConnection
+	broadcaster Broadcaster
+	codecs      []webrtc.RTPCodecCapability
+	role        Role
+	hasRole     bool
+	mode        SubscriberMode
+	muted       map[PublisherStream]bool
+	reports     *reportAggregator
+	// Still waiting to be admitted, it keeps waiting in the room it is inserted into
+	waiting bool
+}
+
+func (p *Participant) ID() string {
+	return p.id
+}
+
+func (p *Participant) Name() string {
+	return p.name
+}
+
+func (p *Participant) Waiting() bool {
+	return p.waiting
+}
+
+// Extract takes the peer out of the router without closing its PeerConnection. Its sinks are removed from
+// the broadcasters of the room, and the subscribers of its own broadcaster are told it left.
+func (r *defaultRouter) Extract(id string, closeSubscriber func(peerId, subscriberId string)) (*Participant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pc, exists := r.connections[id]
+	if !exists || r.isRelay(id) {
+		return nil, fmt.Errorf("PeerConnection with id %s does not exist", id)
+	}
+	p := &Participant{
+		id:      id,
+		name:    r.names[id],
+		pc:      pc,
+		mode:    r.modes[id],
+		muted:   r.muted[id],
+		reports: r.reportsFor(id),
+		waiting: r.waiting[id],
+	}
+	p.role, p.hasRole = r.roles[id]
+
+	// Stop receiving the room
+	for bid, broadcaster := range r.broadcasters {
+		if bid == id {
+			continue
+		}
+		broadcaster.RemoveSinks(id)
+		removeSenders(pc, bid)
+	}
+
+	// Stop sending to the room, the broadcaster keeps reading the peer's tracks
+	if broadcaster, exists := r.broadcasters[id]; exists {
+		broadcaster.RemoveLocalSinks()
+		for _, subscriberId := range broadcaster.DetachSinks() {
+			closeSubscriber(id, subscriberId)
+			if spc, exists := r.connections[subscriberId]; exists {
+				removeSenders(spc, id)
+			}
+		}
+		p.broadcaster = broadcaster
+		delete(r.broadcasters, id)
+	}
+
+	delete(r.connections, id)
+	delete(r.names, id)
+	delete(r.modes, id)
+	delete(r.muted, id)
+	delete(r.waiting, id)
+	delete(r.roles, id)
+	delete(r.movedReports, id)
+	r.applyModes()
+	r.codecMu.Lock()
+	p.codecs = r.codecs[id]
+	delete(r.codecs, id)
+	r.codecMu.Unlock()
+	return p, nil
+}
+
+// Insert adds a peer extracted from another router, it receives the room and the room receives it. A peer
+// that was waiting to be admitted keeps waiting, it only receives the lobby peer until it is admitted.
+func (r *defaultRouter) Insert(p *Participant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[p.id]; exists {
+		return fmt.Errorf("PeerConnection with id %s already exists", p.id)
+	}
+	r.connections[p.id] = p.pc
+	r.names[p.id] = p.name
+	if p.waiting {
+		r.waiting[p.id] = true
+	}
+	if p.reports != nil && p.reports != r.reports {
+		r.movedReports[p.id] = p.reports
+	}
+	if p.hasRole {
+		r.roles[p.id] = p.role
+	}
+	if p.mode != "" {
+		r.modes[p.id] = p.mode
+	}
+	if p.muted != nil {
+		r.muted[p.id] = p.muted
+	}
+	if p.codecs != nil {
+		r.codecMu.Lock()
+		r.codecs[p.id] = p.codecs
+		r.codecMu.Unlock()
+	}
+
+	for bid := range r.broadcasters {
+		r.subscribe(bid, p.id)
+	}
+	if p.broadcaster != nil {
+		p.broadcaster.SetCodecChecker(r)
+		r.addBroadcaster(p.id, p.broadcaster)
+		for rid, pc := range r.connections {
+			if r.canSubscribe(p.id, rid) {
+				p.broadcaster.AddVideoSink(rid, pc)
+				p.broadcaster.AddAudioSink(rid, pc)
+			}
+		}
+	}
+	r.applyModes()
+	return nil
+}
@@ -0,0 +1,110 @@
+package sfu
+
+import (
+	"errors"
+	"expvar"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// MimeTypeRED is RFC 2198 redundant audio, each packet also carries the previous Opus frames
+const MimeTypeRED = "audio/red"
+
+// Counters of the RED audio the sinks forwarded, recovered counts Opus frames that were lost
+// on the way from the publisher and restored from the redundancy of a later packet
+var redPackets = expvar.NewMap("sfu_audio_red")
+
+// opusCodec is what sinks send to subscribers that didn't negotiate RED, every WebRTC endpoint decodes it
+var opusCodec = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+var errShortRED = errors.New("RED payload too short")
+
+func isRED(codec webrtc.RTPCodecCapability) bool {
+	return strings.EqualFold(codec.MimeType, MimeTypeRED)
+}
+
+type redBlock struct {
+	tsOffset uint32
+	payload  []byte
+}
+
+// parseRED splits a RED payload into its redundant blocks, oldest first, and the primary encoding
+func parseRED(payload []byte) ([]redBlock, []byte, error) {
+	var blocks []redBlock
+	var lengths []int
+	offset := 0
+	for {
+		if offset >= len(payload) {
+			return nil, nil, errShortRED
+		}
+		// The F bit is clear on the last header, which belongs to the primary encoding
+		if payload[offset]&0x80 == 0 {
+			offset++
+			break
+		}
+		if offset+4 > len(payload) {
+			return nil, nil, errShortRED
+		}
+		header := uint32(payload[offset+1])<<16 | uint32(payload[offset+2])<<8 | uint32(payload[offset+3])
+		blocks = append(blocks, redBlock{tsOffset: header >> 10})
+		lengths = append(lengths, int(header&0x3ff))
+		offset += 4
+	}
+	for i, length := range lengths {
+		if offset+length > len(payload) {
+			return nil, nil, errShortRED
+		}
+		blocks[i].payload = payload[offset : offset+length]
+		offset += length
+	}
+	return blocks, payload[offset:], nil
+}
+
+// redUnwrapper turns RED packets back into plain Opus. Frames missing from the sequence are restored
+// from the redundant blocks, assuming one frame per packet as WebRTC senders do.
+type redUnwrapper struct {
+	started bool
+	lastSeq uint16
+}
+
+func (u *redUnwrapper) unwrap(packet *rtp.Packet) []*rtp.Packet {
+	blocks, primary, err := parseRED(packet.Payload)
+	if err != nil {
+		return nil
+	}
+	var packets []*rtp.Packet
+	if u.started {
+		missing := packet.SequenceNumber - u.lastSeq - 1
+		if missing >= 0x8000 {
+			// Reordered or repeated, the frame was already forwarded
+			return nil
+		}
+		// The newest redundant block is the frame right before this one
+		for i, block := range blocks {
+			distance := uint16(len(blocks) - i)
+			if distance > missing || len(block.payload) == 0 {
+				continue
+			}
+			recovered := packet.Header.Clone()
+			recovered.SequenceNumber = packet.SequenceNumber - distance
+			recovered.Timestamp = packet.Timestamp - block.tsOffset
+			recovered.Marker = false
+			packets = append(packets, &rtp.Packet{Header: recovered, Payload: block.payload})
+			redPackets.Add("recovered", 1)
+		}
+	}
+	u.started = true
+	u.lastSeq = packet.SequenceNumber
+
+	header := packet.Header.Clone()
+	packets = append(packets, &rtp.Packet{Header: header, Payload: primary})
+	redPackets.Add("unwrapped", 1)
+	return packets
+}
@@ -0,0 +1,119 @@
+package sfu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// redPayload builds a RED payload carrying the blocks, oldest first, and the primary Opus frame
+func redPayload(primary []byte, blocks ...redBlock) []byte {
+	var payload []byte
+	for _, block := range blocks {
+		header := block.tsOffset<<10 | uint32(len(block.payload))
+		payload = append(payload, 0x80|111, byte(header>>16), byte(header>>8), byte(header))
+	}
+	payload = append(payload, 111)
+	for _, block := range blocks {
+		payload = append(payload, block.payload...)
+	}
+	return append(payload, primary...)
+}
+
+func TestParseRED(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		blocks  []redBlock
+		primary []byte
+		err     error
+	}{
+		{"primary only", redPayload([]byte{1, 2, 3}), nil, []byte{1, 2, 3}, nil},
+		{"one block", redPayload([]byte{3, 3}, redBlock{960, []byte{2, 2}}), []redBlock{{960, []byte{2, 2}}}, []byte{3, 3}, nil},
+		{
+			"two blocks",
+			redPayload([]byte{3}, redBlock{1920, []byte{1}}, redBlock{960, []byte{2, 2}}),
+			[]redBlock{{1920, []byte{1}}, {960, []byte{2, 2}}},
+			[]byte{3},
+			nil,
+		},
+		{"empty block", redPayload([]byte{3}, redBlock{960, nil}), []redBlock{{960, nil}}, []byte{3}, nil},
+		{"largest offset and length", redPayload(nil, redBlock{0x3fff, make([]byte, 0x3ff)}), []redBlock{{0x3fff, make([]byte, 0x3ff)}}, []byte{}, nil},
+		{"empty", nil, nil, nil, errShortRED},
+		{"only block headers", []byte{0x80 | 111, 0x0f, 0x00, 0x01}, nil, nil, errShortRED},
+		{"truncated block header", []byte{0x80 | 111, 0x0f, 0x00}, nil, nil, errShortRED},
+		{"block longer than payload", append(redPayload(nil, redBlock{960, []byte{1, 2, 3}})[:5], 1, 2), nil, nil, errShortRED},
+	}
+	for _, tt := range tests {
+		blocks, primary, err := parseRED(tt.payload)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !bytes.Equal(primary, tt.primary) || len(blocks) != len(tt.blocks) {
+			t.Errorf("%s: parsed %d blocks and primary % x, want %d blocks and % x", tt.name, len(blocks), primary, len(tt.blocks), tt.primary)
+			continue
+		}
+		for i := range blocks {
+			if blocks[i].tsOffset != tt.blocks[i].tsOffset || !bytes.Equal(blocks[i].payload, tt.blocks[i].payload) {
+				t.Errorf("%s: block %d is %d/% x, want %d/% x", tt.name, i, blocks[i].tsOffset, blocks[i].payload, tt.blocks[i].tsOffset, tt.blocks[i].payload)
+			}
+		}
+	}
+}
+
+func TestRedUnwrapper(t *testing.T) {
+	// Each frame is 960 samples and its payload is its own sequence number's low byte
+	timestamp := func(seq uint16) uint32 {
+		return 1000 + uint32(seq-65533)*960
+	}
+	redPacket := func(seq uint16) *rtp.Packet {
+		ts := timestamp(seq)
+		return &rtp.Packet{
+			Header: rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: true},
+			Payload: redPayload([]byte{byte(seq)},
+				redBlock{1920, []byte{byte(seq - 2)}},
+				redBlock{960, []byte{byte(seq - 1)}}),
+		}
+	}
+	tests := []struct {
+		name string
+		seq  uint16
+		// The sequence numbers unwrapped, each packet's payload must match
+		want []uint16
+	}{
+		{"first packet", 65533, []uint16{65533}},
+		{"in order", 65534, []uint16{65534}},
+		{"one lost across the wraparound", 0, []uint16{65535, 0}},
+		{"two lost", 3, []uint16{1, 2, 3}},
+		{"more lost than the redundancy", 7, []uint16{5, 6, 7}},
+		{"reordered", 6, nil},
+		{"repeated", 7, nil},
+		{"in order again", 8, []uint16{8}},
+	}
+	u := &redUnwrapper{}
+	for _, tt := range tests {
+		packet := redPacket(tt.seq)
+		got := u.unwrap(packet)
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: unwrapped %d packets, want %d", tt.name, len(got), len(tt.want))
+		}
+		for i, unwrapped := range got {
+			seq := tt.want[i]
+			if unwrapped.SequenceNumber != seq || unwrapped.Timestamp != timestamp(seq) || !bytes.Equal(unwrapped.Payload, []byte{byte(seq)}) {
+				t.Errorf("%s: packet %d is %d/%d/% x, want %d/%d/%02x", tt.name, i, unwrapped.SequenceNumber, unwrapped.Timestamp, unwrapped.Payload, seq, timestamp(seq), byte(seq))
+			}
+			if recovered := i < len(got)-1; recovered == unwrapped.Marker {
+				t.Errorf("%s: packet %d has the marker %v", tt.name, i, unwrapped.Marker)
+			}
+		}
+	}
+
+	if got := u.unwrap(&rtp.Packet{Header: rtp.Header{SequenceNumber: 9}, Payload: []byte{0x80 | 111, 0}}); got != nil {
+		t.Fatalf("a malformed RED packet was unwrapped")
+	}
+	if got := u.unwrap(redPacket(10)); len(got) != 2 || got[0].SequenceNumber != 9 {
+		t.Fatalf("the frame of a malformed packet wasn't recovered from the next one")
+	}
+}
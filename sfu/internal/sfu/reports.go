@@ -0,0 +1,119 @@
+package sfu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// A subscriber's receiver report stops counting toward the publisher's after this long
+const downstreamReportTTL = 5 * time.Second
+
+type downstreamReport struct {
+	fractionLost uint8
+	jitter       uint32
+	received     time.Time
+}
+
+// reportAggregator keeps the latest receiver report of every sink of a room, keyed by the SSRC the
+// publisher sends the source with. Each router has its own, so SSRCs only need to be unique in the room.
+type reportAggregator struct {
+	streams map[uint32]map[*sink]downstreamReport
+	mu      sync.Mutex
+}
+
+func newReportAggregator() *reportAggregator {
+	return &reportAggregator{streams: map[uint32]map[*sink]downstreamReport{}}
+}
+
+func (a *reportAggregator) record(ssrc uint32, s *sink, report rtcp.ReceptionReport) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.streams[ssrc] == nil {
+		a.streams[ssrc] = map[*sink]downstreamReport{}
+	}
+	a.streams[ssrc][s] = downstreamReport{fractionLost: report.FractionLost, jitter: report.Jitter, received: time.Now()}
+}
+
+func (a *reportAggregator) remove(s *sink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ssrc, reports := range a.streams {
+		delete(reports, s)
+		if len(reports) == 0 {
+			delete(a.streams, ssrc)
+		}
+	}
+}
+
+// apply folds the subscribers into a report for the publisher. The loss is raised to the subscribers'
+// mean, so one subscriber on a bad network doesn't lower the quality for everyone, and the jitter to
+// the worst one.
+func (a *reportAggregator) apply(report *rtcp.ReceptionReport) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var lost, count int
+	var jitter uint32
+	for s, downstream := range a.streams[report.SSRC] {
+		if time.Since(downstream.received) > downstreamReportTTL {
+			delete(a.streams[report.SSRC], s)
+			continue
+		}
+		lost += int(downstream.fractionLost)
+		count++
+		if downstream.jitter > jitter {
+			jitter = downstream.jitter
+		}
+	}
+	if count == 0 {
+		return
+	}
+	if mean := uint8(lost / count); mean > report.FractionLost {
+		report.FractionLost = mean
+	}
+	if jitter > report.Jitter {
+		report.Jitter = jitter
+	}
+}
+
+// reportInterceptorFactory creates the interceptors that fold the subscribers' receiver reports into the
+// receiver reports sent to publishers, so that their encoders react to the conditions downstream. It has
+// to be registered before the interceptor generating the receiver reports.
+type reportInterceptorFactory struct {
+	reports *reportAggregator
+}
+
+func (f *reportInterceptorFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &reportInterceptor{reports: f.reports}, nil
+}
+
+type reportInterceptor struct {
+	interceptor.NoOp
+	reports *reportAggregator
+}
+
+func (i *reportInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		for _, pkt := range pkts {
+			if rr, ok := pkt.(*rtcp.ReceiverReport); ok {
+				for j := range rr.Reports {
+					i.reports.apply(&rr.Reports[j])
+				}
+			}
+		}
+		return writer.Write(pkts, attributes)
+	})
+}
+
+// trackReceiver finds the receiver of a remote track on the publisher's PeerConnection
+func trackReceiver(pc *webrtc.PeerConnection, track *webrtc.TrackRemote) *webrtc.RTPReceiver {
+	for _, transceiver := range pc.GetTransceivers() {
+		if receiver := transceiver.Receiver(); receiver != nil && receiver.Track() == track {
+			return receiver
+		}
+	}
+	return nil
+}
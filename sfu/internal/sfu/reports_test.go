@@ -0,0 +1,116 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+)
+
+func TestSinkSenderReport(t *testing.T) {
+	s := &sink{track: &sinkTrack{binding: redBinding{ssrc: 0xabcd}}, munger: newRTPMunger(90000)}
+	sr := &rtcp.SenderReport{SSRC: 0x1234, NTPTime: 0xe000000080000000, RTPTime: 4294967000}
+	if s.senderReport(sr) != nil {
+		t.Fatalf("translated a sender report before the sink forwarded anything")
+	}
+
+	// The publisher's timestamps and the sink's can wrap at different times
+	s.munger.munge(vp8Packet(100, 4294966000, true))
+	s.munger.tsOffset = 2000
+	s.count(100)
+	s.count(50)
+	got := s.senderReport(sr)
+	if got == nil {
+		t.Fatalf("no sender report for a sink that forwarded packets")
+	}
+	want := rtcp.SenderReport{SSRC: 0xabcd, NTPTime: sr.NTPTime, RTPTime: 1704, PacketCount: 2, OctetCount: 150}
+	if got.SSRC != want.SSRC || got.NTPTime != want.NTPTime || got.RTPTime != want.RTPTime || got.PacketCount != want.PacketCount || got.OctetCount != want.OctetCount {
+		t.Fatalf("translated to %+v, want %+v", *got, want)
+	}
+
+	s.replaying = true
+	if s.senderReport(sr) != nil {
+		t.Fatalf("translated a sender report while replaying the GOP")
+	}
+	s.replaying = false
+	s.track.binding = redBinding{}
+	if s.senderReport(sr) != nil {
+		t.Fatalf("translated a sender report for an unbound track")
+	}
+}
+
+func TestReportAggregator(t *testing.T) {
+	a := newReportAggregator()
+	first, second, third := &sink{}, &sink{}, &sink{}
+	a.record(1, first, rtcp.ReceptionReport{FractionLost: 10, Jitter: 100})
+	a.record(1, second, rtcp.ReceptionReport{FractionLost: 40, Jitter: 300})
+	a.record(2, third, rtcp.ReceptionReport{FractionLost: 200, Jitter: 9000})
+
+	tests := []struct {
+		name       string
+		report     rtcp.ReceptionReport
+		wantLost   uint8
+		wantJitter uint32
+	}{
+		{"raised to the subscribers", rtcp.ReceptionReport{SSRC: 1, FractionLost: 5, Jitter: 50}, 25, 300},
+		{"publisher's loss is higher", rtcp.ReceptionReport{SSRC: 1, FractionLost: 30, Jitter: 500}, 30, 500},
+		{"no subscribers", rtcp.ReceptionReport{SSRC: 3, FractionLost: 5, Jitter: 50}, 5, 50},
+	}
+	for _, tt := range tests {
+		report := tt.report
+		a.apply(&report)
+		if report.FractionLost != tt.wantLost || report.Jitter != tt.wantJitter {
+			t.Errorf("%s: folded into %d/%d, want %d/%d", tt.name, report.FractionLost, report.Jitter, tt.wantLost, tt.wantJitter)
+		}
+	}
+
+	// A sink's reports stop counting once it's removed or its report is too old
+	a.remove(second)
+	report := rtcp.ReceptionReport{SSRC: 1}
+	a.apply(&report)
+	if report.FractionLost != 10 || report.Jitter != 100 {
+		t.Fatalf("removed sink still counts: %d/%d", report.FractionLost, report.Jitter)
+	}
+	a.mu.Lock()
+	a.streams[1][first] = downstreamReport{fractionLost: 10, jitter: 100, received: time.Now().Add(-downstreamReportTTL - time.Second)}
+	a.mu.Unlock()
+	report = rtcp.ReceptionReport{SSRC: 1}
+	a.apply(&report)
+	if report.FractionLost != 0 || report.Jitter != 0 {
+		t.Fatalf("expired report still counts: %d/%d", report.FractionLost, report.Jitter)
+	}
+	a.remove(third)
+	if len(a.streams) != 0 {
+		t.Fatalf("streams left behind: %v", a.streams)
+	}
+}
+
+func TestReportInterceptorPerRouter(t *testing.T) {
+	first, second := NewRouter().(*defaultRouter), NewRouter().(*defaultRouter)
+	// Publishers in different rooms may send with the same SSRC
+	first.reports.record(1, &sink{}, rtcp.ReceptionReport{FractionLost: 50, Jitter: 500})
+	second.reports.record(1, &sink{}, rtcp.ReceptionReport{FractionLost: 100, Jitter: 1000})
+
+	for _, tt := range []struct {
+		router   *defaultRouter
+		wantLost uint8
+	}{{first, 50}, {second, 100}} {
+		i, err := tt.router.ReportInterceptor().NewInterceptor("")
+		if err != nil {
+			t.Fatalf("failed to create the interceptor: %v", err)
+		}
+		var written []rtcp.Packet
+		writer := i.BindRTCPWriter(interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, _ interceptor.Attributes) (int, error) {
+			written = pkts
+			return 0, nil
+		}))
+		rr := &rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{SSRC: 1}}}
+		if _, err := writer.Write([]rtcp.Packet{rr}, nil); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if len(written) != 1 || rr.Reports[0].FractionLost != tt.wantLost {
+			t.Errorf("receiver report folded to a loss of %d, want the room's %d", rr.Reports[0].FractionLost, tt.wantLost)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sfu
+
+import "fmt"
+
+// Role decides whether a participant publishes, e.g. attendees of a webinar only watch the stage
+type Role string
+
+const (
+	RoleHost     Role = "host"
+	RolePanelist Role = "panelist"
+	RoleAttendee Role = "attendee"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleHost, RolePanelist, RoleAttendee:
+		return true
+	}
+	return false
+}
+
+// Publishes reports whether the role sends media to the room
+func (r Role) Publishes() bool {
+	return r != RoleAttendee
+}
+
+// SetRole records the participant's role, the tracks of attendees aren't forwarded
+func (r *defaultRouter) SetRole(id string, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[id]; !exists {
+		return fmt.Errorf("PeerConnection with id %s does not exist", id)
+	}
+	r.roles[id] = role
+	return nil
+}
+
+// GetRole returns the participant's role, peers that joined without one are panelists
+func (r *defaultRouter) GetRole(id string) Role {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if role, exists := r.roles[id]; exists {
+		return role
+	}
+	return RolePanelist
+}
+
+// StopPublishing removes the participant's broadcaster, the subscribers' sink tracks go with it
+func (r *defaultRouter) StopPublishing(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The participant stays in the room, so nobody is told it left
+	r.removeBroadcaster(id, func(peerId, subscriberId string) {})
+	r.applyModes()
+}
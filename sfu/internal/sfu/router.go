@@ -3,37 +3,148 @@ package sfu
 import (
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v3"
 )
 
 type Router interface {
 	AddPeerConnection(id string, name string, pc *webrtc.PeerConnection) error
-	RemovePeerConnection(id string, closeSubscriber func(id string)) error
+	RemovePeerConnection(id string, closeSubscriber func(peerId, subscriberId string)) error
+	AddRelaySubscriber(id string, pc *webrtc.PeerConnection) error
+	AddRelayPublisher(id string, pc *webrtc.PeerConnection) error
+	RemoveRelaySource(relayId string, id string, closeSubscriber func(peerId, subscriberId string)) error
 	ForwardVideoTrack(id string, track *webrtc.TrackRemote, isScreenShare bool) error
 	ForwardAudioTrack(id string, track *webrtc.TrackRemote, isScreenShare bool) error
 	GetPeerConnection(id string) *webrtc.PeerConnection
 	GetName(id string) string
+	GetPeerIDs() []string
 	RequestKeyFrames(id string) error
+	SetCodecs(id string, codecs []webrtc.RTPCodecCapability)
+	FilterCodecs(codecs []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters
+	OnCodecMismatch(f func(subscriberId, peerId, streamId string, codec webrtc.RTPCodecCapability))
+	SetSubscriberMode(id string, mode SubscriberMode) error
+	MuteStream(id string, stream PublisherStream, muted bool) error
+	IsMuted(id string, stream PublisherStream) bool
+	SetLocked(locked bool)
+	IsLocked() bool
+	SetWaitingRoom(enabled bool, lobbyId string)
+	WaitingRoomEnabled() bool
+	AddWaitingPeer(id string, name string, pc *webrtc.PeerConnection) error
+	Admit(id string) error
+	GetWaitingPeerIDs() []string
+	SetRole(id string, role Role) error
+	GetRole(id string) Role
+	StopPublishing(id string)
+	Extract(id string, closeSubscriber func(peerId, subscriberId string)) (*Participant, error)
+	Insert(p *Participant) error
+	SetAudioTap(tap AudioTap)
+	AddLocalSink(peerId string, id string, stream PublisherStream, sink LocalSink) error
+	RemoveLocalSink(peerId string, id string)
+	RequestLocalKeyframe(peerId string)
+	ScreenShareActive(peerId string) bool
+	ActiveSpeaker() string
+	LatestKeyframe(peerId string, maxAge time.Duration) *Keyframe
+	ReportInterceptor() interceptor.Factory
 }
 
 type defaultRouter struct {
 	names        map[string]string
 	connections  map[string]*webrtc.PeerConnection
 	broadcasters map[string]Broadcaster
-	mu           sync.Mutex
+	// Relay connections to other SFU nodes, subscribers receive our local sources and
+	// publishers carry sources from the other node into this room
+	relaySubscribers map[string]bool
+	relayPublishers  map[string]bool
+	// Broadcaster id -> relay publisher id for sources that originate on another node
+	origins map[string]string
+	// Subscribers that aren't in the default mode
+	modes map[string]SubscriberMode
+	// Streams moderators stopped, by peer id
+	muted map[string]map[PublisherStream]bool
+	// No new peers are let in while the room is locked
+	locked bool
+	// Peers wait for a moderator to admit them while the waiting room is enabled. They only receive the
+	// lobby peer's streams meanwhile, and nothing they publish is forwarded.
+	waitingRoom bool
+	waiting     map[string]bool
+	lobby       string
+	roles       map[string]Role
+	// Receives the audio of the room's peers, nil when the room isn't tapped
+	audioTap AudioTap
+	mu       sync.Mutex
+	// Codecs each peer can decode, peers missing here are assumed to decode the codecs of the policy but
+	// not RED. The sources check them while r.mu is held, so they have their own lock.
+	codecs          map[string][]webrtc.RTPCodecCapability
+	onCodecMismatch func(subscriberId, peerId, streamId string, codec webrtc.RTPCodecCapability)
+	codecMu         sync.Mutex
+	// The subscribers' receiver reports, folded into the ones sent to the room's publishers. Peers moved in
+	// from another room keep reporting through the aggregator their PeerConnection was created with.
+	reports      *reportAggregator
+	movedReports map[string]*reportAggregator
 }
 
 func NewRouter() Router {
 	return &defaultRouter{
-		names:        make(map[string]string),
-		connections:  make(map[string]*webrtc.PeerConnection),
-		broadcasters: make(map[string]Broadcaster),
+		names:            make(map[string]string),
+		connections:      make(map[string]*webrtc.PeerConnection),
+		broadcasters:     make(map[string]Broadcaster),
+		relaySubscribers: make(map[string]bool),
+		relayPublishers:  make(map[string]bool),
+		origins:          make(map[string]string),
+		modes:            make(map[string]SubscriberMode),
+		muted:            make(map[string]map[PublisherStream]bool),
+		waiting:          make(map[string]bool),
+		roles:            make(map[string]Role),
+		codecs:           make(map[string][]webrtc.RTPCodecCapability),
+		reports:          newReportAggregator(),
+		movedReports:     make(map[string]*reportAggregator),
 	}
 }
 
+// ReportInterceptor returns the interceptor factory that folds the subscribers' receiver reports into the
+// ones sent to the publishers. It goes on the APIs of the room's PeerConnections, before the interceptor
+// generating the receiver reports.
+func (r *defaultRouter) ReportInterceptor() interceptor.Factory {
+	return &reportInterceptorFactory{reports: r.reports}
+}
+
+// reportsFor returns the aggregator the PeerConnection of peer id reports through. r.mu must be held.
+func (r *defaultRouter) reportsFor(id string) *reportAggregator {
+	if reports, moved := r.movedReports[id]; moved {
+		return reports
+	}
+	return r.reports
+}
+
+func (r *defaultRouter) isRelay(id string) bool {
+	return r.relaySubscribers[id] || r.relayPublishers[id]
+}
+
+// canSubscribe reports whether the connection subscriberId should receive the tracks of broadcasterId
+func (r *defaultRouter) canSubscribe(broadcasterId, subscriberId string) bool {
+	if broadcasterId == subscriberId || r.relayPublishers[subscriberId] {
+		return false
+	}
+	if r.waiting[broadcasterId] {
+		return false
+	}
+	if r.waiting[subscriberId] {
+		return broadcasterId == r.lobby
+	}
+	// Relayed sources are only served to local peers, relaying them again could loop between nodes
+	if _, relayed := r.origins[broadcasterId]; relayed && r.relaySubscribers[subscriberId] {
+		return false
+	}
+	return true
+}
+
 func (r *defaultRouter) GetPeerConnection(id string) *webrtc.PeerConnection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	pc, ok := r.connections[id]
 	if !ok {
 		return nil
@@ -42,6 +153,8 @@ func (r *defaultRouter) GetPeerConnection(id string) *webrtc.PeerConnection {
 }
 
 func (r *defaultRouter) GetName(id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	name, ok := r.names[id]
 	if !ok {
 		return ""
@@ -49,9 +162,26 @@ func (r *defaultRouter) GetName(id string) string {
 	return name
 }
 
+func (r *defaultRouter) GetPeerIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.connections))
+	for id := range r.connections {
+		if !r.isRelay(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 func (r *defaultRouter) AddPeerConnection(id string, name string, pc *webrtc.PeerConnection) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return r.addPeer(id, name, pc)
+}
+
+// addPeer subscribes the PeerConnection to the broadcasters it can receive. r.mu must be held.
+func (r *defaultRouter) addPeer(id string, name string, pc *webrtc.PeerConnection) error {
 	if _, exists := r.connections[id]; exists {
 		fmt.Printf("PeerConnection with id %s already exists, replacing PeerConnection\n", id)
 	}
@@ -59,7 +189,7 @@ func (r *defaultRouter) AddPeerConnection(id string, name string, pc *webrtc.Pee
 	if len(r.connections) > 0 {
 		// Add peer to the new PeerConnection
 		for rid, broadcaster := range r.broadcasters {
-			if rid != id {
+			if r.canSubscribe(rid, id) {
 				broadcaster.AddVideoSink(id, pc)
 				broadcaster.AddAudioSink(id, pc)
 			}
@@ -71,16 +201,49 @@ func (r *defaultRouter) AddPeerConnection(id string, name string, pc *webrtc.Pee
 	return nil
 }
 
-func (r *defaultRouter) RemovePeerConnection(id string, closeSubscriber func(id string)) error {
+// AddRelaySubscriber registers a connection from another SFU node that receives the local sources of the room
+func (r *defaultRouter) AddRelaySubscriber(id string, pc *webrtc.PeerConnection) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[id]; exists {
+		return fmt.Errorf("PeerConnection with id %s already exists", id)
+	}
+	r.relaySubscribers[id] = true
+	for rid, broadcaster := range r.broadcasters {
+		if r.canSubscribe(rid, id) {
+			broadcaster.AddVideoSink(id, pc)
+			broadcaster.AddAudioSink(id, pc)
+		}
+	}
+	r.connections[id] = pc
+	return nil
+}
+
+// AddRelayPublisher registers a connection from another SFU node whose tracks are sources of that node's peers
+func (r *defaultRouter) AddRelayPublisher(id string, pc *webrtc.PeerConnection) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.connections[id]; exists {
+		return fmt.Errorf("PeerConnection with id %s already exists", id)
+	}
+	r.relayPublishers[id] = true
+	r.connections[id] = pc
+	return nil
+}
+
+func (r *defaultRouter) RemovePeerConnection(id string, closeSubscriber func(peerId, subscriberId string)) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Delete broadcaster
-	if _, exists := r.broadcasters[id]; !exists {
-		return fmt.Errorf("Broadcaster for connection %s doesn't exist", id)
+	// Delete broadcaster, a peer that never published won't have one
+	r.removeBroadcaster(id, closeSubscriber)
+
+	// A relay takes all the sources of the other node with it
+	for bid, origin := range r.origins {
+		if origin == id {
+			r.removeBroadcaster(bid, closeSubscriber)
+		}
 	}
-	r.broadcasters[id].Close(closeSubscriber)
-	delete(r.broadcasters, id)
 
 	// Remove local sinks from all other broadcasters
 	for _, broadcaster := range r.broadcasters {
@@ -93,49 +256,126 @@ func (r *defaultRouter) RemovePeerConnection(id string, closeSubscriber func(id
 	}
 	err := r.connections[id].Close()
 	delete(r.connections, id)
+	delete(r.names, id)
+	delete(r.relaySubscribers, id)
+	delete(r.relayPublishers, id)
+	delete(r.movedReports, id)
+	delete(r.modes, id)
+	delete(r.muted, id)
+	delete(r.waiting, id)
+	delete(r.roles, id)
+	// Cameras resume for screen priority subscribers if the peer was presenting
+	r.applyModes()
+	r.codecMu.Lock()
+	delete(r.codecs, id)
+	r.codecMu.Unlock()
 	if err != nil {
 		return fmt.Errorf("failed to close PeerConnection: %w", err)
 	}
+	return nil
+}
 
-	// Remove the sink tracks from other PeerConnections
-	for _, pc := range r.connections {
-		senders := pc.GetSenders()
-		for _, sender := range senders {
-			track := sender.Track()
-			if track != nil && track.StreamID() == id || track.StreamID() == id+"-screen" {
-				err := pc.RemoveTrack(sender)
-				if err != nil {
-					fmt.Printf("failed to remove track for id %s: %s", id, err)
-				}
-				log.Println("Removed track for id: ", id)
+// RemoveRelaySource removes a source whose peer left the room on another node. Only the relay publisher
+// the source arrived on can remove it.
+func (r *defaultRouter) RemoveRelaySource(relayId string, id string, closeSubscriber func(peerId, subscriberId string)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if origin, exists := r.origins[id]; !exists || origin != relayId {
+		return fmt.Errorf("Relayed broadcaster %s doesn't exist on relay %s", id, relayId)
+	}
+	r.removeBroadcaster(id, closeSubscriber)
+	r.applyModes()
+	return nil
+}
+
+// removeBroadcaster closes the broadcaster and removes its sink tracks from the subscribing PeerConnections
+func (r *defaultRouter) removeBroadcaster(id string, closeSubscriber func(peerId, subscriberId string)) {
+	broadcaster, exists := r.broadcasters[id]
+	if !exists {
+		return
+	}
+	broadcaster.Close(func(subscriberId string) {
+		closeSubscriber(id, subscriberId)
+	})
+	delete(r.broadcasters, id)
+	delete(r.origins, id)
+	delete(r.names, id)
+
+	for rid, pc := range r.connections {
+		if rid == id {
+			continue
+		}
+		removeSenders(pc, id)
+	}
+}
+
+// removeSenders removes the sink tracks of broadcaster id from the PeerConnection
+func removeSenders(pc *webrtc.PeerConnection, id string) {
+	senders := pc.GetSenders()
+	for _, sender := range senders {
+		track := sender.Track()
+		if track != nil && (track.StreamID() == id || track.StreamID() == id+"-screen") {
+			err := pc.RemoveTrack(sender)
+			if err != nil {
+				fmt.Printf("failed to remove track for id %s: %s", id, err)
 			}
+			log.Println("Removed track for id: ", id)
 		}
 	}
+}
 
-	return nil
+// initBroadcaster creates and registers the broadcaster of a peer. r.mu must be held.
+func (r *defaultRouter) initBroadcaster(id string, pc *webrtc.PeerConnection, videoSrc, audioSrc, screenSrc *webrtc.TrackRemote) Broadcaster {
+	broadcaster := InitBroadcaster(id, pc, videoSrc, audioSrc, screenSrc, r, r.reportsFor(id))
+	r.addBroadcaster(id, broadcaster)
+	return broadcaster
+}
+
+// addBroadcaster registers the broadcaster of a peer. r.mu must be held.
+func (r *defaultRouter) addBroadcaster(id string, broadcaster Broadcaster) {
+	r.applyMuted(id, broadcaster)
+	broadcaster.SetAudioTap(r.tapFor(id))
+	broadcaster.OnScreenShareEnded(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.applyModes()
+	})
+	r.broadcasters[id] = broadcaster
+}
+
+// resolveSource maps a track arriving on connection id to the broadcaster it belongs to. Tracks from a relay
+// publisher carry the id of their original peer as the stream id, the same way our own sinks are labelled.
+func (r *defaultRouter) resolveSource(id string, remote *webrtc.TrackRemote, isScreenShare bool) (string, bool) {
+	if !r.relayPublishers[id] {
+		return id, isScreenShare
+	}
+	streamId := remote.StreamID()
+	source := strings.TrimSuffix(streamId, "-screen")
+	r.origins[source] = id
+	return source, source != streamId
 }
 
 func (r *defaultRouter) ForwardAudioTrack(id string, remote *webrtc.TrackRemote, isScreenShare bool) error {
+	// Add a broadcaster for the audio track
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	rpc, exists := r.connections[id]
 	if !exists {
 		return fmt.Errorf("PeerConnection with id %s does not exist", id)
 	}
+	id, _ = r.resolveSource(id, remote, isScreenShare)
 
-	// Add a broadcaster for the audio track
-	r.mu.Lock()
-	defer r.mu.Unlock()
 	var broadcaster Broadcaster
 	if _, exists := r.broadcasters[id]; exists {
 		broadcaster = r.broadcasters[id]
 		broadcaster.SetAudioSource(remote)
 	} else {
-		broadcaster = InitBroadcaster(id, rpc, nil, remote, nil)
-		r.broadcasters[id] = broadcaster
+		broadcaster = r.initBroadcaster(id, rpc, nil, remote, nil)
 	}
 
 	// Automatically forward audio to all peers -- TODO subscriber management
 	for rid, pc := range r.connections {
-		if rid != id {
+		if r.canSubscribe(id, rid) {
 			broadcaster.AddAudioSink(rid, pc)
 		}
 	}
@@ -144,15 +384,16 @@ func (r *defaultRouter) ForwardAudioTrack(id string, remote *webrtc.TrackRemote,
 }
 
 func (r *defaultRouter) ForwardVideoTrack(id string, remote *webrtc.TrackRemote, isScreenShare bool) error {
+	// Add a broadcaster for the video track
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	//forwardedPc, exists := r.connections[id]
 	rpc, exists := r.connections[id]
 	if !exists {
 		return fmt.Errorf("PeerConnection with id %s does not exist", id)
 	}
+	id, isScreenShare = r.resolveSource(id, remote, isScreenShare)
 
-	// Add a broadcaster for the video track
-	r.mu.Lock()
-	defer r.mu.Unlock()
 	var broadcaster Broadcaster
 	if _, exists := r.broadcasters[id]; exists {
 		broadcaster = r.broadcasters[id]
@@ -163,19 +404,20 @@ func (r *defaultRouter) ForwardVideoTrack(id string, remote *webrtc.TrackRemote,
 		}
 	} else {
 		if isScreenShare {
-			broadcaster = InitBroadcaster(id, rpc, nil, nil, remote)
+			broadcaster = r.initBroadcaster(id, rpc, nil, nil, remote)
 		} else {
-			broadcaster = InitBroadcaster(id, rpc, remote, nil, nil)
+			broadcaster = r.initBroadcaster(id, rpc, remote, nil, nil)
 		}
-		r.broadcasters[id] = broadcaster
 	}
 
 	// Automatically forward video to all peers -- TODO subscriber management
 	for rid, pc := range r.connections {
-		if rid != id {
+		if r.canSubscribe(id, rid) {
 			broadcaster.AddVideoSink(rid, pc)
 		}
 	}
+	// The new sinks follow their subscriber's mode, and a screen share pauses cameras for screen priority
+	r.applyModes()
 
 	//forwardedBroadcaster := r.broadcasters[id]
 	//if forwardedBroadcaster == nil {
@@ -188,10 +430,79 @@ func (r *defaultRouter) ForwardVideoTrack(id string, remote *webrtc.TrackRemote,
 
 func (r *defaultRouter) RequestKeyFrames(id string) error {
 	log.Printf("Requesting keyframes for id %s", id)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Only the sources the subscriber is missing are requested, the broadcasters coalesce the rest
 	for rid, rbd := range r.broadcasters {
-		if rid != id {
-			rbd.SendAllPublisherPli()
+		if r.canSubscribe(rid, id) {
+			rbd.RequestKeyFrames(id)
 		}
 	}
 	return nil
 }
+
+// SetCodecs records the codecs the peer negotiated, sources it can't decode aren't sent to it
+func (r *defaultRouter) SetCodecs(id string, codecs []webrtc.RTPCodecCapability) {
+	r.codecMu.Lock()
+	defer r.codecMu.Unlock()
+	r.codecs[id] = codecs
+}
+
+// FilterCodecs keeps the codecs every peer of the room can decode, in their original order. If the peers
+// have nothing in common the codecs are returned unchanged and the mismatches are reported per sink.
+func (r *defaultRouter) FilterCodecs(codecs []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	r.codecMu.Lock()
+	defer r.codecMu.Unlock()
+	filtered := make([]webrtc.RTPCodecParameters, 0, len(codecs))
+	for _, codec := range codecs {
+		decodable := true
+		for _, capabilities := range r.codecs {
+			if !CodecSupported(codec.RTPCodecCapability, capabilities) {
+				decodable = false
+				break
+			}
+		}
+		if decodable {
+			filtered = append(filtered, codec)
+		}
+	}
+	if len(filtered) == 0 {
+		log.Println("No video codec is decodable by every peer, keeping the full codec list")
+		return codecs
+	}
+	return filtered
+}
+
+func (r *defaultRouter) OnCodecMismatch(f func(subscriberId, peerId, streamId string, codec webrtc.RTPCodecCapability)) {
+	r.codecMu.Lock()
+	defer r.codecMu.Unlock()
+	r.onCodecMismatch = f
+}
+
+func (r *defaultRouter) CanDecode(subscriberId string, codec webrtc.RTPCodecCapability) bool {
+	r.codecMu.Lock()
+	defer r.codecMu.Unlock()
+	// Only a peer that announced codecs of this kind can be told apart from one that decodes everything
+	kind, _, _ := strings.Cut(strings.ToLower(codec.MimeType), "/")
+	known := false
+	for _, capability := range r.codecs[subscriberId] {
+		if strings.HasPrefix(strings.ToLower(capability.MimeType), kind+"/") {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return !isRED(codec)
+	}
+	return CodecSupported(codec, r.codecs[subscriberId])
+}
+
+func (r *defaultRouter) ReportMismatch(subscriberId, peerId, streamId string, codec webrtc.RTPCodecCapability) {
+	log.Printf("Subscriber %s can't decode %s of stream %s", subscriberId, codec.MimeType, streamId)
+	r.codecMu.Lock()
+	onCodecMismatch := r.onCodecMismatch
+	r.codecMu.Unlock()
+	if onCodecMismatch != nil {
+		onCodecMismatch(subscriberId, peerId, streamId, codec)
+	}
+}
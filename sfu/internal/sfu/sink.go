@@ -0,0 +1,303 @@
+package sfu
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// sink forwards a source to one subscriber
+type sink struct {
+	track  *sinkTrack
+	pc     *webrtc.PeerConnection
+	sender *webrtc.RTPSender
+	munger *rtpMunger
+	// What the sink sent, for its sender reports
+	packets atomic.Uint32
+	octets  atomic.Uint32
+	// Set once a keyframe was written, the subscriber can decode the source from then on
+	hasKeyframe atomic.Bool
+	// Live packets are held back until the track is bound and the cached GOP has been replayed
+	replaying bool
+	// Set when the source is RED but the subscriber only decodes plain Opus
+	red *redUnwrapper
+	// Only kept for video, protects the packets once the subscriber reports loss
+	fec *fecEncoder
+	// Set by the subscriber's mode, the slide fields track a slideshow
+	policy         SinkPolicy
+	inSlide        bool
+	slideTS        uint32
+	lastSlide      time.Time
+	slideRequested time.Time
+}
+
+// slide decides whether a slideshow sink forwards the packet, only the packets of a keyframe are once the
+// interval since the last slide has passed. It also reports when a keyframe should be requested for the
+// next slide. The caller must hold the source lock.
+func (s *sink) slide(packet *rtp.Packet, keyframe bool) (forward bool, due bool) {
+	if s.inSlide {
+		if packet.Timestamp == s.slideTS {
+			return true, false
+		}
+		s.inSlide = false
+	}
+	interval := s.policy.Slideshow
+	if time.Since(s.lastSlide) < interval {
+		return false, false
+	}
+	if keyframe {
+		// Slides are apart in time, the subscriber's timeline moves on by the time between them
+		s.munger.Resync()
+		s.inSlide = true
+		s.slideTS = packet.Timestamp
+		s.lastSlide = time.Now()
+		return true, false
+	}
+	if time.Since(s.slideRequested) < interval {
+		return false, false
+	}
+	s.slideRequested = time.Now()
+	return false, true
+}
+
+func (s *sink) write(packet *rtp.Packet) error {
+	if s.red != nil {
+		for _, opus := range s.red.unwrap(packet) {
+			if err := s.writeRTP(s.munger.munge(opus)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	munged := s.munger.munge(packet)
+	if s.fec == nil || !s.fec.active() {
+		return s.writeRTP(munged)
+	}
+	return s.writeProtected(munged)
+}
+
+func (s *sink) writeRTP(packet *rtp.Packet) error {
+	s.count(len(packet.Payload))
+	return s.track.WriteRTP(packet)
+}
+
+func (s *sink) count(payloadLength int) {
+	s.packets.Add(1)
+	s.octets.Add(uint32(payloadLength))
+}
+
+// senderReport translates a sender report of the publisher to the timeline of the sink, so that the
+// subscriber can synchronize the audio and video of the publisher. The caller must hold the source lock.
+func (s *sink) senderReport(sr *rtcp.SenderReport) *rtcp.SenderReport {
+	ssrc := s.track.ssrc()
+	if !s.munger.started || s.replaying || ssrc == 0 {
+		return nil
+	}
+	return &rtcp.SenderReport{
+		SSRC:        ssrc,
+		NTPTime:     sr.NTPTime,
+		RTPTime:     sr.RTPTime + s.munger.tsOffset,
+		PacketCount: s.packets.Load(),
+		OctetCount:  s.octets.Load(),
+	}
+}
+
+// writeProtected sends the packet in RED and follows it with a ULPFEC packet when its group is complete
+func (s *sink) writeProtected(packet *rtp.Packet) error {
+	if !s.track.protect(packet) {
+		// The subscriber didn't negotiate RED and ULPFEC
+		return s.writeRTP(packet)
+	}
+	fec := s.fec.push(packet)
+	s.count(len(packet.Payload) + 1)
+	if err := s.track.writeRED(packet, packet.PayloadType, packet.Payload); err != nil {
+		return err
+	}
+	if fec == nil {
+		return nil
+	}
+	// The FEC packet takes the next sequence number, the munger shifts the following media packets
+	header := packet.Header.Clone()
+	header.SequenceNumber = s.munger.insert()
+	header.Marker = false
+	s.count(len(fec) + 1)
+	return s.track.writeRED(&rtp.Packet{Header: header}, s.track.ulpfecPT(), fec)
+}
+
+// sinkTrack is the local track of a sink. Packets written before the subscriber's PeerConnection binds
+// the track are lost, so the sink is told when that happens. Binding fails when the subscriber didn't
+// negotiate the codec of the track.
+type sinkTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	onBind      func()
+	onBindError func()
+	// What protected packets are written with, found when the track is bound
+	binding redBinding
+	mu      sync.Mutex
+}
+
+type redBinding struct {
+	writer   webrtc.TrackLocalWriter
+	ssrc     uint32
+	mediaPT  uint8
+	redPT    uint8
+	ulpfecPT uint8
+	// Transport-wide congestion control extension id, written by the interceptor after the FEC is computed
+	twccID uint8
+}
+
+func (t *sinkTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err == nil {
+		binding := redBinding{writer: ctx.WriteStream(), ssrc: uint32(ctx.SSRC()), mediaPT: uint8(codec.PayloadType)}
+		for _, negotiated := range ctx.CodecParameters() {
+			switch strings.ToLower(negotiated.MimeType) {
+			case "video/red":
+				binding.redPT = uint8(negotiated.PayloadType)
+			case "video/ulpfec":
+				binding.ulpfecPT = uint8(negotiated.PayloadType)
+			}
+		}
+		for _, extension := range ctx.HeaderExtensions() {
+			if extension.URI == sdp.TransportCCURI {
+				binding.twccID = uint8(extension.ID)
+			}
+		}
+		t.mu.Lock()
+		t.binding = binding
+		t.mu.Unlock()
+	}
+	// Bind runs inside the PeerConnection's negotiation, don't hold it up
+	if err == nil && t.onBind != nil {
+		go t.onBind()
+	} else if err != nil && t.onBindError != nil {
+		go t.onBindError()
+	}
+	return codec, err
+}
+
+func (t *sinkTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	t.binding = redBinding{}
+	t.mu.Unlock()
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+func (t *sinkTrack) ssrc() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.binding.ssrc
+}
+
+// protect prepares a media packet for FEC if the subscriber negotiated it. The packet is protected as it is
+// sent, so the publisher's header extensions are dropped and the congestion control extension the
+// interceptor fills in later is added zeroed, the way receivers zero it before recovering packets.
+func (t *sinkTrack) protect(packet *rtp.Packet) bool {
+	t.mu.Lock()
+	binding := t.binding
+	t.mu.Unlock()
+	if binding.writer == nil || binding.redPT == 0 || binding.ulpfecPT == 0 {
+		return false
+	}
+	packet.SSRC = binding.ssrc
+	packet.PayloadType = binding.mediaPT
+	packet.Extension = false
+	packet.Extensions = nil
+	if binding.twccID != 0 {
+		packet.SetExtension(binding.twccID, []byte{0, 0})
+	}
+	return true
+}
+
+func (t *sinkTrack) ulpfecPT() uint8 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.binding.ulpfecPT
+}
+
+// writeRED sends the payload as the only block of a RED packet
+func (t *sinkTrack) writeRED(packet *rtp.Packet, blockPT uint8, payload []byte) error {
+	t.mu.Lock()
+	binding := t.binding
+	t.mu.Unlock()
+	header := packet.Header.Clone()
+	header.SSRC = binding.ssrc
+	header.PayloadType = binding.redPT
+	red := make([]byte, 1+len(payload))
+	red[0] = blockPT & 0x7f
+	copy(red[1:], payload)
+	_, err := binding.writer.WriteRTP(&header, red)
+	return err
+}
+
+// rtpMunger rewrites the sequence numbers and timestamps forwarded to one sink, so that the subscriber sees
+// a single continuous stream whatever the SFU replays, skips or switches on the way
+type rtpMunger struct {
+	clockRate uint32
+	started   bool
+	resync    bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastTime  time.Time
+}
+
+func newRTPMunger(clockRate uint32) *rtpMunger {
+	return &rtpMunger{clockRate: clockRate}
+}
+
+// Resync makes the next packet continue right after the last one forwarded, for when the
+// source switches to a stream with its own sequence numbers and timestamps
+func (m *rtpMunger) Resync() {
+	m.resync = true
+}
+
+// insert hands out the sequence number after the last forwarded packet to a packet the SFU creates
+func (m *rtpMunger) insert() uint16 {
+	m.lastSeq++
+	m.seqOffset++
+	return m.lastSeq
+}
+
+func (m *rtpMunger) munge(packet *rtp.Packet) *rtp.Packet {
+	switch {
+	case !m.started:
+		// Start at random values like any RTP sender, the subscriber never sees the publisher's numbering
+		var initial [6]byte
+		rand.Read(initial[:])
+		m.seqOffset = binary.BigEndian.Uint16(initial[0:2]) - packet.SequenceNumber
+		m.tsOffset = binary.BigEndian.Uint32(initial[2:6]) - packet.Timestamp
+		m.lastSeq = packet.SequenceNumber + m.seqOffset - 1
+		m.lastTS = packet.Timestamp + m.tsOffset
+		m.started = true
+	case m.resync:
+		// Advance the timeline by the time that passed since the last packet
+		elapsed := uint32(time.Since(m.lastTime).Seconds() * float64(m.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		m.seqOffset = m.lastSeq + 1 - packet.SequenceNumber
+		m.tsOffset = m.lastTS + elapsed - packet.Timestamp
+		m.resync = false
+	}
+
+	munged := *packet
+	munged.SequenceNumber = packet.SequenceNumber + m.seqOffset
+	munged.Timestamp = packet.Timestamp + m.tsOffset
+	// Reordered packets keep their place, only newer ones move the stream forward
+	if diff := munged.SequenceNumber - m.lastSeq; diff != 0 && diff < 0x8000 {
+		m.lastSeq = munged.SequenceNumber
+		m.lastTS = munged.Timestamp
+		m.lastTime = time.Now()
+	}
+	return &munged
+}
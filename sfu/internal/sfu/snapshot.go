@@ -0,0 +1,55 @@
+package sfu
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Keyframe is a copy of the latest keyframe of a camera, e.g. to decode a thumbnail of it
+type Keyframe struct {
+	Codec webrtc.RTPCodecCapability
+	// The packets of the keyframe in order of arrival
+	Packets  []*rtp.Packet
+	Received time.Time
+}
+
+// LatestKeyframe returns the latest keyframe of the peer's camera, nil when the camera is off, muted or
+// the peer waits to be admitted. Publishers may send keyframes far apart, one is requested when the latest
+// is older than maxAge so that the next call gets a fresher picture.
+func (r *defaultRouter) LatestKeyframe(peerId string, maxAge time.Duration) *Keyframe {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	broadcaster, exists := r.broadcasters[peerId]
+	if !exists || r.waiting[peerId] {
+		return nil
+	}
+	return broadcaster.LatestKeyframe(maxAge)
+}
+
+func (b *defaultBroadcaster) LatestKeyframe(maxAge time.Duration) *Keyframe {
+	return b.video.latestKeyframe(maxAge)
+}
+
+func (s *source) latestKeyframe(maxAge time.Duration) *Keyframe {
+	s.mu.RLock()
+	var keyframe *Keyframe
+	// The cache outlives an ended track, its picture mustn't
+	if packets := s.cache.get(); len(packets) > 0 && s.track != nil && !s.muted {
+		keyframe = &Keyframe{Codec: s.codec, Received: s.cache.received}
+		for _, packet := range packets {
+			if packet.Timestamp != packets[0].Timestamp {
+				break
+			}
+			keyframe.Packets = append(keyframe.Packets, packet.Clone())
+		}
+	}
+	request := s.track != nil && !s.muted && (keyframe == nil || time.Since(keyframe.Received) > maxAge)
+	kfr := s.kfr
+	s.mu.RUnlock()
+	if request && kfr != nil {
+		kfr.request()
+	}
+	return keyframe
+}
@@ -0,0 +1,546 @@
+package sfu
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// A GOP longer than this isn't cached, newcomers fall back to requesting a keyframe
+const maxGopPackets = 1500
+
+// source forwards one remote track of a publisher to the sinks of its subscribers
+type source struct {
+	peerId   string
+	streamId string
+	pc       *webrtc.PeerConnection
+	track    *webrtc.TrackRemote
+	// The codec of the media, the track itself may be RED
+	codec    webrtc.RTPCodecCapability
+	videoRED *videoRED
+	receiver *webrtc.RTPReceiver
+	sinks    map[string]*sink
+	kfr      *keyframeRequester
+	codecs   CodecChecker
+	// The receiver reports of the sinks, folded into the ones sent to the publisher
+	reports *reportAggregator
+	// Only kept for video, audio needs no keyframe to start decoding
+	cache *gopCache
+	// Set by a moderator, the track is read but nothing is forwarded
+	muted bool
+	// Receives the audio as well, e.g. for transcription
+	tap    AudioTap
+	tapRED *redUnwrapper
+	// Sinks inside the SFU by id, e.g. live stream egress
+	local map[string]LocalSink
+	// Unwraps RED audio for the local sinks
+	localRED *redUnwrapper
+	// Only kept for audio, the loudness for active speaker detection
+	level audioLevel
+	// Called when the track ends without being replaced
+	endedHandler func()
+	// Signaled when a track is set, the forwarding loop waits for one
+	set  chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	mu   sync.RWMutex
+}
+
+func newSource(peerId string, streamId string, pc *webrtc.PeerConnection, track *webrtc.TrackRemote, kind webrtc.RTPCodecType, codecs CodecChecker, reports *reportAggregator) *source {
+	s := &source{
+		peerId:   peerId,
+		streamId: streamId,
+		codecs:   codecs,
+		reports:  reports,
+		pc:       pc,
+		sinks:    map[string]*sink{},
+		local:    map[string]LocalSink{},
+		localRED: &redUnwrapper{},
+		set:      make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		s.cache = &gopCache{}
+	}
+	if track != nil {
+		s.setTrack(track)
+	}
+	go s.forward()
+	return s
+}
+
+func (s *source) getTrack() *webrtc.TrackRemote {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.track
+}
+
+func (s *source) setTrack(track *webrtc.TrackRemote) {
+	codec, videoRED := resolveMediaCodec(s.pc, track)
+	receiver := trackReceiver(s.pc, track)
+	s.mu.Lock()
+	// A replaced track can arrive on the same receiver, which is already read
+	if receiver != nil && receiver != s.receiver {
+		s.receiver = receiver
+		go s.readPublisherRTCP(receiver)
+	}
+	s.track = track
+	s.codec = codec
+	s.videoRED = videoRED
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		s.level = audioLevel{id: audioLevelID(receiver)}
+	}
+	if s.cache != nil {
+		s.kfr = newKeyframeRequester(s.pc, track)
+		s.cache.reset(codec.MimeType)
+	}
+	// The new track has its own numbering and needs a keyframe before anyone can decode it
+	for _, sink := range s.sinks {
+		sink.munger.Resync()
+		sink.hasKeyframe.Store(false)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.set <- struct{}{}:
+	default:
+	}
+}
+
+func (s *source) addSink(id string, pc *webrtc.PeerConnection) {
+	s.mu.RLock()
+	track := s.track
+	codec := s.codec
+	codecs := s.codecs
+	_, exists := s.sinks[id]
+	s.mu.RUnlock()
+	if track == nil || exists {
+		return
+	}
+	// A sink the subscriber can't decode would only show up as black video
+	var red *redUnwrapper
+	if codecs != nil && !codecs.CanDecode(id, codec) {
+		if !isRED(codec) {
+			codecs.ReportMismatch(id, s.peerId, s.streamId, codec)
+			return
+		}
+		// Subscribers without RED get the primary Opus frames
+		codec = opusCodec
+		red = &redUnwrapper{}
+	}
+
+	// Create new localTrack as a sink for the receiver
+	// Use the broadcaster's clientID as the streamID
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(codec, track.ID(), s.streamId)
+	if err != nil {
+		fmt.Printf("failed to create local track: %s", err)
+		return
+	}
+	newSink := &sink{
+		track:     &sinkTrack{TrackLocalStaticRTP: localTrack},
+		pc:        pc,
+		munger:    newRTPMunger(codec.ClockRate),
+		replaying: s.cache != nil,
+		red:       red,
+	}
+	if s.cache != nil {
+		newSink.fec = &fecEncoder{}
+	}
+	newSink.track.onBind = func() { s.replay(newSink) }
+	newSink.track.onBindError = func() {
+		if codecs != nil {
+			codecs.ReportMismatch(id, s.peerId, s.streamId, codec)
+		}
+	}
+	rtpSender, err := pc.AddTransceiverFromTrack(newSink.track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		fmt.Printf("failed to add track to PeerConnection: %s", err)
+		return
+	}
+	newSink.sender = rtpSender.Sender()
+	fmt.Println("Track added for id: ", id)
+	fmt.Println("Adding sink", id, s.streamId)
+
+	s.mu.Lock()
+	s.sinks[id] = newSink
+	s.mu.Unlock()
+	go s.readSubscriberRTCP(newSink)
+}
+
+// replay writes the cached GOP to a sink whose track was just bound, so the subscriber
+// can start decoding without waiting for the publisher's next keyframe
+func (s *source) replay(newSink *sink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !newSink.replaying {
+		return
+	}
+	newSink.replaying = false
+	if !newSink.policy.Paused {
+		s.writeCache(newSink)
+	}
+}
+
+// writeCache writes the cached GOP to the sink, only its keyframe for a slideshow. s.mu must be held.
+func (s *source) writeCache(sink *sink) {
+	packets := s.cache.get()
+	for _, packet := range packets {
+		if sink.policy.Slideshow > 0 && packet.Timestamp != packets[0].Timestamp {
+			break
+		}
+		if err := sink.write(packet); err != nil {
+			log.Printf("sink %s replay failed: %v", s.streamId, err)
+			return
+		}
+	}
+	if len(packets) > 0 {
+		sink.hasKeyframe.Store(true)
+		sink.lastSlide = time.Now()
+		keyframeRequests.Add("cached", 1)
+	}
+}
+
+// setSinkPolicy changes what the subscriber's sink forwards. A resumed sink continues its numbering where
+// it paused and starts from the cached GOP, or from the next keyframe.
+func (s *source) setSinkPolicy(id string, policy SinkPolicy) {
+	s.mu.Lock()
+	sink, exists := s.sinks[id]
+	if !exists || sink.policy == policy {
+		s.mu.Unlock()
+		return
+	}
+	resumed := sink.policy.Paused && !policy.Paused
+	sink.policy = policy
+	sink.inSlide = false
+	if resumed && !sink.replaying {
+		sink.munger.Resync()
+		sink.hasKeyframe.Store(false)
+		if s.cache != nil {
+			s.writeCache(sink)
+		}
+	}
+	s.mu.Unlock()
+	if resumed {
+		s.requestKeyframe(id)
+	}
+}
+
+// setMuted stops or resumes forwarding. Resumed sinks continue their numbering and wait for a keyframe.
+func (s *source) setMuted(muted bool) {
+	s.mu.Lock()
+	if s.muted == muted {
+		s.mu.Unlock()
+		return
+	}
+	s.muted = muted
+	if muted && s.cache != nil {
+		// Sinks added while muted mustn't replay a picture from before
+		s.cache.reset(s.codec.MimeType)
+	}
+	if !muted {
+		for _, sink := range s.sinks {
+			sink.munger.Resync()
+			sink.hasKeyframe.Store(false)
+		}
+	}
+	kfr := s.kfr
+	s.mu.Unlock()
+	if !muted && kfr != nil {
+		kfr.request()
+	}
+}
+
+func (s *source) onEnded(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endedHandler = f
+}
+
+func (s *source) removeSink(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sink, exists := s.sinks[id]; exists {
+		s.reports.remove(sink)
+		delete(s.sinks, id)
+	}
+}
+
+// removeAllSinks removes the sinks of every subscriber and returns the subscribers
+func (s *source) removeAllSinks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.sinks))
+	for id, sink := range s.sinks {
+		s.reports.remove(sink)
+		ids = append(ids, id)
+	}
+	s.sinks = map[string]*sink{}
+	return ids
+}
+
+func (s *source) setCodecChecker(codecs CodecChecker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codecs = codecs
+}
+
+func (s *source) getSinkIDs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.sinks))
+	for id := range s.sinks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// requestKeyframe asks the publisher for a keyframe if the subscriber hasn't been able to decode the source yet
+func (s *source) requestKeyframe(subscriberId string) {
+	s.mu.RLock()
+	sink, exists := s.sinks[subscriberId]
+	kfr := s.kfr
+	s.mu.RUnlock()
+	if !exists || kfr == nil {
+		return
+	}
+	if sink.hasKeyframe.Load() {
+		keyframeRequests.Add("skipped", 1)
+		return
+	}
+	kfr.request()
+}
+
+func (s *source) sendPli() {
+	s.mu.RLock()
+	kfr := s.kfr
+	s.mu.RUnlock()
+	if kfr != nil {
+		kfr.request()
+	}
+}
+
+func (s *source) readSubscriberRTCP(sink *sink) {
+	for {
+		packets, _, err := sink.sender.ReadRTCP()
+		if err != nil {
+			return // Connection closed?
+		}
+		for _, pkt := range packets {
+			switch pkt := pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.sendPli()
+			case *rtcp.ReceiverReport:
+				track := s.getTrack()
+				for _, report := range pkt.Reports {
+					if report.SSRC != sink.track.ssrc() || track == nil {
+						continue
+					}
+					// The loss the subscriber sees on this sink decides how much FEC it gets, and is
+					// passed on to the publisher
+					if sink.fec != nil {
+						sink.fec.setLoss(float64(report.FractionLost) / 256)
+					}
+					s.reports.record(uint32(track.SSRC()), sink, report)
+				}
+			}
+		}
+	}
+}
+
+// readPublisherRTCP passes the publisher's sender reports for the current track on to the sinks
+func (s *source) readPublisherRTCP(receiver *webrtc.RTPReceiver) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		track := s.getTrack()
+		for _, pkt := range packets {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok && track != nil && sr.SSRC == uint32(track.SSRC()) {
+				s.sendSenderReports(track, sr)
+			}
+		}
+	}
+}
+
+func (s *source) sendSenderReports(track *webrtc.TrackRemote, sr *rtcp.SenderReport) {
+	type report struct {
+		pc *webrtc.PeerConnection
+		sr *rtcp.SenderReport
+	}
+	var reports []report
+	s.mu.RLock()
+	if s.track == track {
+		for _, sink := range s.sinks {
+			if translated := sink.senderReport(sr); translated != nil {
+				reports = append(reports, report{sink.pc, translated})
+			}
+		}
+	}
+	s.mu.RUnlock()
+	for _, r := range reports {
+		if err := r.pc.WriteRTCP([]rtcp.Packet{r.sr}); err != nil {
+			log.Printf("sink %s sender report failed: %v", s.streamId, err)
+		}
+	}
+}
+
+func (s *source) close() {
+	close(s.stop)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sink := range s.sinks {
+		s.reports.remove(sink)
+	}
+}
+
+func (s *source) forward() {
+	defer close(s.done)
+	for {
+		track := s.getTrack()
+		if track == nil {
+			// Wait for a track instead of spinning
+			select {
+			case <-s.stop:
+				return
+			case <-s.set:
+				continue
+			}
+		}
+		select {
+		case <-s.stop:
+			// Exit the goroutine
+			log.Println("Exiting broadcast goroutine")
+			return
+		default:
+		}
+
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			// The publisher stopped the track, wait for the next one unless it was replaced already
+			log.Printf("track %s ended: %v", s.streamId, err)
+			s.mu.Lock()
+			ended := s.track == track
+			if ended {
+				s.track = nil
+			}
+			endedHandler := s.endedHandler
+			s.mu.Unlock()
+			if ended && endedHandler != nil {
+				endedHandler()
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		if s.track != track {
+			// The track was replaced while reading, the packet belongs to the old stream
+			s.mu.Unlock()
+			continue
+		}
+		if s.videoRED != nil && !s.videoRED.unwrap(packet) {
+			s.mu.Unlock()
+			continue
+		}
+		if s.muted {
+			s.mu.Unlock()
+			continue
+		}
+		s.level.update(packet)
+		if s.tap != nil {
+			s.writeTap(packet)
+		}
+		if len(s.local) > 0 {
+			s.writeLocal(packet)
+		}
+		s.writeSinks(s.codec.MimeType, packet)
+		s.mu.Unlock()
+	}
+}
+
+// writeSinks forwards a packet to the sinks, noting which of them received a keyframe. s.mu must be held.
+func (s *source) writeSinks(mimeType string, packet *rtp.Packet) {
+	keyframe := false
+	if s.cache != nil {
+		keyframe = s.cache.push(packet)
+	}
+	requestSlide := false
+	for id, sink := range s.sinks {
+		if sink.replaying || sink.policy.Paused {
+			continue
+		}
+		if sink.policy.Slideshow > 0 {
+			forward, due := sink.slide(packet, keyframe)
+			requestSlide = requestSlide || due
+			if !forward {
+				continue
+			}
+		}
+		if keyframe {
+			sink.hasKeyframe.Store(true)
+		}
+		if err := sink.write(packet); err != nil {
+			log.Printf("sink %s write failed: %v", id, err)
+		}
+		if sink.red == nil && strings.EqualFold(mimeType, MimeTypeRED) {
+			redPackets.Add("forwarded", 1)
+		}
+	}
+	// Publishers may send keyframes far apart, slideshows ask for them when the next slide is due
+	if requestSlide && s.kfr != nil {
+		s.kfr.request()
+	}
+}
+
+// gopCache keeps the packets of the most recent keyframe and the frames after it
+type gopCache struct {
+	mimeType string
+	packets  []*rtp.Packet
+	// When the keyframe arrived
+	received time.Time
+	// Cleared when the GOP outgrows the cache, until the next keyframe
+	valid bool
+}
+
+func (c *gopCache) reset(mimeType string) {
+	c.mimeType = mimeType
+	c.packets = nil
+	c.valid = false
+}
+
+// push adds the packet to the GOP, starting a new one on a keyframe which it reports
+func (c *gopCache) push(packet *rtp.Packet) bool {
+	keyframe := isKeyframe(c.mimeType, packet.Payload)
+	// A keyframe can span several packets that each look like its start (e.g. H.264 SPS and IDR)
+	if keyframe && (!c.valid || len(c.packets) == 0 || c.packets[0].Timestamp != packet.Timestamp) {
+		c.packets = c.packets[:0]
+		c.received = time.Now()
+		c.valid = true
+	}
+	if !c.valid {
+		return keyframe
+	}
+	if len(c.packets) >= maxGopPackets {
+		c.packets = nil
+		c.valid = false
+		return keyframe
+	}
+	c.packets = append(c.packets, packet)
+	return keyframe
+}
+
+func (c *gopCache) get() []*rtp.Packet {
+	if c == nil || !c.valid {
+		return nil
+	}
+	return c.packets
+}
@@ -0,0 +1,141 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// vp8Packet builds a VP8 packet that starts a keyframe or an interframe
+func vp8Packet(seq uint16, ts uint32, keyframe bool) *rtp.Packet {
+	payload := []byte{0x10, 0x01}
+	if keyframe {
+		payload[1] = 0x00
+	}
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}, Payload: payload}
+}
+
+func TestGopCache(t *testing.T) {
+	c := &gopCache{}
+	c.reset(webrtc.MimeTypeVP8)
+
+	if c.push(vp8Packet(1, 100, false)) || c.get() != nil {
+		t.Fatalf("packets before the first keyframe were cached")
+	}
+	if !c.push(vp8Packet(2, 200, true)) {
+		t.Fatalf("keyframe wasn't reported")
+	}
+	c.push(vp8Packet(3, 300, false))
+	c.push(vp8Packet(4, 400, false))
+	if got := c.get(); len(got) != 3 || got[0].SequenceNumber != 2 || got[2].SequenceNumber != 4 {
+		t.Fatalf("cached %d packets, want the keyframe and the two after it", len(got))
+	}
+
+	// The next keyframe starts a new GOP
+	c.push(vp8Packet(5, 500, true))
+	if got := c.get(); len(got) != 1 || got[0].SequenceNumber != 5 {
+		t.Fatalf("a new keyframe didn't replace the GOP")
+	}
+
+	c.reset(webrtc.MimeTypeVP8)
+	if c.get() != nil {
+		t.Fatalf("reset left a GOP behind")
+	}
+	var nilCache *gopCache
+	if nilCache.get() != nil {
+		t.Fatalf("a nil cache returned packets")
+	}
+}
+
+func TestGopCacheMultiPacketKeyframe(t *testing.T) {
+	c := &gopCache{}
+	c.reset(webrtc.MimeTypeH264)
+	sps := &rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 900}, Payload: []byte{0x67, 0x42}}
+	idr := &rtp.Packet{Header: rtp.Header{SequenceNumber: 11, Timestamp: 900}, Payload: []byte{0x65, 0x88}}
+	next := &rtp.Packet{Header: rtp.Header{SequenceNumber: 12, Timestamp: 3900}, Payload: []byte{0x41, 0x9a}}
+	for _, packet := range []*rtp.Packet{sps, idr, next} {
+		c.push(packet)
+	}
+	if got := c.get(); len(got) != 3 || got[0] != sps || got[1] != idr {
+		t.Fatalf("the IDR after the SPS of the same frame restarted the GOP")
+	}
+}
+
+func TestGopCacheOverflow(t *testing.T) {
+	c := &gopCache{}
+	c.reset(webrtc.MimeTypeVP8)
+	c.push(vp8Packet(0, 0, true))
+	for i := 1; i < maxGopPackets; i++ {
+		c.push(vp8Packet(uint16(i), uint32(i), false))
+	}
+	if len(c.get()) != maxGopPackets {
+		t.Fatalf("cache dropped packets below its limit")
+	}
+	c.push(vp8Packet(maxGopPackets, maxGopPackets, false))
+	if c.get() != nil {
+		t.Fatalf("a GOP larger than the cache is still served")
+	}
+	c.push(vp8Packet(maxGopPackets+1, maxGopPackets+1, false))
+	if c.get() != nil {
+		t.Fatalf("cache restarted without a keyframe")
+	}
+	c.push(vp8Packet(maxGopPackets+2, maxGopPackets+2, true))
+	if len(c.get()) != 1 {
+		t.Fatalf("cache didn't restart on the next keyframe")
+	}
+}
+
+func TestRTPMunger(t *testing.T) {
+	m := newRTPMunger(90000)
+	first := m.munge(vp8Packet(65534, 4294967000, true))
+	seqOffset := first.SequenceNumber - 65534
+	tsOffset := first.Timestamp - 4294967000
+
+	tests := []struct {
+		seq     uint16
+		ts      uint32
+		wantSeq uint16
+	}{
+		// Across the wraparound of the publisher's sequence numbers and timestamps
+		{65535, 4294967200, 65535 + seqOffset},
+		{0, 100, 0 + seqOffset},
+		{1, 300, 1 + seqOffset},
+		// Reordered, keeps its number without moving the stream back
+		{65535, 4294967200, 65535 + seqOffset},
+		{2, 500, 2 + seqOffset},
+	}
+	for _, tt := range tests {
+		munged := m.munge(vp8Packet(tt.seq, tt.ts, false))
+		if munged.SequenceNumber != tt.wantSeq || munged.Timestamp != tt.ts+tsOffset {
+			t.Fatalf("seq %d ts %d munged to %d/%d, want %d/%d", tt.seq, tt.ts, munged.SequenceNumber, munged.Timestamp, tt.wantSeq, tt.ts+tsOffset)
+		}
+	}
+	if m.lastSeq != 2+seqOffset {
+		t.Fatalf("the reordered packet moved the last sequence number to %d", m.lastSeq)
+	}
+
+	// An inserted packet takes the next number and shifts the ones after it
+	if inserted := m.insert(); inserted != 3+seqOffset {
+		t.Fatalf("inserted %d, want %d", inserted, 3+seqOffset)
+	}
+	if munged := m.munge(vp8Packet(3, 700, false)); munged.SequenceNumber != 4+seqOffset {
+		t.Fatalf("packet after an insert munged to %d, want %d", munged.SequenceNumber, 4+seqOffset)
+	}
+
+	// After a resync a stream with its own numbering continues right after the last packet
+	m.Resync()
+	lastTS := m.lastTS
+	time.Sleep(10 * time.Millisecond)
+	munged := m.munge(vp8Packet(40000, 123, true))
+	if munged.SequenceNumber != 5+seqOffset {
+		t.Fatalf("resynced packet munged to %d, want %d", munged.SequenceNumber, 5+seqOffset)
+	}
+	if elapsed := munged.Timestamp - lastTS; elapsed < 900 || elapsed > 90000 {
+		t.Fatalf("resynced timestamp advanced by %d, want the time since the last packet", elapsed)
+	}
+	if next := m.munge(vp8Packet(40001, 3123, false)); next.SequenceNumber != 6+seqOffset || next.Timestamp != munged.Timestamp+3000 {
+		t.Fatalf("packet after a resync munged to %d/%d", next.SequenceNumber, next.Timestamp)
+	}
+}
@@ -0,0 +1,95 @@
+package sfu
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// How fast the smoothed loudness follows the levels, per packet of usually 20ms
+	levelSmoothing = 0.1
+	// A publisher that stopped sending levels, e.g. with DTX, is silent
+	levelTimeout = time.Second
+	// Quieter than this, 127 - 70 dBov, isn't speech
+	minSpeakerLoudness = 57
+)
+
+// audioLevel smooths the RFC 6464 levels a publisher sends with its audio, so that a cough doesn't make an
+// active speaker
+type audioLevel struct {
+	// The extension id the publisher negotiated, 0 when it sends no levels
+	id       int
+	loudness float64
+	updated  time.Time
+}
+
+// audioLevelID returns the id of the audio level extension the receiver negotiated, 0 when there is none
+func audioLevelID(receiver *webrtc.RTPReceiver) int {
+	if receiver == nil {
+		return 0
+	}
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == sdp.AudioLevelURI {
+			return extension.ID
+		}
+	}
+	return 0
+}
+
+func (l *audioLevel) update(packet *rtp.Packet) {
+	if l.id == 0 {
+		return
+	}
+	data := packet.GetExtension(uint8(l.id))
+	if data == nil {
+		return
+	}
+	var extension rtp.AudioLevelExtension
+	if err := extension.Unmarshal(data); err != nil {
+		return
+	}
+	// Levels are -dBov, 0 is the loudest and 127 silence
+	loudness := float64(127 - min(extension.Level, 127))
+	l.loudness += (loudness - l.loudness) * levelSmoothing
+	l.updated = time.Now()
+}
+
+func (l *audioLevel) get() float64 {
+	if time.Since(l.updated) > levelTimeout {
+		return 0
+	}
+	return l.loudness
+}
+
+func (s *source) getLoudness() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.level.get()
+}
+
+// AudioLevel returns the smoothed loudness of the peer's audio from 0 to 127
+func (b *defaultBroadcaster) AudioLevel() float64 {
+	return b.audio.getLoudness()
+}
+
+// ActiveSpeaker returns the peer whose audio is loudest, empty when nobody speaks or the publishers don't
+// send audio levels
+func (r *defaultRouter) ActiveSpeaker() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	speaker := ""
+	loudest := float64(minSpeakerLoudness)
+	for id, broadcaster := range r.broadcasters {
+		if r.waiting[id] {
+			continue
+		}
+		if loudness := broadcaster.AudioLevel(); loudness > loudest {
+			speaker = id
+			loudest = loudness
+		}
+	}
+	return speaker
+}
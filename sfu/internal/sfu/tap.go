@@ -0,0 +1,55 @@
+package sfu
+
+import (
+	"github.com/pion/rtp"
+)
+
+// AudioTap receives the Opus frames of a room's audio sources, e.g. for live transcription. WriteAudio is
+// called from the forwarding loops, it must not block and the packet is only valid during the call.
+type AudioTap interface {
+	WriteAudio(peerId string, packet *rtp.Packet)
+}
+
+// SetAudioTap sends the audio of the room's peers to the tap, nil stops it. Waiting peers aren't tapped,
+// and neither are sources relayed from another node, the node they are connected to taps them.
+func (r *defaultRouter) SetAudioTap(tap AudioTap) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.audioTap = tap
+	for id, broadcaster := range r.broadcasters {
+		broadcaster.SetAudioTap(r.tapFor(id))
+	}
+}
+
+// tapFor returns the tap the broadcaster's audio goes to, nil if it isn't tapped. r.mu must be held.
+func (r *defaultRouter) tapFor(id string) AudioTap {
+	if r.waiting[id] {
+		return nil
+	}
+	if _, relayed := r.origins[id]; relayed {
+		return nil
+	}
+	return r.audioTap
+}
+
+func (b *defaultBroadcaster) SetAudioTap(tap AudioTap) {
+	b.audio.setTap(tap)
+}
+
+func (s *source) setTap(tap AudioTap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tap = tap
+	s.tapRED = &redUnwrapper{}
+}
+
+// writeTap passes a packet to the tap, RED is unwrapped to the Opus frames. s.mu must be held.
+func (s *source) writeTap(packet *rtp.Packet) {
+	if !isRED(s.codec) {
+		s.tap.WriteAudio(s.peerId, packet)
+		return
+	}
+	for _, opus := range s.tapRED.unwrap(packet) {
+		s.tap.WriteAudio(s.peerId, opus)
+	}
+}
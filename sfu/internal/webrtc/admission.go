@@ -0,0 +1,51 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+)
+
+func (s *session) admit(roomId string, router sfu.Router, id string) error {
+	if err := router.Admit(id); err != nil {
+		return err
+	}
+	s.srv.sendAdmission(id, signaling.AdmissionAdmitted)
+	log.Printf("Admitted %s to room %s", id, roomId)
+	return nil
+}
+
+func (srv *defaultServer) sendAdmission(id string, status signaling.AdmissionStatus) {
+	payload, err := json.Marshal(signaling.Admission{Status: status})
+	if err != nil {
+		log.Printf("Error marshaling the Admission payload for peer %s", id)
+		return
+	}
+	srv.writeTo(id, signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypeAdmission,
+		ClientID: id,
+		Payload:  payload,
+	})
+}
+
+// sendAdmissionRequest asks the room's moderators, or the one moderator given, to admit the peer
+func (srv *defaultServer) sendAdmissionRequest(roomId string, moderatorId string, peerId string, name string) {
+	payload, err := json.Marshal(signaling.AdmissionRequest{PeerID: peerId, PeerName: name})
+	if err != nil {
+		log.Printf("Error marshaling the AdmissionRequest payload for peer %s", peerId)
+		return
+	}
+	for _, sess := range srv.getSessions() {
+		for _, id := range sess.getClients() {
+			if (moderatorId == "" || id == moderatorId) && sess.isModerator(id, roomId) {
+				srv.writeTo(id, signaling.SignalMessage{
+					Type:     signaling.SignalMessageTypeAdmissionRequest,
+					ClientID: id,
+					RoomID:   roomId,
+					Payload:  payload,
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sfu/internal/auth"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// admissionOf returns the admission status the peer was told last
+func (p *testPeer) admissionOf(t *testing.T) signaling.AdmissionStatus {
+	t.Helper()
+	var admission signaling.Admission
+	if err := json.Unmarshal(p.waitForMessage(t, signaling.SignalMessageTypeAdmission).Payload, &admission); err != nil {
+		t.Fatalf("invalid admission payload: %v", err)
+	}
+	return admission.Status
+}
+
+func TestIntegrationWaitingRoom(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	m, peers := joinModerated(t, h, "a")
+	a := peers[0]
+	m.send(t, signaling.SignalMessageTypeWaitingRoom, signaling.WaitingRoom{Enabled: true, LobbyPeerID: "m"})
+	eventually(t, 5*time.Second, "the waiting room to be enabled", h.srv.getRouter("room").WaitingRoomEnabled)
+
+	w := h.join("w", peerOptions{token: signToken(t, auth.Claims{UserID: "w", RoomID: "room"})})
+	if status := w.admissionOf(t); status != signaling.AdmissionWaiting {
+		t.Fatalf("w was told it is %s, want waiting", status)
+	}
+	var request signaling.AdmissionRequest
+	if json.Unmarshal(m.waitForMessage(t, signaling.SignalMessageTypeAdmissionRequest).Payload, &request) != nil || request.PeerID != "w" {
+		t.Fatalf("the moderator was asked to admit %q", request.PeerID)
+	}
+
+	// Waiting, w previews the lobby and nothing else
+	w.waitForMedia(t, "m", 20)
+	time.Sleep(time.Second)
+	if got := w.received("a", webrtc.RTPCodecTypeVideo); got != 0 {
+		t.Fatalf("the waiting w received %d packets of a", got)
+	}
+	for _, p := range []*testPeer{m, a} {
+		if got := p.received("w", webrtc.RTPCodecTypeVideo); got != 0 {
+			t.Fatalf("%s received %d packets of the waiting w", p.id, got)
+		}
+	}
+
+	m.send(t, signaling.SignalMessageTypeAdmit, signaling.ModeratorAction{PeerID: "w"})
+	eventually(t, 5*time.Second, "w being admitted", func() bool {
+		return w.admissionOf(t) == signaling.AdmissionAdmitted
+	})
+	w.waitForMedia(t, "a", 20)
+	a.waitForMedia(t, "w", 20)
+	m.waitForMedia(t, "w", 20)
+
+	d := h.join("d", peerOptions{token: signToken(t, auth.Claims{UserID: "d", RoomID: "room"})})
+	d.admissionOf(t)
+	m.send(t, signaling.SignalMessageTypeDeny, signaling.ModeratorAction{PeerID: "d"})
+	eventually(t, 5*time.Second, "d being denied", func() bool {
+		return d.admissionOf(t) == signaling.AdmissionDenied
+	})
+	eventually(t, 5*time.Second, "d being removed", func() bool {
+		return !inRoom(h, "room", "d")
+	})
+}
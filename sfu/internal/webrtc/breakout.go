@@ -0,0 +1,171 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+)
+
+// mainRoom returns the room the breakout was opened from, or the room itself. srv.mu must be held.
+func (srv *defaultServer) mainRoom(roomId string) string {
+	if main, exists := srv.breakouts[roomId]; exists {
+		return main
+	}
+	return roomId
+}
+
+// handleMoveParticipant moves a participant between the moderator's main room and its breakouts
+func (s *session) handleMoveParticipant(msg *signaling.SignalMessage) error {
+	var move signaling.MoveParticipant
+	if err := json.Unmarshal(msg.Payload, &move); err != nil {
+		return fmt.Errorf("failed to unmarshal moveParticipant payload: %w", err)
+	}
+	target := s.srv.sessionOf(move.PeerID)
+	if target == nil {
+		return fmt.Errorf("no signaling connection for client %s", move.PeerID)
+	}
+	from := target.roomOf(move.PeerID, "")
+
+	s.srv.mu.Lock()
+	main := s.srv.mainRoom(msg.RoomID)
+	inMain := s.srv.mainRoom(from) == main
+	isBreakout := s.srv.mainRoom(move.RoomID) == main
+	dst, exists := s.srv.routers[move.RoomID]
+	s.srv.mu.Unlock()
+	if !inMain {
+		return fmt.Errorf("client %s isn't in room %s or its breakouts", move.PeerID, main)
+	}
+	// The router is only asked once srv.mu is released, router.mu is always taken first
+	if move.RoomID != main && exists {
+		if !isBreakout && len(dst.GetPeerIDs()) > 0 {
+			return fmt.Errorf("room %s isn't a breakout of %s", move.RoomID, main)
+		}
+		// A locked breakout lets nobody in but moderators, the same as a join. Everyone may go back to the
+		// main room, they were let in there already.
+		if dst.IsLocked() && !target.isModerator(move.PeerID, from) {
+			return fmt.Errorf("room %s is locked", move.RoomID)
+		}
+	}
+	if move.RoomID != main {
+		s.srv.mu.Lock()
+		s.srv.breakouts[move.RoomID] = main
+		s.srv.mu.Unlock()
+	}
+
+	return s.srv.moveParticipant(target, move.PeerID, from, move.RoomID)
+}
+
+// handleCloseBreakouts calls everyone in the breakouts of the moderator's room back into the main room
+func (s *session) handleCloseBreakouts(msg *signaling.SignalMessage) {
+	s.srv.mu.Lock()
+	main := s.srv.mainRoom(msg.RoomID)
+	var breakouts []string
+	for breakout, room := range s.srv.breakouts {
+		if room == main {
+			breakouts = append(breakouts, breakout)
+			delete(s.srv.breakouts, breakout)
+		}
+	}
+	s.srv.mu.Unlock()
+
+	for _, breakout := range breakouts {
+		for _, id := range s.srv.getRouter(breakout).GetPeerIDs() {
+			target := s.srv.sessionOf(id)
+			if target == nil {
+				continue
+			}
+			if err := s.srv.moveParticipant(target, id, breakout, main); err != nil {
+				log.Printf("Failed to move %s back to room %s: %v", id, main, err)
+			}
+		}
+	}
+	log.Printf("Closed the breakouts of room %s", main)
+}
+
+// moveParticipant takes the client's PeerConnection and broadcaster out of one router and into another. The
+// client's offers are held meanwhile, so that it renegotiates once for the whole move.
+func (srv *defaultServer) moveParticipant(target *session, id string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	src := srv.getRouter(from)
+	dst := srv.getRouter(to)
+	pc := src.GetPeerConnection(id)
+	if pc == nil {
+		return fmt.Errorf("PeerConnection with id %s does not exist", id)
+	}
+
+	negotiator := target.negotiatorFor(id, pc)
+	negotiator.hold()
+	p, err := src.Extract(id, srv.peerExitNotifier(id, src.GetName(id)))
+	if err != nil {
+		negotiator.release()
+		return err
+	}
+	target.rebind(id, to)
+	if err := dst.Insert(p); err != nil {
+		// Put the client back where it was
+		target.rebind(id, from)
+		if err := src.Insert(p); err != nil {
+			log.Printf("Failed to put %s back into room %s: %v", id, from, err)
+		}
+		negotiator.release()
+		return err
+	}
+	negotiator.release()
+	srv.sendRoomState(id, to, dst)
+	log.Printf("Moved %s from room %s to room %s", id, from, to)
+	if p.Waiting() {
+		srv.sendAdmissionRequest(to, "", id, p.Name())
+	}
+
+	srv.startRelay(to, dst)
+	srv.startTap(to, dst)
+	if len(src.GetPeerIDs()) == 0 {
+		srv.closeRelay(from)
+		srv.closeTap(from)
+		srv.closeThumbnails(from)
+		srv.stopEgresses(from)
+	}
+	return nil
+}
+
+func (srv *defaultServer) sendRoomState(id string, roomId string, router sfu.Router) {
+	state := signaling.RoomState{RoomID: roomId, Peers: []signaling.RoomPeer{}}
+	for _, peerId := range router.GetPeerIDs() {
+		if peerId != id {
+			state.Peers = append(state.Peers, signaling.RoomPeer{PeerID: peerId, PeerName: router.GetName(peerId)})
+		}
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Error marshaling the RoomState payload for peer %s", id)
+		return
+	}
+	srv.writeTo(id, signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypeRoomState,
+		ClientID: id,
+		RoomID:   roomId,
+		Payload:  payload,
+	})
+}
+
+// roomOf returns the room the client is in now, clients can be moved between rooms
+func (s *session) roomOf(id string, fallback string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if roomId, exists := s.clients[id]; exists {
+		return roomId
+	}
+	return fallback
+}
+
+func (s *session) rebind(id string, roomId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.clients[id]; exists {
+		s.clients[id] = roomId
+	}
+}
@@ -0,0 +1,144 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sfu/internal/auth"
+	"sfu/pkg/signaling"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// joinModerated joins a moderator m and the panelists into a room that requires tokens
+func joinModerated(t *testing.T, h *harness, panelists ...string) (*testPeer, []*testPeer) {
+	h.srv.config.Tokens = auth.NewVerifier(testSecret)
+	m := h.join("m", peerOptions{token: signToken(t, auth.Claims{UserID: "m", RoomID: "room", Moderator: true})})
+	var peers []*testPeer
+	for _, id := range panelists {
+		peers = append(peers, h.join(id, peerOptions{token: signToken(t, auth.Claims{UserID: auth.ID(id), RoomID: "room"})}))
+	}
+	return m, peers
+}
+
+func (p *testPeer) send(t *testing.T, msgType signaling.SignalMessageType, payload any) {
+	t.Helper()
+	if err := p.Send(msgType, payload); err != nil {
+		t.Fatalf("%s failed to send %s: %v", p.id, msgType, err)
+	}
+}
+
+// waitForRoomState waits until the peer was told that it is in the room now
+func (p *testPeer) waitForRoomState(t *testing.T, roomId string) {
+	t.Helper()
+	eventually(t, 5*time.Second, p.id+" being moved into "+roomId, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		var state signaling.RoomState
+		for i := len(p.messages) - 1; i >= 0; i-- {
+			if p.messages[i].Type == signaling.SignalMessageTypeRoomState && json.Unmarshal(p.messages[i].Payload, &state) == nil {
+				return state.RoomID == roomId
+			}
+		}
+		return false
+	})
+}
+
+func inRoom(h *harness, roomId string, id string) bool {
+	return slices.Contains(h.srv.getRouter(roomId).GetPeerIDs(), id)
+}
+
+func TestIntegrationBreakoutMoveAndReturn(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	m, peers := joinModerated(t, h, "a", "b")
+	a, b := peers[0], peers[1]
+	b.waitForMedia(t, "a", 10)
+
+	m.send(t, signaling.SignalMessageTypeMoveParticipant, signaling.MoveParticipant{PeerID: "a", RoomID: "side"})
+	a.waitForRoomState(t, "side")
+	b.waitForPeerExit(t, "a", 5*time.Second)
+	if inRoom(h, "room", "a") || !inRoom(h, "side", "a") {
+		t.Fatal("a wasn't moved into the breakout")
+	}
+
+	// Closing the breakouts brings a back to b
+	before := b.received("a", webrtc.RTPCodecTypeVideo)
+	m.send(t, signaling.SignalMessageTypeCloseBreakouts, nil)
+	a.waitForRoomState(t, "room")
+	eventually(t, 10*time.Second, "b receiving a again", func() bool {
+		return b.received("a", webrtc.RTPCodecTypeVideo) >= before+20
+	})
+	if inRoom(h, "side", "a") {
+		t.Fatal("a is still in the breakout")
+	}
+}
+
+func TestIntegrationBreakoutKeepsWaiting(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	m, peers := joinModerated(t, h, "a")
+	a := peers[0]
+	m.send(t, signaling.SignalMessageTypeWaitingRoom, signaling.WaitingRoom{Enabled: true})
+	eventually(t, 5*time.Second, "the waiting room to be enabled", h.srv.getRouter("room").WaitingRoomEnabled)
+	w := h.join("w", peerOptions{token: signToken(t, auth.Claims{UserID: "w", RoomID: "room"})})
+	eventually(t, 5*time.Second, "w waiting", func() bool {
+		return slices.Contains(h.srv.getRouter("room").GetWaitingPeerIDs(), "w")
+	})
+
+	// Moving w into a breakout mustn't admit it
+	m.send(t, signaling.SignalMessageTypeMoveParticipant, signaling.MoveParticipant{PeerID: "m", RoomID: "side"})
+	m.waitForRoomState(t, "side")
+	m.send(t, signaling.SignalMessageTypeMoveParticipant, signaling.MoveParticipant{PeerID: "a", RoomID: "side"})
+	m.send(t, signaling.SignalMessageTypeMoveParticipant, signaling.MoveParticipant{PeerID: "w", RoomID: "side"})
+	w.waitForRoomState(t, "side")
+	if !slices.Contains(h.srv.getRouter("side").GetWaitingPeerIDs(), "w") {
+		t.Fatal("w was admitted by the move")
+	}
+	time.Sleep(2 * time.Second)
+	if got := a.received("w", webrtc.RTPCodecTypeVideo); got != 0 {
+		t.Fatalf("a received %d packets of w while it waits", got)
+	}
+	if got := w.received("a", webrtc.RTPCodecTypeVideo); got != 0 {
+		t.Fatalf("w received %d packets of a while it waits", got)
+	}
+
+	// The moderators of the breakout are asked to admit it and can
+	eventually(t, 5*time.Second, "m being asked to admit w in the breakout", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, msg := range m.messages {
+			var request signaling.AdmissionRequest
+			if msg.Type == signaling.SignalMessageTypeAdmissionRequest && msg.RoomID == "side" &&
+				json.Unmarshal(msg.Payload, &request) == nil && request.PeerID == "w" {
+				return true
+			}
+		}
+		return false
+	})
+	m.send(t, signaling.SignalMessageTypeAdmit, signaling.ModeratorAction{PeerID: "w"})
+	a.waitForMedia(t, "w", 10)
+	w.waitForMedia(t, "a", 10)
+}
+
+func TestIntegrationBreakoutLocked(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	m, peers := joinModerated(t, h, "a")
+	a := peers[0]
+
+	m.send(t, signaling.SignalMessageTypeMoveParticipant, signaling.MoveParticipant{PeerID: "m", RoomID: "side"})
+	m.waitForRoomState(t, "side")
+	m.send(t, signaling.SignalMessageTypeLockRoom, signaling.LockRoom{Locked: true})
+	eventually(t, 5*time.Second, "the breakout to be locked", h.srv.getRouter("side").IsLocked)
+
+	m.send(t, signaling.SignalMessageTypeMoveParticipant, signaling.MoveParticipant{PeerID: "a", RoomID: "side"})
+	time.Sleep(time.Second)
+	if inRoom(h, "side", "a") || !inRoom(h, "room", "a") {
+		t.Fatal("a was moved into the locked breakout")
+	}
+
+	// The main room takes everyone back, locked or not
+	h.srv.getRouter("room").SetLocked(true)
+	m.send(t, signaling.SignalMessageTypeCloseBreakouts, nil)
+	m.waitForRoomState(t, "room")
+	a.waitForMedia(t, "m", 10)
+}
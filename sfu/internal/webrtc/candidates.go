@@ -0,0 +1,46 @@
+package webrtc
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// maxQueuedCandidates bounds the candidates kept for a client before its PeerConnection can take them
+const maxQueuedCandidates = 64
+
+// queueCandidate keeps a candidate that arrived before the client's PeerConnection exists
+func (s *session) queueCandidate(id string, candidate webrtc.ICECandidateInit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.candidates[id]) >= maxQueuedCandidates {
+		log.Printf("Dropping candidate of %s, %d are already queued", id, maxQueuedCandidates)
+		return
+	}
+	s.candidates[id] = append(s.candidates[id], candidate)
+}
+
+// addCandidate adds the client's candidate, until a remote description is applied it waits in the queue
+func (n *negotiator) addCandidate(candidate webrtc.ICECandidateInit) error {
+	n.sdpMu.Lock()
+	defer n.sdpMu.Unlock()
+	if n.pc.RemoteDescription() == nil {
+		if len(n.candidates) >= maxQueuedCandidates {
+			log.Printf("Dropping candidate of %s, %d are already queued", n.id, maxQueuedCandidates)
+			return nil
+		}
+		n.candidates = append(n.candidates, candidate)
+		return nil
+	}
+	return n.pc.AddICECandidate(candidate)
+}
+
+// flushCandidates adds the queued candidates once a remote description is applied. n.sdpMu must be held.
+func (n *negotiator) flushCandidates() {
+	for _, candidate := range n.candidates {
+		if err := n.pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Failed to add queued candidate of %s: %v", n.id, err)
+		}
+	}
+	n.candidates = nil
+}
@@ -0,0 +1,103 @@
+package webrtc
+
+import (
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestClientCandidatesAheadOfDescription(t *testing.T) {
+	srv := NewServer(Config{ICEServers: []webrtc.ICEServer{}}).(*defaultServer)
+	sess := createSession(srv, &offerWriter{offers: make(chan string, 16)})
+
+	// The client offers without candidates and trickles every one of them
+	client := newTestPeerConnection(t)
+	addSendTransceiver(t, client)
+	var candidates []*webrtc.ICECandidate
+	gathered := make(chan struct{})
+	client.OnICECandidate(func(c *webrtc.ICECandidate) {
+		candidates = append(candidates, c)
+		if c == nil {
+			close(gathered)
+		}
+	})
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("client failed to offer: %v", err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatalf("client failed to set its offer: %v", err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client never finished gathering")
+	}
+	if len(candidates) < 2 {
+		t.Fatalf("client gathered %d candidates", len(candidates)-1)
+	}
+	trickle := func(c *webrtc.ICECandidate) {
+		candidate := signaling.NewIceCandidate(c)
+		if err := sess.handleRemoteCandidate("a", "room", &candidate); err != nil {
+			t.Fatalf("failed to handle a candidate: %v", err)
+		}
+	}
+
+	// Ahead of the PeerConnection
+	trickle(candidates[0])
+	if got := len(sess.candidates["a"]); got != 1 {
+		t.Fatalf("%d candidates are queued for the PeerConnection, want 1", got)
+	}
+
+	// Ahead of the remote description, the end of candidates included
+	pc := newTestPeerConnection(t)
+	if err := srv.getRouter("room").AddPeerConnection("a", "a", pc); err != nil {
+		t.Fatalf("failed to add the PeerConnection: %v", err)
+	}
+	for _, c := range candidates[1:] {
+		trickle(c)
+	}
+	n := sess.negotiatorFor("a", pc)
+	if got := len(n.candidates); got != len(candidates) {
+		t.Fatalf("%d candidates are queued for the remote description, want %d", got, len(candidates))
+	}
+	if _, queued := sess.candidates["a"]; queued {
+		t.Fatal("the session kept the candidates the negotiator took")
+	}
+
+	// The queue is flushed with the offer
+	answered := webrtc.GatheringCompletePromise(pc)
+	answer, err := n.answer(offer.SDP)
+	if err != nil || answer == nil {
+		t.Fatalf("failed to answer: %v", err)
+	}
+	if len(n.candidates) != 0 {
+		t.Fatalf("%d candidates are still queued after the remote description", len(n.candidates))
+	}
+	connected := make(chan struct{})
+	client.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	// The client takes the SFU's candidates with the answer
+	<-answered
+	if err := client.SetRemoteDescription(*pc.LocalDescription()); err != nil {
+		t.Fatalf("client failed to set the answer: %v", err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the connection never came up")
+	}
+	// Dropped candidates would still connect through peer reflexive ones learned from the connectivity checks
+	for _, stat := range pc.GetStats() {
+		if candidate, ok := stat.(webrtc.ICECandidateStats); ok && candidate.Type == webrtc.StatsTypeRemoteCandidate &&
+			candidate.CandidateType == webrtc.ICECandidateTypeHost {
+			return
+		}
+	}
+	t.Fatal("the SFU has none of the candidates trickled ahead of the description")
+}
@@ -0,0 +1,300 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+	"strconv"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// CodecPolicy is the set of codecs a room negotiates with its peers
+type CodecPolicy struct {
+	// Video codecs in order of preference, one of vp8, vp9, h264 (constrained baseline), h264-baseline,
+	// h264-main, h264-high or av1
+	Video []string `json:"video"`
+	// ULPFEC toward subscribers that report loss, sent in RED
+	VideoFEC bool       `json:"videoFec"`
+	Opus     OpusPolicy `json:"opus"`
+}
+
+type OpusPolicy struct {
+	Stereo bool `json:"stereo"`
+	// In-band forward error correction
+	FEC bool `json:"fec"`
+	// Discontinuous transmission, silence is sent at a much lower rate
+	DTX bool `json:"dtx"`
+	// RFC 2198 redundant audio, preferred over plain Opus when the peer supports it
+	RED bool `json:"red"`
+}
+
+// CodecPolicies holds the deployment-wide codec policy and the rooms that override it
+type CodecPolicies struct {
+	Default CodecPolicy            `json:"default"`
+	Rooms   map[string]CodecPolicy `json:"rooms"`
+}
+
+func DefaultCodecPolicy() CodecPolicy {
+	return CodecPolicy{
+		Video:    []string{"vp8", "vp9", "h264", "av1"},
+		VideoFEC: true,
+		Opus:     OpusPolicy{FEC: true, RED: true},
+	}
+}
+
+// LoadCodecPolicies reads the codec policies from a JSON file
+func LoadCodecPolicies(path string) (CodecPolicies, error) {
+	var policies CodecPolicies
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policies, fmt.Errorf("failed to read codec policy: %w", err)
+	}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return policies, fmt.Errorf("failed to parse codec policy: %w", err)
+	}
+	for roomId, policy := range policies.Rooms {
+		if _, err := policy.videoCodecs(); err != nil {
+			return policies, fmt.Errorf("room %s: %w", roomId, err)
+		}
+	}
+	if _, err := policies.Default.videoCodecs(); err != nil {
+		return policies, err
+	}
+	return policies, nil
+}
+
+// forRoom returns the policy of the room, rooms without their own use the default
+func (p CodecPolicies) forRoom(roomId string) CodecPolicy {
+	if policy, exists := p.Rooms[roomId]; exists {
+		return policy
+	}
+	if len(p.Default.Video) == 0 {
+		return DefaultCodecPolicy()
+	}
+	return p.Default
+}
+
+var videoCodecs = map[string]webrtc.RTPCodecParameters{
+	"vp8": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	},
+	"vp9": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		PayloadType:        98,
+	},
+	"h264": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		PayloadType:        102,
+	},
+	"h264-baseline": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
+		PayloadType:        104,
+	},
+	"h264-main": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"},
+		PayloadType:        106,
+	},
+	"h264-high": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"},
+		PayloadType:        108,
+	},
+	"av1": {
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+		PayloadType:        45,
+	},
+}
+
+// videoCodecs returns the allowed video codecs in order of preference
+func (p CodecPolicy) videoCodecs() ([]webrtc.RTPCodecParameters, error) {
+	codecs := make([]webrtc.RTPCodecParameters, 0, len(p.Video))
+	for _, name := range p.Video {
+		codec, known := videoCodecs[strings.ToLower(name)]
+		if !known {
+			return nil, fmt.Errorf("unknown video codec %q", name)
+		}
+		// NACK, PLI and transport-cc feedback is added by the interceptors
+		codec.RTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}}
+		codecs = append(codecs, codec)
+	}
+	return codecs, nil
+}
+
+// fecCodecs returns the video formats the sinks send FEC in. Pion negotiates the video codecs of a
+// PeerConnection from its first video section, so they are offered to publishers as well.
+func (p CodecPolicy) fecCodecs() []webrtc.RTPCodecParameters {
+	if !p.VideoFEC {
+		return nil
+	}
+	return []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/red", ClockRate: 90000}, PayloadType: 116},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/ulpfec", ClockRate: 90000}, PayloadType: 117},
+	}
+}
+
+func (p CodecPolicy) opusCodec() webrtc.RTPCodecParameters {
+	fmtp := []string{"minptime=10", "useinbandfec=" + strconv.Itoa(boolParam(p.Opus.FEC))}
+	if p.Opus.Stereo {
+		fmtp = append(fmtp, "stereo=1", "sprop-stereo=1")
+	}
+	if p.Opus.DTX {
+		fmtp = append(fmtp, "usedtx=1")
+	}
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: strings.Join(fmtp, ";"),
+		},
+		PayloadType: 111,
+	}
+}
+
+func boolParam(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// newAPI creates a pion API that only negotiates the codecs of the policy and folds the subscribers' receiver
+// reports through the room's report interceptor, settings may be nil
+func newAPI(policy CodecPolicy, settings *webrtc.SettingEngine, reports interceptor.Factory) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	codecs, err := policy.videoCodecs()
+	if err != nil {
+		return nil, err
+	}
+	for _, codec := range codecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", codec.MimeType, err)
+		}
+	}
+	for _, codec := range policy.fecCodecs() {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", codec.MimeType, err)
+		}
+	}
+	opus := policy.opusCodec()
+	if policy.Opus.RED {
+		// Registered first so that publishers pick it, subscribers without it get Opus unwrapped from it
+		red := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    sfu.MimeTypeRED,
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: fmt.Sprintf("%d/%d", opus.PayloadType, opus.PayloadType),
+			},
+			PayloadType: 63,
+		}
+		if err := m.RegisterCodec(red, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", sfu.MimeTypeRED, err)
+		}
+	}
+	if err := m.RegisterCodec(opus, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register %s: %w", webrtc.MimeTypeOpus, err)
+	}
+	// Publishers send the level of their audio with it, it tells who the active speaker is
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register the audio level extension: %w", err)
+	}
+
+	// Pion's defaults, except that sender reports are translated from the publishers' per sink and the
+	// receiver reports to publishers include what the subscribers report
+	i := &interceptor.Registry{}
+	i.Add(reports)
+	if err := webrtc.ConfigureNack(m, i); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	receiver, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	i.Add(receiver)
+	if err := webrtc.ConfigureTWCCSender(m, i); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	options := []func(*webrtc.API){webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)}
+	if settings != nil {
+		options = append(options, webrtc.WithSettingEngine(*settings))
+	}
+	return webrtc.NewAPI(options...), nil
+}
+
+// remoteCodecs lists the audio and video codecs in the remote description of the PeerConnection, these
+// are the codecs the remote peer can decode
+func remoteCodecs(pc *webrtc.PeerConnection) []webrtc.RTPCodecCapability {
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return nil
+	}
+	// Unmarshal caches the parse in the description, pion's own goroutines read the original
+	desc := *remote
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil
+	}
+	var codecs []webrtc.RTPCodecCapability
+	seen := map[string]bool{}
+	for _, media := range parsed.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind != "video" && kind != "audio" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil || !isMediaCodec(kind, codec) {
+				continue
+			}
+			capability := webrtc.RTPCodecCapability{
+				MimeType:    kind + "/" + codec.Name,
+				ClockRate:   codec.ClockRate,
+				SDPFmtpLine: codec.Fmtp,
+			}
+			key := strings.ToLower(capability.MimeType) + ";" + capability.SDPFmtpLine
+			if !seen[key] {
+				seen[key] = true
+				codecs = append(codecs, capability)
+			}
+		}
+	}
+	return codecs
+}
+
+// isMediaCodec tells the codecs carrying media apart from retransmission and error correction formats.
+// Audio RED is forwarded as it is, video RED only wraps FEC.
+func isMediaCodec(kind string, codec sdp.Codec) bool {
+	switch strings.ToLower(codec.Name) {
+	case "rtx", "ulpfec", "flexfec-03":
+		return false
+	case "red":
+		return kind == "audio"
+	}
+	return true
+}
+
+// joinCodecs converts the codecs a client announced in its join
+func joinCodecs(join *signaling.Join) []webrtc.RTPCodecCapability {
+	capabilities := make([]webrtc.RTPCodecCapability, 0, len(join.VideoCodecs)+len(join.AudioCodecs))
+	for _, codec := range append(append([]signaling.CodecCapability{}, join.VideoCodecs...), join.AudioCodecs...) {
+		capabilities = append(capabilities, webrtc.RTPCodecCapability{
+			MimeType:    codec.MimeType,
+			ClockRate:   codec.ClockRate,
+			Channels:    codec.Channels,
+			SDPFmtpLine: codec.SDPFmtpLine,
+		})
+	}
+	return capabilities
+}
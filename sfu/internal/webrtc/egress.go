@@ -0,0 +1,338 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sfu/internal/egress"
+	"sfu/internal/sfu"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often an egress checks whom it should stream
+	egressPollInterval = 500 * time.Millisecond
+	// An active speaker is kept at least this long, so that the stream doesn't jump between voices
+	egressSpeakerHold = 2 * time.Second
+)
+
+// egressRequest is the body of a request to start streaming a room
+type egressRequest struct {
+	RoomID string `json:"roomId"`
+	// The participant to stream, the active speaker when empty
+	PeerID string `json:"peerId,omitempty"`
+	// rtmp:// or rtmps:// URL ending in the stream key
+	RTMPURL string `json:"rtmpUrl,omitempty"`
+	// Serve an HLS playlist of the stream from this server
+	HLS bool `json:"hls,omitempty"`
+}
+
+type egressResponse struct {
+	EgressID string `json:"egressId"`
+	// Path of the playlist on this server, when HLS was requested
+	HLSURL string `json:"hlsUrl,omitempty"`
+}
+
+// roomEgress streams one participant of a room at a time, with their screen share in place of their camera
+// while they share. The media is remuxed, not mixed, so only that participant is heard.
+type roomEgress struct {
+	id     string
+	roomId string
+	router sfu.Router
+	// The participant to stream, the active speaker when empty
+	peerId string
+	stream *egress.Stream
+	video  *egress.StreamSink
+	audio  *egress.StreamSink
+	hls    *egress.HLS
+	// The participant and video stream the sinks are attached to
+	current      string
+	currentVideo sfu.PublisherStream
+	switched     time.Time
+	stop         chan struct{}
+	once         sync.Once
+	mu           sync.Mutex
+}
+
+// startEgress starts streaming the room to the request's RTMP URL and HLS playlist
+func (srv *defaultServer) startEgress(request *egressRequest) (*roomEgress, error) {
+	if request.RTMPURL == "" && !request.HLS {
+		return nil, errors.New("no RTMP URL and no HLS, nothing to stream to")
+	}
+	if srv.isDraining() {
+		return nil, errors.New("server is draining")
+	}
+	srv.mu.Lock()
+	router, exists := srv.routers[request.RoomID]
+	srv.mu.Unlock()
+	if !exists || len(router.GetPeerIDs()) == 0 {
+		return nil, fmt.Errorf("room %s is empty", request.RoomID)
+	}
+	// Video is remuxed as it arrives, only H.264 fits FLV and HLS
+	h264 := false
+	for _, name := range srv.config.Codecs.forRoom(request.RoomID).Video {
+		h264 = h264 || strings.HasPrefix(strings.ToLower(name), "h264")
+	}
+	if !h264 {
+		return nil, fmt.Errorf("room %s doesn't negotiate H.264, which egress needs to stream video without transcoding", request.RoomID)
+	}
+	id, err := egressID()
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []egress.Output
+	if request.RTMPURL != "" {
+		rtmp, err := egress.DialRTMP(context.Background(), request.RTMPURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the RTMP server: %w", err)
+		}
+		outputs = append(outputs, rtmp)
+	}
+	e := &roomEgress{
+		id:     id,
+		roomId: request.RoomID,
+		router: router,
+		peerId: request.PeerID,
+		stop:   make(chan struct{}),
+	}
+	if request.HLS {
+		e.hls = egress.NewHLS()
+		outputs = append(outputs, e.hls)
+	}
+	e.stream = egress.NewStream(e.requestKeyframe, outputs...)
+	e.video = e.stream.VideoSink()
+	e.audio = e.stream.AudioSink()
+
+	srv.mu.Lock()
+	srv.egresses[id] = e
+	srv.mu.Unlock()
+	log.Printf("Egress %s started streaming room %s", id, e.roomId)
+	go srv.runEgress(e)
+	return e, nil
+}
+
+// runEgress keeps the sinks on the participant to stream until the egress is stopped or its outputs fail
+func (srv *defaultServer) runEgress(e *roomEgress) {
+	ticker := time.NewTicker(egressPollInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		e.follow()
+		select {
+		case <-e.stop:
+			running = false
+		case <-e.stream.Done():
+			log.Printf("Egress %s failed: %v", e.id, e.stream.Err())
+			running = false
+		case <-ticker.C:
+		}
+	}
+	e.detach()
+	e.stream.Close()
+
+	srv.mu.Lock()
+	delete(srv.egresses, e.id)
+	srv.mu.Unlock()
+	log.Printf("Egress %s of room %s stopped", e.id, e.roomId)
+}
+
+// follow attaches the sinks to whom the egress should stream now
+func (e *roomEgress) follow() {
+	peers := e.router.GetPeerIDs()
+	e.mu.Lock()
+	current := e.current
+	e.mu.Unlock()
+	if current != "" && !slices.Contains(peers, current) {
+		// The participant left or was moved to another room
+		e.detach()
+		current = ""
+	}
+
+	candidates := []string{e.peerId}
+	if e.peerId == "" {
+		candidates = e.speakerCandidates(current, peers)
+	}
+	for _, peerId := range candidates {
+		video := sfu.StreamVideo
+		if e.router.ScreenShareActive(peerId) {
+			video = sfu.StreamScreen
+		}
+		if peerId == current && video == e.currentVideo {
+			return
+		}
+		if e.attach(peerId, video) {
+			return
+		}
+	}
+}
+
+// speakerCandidates lists whom to stream in order of preference: the active speaker once the current one
+// was held long enough, then the current one, then everyone in a stable order
+func (e *roomEgress) speakerCandidates(current string, peers []string) []string {
+	var candidates []string
+	speaker := e.router.ActiveSpeaker()
+	if speaker != "" && (current == "" || time.Since(e.switched) >= egressSpeakerHold) {
+		candidates = append(candidates, speaker)
+	}
+	if current != "" {
+		candidates = append(candidates, current)
+	}
+	sort.Strings(peers)
+	return append(candidates, peers...)
+}
+
+// attach moves the sinks to the participant's streams, it reports false when the participant publishes nothing
+func (e *roomEgress) attach(peerId string, video sfu.PublisherStream) bool {
+	e.detach()
+	if err := e.router.AddLocalSink(peerId, e.id, video, e.video); err != nil {
+		return false
+	}
+	if err := e.router.AddLocalSink(peerId, e.id, sfu.StreamAudio, e.audio); err != nil {
+		e.router.RemoveLocalSink(peerId, e.id)
+		return false
+	}
+	e.mu.Lock()
+	e.current = peerId
+	e.currentVideo = video
+	e.switched = time.Now()
+	e.mu.Unlock()
+	log.Printf("Egress %s streams %s of %s", e.id, video, peerId)
+	return true
+}
+
+func (e *roomEgress) detach() {
+	e.mu.Lock()
+	current := e.current
+	e.current = ""
+	e.mu.Unlock()
+	if current != "" {
+		e.router.RemoveLocalSink(current, e.id)
+	}
+}
+
+// requestKeyframe is called by the stream while it waits for a picture
+func (e *roomEgress) requestKeyframe() {
+	e.mu.Lock()
+	current := e.current
+	e.mu.Unlock()
+	if current != "" {
+		e.router.RequestLocalKeyframe(current)
+	}
+}
+
+func (e *roomEgress) Stop() {
+	e.once.Do(func() { close(e.stop) })
+}
+
+// stopEgress stops an egress, it must stream the room
+func (srv *defaultServer) stopEgress(roomId string, id string) error {
+	srv.mu.Lock()
+	e, exists := srv.egresses[id]
+	srv.mu.Unlock()
+	if !exists || e.roomId != roomId {
+		return fmt.Errorf("no egress %s in room %s", id, roomId)
+	}
+	e.Stop()
+	return nil
+}
+
+// stopEgresses stops the egresses of the room, every room's when roomId is empty
+func (srv *defaultServer) stopEgresses(roomId string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, e := range srv.egresses {
+		if roomId == "" || e.roomId == roomId {
+			e.Stop()
+		}
+	}
+}
+
+func egressID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "egress-" + hex.EncodeToString(b), nil
+}
+
+// HandleEgress starts streaming a room on POST and stops it on DELETE ?roomId=&egressId=. The backend
+// authorizes the request with a bearer token that gives moderator rights for the room.
+func (srv *defaultServer) HandleEgress(w http.ResponseWriter, r *http.Request) {
+	var roomId string
+	var request egressRequest
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&request); err != nil {
+			http.Error(w, "invalid egress request", http.StatusBadRequest)
+			return
+		}
+		roomId = request.RoomID
+	case http.MethodDelete:
+		roomId = r.URL.Query().Get("roomId")
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if roomId == "" {
+		http.Error(w, "roomId is missing", http.StatusBadRequest)
+		return
+	}
+	if err := srv.authorizeModerator(r, roomId); err != nil {
+		log.Printf("Refusing egress request for room %s: %v", roomId, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := srv.stopEgress(roomId, r.URL.Query().Get("egressId")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	e, err := srv.startEgress(&request)
+	if err != nil {
+		log.Printf("Failed to start egress of room %s: %v", roomId, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	response := egressResponse{EgressID: e.id}
+	if e.hls != nil {
+		response.HLSURL = "/hls/" + e.id + "/index.m3u8"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleHLS serves the playlists and segments of the egresses under /hls/<egressId>/. The egress ids are
+// random, so anyone given the URL can watch, like a stream key.
+func (srv *defaultServer) HandleHLS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	srv.mu.Lock()
+	e, exists := srv.egresses[id]
+	srv.mu.Unlock()
+	if !exists || e.hls == nil {
+		http.NotFound(w, r)
+		return
+	}
+	e.hls.ServeHTTP(w, r)
+}
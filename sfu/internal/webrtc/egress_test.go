@@ -0,0 +1,128 @@
+package webrtc
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sfu/internal/egress"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rtmpTags counts the FLV tags a stand-in RTMP receiver gets
+type rtmpTags struct {
+	streamKey string
+	// AVC sequence headers, H.264 frames and Enhanced RTMP Opus tags
+	sequenceHeaders int
+	videoFrames     int
+	opusFrames      int
+	closed          bool
+	mu              sync.Mutex
+}
+
+func (c *rtmpTags) WriteTag(tagType uint8, timestamp uint32, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case tagType == 9 && len(data) > 1 && data[1] == 0:
+		c.sequenceHeaders++
+	case tagType == 9 && len(data) > 1 && data[1] == 1:
+		c.videoFrames++
+	case tagType == 8 && len(data) > 5 && data[0]>>4 == 9 && string(data[1:5]) == "Opus":
+		c.opusFrames++
+	}
+	return nil
+}
+
+func (c *rtmpTags) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *rtmpTags) counts() (int, int, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sequenceHeaders, c.videoFrames, c.opusFrames, c.closed
+}
+
+func TestIntegrationEgress(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Codecs.Rooms = map[string]CodecPolicy{"room": {Video: []string{"h264"}}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	tags := &rtmpTags{}
+	receiver := &egress.Receiver{OnPublish: func(app string, streamKey string) (egress.TagHandler, error) {
+		tags.mu.Lock()
+		defer tags.mu.Unlock()
+		tags.streamKey = streamKey
+		return tags, nil
+	}}
+	go receiver.Serve(listener)
+
+	h.join("a", peerOptions{h264: true})
+	h.join("b", peerOptions{h264: true}).waitForMedia(t, "a", 50)
+
+	e, err := h.srv.startEgress(&egressRequest{RoomID: "room", PeerID: "a", RTMPURL: "rtmp://" + listener.Addr().String() + "/live/key", HLS: true})
+	if err != nil {
+		t.Fatalf("failed to start the egress: %v", err)
+	}
+	playlistURL := "/hls/" + e.id + "/index.m3u8"
+
+	eventually(t, 15*time.Second, "H.264 and Opus reaching the RTMP receiver", func() bool {
+		headers, video, opus, _ := tags.counts()
+		return headers >= 1 && video >= 30 && opus >= 50
+	})
+	tags.mu.Lock()
+	streamKey := tags.streamKey
+	tags.mu.Unlock()
+	if streamKey != "key" {
+		t.Fatalf("published stream key %q, want key", streamKey)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		h.srv.HandleHLS(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+	var playlist string
+	eventually(t, 15*time.Second, "the first HLS segment", func() bool {
+		recorder := get(playlistURL)
+		playlist = recorder.Body.String()
+		return recorder.Code == http.StatusOK && strings.Contains(playlist, ".ts")
+	})
+	var segment string
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.HasSuffix(line, ".ts") {
+			segment = line
+			break
+		}
+	}
+	data := get(strings.TrimSuffix(playlistURL, "index.m3u8") + segment).Body.Bytes()
+	if len(data) == 0 || len(data)%188 != 0 {
+		t.Fatalf("segment %s has %d bytes, want whole TS packets", segment, len(data))
+	}
+	for i := 0; i < len(data); i += 188 {
+		if data[i] != 0x47 {
+			t.Fatalf("TS packet at %d has no sync byte", i)
+		}
+	}
+
+	if err := h.srv.stopEgress("room", e.id); err != nil {
+		t.Fatalf("failed to stop the egress: %v", err)
+	}
+	eventually(t, 5*time.Second, "the RTMP stream ending", func() bool {
+		_, _, _, closed := tags.counts()
+		return closed
+	})
+	if code := get(playlistURL).Code; code != http.StatusNotFound {
+		t.Fatalf("the playlist of a stopped egress returned %d", code)
+	}
+}
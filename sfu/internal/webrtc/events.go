@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"sfu/pkg/signaling"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// EventLimits bound what a single sender can push through the events channels
+type EventLimits struct {
+	// MaxMessageSize is the largest event in bytes, larger ones are dropped
+	MaxMessageSize int
+	// MessagesPerSecond is the sustained rate, up to Burst events can be sent at once
+	MessagesPerSecond float64
+	Burst             int
+}
+
+func DefaultEventLimits() EventLimits {
+	return EventLimits{
+		MaxMessageSize:    1024,
+		MessagesPerSecond: 20,
+		Burst:             40,
+	}
+}
+
+type eventChannel struct {
+	dc   *webrtc.DataChannel
+	sess *session
+	// Token bucket of the sender
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// allow takes a token from the sender's bucket, refilled at the configured rate
+func (ch *eventChannel) allow(limits EventLimits) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	now := time.Now()
+	ch.tokens += now.Sub(ch.last).Seconds() * limits.MessagesPerSecond
+	if ch.tokens > float64(limits.Burst) {
+		ch.tokens = float64(limits.Burst)
+	}
+	ch.last = now
+	if ch.tokens < 1 {
+		return false
+	}
+	ch.tokens--
+	return true
+}
+
+// openEventChannel creates the client's negotiated events channel, it is part of the first offer
+func (s *session) openEventChannel(id string, pc *webrtc.PeerConnection) error {
+	negotiated := true
+	channelId := signaling.EventChannelID
+	dc, err := pc.CreateDataChannel(signaling.EventChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &channelId,
+	})
+	if err != nil {
+		return err
+	}
+	ch := &eventChannel{
+		dc:     dc,
+		sess:   s,
+		tokens: float64(s.srv.config.Events.Burst),
+		last:   time.Now(),
+	}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		s.srv.relayEvent(id, ch, msg.Data)
+	})
+	dc.OnClose(func() {
+		s.srv.removeEventChannel(id, ch)
+	})
+
+	s.srv.mu.Lock()
+	s.srv.events[id] = ch
+	s.srv.mu.Unlock()
+	return nil
+}
+
+func (srv *defaultServer) removeEventChannel(id string, ch *eventChannel) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.events[id] == ch {
+		delete(srv.events, id)
+	}
+}
+
+// relayEvent sends the sender's event to everyone admitted to its room, or to the one peer it targets
+func (srv *defaultServer) relayEvent(id string, ch *eventChannel, data []byte) {
+	limits := srv.config.Events
+	if len(data) > limits.MaxMessageSize {
+		log.Printf("Dropping %d byte event from %s, the limit is %d", len(data), id, limits.MaxMessageSize)
+		return
+	}
+	if !ch.allow(limits) {
+		// Pointer moves easily exceed the rate, so don't log every drop
+		return
+	}
+
+	var event signaling.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Dropping malformed event from %s: %v", id, err)
+		return
+	}
+	if !event.Type.Valid() {
+		log.Printf("Dropping event of unknown type %q from %s", event.Type, id)
+		return
+	}
+	event.From = id
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling event from %s", id)
+		return
+	}
+
+	roomId := ch.sess.roomOf(id, "")
+	if roomId == "" {
+		return
+	}
+	router := srv.getRouter(roomId)
+	waiting := make(map[string]bool)
+	for _, peerId := range router.GetWaitingPeerIDs() {
+		waiting[peerId] = true
+	}
+	// Waiting peers neither see the room nor talk to it
+	if waiting[id] {
+		return
+	}
+
+	var recipients []string
+	if event.To != "" {
+		if router.GetPeerConnection(event.To) == nil || waiting[event.To] {
+			return
+		}
+		recipients = []string{event.To}
+	} else {
+		for _, peerId := range router.GetPeerIDs() {
+			if peerId != id && !waiting[peerId] {
+				recipients = append(recipients, peerId)
+			}
+		}
+	}
+
+	for _, peerId := range recipients {
+		srv.mu.Lock()
+		target, exists := srv.events[peerId]
+		srv.mu.Unlock()
+		if !exists || target.dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if err := target.dc.Send(data); err != nil {
+			log.Printf("Failed to send %s event to %s: %v", event.Type, peerId, err)
+		}
+	}
+}
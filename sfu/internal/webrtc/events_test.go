@@ -0,0 +1,90 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sfu/pkg/signaling"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventLog collects the events a peer receives over its data channel
+type eventLog struct {
+	events []signaling.Event
+	mu     sync.Mutex
+}
+
+func logEvents(p *testPeer) *eventLog {
+	l := &eventLog{}
+	p.OnEvent(func(event signaling.Event) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.events = append(l.events, event)
+	})
+	return l
+}
+
+func (l *eventLog) count(eventType signaling.EventType) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, event := range l.events {
+		if event.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *eventLog) last() signaling.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.events[len(l.events)-1]
+}
+
+func TestIntegrationEvents(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Events = EventLimits{MaxMessageSize: 256, MessagesPerSecond: 1, Burst: 10}
+	a := h.join("a", peerOptions{noMedia: true})
+	b := h.join("b", peerOptions{noMedia: true})
+	c := h.join("c", peerOptions{noMedia: true})
+	bEvents, cEvents := logEvents(b), logEvents(c)
+
+	// The channel opens shortly after the join, the sender can't pose as someone else
+	eventually(t, 5*time.Second, "b and c receiving a's reaction", func() bool {
+		a.SendEvent(signaling.Event{Type: signaling.EventTypeReaction, From: "c", Payload: json.RawMessage(`"👍"`)})
+		time.Sleep(200 * time.Millisecond)
+		return bEvents.count(signaling.EventTypeReaction) > 0 && cEvents.count(signaling.EventTypeReaction) > 0
+	})
+	if from := bEvents.last().From; from != "a" {
+		t.Fatalf("the reaction came from %q, want a", from)
+	}
+
+	if err := a.SendEvent(signaling.Event{Type: signaling.EventTypeHandRaise, To: "b"}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	// Neither are relayed
+	a.SendEvent(signaling.Event{Type: "unknown"})
+	a.SendEvent(signaling.Event{Type: signaling.EventTypeTyping, Payload: json.RawMessage(`"` + strings.Repeat("x", 512) + `"`)})
+	eventually(t, 5*time.Second, "b receiving the hand raise", func() bool {
+		return bEvents.count(signaling.EventTypeHandRaise) == 1
+	})
+	time.Sleep(500 * time.Millisecond)
+	if got := cEvents.count(signaling.EventTypeHandRaise); got != 0 {
+		t.Fatalf("c received %d hand raises meant for b", got)
+	}
+	if got := bEvents.count("unknown") + bEvents.count(signaling.EventTypeTyping); got != 0 {
+		t.Fatalf("b received %d invalid or oversized events", got)
+	}
+
+	// The bucket holds 10 events, only one a second is added
+	before := bEvents.count(signaling.EventTypePointer)
+	for i := 0; i < 30; i++ {
+		a.SendEvent(signaling.Event{Type: signaling.EventTypePointer})
+	}
+	time.Sleep(time.Second)
+	if got := bEvents.count(signaling.EventTypePointer) - before; got == 0 || got > 12 {
+		t.Fatalf("b received %d of 30 pointer events sent at once, want at most the burst", got)
+	}
+}
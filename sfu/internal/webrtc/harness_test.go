@@ -0,0 +1,431 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sfu/pkg/client"
+	"sfu/pkg/signaling"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/vnet"
+	"github.com/pion/webrtc/v3"
+)
+
+// linkConditions shape the virtual network between the SFU and its clients. Loss and bandwidth apply to
+// each direction of each client's link, latency and jitter to every packet.
+type linkConditions struct {
+	// Loss is the percentage of packets dropped
+	Loss      int
+	Latency   time.Duration
+	Jitter    time.Duration
+	Bandwidth int // bits per second, unlimited when 0
+}
+
+// ICE gives up quickly, so that a cut link fails the PeerConnections within seconds
+const (
+	harnessDisconnectedTimeout = time.Second
+	harnessFailedTimeout       = 3 * time.Second
+	harnessKeepAliveInterval   = 250 * time.Millisecond
+)
+
+// harness runs the real HandleSession behind an httptest.Server. Signaling goes over loopback, the media of
+// the SFU and every client over a virtual network, so the tests run offline.
+type harness struct {
+	t          *testing.T
+	conditions linkConditions
+	wan        *vnet.Router
+	srv        *defaultServer
+	url        string
+	// Files the playback bots can play
+	mediaDir string
+	// IPs whose packets the virtual network drops
+	cut    map[string]bool
+	nextIP int
+	mu     sync.Mutex
+}
+
+func newHarness(t *testing.T, conditions linkConditions) *harness {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration tests don't run in short mode")
+	}
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = logging.LogLevelError
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		MinDelay:      conditions.Latency,
+		MaxJitter:     conditions.Jitter,
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		t.Fatalf("failed to create virtual network: %v", err)
+	}
+	h := &harness{
+		t:          t,
+		conditions: conditions,
+		wan:        wan,
+		cut:        make(map[string]bool),
+		nextIP:     2,
+		mediaDir:   t.TempDir(),
+	}
+	wan.AddChunkFilter(h.deliver)
+
+	if err := wan.Start(); err != nil {
+		t.Fatalf("failed to start virtual network: %v", err)
+	}
+	t.Cleanup(func() { wan.Stop() })
+	h.srv, h.url = h.startNode("10.0.0.1", Config{})
+	return h
+}
+
+// addNode starts another SFU on its own virtual host that relays its rooms to the harness's SFU, peers
+// join it with peerOptions.url
+func (h *harness) addNode(nodeId string) (*defaultServer, string) {
+	h.t.Helper()
+	return h.startNode(h.nextHost(), Config{NodeID: nodeId, RelayURL: h.url})
+}
+
+// startNode serves an SFU with the host's media behind an httptest.Server and returns its signaling URL
+func (h *harness) startNode(ip string, config Config) (*defaultServer, string) {
+	h.t.Helper()
+	// The playback bots need the URL before the server starts
+	mux := http.NewServeMux()
+	server := httptest.NewUnstartedServer(mux)
+	url := "ws://" + server.Listener.Addr().String() + "/ws"
+	config.Codecs = CodecPolicies{Default: DefaultCodecPolicy()}
+	config.ICEServers = []webrtc.ICEServer{}
+	config.SettingEngine = h.settingEngine(ip)
+	config.MediaDir = h.mediaDir
+	config.PlaybackURL = url
+	srv := NewServer(config).(*defaultServer)
+	mux.HandleFunc("/ws", srv.HandleSession)
+	server.Start()
+	h.t.Cleanup(server.Close)
+	return srv, url
+}
+
+// nextHost returns the IP of a new virtual host
+func (h *harness) nextHost() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ip := fmt.Sprintf("10.0.0.%d", h.nextIP)
+	h.nextIP++
+	return ip
+}
+
+// settingEngine attaches a new host with the given IP to the virtual network
+func (h *harness) settingEngine(ip string) *webrtc.SettingEngine {
+	h.t.Helper()
+	vnic, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+	if err != nil {
+		h.t.Fatalf("failed to create virtual host: %v", err)
+	}
+	var nic vnet.NIC = vnic
+	if h.conditions.Loss > 0 {
+		if nic, err = vnet.NewLossFilter(nic, h.conditions.Loss); err != nil {
+			h.t.Fatalf("failed to add loss: %v", err)
+		}
+	}
+	if h.conditions.Bandwidth > 0 {
+		tbf, err := vnet.NewTokenBucketFilter(nic, vnet.TBFRate(h.conditions.Bandwidth))
+		if err != nil {
+			h.t.Fatalf("failed to limit bandwidth: %v", err)
+		}
+		h.t.Cleanup(func() { tbf.Close() })
+		nic = tbf
+	}
+	if err := h.wan.AddNet(nic); err != nil {
+		h.t.Fatalf("failed to attach virtual host: %v", err)
+	}
+
+	settings := &webrtc.SettingEngine{}
+	settings.SetNet(vnic)
+	settings.SetICETimeouts(harnessDisconnectedTimeout, harnessFailedTimeout, harnessKeepAliveInterval)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return settings
+}
+
+// deliver drops the packets from and to cut hosts
+func (h *harness) deliver(c vnet.Chunk) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.cut[hostOf(c.SourceAddr())] && !h.cut[hostOf(c.DestinationAddr())]
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// peerOptions choose what a test peer publishes
+type peerOptions struct {
+	roomId string
+	// Signaling URL of the node to join, the harness's SFU when empty
+	url string
+	// Audio and video are published unless noMedia is set
+	noMedia bool
+	// The screen share is published but only sent once startScreenShare is called
+	screenShare bool
+	// The camera is H.264 rather than VP8
+	h264 bool
+	// Token to join with, for an SFU that requires them
+	token string
+}
+
+// testPeer is a client on its own virtual host that counts the packets it receives per stream
+type testPeer struct {
+	client.Client
+	id string
+	ip string
+	h  *harness
+	// Stream id and kind -> packets received
+	packets  map[string]int
+	messages []signaling.SignalMessage
+	screen   client.Source
+	// Cancels the screen share source
+	stopScreen context.CancelFunc
+	ctx        context.Context
+	mu         sync.Mutex
+}
+
+// join connects a new client with the id to the SFU and waits until it is connected
+func (h *harness) join(id string, options peerOptions) *testPeer {
+	h.t.Helper()
+	p, err := h.tryJoin(id, options)
+	if err != nil {
+		h.t.Fatalf("%s failed to join: %v", id, err)
+	}
+	return p
+}
+
+// tryJoin is join for peers the SFU may turn away, it returns the error Join failed with
+func (h *harness) tryJoin(id string, options peerOptions) (*testPeer, error) {
+	h.t.Helper()
+	if options.roomId == "" {
+		options.roomId = "room"
+	}
+	if options.url == "" {
+		options.url = h.url
+	}
+	ip := h.nextHost()
+
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		h.t.Fatalf("failed to register codecs: %v", err)
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
+		h.t.Fatalf("failed to register interceptors: %v", err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(*h.settingEngine(ip)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.t.Cleanup(cancel)
+	p := &testPeer{
+		Client: client.NewClient(client.Config{
+			URL:      options.url,
+			RoomID:   options.roomId,
+			ClientID: id,
+			Name:     id,
+			Token:    options.token,
+			API:      api,
+		}),
+		id:      id,
+		ip:      ip,
+		h:       h,
+		packets: make(map[string]int),
+		ctx:     ctx,
+	}
+	h.t.Cleanup(func() { p.Close() })
+
+	var sources []client.Source
+	if !options.noMedia {
+		newVideo := client.NewGeneratedVideo
+		if options.h264 {
+			newVideo = client.NewGeneratedH264
+		}
+		video, err := newVideo("video", id, 30, time.Second)
+		if err != nil {
+			h.t.Fatalf("failed to create video: %v", err)
+		}
+		audio, err := client.NewGeneratedAudio("audio", id)
+		if err != nil {
+			h.t.Fatalf("failed to create audio: %v", err)
+		}
+		sources = append(sources, video, audio)
+	}
+	publish := sources
+	if options.screenShare {
+		screen, err := client.NewGeneratedVideo("screen", id+"-screen", 15, time.Second)
+		if err != nil {
+			h.t.Fatalf("failed to create screen share: %v", err)
+		}
+		p.screen = screen
+		publish = append(publish, screen)
+	}
+	for _, source := range publish {
+		if err := p.Publish(source.Track()); err != nil {
+			h.t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	p.OnTrack(p.count)
+	p.OnMessage(func(msg signaling.SignalMessage) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.messages = append(p.messages, msg)
+	})
+
+	joinCtx, cancelJoin := context.WithTimeout(ctx, 15*time.Second)
+	defer cancelJoin()
+	if err := p.Join(joinCtx); err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		go source.Run(ctx)
+	}
+	return p, nil
+}
+
+func (p *testPeer) count(remote *client.RemoteTrack) {
+	key := streamKey(remote.Track.StreamID(), remote.Track.Kind())
+	go func() {
+		for {
+			if _, _, err := remote.Track.ReadRTP(); err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.packets[key]++
+			p.mu.Unlock()
+		}
+	}()
+}
+
+func streamKey(streamId string, kind webrtc.RTPCodecType) string {
+	return streamId + "/" + kind.String()
+}
+
+func (p *testPeer) received(streamId string, kind webrtc.RTPCodecType) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.packets[streamKey(streamId, kind)]
+}
+
+// startScreenShare starts sending on the screen share transceiver
+func (p *testPeer) startScreenShare() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.screen == nil {
+		p.h.t.Fatalf("%s doesn't publish a screen share", p.id)
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.stopScreen = cancel
+	go p.screen.Run(ctx)
+}
+
+// stopScreenShare stops sending, the way the app does when the user ends the share
+func (p *testPeer) stopScreenShare() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopScreen != nil {
+		p.stopScreen()
+		p.stopScreen = nil
+	}
+}
+
+// cutLink drops every packet of the peer's media, the signaling connection stays up
+func (p *testPeer) cutLink() {
+	p.h.mu.Lock()
+	defer p.h.mu.Unlock()
+	p.h.cut[p.ip] = true
+}
+
+// dial opens a bare signaling connection to the SFU, for messages a well-behaved client doesn't send
+func (h *harness) dial() *websocket.Conn {
+	h.t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(h.url, nil)
+	if err != nil {
+		h.t.Fatalf("failed to dial: %v", err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendSignal(t *testing.T, conn *websocket.Conn, msgType signaling.SignalMessageType, clientId string, payload any) {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal %s: %v", msgType, err)
+	}
+	if err := conn.WriteJSON(signaling.SignalMessage{Type: msgType, ClientID: clientId, RoomID: "room", Payload: data}); err != nil {
+		t.Fatalf("failed to send %s: %v", msgType, err)
+	}
+}
+
+// readSignal reads messages until one of the type arrives, nil when none does within timeout
+func readSignal(conn *websocket.Conn, msgType signaling.SignalMessageType, timeout time.Duration) *signaling.SignalMessage {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg signaling.SignalMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return nil
+		}
+		if msg.Type == msgType {
+			return &msg
+		}
+	}
+}
+
+// eventually fails the test unless condition holds within timeout
+func eventually(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't happen within %v", what, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitForMedia waits until the peer received packets of both kinds from the stream
+func (p *testPeer) waitForMedia(t *testing.T, streamId string, packets int) {
+	t.Helper()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		eventually(t, 15*time.Second, fmt.Sprintf("%s receiving %d %s packets of %s", p.id, packets, kind, streamId), func() bool {
+			return p.received(streamId, kind) >= packets
+		})
+	}
+}
+
+// waitForPeerExit waits until the peer was told that peerId left
+func (p *testPeer) waitForPeerExit(t *testing.T, peerId string, timeout time.Duration) {
+	t.Helper()
+	eventually(t, timeout, fmt.Sprintf("%s being told that %s left", p.id, peerId), func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, msg := range p.messages {
+			if msg.Type != signaling.SignalMessageTypePeerExit {
+				continue
+			}
+			var peerExit signaling.PeerExit
+			if err := json.Unmarshal(msg.Payload, &peerExit); err == nil && peerExit.PeerID == peerId {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,282 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/client"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIntegrationMediaFlow(t *testing.T) {
+	networks := []struct {
+		name       string
+		conditions linkConditions
+	}{
+		{"clean", linkConditions{}},
+		{"lossy", linkConditions{Loss: 5, Latency: 40 * time.Millisecond, Jitter: 10 * time.Millisecond}},
+		{"constrained", linkConditions{Latency: 20 * time.Millisecond, Bandwidth: 2_000_000}},
+	}
+	for _, network := range networks {
+		t.Run(network.name, func(t *testing.T) {
+			h := newHarness(t, network.conditions)
+			a := h.join("a", peerOptions{})
+			b := h.join("b", peerOptions{})
+
+			a.waitForMedia(t, "b", 50)
+			b.waitForMedia(t, "a", 50)
+		})
+	}
+}
+
+func TestIntegrationPeerExit(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	a := h.join("a", peerOptions{})
+	b := h.join("b", peerOptions{})
+	a.waitForMedia(t, "b", 10)
+
+	b.Close()
+	a.waitForPeerExit(t, "b", 5*time.Second)
+}
+
+func TestIntegrationScreenShare(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	a := h.join("a", peerOptions{screenShare: true})
+	b := h.join("b", peerOptions{})
+	b.waitForMedia(t, "a", 10)
+	if packets := b.received("a-screen", webrtc.RTPCodecTypeVideo); packets != 0 {
+		t.Fatalf("got %d screen share packets before the share started", packets)
+	}
+
+	a.startScreenShare()
+	eventually(t, 10*time.Second, "b receiving the screen share", func() bool {
+		return b.received("a-screen", webrtc.RTPCodecTypeVideo) >= 20
+	})
+
+	a.stopScreenShare()
+	// Let the packets in flight arrive
+	time.Sleep(500 * time.Millisecond)
+	screen := b.received("a-screen", webrtc.RTPCodecTypeVideo)
+	camera := b.received("a", webrtc.RTPCodecTypeVideo)
+	time.Sleep(time.Second)
+	if got := b.received("a-screen", webrtc.RTPCodecTypeVideo); got != screen {
+		t.Fatalf("got %d screen share packets after the share stopped", got-screen)
+	}
+	if got := b.received("a", webrtc.RTPCodecTypeVideo); got == camera {
+		t.Fatal("the camera stopped with the screen share")
+	}
+
+	// Sharing again reuses the transceiver
+	a.startScreenShare()
+	eventually(t, 10*time.Second, "b receiving the screen share again", func() bool {
+		return b.received("a-screen", webrtc.RTPCodecTypeVideo) >= screen+20
+	})
+}
+
+func TestIntegrationRenegotiation(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	a := h.join("a", peerOptions{})
+	b := h.join("b", peerOptions{})
+	a.waitForMedia(t, "b", 10)
+
+	// The SFU renegotiates a and b to add the tracks of the newcomer
+	c := h.join("c", peerOptions{})
+	a.waitForMedia(t, "c", 20)
+	b.waitForMedia(t, "c", 20)
+	c.waitForMedia(t, "a", 20)
+	c.waitForMedia(t, "b", 20)
+
+	// And again to remove them
+	c.Close()
+	a.waitForPeerExit(t, "c", 5*time.Second)
+	before := a.received("b", webrtc.RTPCodecTypeVideo)
+	eventually(t, 5*time.Second, "a still receiving b", func() bool {
+		return a.received("b", webrtc.RTPCodecTypeVideo) >= before+20
+	})
+}
+
+func TestIntegrationReconnection(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	a := h.join("a", peerOptions{})
+	b := h.join("b", peerOptions{})
+	b.waitForMedia(t, "a", 10)
+
+	// The network of a goes away, the SFU notices once ICE fails
+	a.cutLink()
+	b.waitForPeerExit(t, "a", harnessFailedTimeout+10*time.Second)
+	a.Close()
+
+	// a comes back on a new network with the same id
+	rejoined := h.join("a", peerOptions{})
+	rejoined.waitForMedia(t, "b", 20)
+	before := b.received("a", webrtc.RTPCodecTypeVideo)
+	eventually(t, 15*time.Second, "b receiving a again", func() bool {
+		return b.received("a", webrtc.RTPCodecTypeVideo) >= before+20
+	})
+}
+
+func TestIntegrationJoinToken(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Tokens = auth.NewVerifier(testSecret)
+
+	rejections := []struct {
+		name  string
+		token string
+	}{
+		{"no token", ""},
+		{"forged token", signToken(t, auth.Claims{UserID: "x", RoomID: "room"}) + "x"},
+		{"token for another room", signToken(t, auth.Claims{UserID: "x", RoomID: "other"})},
+	}
+	for _, rejection := range rejections {
+		_, err := h.tryJoin("x", peerOptions{token: rejection.token})
+		var rejected *client.JoinRejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != string(signaling.JoinRejectedInvalidToken) {
+			t.Fatalf("%s: join returned %v, want it rejected for an invalid token", rejection.name, err)
+		}
+	}
+	if ids := h.srv.getRouter("room").GetPeerIDs(); len(ids) != 0 {
+		t.Fatalf("rejected peers were added to the room: %v", ids)
+	}
+
+	a := h.join("a", peerOptions{token: signToken(t, auth.Claims{UserID: "a", RoomID: "room"})})
+	b := h.join("b", peerOptions{token: signToken(t, auth.Claims{UserID: "b", RoomID: "room"})})
+	a.waitForMedia(t, "b", 20)
+	b.waitForMedia(t, "a", 20)
+}
+
+func TestJoinRole(t *testing.T) {
+	open := &defaultServer{}
+	required := &defaultServer{config: Config{Tokens: auth.NewVerifier(testSecret)}}
+	tests := []struct {
+		name   string
+		srv    *defaultServer
+		claims *auth.Claims
+		want   sfu.Role
+	}{
+		{"no tokens configured", open, nil, sfu.RolePanelist},
+		{"tokens required without claims", required, nil, sfu.RoleAttendee},
+		{"claims without a role", required, &auth.Claims{}, sfu.RolePanelist},
+		{"role claim", required, &auth.Claims{Role: string(sfu.RoleHost)}, sfu.RoleHost},
+	}
+	for _, tt := range tests {
+		if got, err := tt.srv.joinRole(tt.claims); err != nil || got != tt.want {
+			t.Errorf("%s: joinRole returned %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := required.joinRole(&auth.Claims{Role: "owner"}); err == nil {
+		t.Errorf("an unknown role was accepted")
+	}
+}
+
+func TestIntegrationStats(t *testing.T) {
+	h := newHarness(t, linkConditions{Latency: 20 * time.Millisecond})
+	h.srv.config.StatsInterval = 200 * time.Millisecond
+	a := h.join("a", peerOptions{})
+	b := h.join("b", peerOptions{})
+	a.waitForMedia(t, "b", 20)
+
+	var stats signaling.Stats
+	eventually(t, 5*time.Second, "a receiving the stats of its connection", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, msg := range a.messages {
+			if msg.Type == signaling.SignalMessageTypeStats && msg.ClientID == "a" && json.Unmarshal(msg.Payload, &stats) == nil &&
+				stats.BytesSent > 0 && stats.BytesReceived > 0 {
+				return true
+			}
+		}
+		return false
+	})
+	if stats.RoundTripTimeMs <= 0 {
+		t.Fatalf("stats have a round trip time of %vms", stats.RoundTripTimeMs)
+	}
+	b.Close()
+}
+
+func TestIntegrationOfferWithoutJoin(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Tokens = auth.NewVerifier(testSecret)
+	h.join("a", peerOptions{token: signToken(t, auth.Claims{UserID: "a", RoomID: "room"})})
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create a peer connection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("failed to add a transceiver: %v", err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("failed to create an offer: %v", err)
+	}
+
+	// Neither a client that never joined nor one that joined through another connection gets an answer
+	for _, id := range []string{"x", "a"} {
+		conn := h.dial()
+		sendSignal(t, conn, signaling.SignalMessageTypeOffer, id, signaling.SdpOffer{SDP: offer.SDP})
+		msg := readSignal(conn, signaling.SignalMessageTypeJoinRejected, 5*time.Second)
+		var rejected signaling.JoinRejected
+		if msg == nil || json.Unmarshal(msg.Payload, &rejected) != nil || rejected.Reason != signaling.JoinRejectedNotJoined {
+			t.Fatalf("offer for %s wasn't refused", id)
+		}
+	}
+	if ids := h.srv.getRouter("room").GetPeerIDs(); len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("room has peers %v, want a", ids)
+	}
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.ReconnectDelay = 3 * time.Second
+	a := h.join("a", peerOptions{})
+	b := h.join("b", peerOptions{})
+	a.waitForMedia(t, "b", 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.srv.Shutdown(ctx) }()
+
+	for _, p := range []*testPeer{a, b} {
+		eventually(t, 5*time.Second, p.id+" being told that the server drains", func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			for _, msg := range p.messages {
+				var draining signaling.ServerDraining
+				if msg.Type == signaling.SignalMessageTypeServerDraining && json.Unmarshal(msg.Payload, &draining) == nil {
+					return draining.ReconnectDelayMs == 3000
+				}
+			}
+			return false
+		})
+	}
+
+	// Newcomers are pointed elsewhere instead of joining
+	conn := h.dial()
+	sendSignal(t, conn, signaling.SignalMessageTypeJoin, "c", signaling.Join{Name: "c"})
+	if readSignal(conn, signaling.SignalMessageTypeServerDraining, 5*time.Second) == nil {
+		t.Fatal("a join while draining wasn't refused")
+	}
+	if ids := h.srv.getRouter("room").GetPeerIDs(); len(ids) != 2 {
+		t.Fatalf("room has peers %v while draining, want a and b", ids)
+	}
+
+	// The drain ends once the clients left
+	a.Close()
+	b.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown returned %v after the rooms emptied", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Shutdown didn't return once the rooms emptied")
+	}
+}
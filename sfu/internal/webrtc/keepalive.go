@@ -0,0 +1,49 @@
+package webrtc
+
+import (
+	"time"
+
+	websocket "github.com/gorilla/websocket"
+)
+
+// Keepalive detects half-open signaling connections, e.g. a client whose network went away without closing
+// the TCP connection. A zero duration disables that part.
+type Keepalive struct {
+	// PingInterval is how often the writer pings the peer, it must be shorter than PongTimeout
+	PingInterval time.Duration
+	// PongTimeout is how long the peer may stay silent before the connection is considered dead
+	PongTimeout time.Duration
+	// WriteTimeout bounds every write, a peer that stops reading is dropped instead of blocking the writer
+	WriteTimeout time.Duration
+}
+
+func DefaultKeepalive() Keepalive {
+	return Keepalive{
+		PingInterval: 10 * time.Second,
+		PongTimeout:  30 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// watch makes reads on the connection fail once the peer stops answering pings and sending messages
+func (k Keepalive) watch(conn *websocket.Conn) {
+	k.alive(conn)
+	conn.SetPongHandler(func(string) error {
+		k.alive(conn)
+		return nil
+	})
+}
+
+// alive extends the read deadline, the peer was just heard from
+func (k Keepalive) alive(conn *websocket.Conn) {
+	if k.PongTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(k.PongTimeout))
+	}
+}
+
+func (k Keepalive) writeDeadline() time.Time {
+	if k.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(k.WriteTimeout)
+}
@@ -0,0 +1,291 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+	"slices"
+)
+
+// verifyJoin checks the token a client joins with. Without a verifier configured tokens are ignored and
+// nobody has moderator rights, with one every client needs a token.
+func (srv *defaultServer) verifyJoin(roomId string, join *signaling.Join) (*auth.Claims, error) {
+	if srv.config.Tokens == nil {
+		return nil, nil
+	}
+	if join.Token == "" {
+		return nil, errors.New("no token")
+	}
+	claims, err := srv.config.Tokens.Verify(join.Token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.RoomID != "" && claims.RoomID != roomId {
+		return nil, fmt.Errorf("token is for room %s", claims.RoomID)
+	}
+	return claims, nil
+}
+
+// verifyRelayJoin checks the token another node relays the room with. With a verifier configured only a
+// token signed for that node lets it relay, a client's token doesn't let it subscribe to every source.
+func (srv *defaultServer) verifyRelayJoin(roomId string, relayJoin *signaling.RelayJoin) error {
+	if srv.config.Tokens == nil {
+		return nil
+	}
+	if relayJoin.Token == "" {
+		return errors.New("no token")
+	}
+	claims, err := srv.config.Tokens.Verify(relayJoin.Token)
+	if err != nil {
+		return err
+	}
+	if claims.NodeID == "" || claims.NodeID != relayJoin.NodeID {
+		return fmt.Errorf("token isn't for node %s", relayJoin.NodeID)
+	}
+	if claims.RoomID != "" && claims.RoomID != roomId {
+		return fmt.Errorf("token is for room %s", claims.RoomID)
+	}
+	return nil
+}
+
+// joinRole returns the role the claims give the client, clients without a role claim are panelists. When
+// tokens are required a client without claims only gets to watch.
+func (srv *defaultServer) joinRole(claims *auth.Claims) (sfu.Role, error) {
+	if claims == nil && srv.config.Tokens != nil {
+		return sfu.RoleAttendee, nil
+	}
+	if claims == nil || claims.Role == "" {
+		return sfu.RolePanelist, nil
+	}
+	role := sfu.Role(claims.Role)
+	if !role.Valid() {
+		return "", fmt.Errorf("unknown role %q", claims.Role)
+	}
+	return role, nil
+}
+
+// moderates reports whether the claims give moderator rights, hosts have them as well
+func moderates(claims *auth.Claims) bool {
+	return claims != nil && (claims.Moderator || sfu.Role(claims.Role) == sfu.RoleHost)
+}
+
+func (s *session) sendJoinRejected(id string, reason signaling.JoinRejectedReason) {
+	payload, err := json.Marshal(signaling.JoinRejected{Reason: reason})
+	if err != nil {
+		log.Printf("Error marshaling the JoinRejected payload for peer %s", id)
+		return
+	}
+	s.writer.WriteJSON(signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypeJoinRejected,
+		ClientID: id,
+		Payload:  payload,
+	})
+}
+
+func (s *session) setClaims(id string, claims *auth.Claims) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if claims == nil {
+		delete(s.claims, id)
+		return
+	}
+	s.claims[id] = claims
+}
+
+// isModerator reports whether the client joined the room with moderator rights through this session
+func (s *session) isModerator(id string, roomId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[id] == roomId && moderates(s.claims[id])
+}
+
+// sessionOf finds the session the client signals through
+func (srv *defaultServer) sessionOf(id string) *session {
+	for _, sess := range srv.getSessions() {
+		sess.mu.Lock()
+		_, exists := sess.clients[id]
+		sess.mu.Unlock()
+		if exists {
+			return sess
+		}
+	}
+	return nil
+}
+
+// handleModeratorAction applies a moderator's message to the room and tells the participants it targets
+func (s *session) handleModeratorAction(msg *signaling.SignalMessage, router sfu.Router) error {
+	if !s.isModerator(msg.ClientID, msg.RoomID) {
+		return fmt.Errorf("client %s is not a moderator of room %s", msg.ClientID, msg.RoomID)
+	}
+
+	if msg.Type == signaling.SignalMessageTypeWaitingRoom {
+		var waitingRoom signaling.WaitingRoom
+		if err := json.Unmarshal(msg.Payload, &waitingRoom); err != nil {
+			return fmt.Errorf("failed to unmarshal waitingRoom payload: %w", err)
+		}
+		router.SetWaitingRoom(waitingRoom.Enabled, waitingRoom.LobbyPeerID)
+		log.Printf("Room %s waiting room enabled: %v", msg.RoomID, waitingRoom.Enabled)
+		if !waitingRoom.Enabled {
+			// Nobody would be left to admit them
+			for _, id := range router.GetWaitingPeerIDs() {
+				s.admit(msg.RoomID, router, id)
+			}
+		}
+		return nil
+	}
+
+	if msg.Type == signaling.SignalMessageTypeLockRoom {
+		var lock signaling.LockRoom
+		if err := json.Unmarshal(msg.Payload, &lock); err != nil {
+			return fmt.Errorf("failed to unmarshal lockRoom payload: %w", err)
+		}
+		router.SetLocked(lock.Locked)
+		log.Printf("Room %s locked: %v", msg.RoomID, lock.Locked)
+		return nil
+	}
+
+	if msg.Type == signaling.SignalMessageTypeMoveParticipant {
+		return s.handleMoveParticipant(msg)
+	}
+	if msg.Type == signaling.SignalMessageTypeCloseBreakouts {
+		s.handleCloseBreakouts(msg)
+		return nil
+	}
+	if msg.Type == signaling.SignalMessageTypeStartPlayback || msg.Type == signaling.SignalMessageTypeStopPlayback {
+		return s.handlePlayback(msg)
+	}
+
+	var action signaling.ModeratorAction
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &action); err != nil {
+			return fmt.Errorf("failed to unmarshal %s payload: %w", msg.Type, err)
+		}
+	}
+
+	switch msg.Type {
+	case signaling.SignalMessageTypeMuteParticipant:
+		return s.moderateStream(msg, router, action.PeerID, sfu.StreamAudio, action.Release)
+
+	case signaling.SignalMessageTypeMuteAll:
+		for _, id := range router.GetPeerIDs() {
+			if id == msg.ClientID {
+				continue
+			}
+			if err := s.moderateStream(msg, router, id, sfu.StreamAudio, action.Release); err != nil {
+				log.Printf("Failed to mute %s: %v", id, err)
+			}
+		}
+		return nil
+
+	case signaling.SignalMessageTypeStopVideo:
+		return s.moderateStream(msg, router, action.PeerID, sfu.StreamVideo, action.Release)
+
+	case signaling.SignalMessageTypeStopScreenShare:
+		return s.moderateStream(msg, router, action.PeerID, sfu.StreamScreen, action.Release)
+
+	case signaling.SignalMessageTypeAdmit:
+		return s.admit(msg.RoomID, router, action.PeerID)
+
+	case signaling.SignalMessageTypeDeny:
+		if !slices.Contains(router.GetWaitingPeerIDs(), action.PeerID) {
+			return fmt.Errorf("peer %s is not waiting", action.PeerID)
+		}
+		s.srv.sendAdmission(action.PeerID, signaling.AdmissionDenied)
+		s.srv.exitClient(s, action.PeerID, msg.RoomID)
+		log.Printf("Moderator %s denied %s entry to room %s", msg.ClientID, action.PeerID, msg.RoomID)
+		return nil
+
+	case signaling.SignalMessageTypePromote:
+		return s.changeRole(msg, router, action.PeerID, sfu.RolePanelist)
+
+	case signaling.SignalMessageTypeDemote:
+		return s.changeRole(msg, router, action.PeerID, sfu.RoleAttendee)
+
+	case signaling.SignalMessageTypeRemoveParticipant:
+		if router.GetPeerConnection(action.PeerID) == nil {
+			return fmt.Errorf("PeerConnection with id %s does not exist", action.PeerID)
+		}
+		// Tell the participant before its writer is unbound
+		s.notifyModerated(msg, action.PeerID)
+		s.srv.exitClient(s, action.PeerID, msg.RoomID)
+		log.Printf("Moderator %s removed %s from room %s", msg.ClientID, action.PeerID, msg.RoomID)
+		return nil
+	}
+	return fmt.Errorf("unknown moderator action %s", msg.Type)
+}
+
+// exitClient removes the client from the room through the session it signals on
+func (srv *defaultServer) exitClient(fallback *session, id string, roomId string) {
+	target := srv.sessionOf(id)
+	if target == nil {
+		target = fallback
+	}
+	target.handleExit(id, roomId, "")
+}
+
+// changeRole moves a participant onto or off the stage. Its publish transceivers are added or stopped,
+// and its PeerConnection renegotiated.
+func (s *session) changeRole(msg *signaling.SignalMessage, router sfu.Router, target string, role sfu.Role) error {
+	current := router.GetRole(target)
+	if current == sfu.RoleHost {
+		return fmt.Errorf("the role of host %s can't be changed", target)
+	}
+	pc := router.GetPeerConnection(target)
+	if pc == nil {
+		return fmt.Errorf("PeerConnection with id %s does not exist", target)
+	}
+	targetSess := s.srv.sessionOf(target)
+	if targetSess == nil {
+		return fmt.Errorf("no signaling connection for client %s", target)
+	}
+	if err := router.SetRole(target, role); err != nil {
+		return err
+	}
+	// Tell the participant before the offer arrives
+	s.notifyModerated(msg, target)
+	switch {
+	case role.Publishes() && !current.Publishes():
+		if err := targetSess.addPublishTransceivers(msg.RoomID, target, pc); err != nil {
+			return err
+		}
+	case !role.Publishes() && current.Publishes():
+		router.StopPublishing(target)
+		targetSess.stopPublishTransceivers(target, pc)
+	}
+	log.Printf("Moderator %s changed the role of %s to %s", msg.ClientID, target, role)
+	return nil
+}
+
+// moderateStream stops or resumes a stream of the target and tells the target
+func (s *session) moderateStream(msg *signaling.SignalMessage, router sfu.Router, target string, stream sfu.PublisherStream, release bool) error {
+	if err := router.MuteStream(target, stream, !release); err != nil {
+		return err
+	}
+	s.notifyModerated(msg, target)
+	log.Printf("Moderator %s set %s of %s muted: %v", msg.ClientID, stream, target, !release)
+	return nil
+}
+
+func (s *session) notifyModerated(msg *signaling.SignalMessage, target string) {
+	var action signaling.ModeratorAction
+	if len(msg.Payload) > 0 {
+		json.Unmarshal(msg.Payload, &action)
+	}
+	action.PeerID = target
+	action.By = msg.ClientID
+	payload, err := json.Marshal(action)
+	if err != nil {
+		log.Printf("Error marshaling the %s payload for peer %s", msg.Type, target)
+		return
+	}
+	s.srv.writeTo(target, signaling.SignalMessage{
+		Type:     msg.Type,
+		ClientID: target,
+		RoomID:   msg.RoomID,
+		Payload:  payload,
+	})
+}
@@ -0,0 +1,99 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"sfu/internal/auth"
+	"sfu/pkg/client"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// waitForMessage waits until the peer received a message of the type and returns the latest
+func (p *testPeer) waitForMessage(t *testing.T, msgType signaling.SignalMessageType) signaling.SignalMessage {
+	t.Helper()
+	var found signaling.SignalMessage
+	eventually(t, 5*time.Second, p.id+" receiving "+string(msgType), func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i := len(p.messages) - 1; i >= 0; i-- {
+			if p.messages[i].Type == msgType {
+				found = p.messages[i]
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+func TestIntegrationModeratorControls(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	m, peers := joinModerated(t, h, "a", "b")
+	a, b := peers[0], peers[1]
+	m.waitForMedia(t, "a", 10)
+	m.waitForMedia(t, "b", 10)
+
+	// Participants can't moderate each other
+	a.send(t, signaling.SignalMessageTypeMuteParticipant, signaling.ModeratorAction{PeerID: "b"})
+	time.Sleep(500 * time.Millisecond)
+	if m.receivedWithin("b", webrtc.RTPCodecTypeAudio, time.Second) == 0 {
+		t.Fatal("a participant muted another")
+	}
+
+	m.send(t, signaling.SignalMessageTypeMuteParticipant, signaling.ModeratorAction{PeerID: "a"})
+	var action signaling.ModeratorAction
+	if msg := a.waitForMessage(t, signaling.SignalMessageTypeMuteParticipant); json.Unmarshal(msg.Payload, &action) != nil || action.By != "m" {
+		t.Fatalf("a was told it was muted by %q", action.By)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeAudio, time.Second); got != 0 {
+		t.Fatalf("b received %d audio packets of the muted a", got)
+	}
+	if b.receivedWithin("a", webrtc.RTPCodecTypeVideo, time.Second) == 0 {
+		t.Fatal("muting a stopped its video")
+	}
+
+	m.send(t, signaling.SignalMessageTypeMuteParticipant, signaling.ModeratorAction{PeerID: "a", Release: true})
+	eventually(t, 5*time.Second, "b receiving a's audio again", func() bool {
+		return b.receivedWithin("a", webrtc.RTPCodecTypeAudio, 200*time.Millisecond) > 0
+	})
+
+	m.send(t, signaling.SignalMessageTypeStopVideo, signaling.ModeratorAction{PeerID: "a"})
+	a.waitForMessage(t, signaling.SignalMessageTypeStopVideo)
+	time.Sleep(500 * time.Millisecond)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeVideo, time.Second); got != 0 {
+		t.Fatalf("b received %d video packets of a after its video was stopped", got)
+	}
+
+	// Everyone but the moderator
+	m.send(t, signaling.SignalMessageTypeMuteAll, nil)
+	b.waitForMessage(t, signaling.SignalMessageTypeMuteAll)
+	time.Sleep(500 * time.Millisecond)
+	if got := a.receivedWithin("b", webrtc.RTPCodecTypeAudio, time.Second); got != 0 {
+		t.Fatalf("a received %d audio packets of b after everyone was muted", got)
+	}
+	if a.receivedWithin("m", webrtc.RTPCodecTypeAudio, time.Second) == 0 {
+		t.Fatal("muting everyone muted the moderator")
+	}
+
+	m.send(t, signaling.SignalMessageTypeRemoveParticipant, signaling.ModeratorAction{PeerID: "b"})
+	b.waitForMessage(t, signaling.SignalMessageTypeRemoveParticipant)
+	a.waitForPeerExit(t, "b", 5*time.Second)
+	if inRoom(h, "room", "b") {
+		t.Fatal("b is still in the room")
+	}
+
+	m.send(t, signaling.SignalMessageTypeLockRoom, signaling.LockRoom{Locked: true})
+	eventually(t, 5*time.Second, "the room to be locked", h.srv.getRouter("room").IsLocked)
+	_, err := h.tryJoin("c", peerOptions{token: signToken(t, auth.Claims{UserID: "c", RoomID: "room"})})
+	var rejected *client.JoinRejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != string(signaling.JoinRejectedRoomLocked) {
+		t.Fatalf("join of a locked room returned %v, want it rejected", err)
+	}
+	// Moderators still get in
+	h.join("m2", peerOptions{token: signToken(t, auth.Claims{UserID: "m2", RoomID: "room", Moderator: true})})
+}
@@ -0,0 +1,63 @@
+package webrtc
+
+import (
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// receivedWithin counts the packets of the stream the peer receives over the period
+func (p *testPeer) receivedWithin(streamId string, kind webrtc.RTPCodecType, period time.Duration) int {
+	before := p.received(streamId, kind)
+	time.Sleep(period)
+	return p.received(streamId, kind) - before
+}
+
+func (p *testPeer) setMode(t *testing.T, mode sfu.SubscriberMode) {
+	t.Helper()
+	p.send(t, signaling.SignalMessageTypeSubscriberMode, signaling.SubscriberMode{Mode: string(mode)})
+	// Let the mode apply and the packets in flight arrive
+	time.Sleep(500 * time.Millisecond)
+}
+
+func TestIntegrationSubscriberModes(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	a := h.join("a", peerOptions{screenShare: true})
+	b := h.join("b", peerOptions{})
+	b.waitForMedia(t, "a", 20)
+
+	b.setMode(t, sfu.SubscriberModeAudioOnly)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeVideo, time.Second); got != 0 {
+		t.Fatalf("got %d video packets in audio only mode", got)
+	}
+	if b.receivedWithin("a", webrtc.RTPCodecTypeAudio, time.Second) == 0 {
+		t.Fatal("audio stopped in audio only mode")
+	}
+
+	// The 30fps camera sends a packet per frame at least, the slideshow a keyframe every few seconds
+	b.setMode(t, sfu.SubscriberModeLowData)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeVideo, 3*time.Second); got >= 30 {
+		t.Fatalf("got %d video packets in 3s in low data mode", got)
+	}
+
+	b.setMode(t, sfu.SubscriberModeScreenPriority)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeVideo, time.Second); got < 20 {
+		t.Fatalf("got %d camera packets without a screen share in screen priority mode", got)
+	}
+	a.startScreenShare()
+	eventually(t, 10*time.Second, "b receiving the screen share", func() bool {
+		return b.received("a-screen", webrtc.RTPCodecTypeVideo) >= 20
+	})
+	time.Sleep(500 * time.Millisecond)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeVideo, time.Second); got != 0 {
+		t.Fatalf("got %d camera packets during the screen share in screen priority mode", got)
+	}
+
+	b.setMode(t, sfu.SubscriberModeDefault)
+	if got := b.receivedWithin("a", webrtc.RTPCodecTypeVideo, time.Second); got < 20 {
+		t.Fatalf("got %d camera packets back in the default mode", got)
+	}
+}
@@ -0,0 +1,230 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sfu/pkg/signaling"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// negotiationDebounce collects bursts of track changes, e.g. a peer joining with camera, microphone and
+// screen share, into one offer
+const negotiationDebounce = 50 * time.Millisecond
+
+// negotiator serializes the offers and answers of one client's PeerConnection, with perfect negotiation
+// semantics when both sides offer at once. pion can't roll back a local offer, so with clients that declare
+// in their join that they roll back, the SFU is the impolite side: it ignores a colliding offer, and the
+// client rolls its own back, answers the SFU's and offers again. Browsers roll back implicitly when they
+// set a remote offer over their own, which the Electron app relies on and declares.
+// With other clients the SFU yields instead. Its renegotiation offers are only applied once answered, so
+// that a colliding offer of the client can replace them, and it offers again afterwards. pion names the
+// new m-lines when it creates the offer, so the client's offer mustn't add any: clients publish on the
+// transceivers the SFU offers.
+// Renegotiations requested while an offer is outstanding are coalesced into one offer once it is answered.
+type negotiator struct {
+	id     string
+	pc     *webrtc.PeerConnection
+	writer Writer
+	// The client doesn't roll back colliding offers, the SFU yields to them
+	yields bool
+	// Our renegotiation offer, sent to a yielding client's peer but not applied until it is answered
+	offered *webrtc.SessionDescription
+	// Held while the PeerConnection's descriptions change
+	sdpMu sync.Mutex
+	mu    sync.Mutex
+	timer *time.Timer
+	// A renegotiation is due once the signaling state is stable again
+	pending bool
+	// Offers wait until release, e.g. while the client is moved between rooms
+	held bool
+	// Remote candidates that arrived before the remote description
+	candidates []webrtc.ICECandidateInit
+	closed     bool
+}
+
+// negotiatorFor returns the client's negotiator, a new PeerConnection gets a new one
+func (s *session) negotiatorFor(id string, pc *webrtc.PeerConnection) *negotiator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, exists := s.negotiators[id]; exists && n.pc == pc {
+		return n
+	}
+	n := &negotiator{
+		id:         id,
+		pc:         pc,
+		writer:     s.writer,
+		yields:     !s.rollbacks[id],
+		candidates: s.candidates[id],
+	}
+	delete(s.candidates, id)
+	if previous, exists := s.negotiators[id]; exists {
+		previous.close()
+	}
+	s.negotiators[id] = n
+	return n
+}
+
+// negotiate schedules an offer, the requests that arrive before it is sent share it
+func (n *negotiator) negotiate() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed || n.timer != nil {
+		return
+	}
+	n.timer = time.AfterFunc(negotiationDebounce, n.offer)
+}
+
+func (n *negotiator) offer() {
+	n.mu.Lock()
+	n.timer = nil
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	if n.held {
+		n.pending = true
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	n.sdpMu.Lock()
+	defer n.sdpMu.Unlock()
+	if n.pc.SignalingState() != webrtc.SignalingStateStable || n.offered != nil {
+		// The outstanding offer is answered first
+		n.mu.Lock()
+		n.pending = true
+		n.mu.Unlock()
+		return
+	}
+
+	offer, err := n.pc.CreateOffer(nil)
+	if err != nil {
+		fmt.Printf("Failed to create offer: %v\n", err)
+		return
+	}
+
+	// The first offer is applied right away, gathering starts with it and the client has nothing to offer yet
+	if n.yields && n.pc.CurrentLocalDescription() != nil {
+		n.offered = &offer
+	} else if err := n.pc.SetLocalDescription(offer); err != nil {
+		fmt.Printf("Failed to set local description: %v\n", err)
+		return
+	}
+
+	payload, _ := json.Marshal(signaling.SdpOffer{SDP: offer.SDP})
+	n.writer.WriteJSON(signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypeOffer,
+		ClientID: n.id,
+		Payload:  payload,
+	})
+}
+
+// answer applies the client's offer and returns the answer to send. A nil answer means the offer collided
+// with the SFU's and was ignored.
+func (n *negotiator) answer(sdp string) (*webrtc.SessionDescription, error) {
+	n.sdpMu.Lock()
+	defer n.resume()
+	defer n.sdpMu.Unlock()
+
+	if n.offered != nil {
+		// Ours was never applied, it's dropped and sent again once this one is answered
+		log.Printf("Yielding to the offer of %s, it collided with ours", n.id)
+		n.offered = nil
+		n.mu.Lock()
+		n.pending = true
+		n.mu.Unlock()
+	} else if n.pc.SignalingState() != webrtc.SignalingStateStable {
+		// The client rolls back and answers ours, then offers again
+		log.Printf("Ignoring offer of %s, it collided with ours", n.id)
+		return nil, nil
+	}
+
+	err := n.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set remote description: %w", err)
+	}
+	n.flushCandidates()
+
+	// Create an answer
+	answer, err := n.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	// Set the local description
+	err = n.pc.SetLocalDescription(answer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set local description: %w", err)
+	}
+	return &answer, nil
+}
+
+// accept applies the client's answer to our offer
+func (n *negotiator) accept(sdp string) error {
+	n.sdpMu.Lock()
+	defer n.resume()
+	defer n.sdpMu.Unlock()
+
+	if n.offered != nil {
+		offer := *n.offered
+		n.offered = nil
+		if err := n.pc.SetLocalDescription(offer); err != nil {
+			return fmt.Errorf("failed to set local description: %w", err)
+		}
+	}
+	if n.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		// A stale answer, e.g. sent twice
+		log.Printf("Ignoring answer of %s, no offer is outstanding", n.id)
+		return nil
+	}
+	err := n.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp})
+	if err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+	n.flushCandidates()
+	return nil
+}
+
+// resume sends the renegotiation that waited for the signaling state to become stable
+func (n *negotiator) resume() {
+	n.mu.Lock()
+	due := n.pending && !n.held
+	if due {
+		n.pending = false
+	}
+	n.mu.Unlock()
+	if due {
+		n.negotiate()
+	}
+}
+
+// hold defers the offers until release
+func (n *negotiator) hold() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.held = true
+}
+
+// release sends one offer covering every change made while the offers were held
+func (n *negotiator) release() {
+	n.mu.Lock()
+	n.held = false
+	n.pending = false
+	n.mu.Unlock()
+	n.negotiate()
+}
+
+func (n *negotiator) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+}
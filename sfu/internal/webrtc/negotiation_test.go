@@ -0,0 +1,191 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sfu/pkg/signaling"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// offerWriter collects the offers a negotiator sends
+type offerWriter struct {
+	offers chan string
+}
+
+func (w *offerWriter) Close() {}
+
+func (w *offerWriter) Stats() WriterStats { return WriterStats{} }
+
+func (w *offerWriter) WriteJSON(msg any) {
+	signalMsg, ok := msg.(signaling.SignalMessage)
+	if !ok || signalMsg.Type != signaling.SignalMessageTypeOffer {
+		return
+	}
+	var offer signaling.SdpOffer
+	json.Unmarshal(signalMsg.Payload, &offer)
+	w.offers <- offer.SDP
+}
+
+func (w *offerWriter) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case sdp := <-w.offers:
+		return sdp
+	case <-time.After(2 * time.Second):
+		t.Fatal("no offer was sent")
+		return ""
+	}
+}
+
+func (w *offerWriter) none(t *testing.T, within time.Duration) {
+	t.Helper()
+	select {
+	case <-w.offers:
+		t.Fatal("an extra offer was sent")
+	case <-time.After(within):
+	}
+}
+
+func newTestPeerConnection(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create a peer connection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func addSendTransceiver(t *testing.T, pc *webrtc.PeerConnection) {
+	t.Helper()
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("failed to add a transceiver: %v", err)
+	}
+}
+
+// answerOffer plays the client, answering the SFU's offer
+func answerOffer(t *testing.T, client *webrtc.PeerConnection, sdp string) string {
+	t.Helper()
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		t.Fatalf("client failed to set the offer: %v", err)
+	}
+	answer, err := client.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("client failed to answer: %v", err)
+	}
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatalf("client failed to set its answer: %v", err)
+	}
+	return answer.SDP
+}
+
+// negotiated returns a negotiator whose first offer the client answered
+func negotiated(t *testing.T, yields bool) (*negotiator, *offerWriter, *webrtc.PeerConnection) {
+	t.Helper()
+	writer := &offerWriter{offers: make(chan string, 16)}
+	n := &negotiator{id: "a", pc: newTestPeerConnection(t), writer: writer, yields: yields}
+	t.Cleanup(n.close)
+	client := newTestPeerConnection(t)
+	addSendTransceiver(t, n.pc)
+	n.negotiate()
+	if err := n.accept(answerOffer(t, client, writer.next(t))); err != nil {
+		t.Fatalf("failed to accept the answer: %v", err)
+	}
+	return n, writer, client
+}
+
+func TestNegotiatorDebounce(t *testing.T) {
+	n, writer, _ := negotiated(t, false)
+	// A burst of track changes is one offer
+	for i := 0; i < 3; i++ {
+		addSendTransceiver(t, n.pc)
+		n.negotiate()
+	}
+	writer.next(t)
+	writer.none(t, 5*negotiationDebounce)
+
+	// Requested while that offer is outstanding, the next one waits for the answer
+	n.negotiate()
+	writer.none(t, 5*negotiationDebounce)
+}
+
+func TestNegotiatorCoalescesOnceAnswered(t *testing.T) {
+	n, writer, client := negotiated(t, false)
+	addSendTransceiver(t, n.pc)
+	n.negotiate()
+	offer := writer.next(t)
+	addSendTransceiver(t, n.pc)
+	n.negotiate()
+	n.negotiate()
+	if err := n.accept(answerOffer(t, client, offer)); err != nil {
+		t.Fatalf("failed to accept the answer: %v", err)
+	}
+	writer.next(t)
+	writer.none(t, 5*negotiationDebounce)
+}
+
+func TestNegotiatorGlare(t *testing.T) {
+	tests := []struct {
+		name   string
+		yields bool
+	}{
+		{"client rolls back", false},
+		{"client doesn't roll back", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, writer, client := negotiated(t, tt.yields)
+			addSendTransceiver(t, n.pc)
+			n.negotiate()
+			ours := writer.next(t)
+
+			// The client renegotiates at the same time, e.g. to start its screen share
+			theirs, err := client.CreateOffer(nil)
+			if err != nil {
+				t.Fatalf("client failed to offer: %v", err)
+			}
+			answer, err := n.answer(theirs.SDP)
+			if err != nil {
+				t.Fatalf("the colliding offer failed: %v", err)
+			}
+
+			if !tt.yields {
+				if answer != nil {
+					t.Fatal("the SFU answered a colliding offer instead of expecting a rollback")
+				}
+				// pion can't roll back, the client never applying its offer leaves it in the same state
+				if err := n.accept(answerOffer(t, client, ours)); err != nil {
+					t.Fatalf("failed to accept the answer: %v", err)
+				}
+				if state := n.pc.SignalingState(); state != webrtc.SignalingStateStable {
+					t.Fatalf("signaling state is %s after the glare", state)
+				}
+				return
+			}
+			if err := client.SetLocalDescription(theirs); err != nil {
+				t.Fatalf("client failed to set its offer: %v", err)
+			}
+
+			// The client can't take ours, the SFU answers the client and offers again
+			if answer == nil {
+				t.Fatal("the SFU ignored the offer of a client that can't roll back")
+			}
+			if err := client.SetRemoteDescription(*answer); err != nil {
+				t.Fatalf("client failed to set the answer: %v", err)
+			}
+			if err := n.accept(answerOffer(t, client, writer.next(t))); err != nil {
+				t.Fatalf("failed to accept the answer to the second offer: %v", err)
+			}
+			if state := n.pc.SignalingState(); state != webrtc.SignalingStateStable {
+				t.Fatalf("signaling state is %s after the glare", state)
+			}
+			// The transceiver of the dropped offer was in the second one
+			if got, want := strings.Count(n.pc.CurrentLocalDescription().SDP, "m=video"), len(n.pc.GetTransceivers()); got != want {
+				t.Fatalf("got %d negotiated transceivers, want %d", got, want)
+			}
+		})
+	}
+}
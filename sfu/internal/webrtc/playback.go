@@ -0,0 +1,383 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/client"
+	"sfu/pkg/signaling"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// playbackJoinTimeout bounds how long a bot may take to connect to its room
+const playbackJoinTimeout = 15 * time.Second
+
+// playback is a bot that joins a room through our own signaling endpoint like any client, so that it shows
+// up as a regular broadcaster with its display name
+type playback struct {
+	id     string
+	roomId string
+	// The moderator told about the end of the playback, empty when it was started over HTTP
+	requester string
+	client    client.Client
+	cancel    context.CancelFunc
+}
+
+// startPlayback joins a bot that plays the files into the room and returns its peer id once it is connected
+func (srv *defaultServer) startPlayback(roomId string, requester string, request *signaling.StartPlayback) (string, error) {
+	if srv.config.MediaDir == "" || srv.config.PlaybackURL == "" {
+		return "", errors.New("playback is disabled, no media directory is configured")
+	}
+	if srv.isDraining() {
+		return "", errors.New("server is draining")
+	}
+	id, err := playbackID()
+	if err != nil {
+		return "", err
+	}
+	sources, err := srv.playbackSources(id, request.Files, request.Loop)
+	if err != nil {
+		return "", err
+	}
+	name := request.Name
+	if name == "" {
+		name = "Playback"
+	}
+	token, err := srv.playbackToken(roomId, id)
+	if err != nil {
+		closeSources(sources)
+		return "", err
+	}
+
+	api, err := srv.playbackAPI()
+	if err != nil {
+		closeSources(sources)
+		return "", err
+	}
+	bot := client.NewClient(client.Config{
+		URL:        srv.config.PlaybackURL,
+		RoomID:     roomId,
+		ClientID:   id,
+		Name:       name,
+		Token:      token,
+		API:        api,
+		ICEServers: srv.config.ICEServers,
+	})
+	for _, source := range sources {
+		if err := bot.Publish(source.Track()); err != nil {
+			closeSources(sources)
+			return "", err
+		}
+	}
+	joinCtx, cancelJoin := context.WithTimeout(context.Background(), playbackJoinTimeout)
+	defer cancelJoin()
+	if err := bot.Join(joinCtx); err != nil {
+		closeSources(sources)
+		return "", fmt.Errorf("bot failed to join: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &playback{id: id, roomId: roomId, requester: requester, client: bot, cancel: cancel}
+	srv.mu.Lock()
+	srv.playbacks[id] = p
+	srv.mu.Unlock()
+	log.Printf("Playback %s (%s) joined room %s with %s", id, name, roomId, strings.Join(request.Files, ", "))
+
+	go srv.runPlayback(ctx, p, sources)
+	return id, nil
+}
+
+// playbackToken mints the token a bot joins with when tokens are required. It only lets the bot onto the
+// stage of its room and expires once the bot had its time to join.
+func (srv *defaultServer) playbackToken(roomId string, id string) (string, error) {
+	if srv.config.Tokens == nil {
+		return "", nil
+	}
+	if srv.config.Signer == nil {
+		return "", errors.New("playback needs the JWT secret to sign the bots' tokens")
+	}
+	return srv.config.Signer.Sign(&auth.Claims{
+		UserID:    auth.ID(id),
+		RoomID:    roomId,
+		Role:      string(sfu.RolePanelist),
+		ExpiresAt: time.Now().Add(playbackJoinTimeout).Unix() + 1,
+	})
+}
+
+// playbackAPI gives the bots pion's default codecs and the transport settings of the SFU's own
+// PeerConnections, the bots run on the same host
+func (srv *defaultServer) playbackAPI() (*webrtc.API, error) {
+	if srv.config.SettingEngine == nil {
+		return nil, nil
+	}
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(*srv.config.SettingEngine)), nil
+}
+
+// runPlayback plays the sources until they end, the playback is stopped or the bot loses its connection
+func (srv *defaultServer) runPlayback(ctx context.Context, p *playback, sources []client.Source) {
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := source.Run(ctx); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+				log.Printf("Playback %s failed: %v", p.id, err)
+			}
+		}()
+	}
+	ended := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ended)
+	}()
+
+	select {
+	case <-ended:
+	case <-ctx.Done():
+	case <-p.client.Done():
+	}
+	p.cancel()
+	p.client.Close()
+
+	srv.mu.Lock()
+	delete(srv.playbacks, p.id)
+	srv.mu.Unlock()
+	log.Printf("Playback %s left room %s", p.id, p.roomId)
+	if p.requester != "" {
+		srv.sendPlayback(p.requester, signaling.Playback{PeerID: p.id, State: signaling.PlaybackEnded})
+	}
+}
+
+// stopPlayback makes the bot leave, it must be playing in the room
+func (srv *defaultServer) stopPlayback(roomId string, id string) error {
+	srv.mu.Lock()
+	p, exists := srv.playbacks[id]
+	srv.mu.Unlock()
+	if !exists || p.roomId != roomId {
+		return fmt.Errorf("no playback %s in room %s", id, roomId)
+	}
+	p.cancel()
+	return nil
+}
+
+// stopPlaybacks makes every bot leave, e.g. so that the rooms can drain
+func (srv *defaultServer) stopPlaybacks() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, p := range srv.playbacks {
+		p.cancel()
+	}
+}
+
+// playbackSources opens the files in the media directory, at most one video and one audio source
+func (srv *defaultServer) playbackSources(id string, files []string, loop bool) ([]client.Source, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files to play")
+	}
+	var sources []client.Source
+	fail := func(err error) ([]client.Source, error) {
+		closeSources(sources)
+		return nil, err
+	}
+	kinds := map[webrtc.RTPCodecType]bool{}
+	for _, file := range files {
+		// Requests may only name files inside the media directory
+		if !filepath.IsLocal(file) {
+			return fail(fmt.Errorf("invalid file name %q", file))
+		}
+		path := filepath.Join(srv.config.MediaDir, file)
+
+		var opened []client.Source
+		var err error
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".ivf":
+			var source client.Source
+			source, err = client.NewIVFSource(path, "video", id, loop)
+			opened = []client.Source{source}
+		case ".ogg", ".opus":
+			var source client.Source
+			source, err = client.NewOggSource(path, "audio", id, loop)
+			opened = []client.Source{source}
+		case ".webm":
+			opened, err = client.NewWebMSources(path, id, loop)
+		default:
+			err = errors.New("unsupported format, use IVF, Ogg Opus or WebM")
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to open %s: %w", file, err))
+		}
+		sources = append(sources, opened...)
+		for _, source := range opened {
+			kind := source.Track().Kind()
+			if kinds[kind] {
+				return fail(fmt.Errorf("more than one %s stream", kind))
+			}
+			kinds[kind] = true
+		}
+	}
+	return sources, nil
+}
+
+func closeSources(sources []client.Source) {
+	for _, source := range sources {
+		source.Close()
+	}
+}
+
+func playbackID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "playback-" + hex.EncodeToString(b), nil
+}
+
+func (srv *defaultServer) sendPlayback(id string, state signaling.Playback) {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Error marshaling the Playback payload for peer %s", id)
+		return
+	}
+	srv.writeTo(id, signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypePlayback,
+		ClientID: id,
+		Payload:  payload,
+	})
+}
+
+// handlePlayback starts or stops a bot for a moderator. Joining takes a while, so the outcome is sent
+// back once it is known rather than holding up the moderator's other messages.
+func (s *session) handlePlayback(msg *signaling.SignalMessage) error {
+	if msg.Type == signaling.SignalMessageTypeStopPlayback {
+		var stop signaling.StopPlayback
+		if err := json.Unmarshal(msg.Payload, &stop); err != nil {
+			return fmt.Errorf("failed to unmarshal stopPlayback payload: %w", err)
+		}
+		return s.srv.stopPlayback(msg.RoomID, stop.PeerID)
+	}
+
+	var start signaling.StartPlayback
+	if err := json.Unmarshal(msg.Payload, &start); err != nil {
+		return fmt.Errorf("failed to unmarshal startPlayback payload: %w", err)
+	}
+	go func() {
+		id, err := s.srv.startPlayback(msg.RoomID, msg.ClientID, &start)
+		if err != nil {
+			log.Printf("Failed to start playback for %s: %v", msg.ClientID, err)
+			s.srv.sendPlayback(msg.ClientID, signaling.Playback{State: signaling.PlaybackFailed, Error: err.Error()})
+			return
+		}
+		s.srv.sendPlayback(msg.ClientID, signaling.Playback{PeerID: id, State: signaling.PlaybackStarted})
+	}()
+	return nil
+}
+
+// playbackRequest is the body of a request to start a bot over HTTP
+type playbackRequest struct {
+	RoomID string `json:"roomId"`
+	signaling.StartPlayback
+}
+
+// HandlePlayback starts a bot on POST and stops it on DELETE ?roomId=&peerId=. The backend authorizes the
+// request with a bearer token that gives moderator rights for the room.
+func (srv *defaultServer) HandlePlayback(w http.ResponseWriter, r *http.Request) {
+	var roomId string
+	var request playbackRequest
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&request); err != nil {
+			http.Error(w, "invalid playback request", http.StatusBadRequest)
+			return
+		}
+		roomId = request.RoomID
+	case http.MethodDelete:
+		roomId = r.URL.Query().Get("roomId")
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if roomId == "" {
+		http.Error(w, "roomId is missing", http.StatusBadRequest)
+		return
+	}
+	if err := srv.authorizeModerator(r, roomId); err != nil {
+		log.Printf("Refusing playback request for room %s: %v", roomId, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := srv.stopPlayback(roomId, r.URL.Query().Get("peerId")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id, err := srv.startPlayback(roomId, "", &request.StartPlayback)
+	if err != nil {
+		log.Printf("Failed to start playback in room %s: %v", roomId, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(signaling.Playback{PeerID: id, State: signaling.PlaybackStarted})
+}
+
+// authorizeModerator checks the bearer token of an HTTP request of the backend, e.g. to start a bot. Like
+// the moderator actions, nobody may make them without a verifier configured.
+func (srv *defaultServer) authorizeModerator(r *http.Request, roomId string) error {
+	claims, err := srv.authorize(r, roomId)
+	if err != nil {
+		return err
+	}
+	if !moderates(claims) {
+		return errors.New("token gives no moderator rights")
+	}
+	return nil
+}
+
+// authorize checks that the bearer token of an HTTP request is valid for the room
+func (srv *defaultServer) authorize(r *http.Request, roomId string) (*auth.Claims, error) {
+	if srv.config.Tokens == nil {
+		return nil, errors.New("authorized requests need the JWT secret to be configured")
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil, errors.New("bearer token is missing")
+	}
+	claims, err := srv.config.Tokens.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.RoomID != "" && claims.RoomID != roomId {
+		return nil, fmt.Errorf("token is for room %s", claims.RoomID)
+	}
+	return claims, nil
+}
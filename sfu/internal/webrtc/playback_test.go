@@ -0,0 +1,228 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// VP8 frames the SFU accepts, see client.NewGeneratedVideo
+var (
+	testKeyFrame   = []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00}
+	testDeltaFrame = []byte{0x11, 0x00, 0x00}
+	testOpusFrame  = []byte{0xf8, 0xff, 0xfe}
+)
+
+func testVideoFrame(i int) []byte {
+	if i%30 == 0 {
+		return testKeyFrame
+	}
+	return testDeltaFrame
+}
+
+// writeIVF writes seconds of 30 fps VP8
+func writeIVF(t *testing.T, path string, seconds int) {
+	t.Helper()
+	writer, err := ivfwriter.New(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	for i := 0; i < 30*seconds; i++ {
+		// The VP8 payload descriptor marks the start of the frame
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: uint16(i), Timestamp: uint32(i * 3000)},
+			Payload: append([]byte{0x10}, testVideoFrame(i)...),
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	writer.Close()
+}
+
+// writeOgg writes seconds of 20ms Opus frames
+func writeOgg(t *testing.T, path string, seconds int) {
+	t.Helper()
+	writer, err := oggwriter.New(path, 48000, 2)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	for i := 0; i < 50*seconds; i++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: testOpusFrame,
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	writer.Close()
+}
+
+// Matroska element ids of the test WebM files
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDTracks        = 0x1654AE6B
+	ebmlIDTrackEntry    = 0xAE
+	ebmlIDTrackNumber   = 0xD7
+	ebmlIDCodecID       = 0x86
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecode      = 0xE7
+	ebmlIDSimpleBlock   = 0xA3
+)
+
+// ebmlElement encodes an element, the size of segments and clusters may be left unknown
+func ebmlElement(id uint32, data []byte, unknownSize bool) []byte {
+	var out bytes.Buffer
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	out.Write(bytes.TrimLeft(idBytes, "\x00"))
+	if unknownSize {
+		out.WriteByte(0xff)
+	} else {
+		// Eight byte sizes fit every element
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(len(data)))
+		size[0] = 0x01
+		out.Write(size)
+	}
+	out.Write(data)
+	return out.Bytes()
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return ebmlElement(id, data, false)
+}
+
+func simpleBlock(track byte, relative int16, frame []byte) []byte {
+	data := []byte{0x80 | track, 0, 0, 0x80}
+	binary.BigEndian.PutUint16(data[1:], uint16(relative))
+	return ebmlElement(ebmlIDSimpleBlock, append(data, frame...), false)
+}
+
+// writeWebM writes seconds of VP8 and Opus the way a recorder does, with a segment of unknown size and one
+// cluster per second
+func writeWebM(t *testing.T, path string, seconds int) {
+	t.Helper()
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	header := ebmlElement(ebmlIDHeader, ebmlElement(0x4282, []byte("webm"), false), false)
+	info := ebmlElement(ebmlIDInfo, ebmlUint(ebmlIDTimecodeScale, 1000000), false)
+	tracks := ebmlElement(ebmlIDTracks, concat(
+		ebmlElement(ebmlIDTrackEntry, concat(ebmlUint(ebmlIDTrackNumber, 1), ebmlElement(ebmlIDCodecID, []byte("V_VP8"), false)), false),
+		ebmlElement(ebmlIDTrackEntry, concat(ebmlUint(ebmlIDTrackNumber, 2), ebmlElement(ebmlIDCodecID, []byte("A_OPUS"), false)), false),
+	), false)
+
+	var clusters []byte
+	for second := 0; second < seconds; second++ {
+		blocks := ebmlUint(ebmlIDTimecode, uint64(second*1000))
+		video, audio := 0, 0
+		// Interleaved by time, 30 video and 50 audio frames
+		for video < 30 || audio < 50 {
+			if video < 30 && (audio >= 50 || video*1000/30 <= audio*20) {
+				blocks = append(blocks, simpleBlock(1, int16(video*1000/30), testVideoFrame(second*30+video))...)
+				video++
+			} else {
+				blocks = append(blocks, simpleBlock(2, int16(audio*20), testOpusFrame)...)
+				audio++
+			}
+		}
+		clusters = append(clusters, ebmlElement(ebmlIDCluster, blocks, false)...)
+	}
+	segment := ebmlElement(ebmlIDSegment, concat(info, tracks, clusters), true)
+	if err := os.WriteFile(path, concat(header, segment), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestIntegrationPlayback(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	writeWebM(t, filepath.Join(h.mediaDir, "music.webm"), 2)
+	writeIVF(t, filepath.Join(h.mediaDir, "announcement.ivf"), 1)
+	writeOgg(t, filepath.Join(h.mediaDir, "announcement.ogg"), 1)
+	a := h.join("a", peerOptions{noMedia: true})
+
+	// A looping bot plays until it is stopped
+	music, err := h.srv.startPlayback("room", "", &signaling.StartPlayback{
+		Name:  "Hold music",
+		Files: []string{"music.webm"},
+		Loop:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to start playback: %v", err)
+	}
+	if name := h.srv.getRouter("room").GetName(music); name != "Hold music" {
+		t.Fatalf("bot joined as %q, want Hold music", name)
+	}
+	// Past the end of the file
+	a.waitForMedia(t, music, 150)
+
+	// A bot without loop leaves once its files ended
+	announcement, err := h.srv.startPlayback("room", "", &signaling.StartPlayback{
+		Name:  "Announcement",
+		Files: []string{"announcement.ivf", "announcement.ogg"},
+	})
+	if err != nil {
+		t.Fatalf("failed to start playback: %v", err)
+	}
+	a.waitForMedia(t, announcement, 10)
+	a.waitForPeerExit(t, announcement, 5*time.Second)
+	if got := a.received(announcement, webrtc.RTPCodecTypeAudio); got > 60 {
+		t.Fatalf("got %d audio packets of a one second announcement", got)
+	}
+
+	if err := h.srv.stopPlayback("other", music); err == nil {
+		t.Fatal("stopped a playback of another room")
+	}
+	if err := h.srv.stopPlayback("room", music); err != nil {
+		t.Fatalf("failed to stop playback: %v", err)
+	}
+	a.waitForPeerExit(t, music, 5*time.Second)
+
+	for _, files := range [][]string{
+		{"../music.webm"},
+		{"missing.ivf"},
+		{"music.webm", "announcement.ivf"},
+	} {
+		if _, err := h.srv.startPlayback("room", "", &signaling.StartPlayback{Files: files}); err == nil {
+			t.Fatalf("started a playback of %v", files)
+		}
+	}
+}
+
+func TestIntegrationPlaybackToken(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Tokens = auth.NewVerifier(testSecret)
+	writeIVF(t, filepath.Join(h.mediaDir, "announcement.ivf"), 1)
+	writeOgg(t, filepath.Join(h.mediaDir, "announcement.ogg"), 1)
+	a := h.join("a", peerOptions{noMedia: true, token: signToken(t, auth.Claims{UserID: "a", RoomID: "room"})})
+
+	if _, err := h.srv.startPlayback("room", "", &signaling.StartPlayback{Files: []string{"announcement.ivf", "announcement.ogg"}}); err == nil {
+		t.Fatal("started a playback without a way to sign the bot's token")
+	}
+
+	h.srv.config.Signer = auth.NewSigner(testSecret)
+	id, err := h.srv.startPlayback("room", "", &signaling.StartPlayback{Files: []string{"announcement.ivf", "announcement.ogg"}})
+	if err != nil {
+		t.Fatalf("failed to start playback: %v", err)
+	}
+	if role := h.srv.getRouter("room").GetRole(id); role != sfu.RolePanelist {
+		t.Fatalf("bot joined as %s, want %s", role, sfu.RolePanelist)
+	}
+	a.waitForMedia(t, id, 10)
+}
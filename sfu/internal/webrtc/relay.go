@@ -0,0 +1,331 @@
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// relayTokenLifetime bounds how long the token of a relay join is valid
+const relayTokenLifetime = time.Minute
+
+// relay connects a room on this node to the same room on an upstream SFU node. Upstream sources arrive on
+// one server-to-server PeerConnection and local sources leave on another, so that each of them only ever
+// has one offering side. The relay is registered as the writer of both of its client ids, which lets the
+// router notify the upstream node like any other subscriber.
+type relay struct {
+	srv    *defaultServer
+	roomId string
+	router sfu.Router
+	conn   *websocket.Conn
+	writer Writer
+	// The upstream node offers its sources on subPc, this node offers its own sources on pubPc
+	subId string
+	subPc *webrtc.PeerConnection
+	pubId string
+	pubPc *webrtc.PeerConnection
+	// Apply the descriptions of each PeerConnection and hold the candidates that arrive ahead of them
+	negotiators map[string]*negotiator
+	once        sync.Once
+}
+
+// startRelay dials the configured upstream node for the room unless a relay already exists
+func (srv *defaultServer) startRelay(roomId string, router sfu.Router) {
+	if srv.config.RelayURL == "" {
+		return
+	}
+	srv.mu.Lock()
+	if _, exists := srv.relays[roomId]; exists {
+		srv.mu.Unlock()
+		return
+	}
+	// Reserve the room while dialing so concurrent joins don't open a second relay
+	srv.relays[roomId] = nil
+	srv.mu.Unlock()
+
+	go func() {
+		rl, err := dialRelay(srv, srv.config.RelayURL, roomId, router)
+		srv.mu.Lock()
+		if err != nil {
+			log.Printf("Failed to relay room %s to %s: %v", roomId, srv.config.RelayURL, err)
+			delete(srv.relays, roomId)
+			srv.mu.Unlock()
+			return
+		}
+		srv.relays[roomId] = rl
+		srv.mu.Unlock()
+		// closeRelay found nothing to close if the room emptied while dialing
+		if len(router.GetPeerIDs()) == 0 {
+			rl.Close()
+		}
+	}()
+}
+
+// randomNodeID names a node that wasn't given an id, hostnames aren't unique among containers
+func randomNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "node-" + hex.EncodeToString(b)
+}
+
+func (srv *defaultServer) closeRelay(roomId string) {
+	srv.mu.Lock()
+	rl := srv.relays[roomId]
+	srv.mu.Unlock()
+	if rl != nil {
+		rl.Close()
+	}
+}
+
+func dialRelay(srv *defaultServer, url string, roomId string, router sfu.Router) (*relay, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream node: %w", err)
+	}
+
+	rl := &relay{
+		srv:    srv,
+		roomId: roomId,
+		router: router,
+		conn:   conn,
+		writer: CreateWriter(conn, srv.config.Keepalive),
+		subId:  "relay-" + srv.config.NodeID,
+		pubId:  "relay-" + srv.config.NodeID + "-publish",
+	}
+
+	if rl.subPc, err = srv.newPeerConnection(roomId); err != nil {
+		rl.writer.Close()
+		return nil, err
+	}
+	if rl.pubPc, err = srv.newPeerConnection(roomId); err != nil {
+		rl.subPc.Close()
+		rl.writer.Close()
+		return nil, err
+	}
+	rl.negotiators = map[string]*negotiator{
+		rl.subId: {id: rl.subId, pc: rl.subPc, writer: rl},
+		rl.pubId: {id: rl.pubId, pc: rl.pubPc, writer: rl},
+	}
+	rl.registerHandlers()
+
+	// Join both directions upstream before any offer can be sent for them
+	rl.sendRelayJoin(rl.subId, signaling.RelayDirectionSubscribe)
+	rl.sendRelayJoin(rl.pubId, signaling.RelayDirectionPublish)
+
+	srv.setWriter(rl.subId, rl)
+	srv.setWriter(rl.pubId, rl)
+	if err := router.AddRelayPublisher(rl.subId, rl.subPc); err != nil {
+		rl.Close()
+		return nil, err
+	}
+	if err := router.AddRelaySubscriber(rl.pubId, rl.pubPc); err != nil {
+		rl.Close()
+		return nil, err
+	}
+
+	go rl.readLoop()
+	log.Printf("Relaying room %s to %s", roomId, url)
+	return rl, nil
+}
+
+func (rl *relay) registerHandlers() {
+	rl.subPc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		fmt.Printf("New relayed track: kind=%s, stream=%s\n", track.Kind(), track.StreamID())
+		var err error
+		// The router resolves the original peer and screen share from the stream id
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			err = rl.router.ForwardVideoTrack(rl.subId, track, false)
+		} else {
+			err = rl.router.ForwardAudioTrack(rl.subId, track, false)
+		}
+		if err != nil {
+			log.Printf("Failed to forward relayed track: %v", err)
+		}
+	})
+
+	rl.pubPc.OnNegotiationNeeded(rl.negotiators[rl.pubId].negotiate)
+
+	for id, pc := range map[string]*webrtc.PeerConnection{rl.subId: rl.subPc, rl.pubId: rl.pubPc} {
+		id := id
+		pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+			payload, _ := json.Marshal(signaling.NewIceCandidate(c))
+			rl.send(id, signaling.SignalMessageTypeCandidate, payload)
+		})
+		pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			fmt.Printf("Relay %s connection state change: %s\n", id, state)
+			if state == webrtc.PeerConnectionStateFailed {
+				go rl.Close()
+			}
+		})
+	}
+}
+
+func (rl *relay) readLoop() {
+	defer rl.Close()
+	rl.srv.config.Keepalive.watch(rl.conn)
+	for {
+		var msg signaling.SignalMessage
+		if err := rl.conn.ReadJSON(&msg); err != nil {
+			fmt.Println("relay read:", err)
+			return
+		}
+		rl.srv.config.Keepalive.alive(rl.conn)
+
+		n, exists := rl.negotiators[msg.ClientID]
+		if !exists {
+			log.Printf("Relay received message for unknown client %s", msg.ClientID)
+			continue
+		}
+
+		switch msg.Type {
+		case signaling.SignalMessageTypeOffer:
+			var offer signaling.SdpOffer
+			if err := json.Unmarshal(msg.Payload, &offer); err != nil {
+				log.Printf("Failed to unmarshal relay offer: %v", err)
+				continue
+			}
+			if err := rl.handleOffer(n, &offer); err != nil {
+				log.Printf("Failed to handle relay offer: %v", err)
+			}
+
+		case signaling.SignalMessageTypeAnswer:
+			var answer signaling.SdpAnswer
+			if err := json.Unmarshal(msg.Payload, &answer); err != nil {
+				log.Printf("Failed to unmarshal relay answer: %v", err)
+				continue
+			}
+			if err := n.accept(answer.SDP); err != nil {
+				log.Printf("Failed to set relay remote description: %v", err)
+			}
+
+		case signaling.SignalMessageTypeCandidate:
+			var candidate signaling.IceCandidate
+			if err := json.Unmarshal(msg.Payload, &candidate); err != nil {
+				log.Printf("Failed to unmarshal relay candidate: %v", err)
+				continue
+			}
+			// Trickled ahead of the description it belongs to, it's added once that is applied
+			if err := n.addCandidate(candidate.ICECandidateInit()); err != nil {
+				log.Printf("Failed to add relay candidate: %v", err)
+			}
+
+		case signaling.SignalMessageTypePeerExit:
+			// A peer of the upstream node left, drop its relayed source
+			var peerExit signaling.PeerExit
+			if err := json.Unmarshal(msg.Payload, &peerExit); err != nil {
+				log.Printf("Failed to unmarshal relay peerExit: %v", err)
+				continue
+			}
+			err := rl.router.RemoveRelaySource(rl.subId, peerExit.PeerID, rl.srv.peerExitNotifier(peerExit.PeerID, peerExit.PeerName))
+			if err != nil {
+				log.Printf("Failed to remove relayed peer %s: %v", peerExit.PeerID, err)
+			}
+
+		case signaling.SignalMessageTypeJoinRejected:
+			log.Printf("Upstream node rejected relay %s of room %s: %s", msg.ClientID, rl.roomId, msg.Payload)
+			return
+
+		case signaling.SignalMessageTypeServerDraining:
+			log.Printf("Upstream node is draining, closing relay for room %s", rl.roomId)
+			return
+
+		default:
+			// Other message types are meant for clients
+		}
+	}
+}
+
+func (rl *relay) handleOffer(n *negotiator, offer *signaling.SdpOffer) error {
+	answer, err := n.answer(offer.SDP)
+	if err != nil || answer == nil {
+		return err
+	}
+	payload, _ := json.Marshal(signaling.SdpAnswer{SDP: answer.SDP})
+	rl.send(n.id, signaling.SignalMessageTypeAnswer, payload)
+	return nil
+}
+
+func (rl *relay) sendRelayJoin(id string, direction signaling.RelayDirection) {
+	token, err := rl.srv.relayToken(rl.roomId)
+	if err != nil {
+		log.Printf("Failed to sign the relay token for room %s: %v", rl.roomId, err)
+	}
+	payload, _ := json.Marshal(signaling.RelayJoin{NodeID: rl.srv.config.NodeID, Direction: direction, Token: token})
+	rl.send(id, signaling.SignalMessageTypeRelayJoin, payload)
+}
+
+// relayToken signs the token this node relays the room upstream with, none without a signer. It only
+// needs to last until the upstream node verified the relay join.
+func (srv *defaultServer) relayToken(roomId string) (string, error) {
+	if srv.config.Signer == nil {
+		return "", nil
+	}
+	return srv.config.Signer.Sign(&auth.Claims{
+		UserID:    auth.ID(srv.config.NodeID),
+		RoomID:    roomId,
+		NodeID:    srv.config.NodeID,
+		ExpiresAt: time.Now().Add(relayTokenLifetime).Unix(),
+	})
+}
+
+func (rl *relay) send(id string, msgType signaling.SignalMessageType, payload json.RawMessage) {
+	rl.writer.WriteJSON(signaling.SignalMessage{
+		Type:     msgType,
+		ClientID: id,
+		RoomID:   rl.roomId,
+		Payload:  payload,
+	})
+}
+
+// WriteJSON forwards the messages the router addresses to the relay's clients upstream
+func (rl *relay) WriteJSON(msg any) {
+	signalMsg, ok := msg.(signaling.SignalMessage)
+	if !ok {
+		log.Printf("Relay cannot forward message of type %T", msg)
+		return
+	}
+	// The upstream node needs the room to resolve the relay's clients
+	signalMsg.RoomID = rl.roomId
+	rl.writer.WriteJSON(signalMsg)
+}
+
+func (rl *relay) Stats() WriterStats {
+	return rl.writer.Stats()
+}
+
+func (rl *relay) Close() {
+	rl.once.Do(func() {
+		rl.srv.mu.Lock()
+		if rl.srv.relays[rl.roomId] == rl {
+			delete(rl.srv.relays, rl.roomId)
+		}
+		rl.srv.mu.Unlock()
+		rl.srv.removeWriter(rl.subId, rl)
+		rl.srv.removeWriter(rl.pubId, rl)
+
+		// Tell the local peers that the upstream peers are gone
+		for _, id := range []string{rl.subId, rl.pubId} {
+			if err := rl.router.RemovePeerConnection(id, rl.srv.peerExitNotifier("", "")); err != nil {
+				log.Printf("Failed to remove relay connection %s: %v", id, err)
+			}
+		}
+		for _, n := range rl.negotiators {
+			n.close()
+		}
+		// Closing twice is harmless, this covers a relay that failed before joining the router
+		rl.subPc.Close()
+		rl.pubPc.Close()
+		rl.writer.Close()
+		log.Printf("Relay for room %s closed", rl.roomId)
+	})
+}
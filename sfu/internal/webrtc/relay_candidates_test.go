@@ -0,0 +1,100 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRelayCandidatesAheadOfOffer(t *testing.T) {
+	upstream, conns := fakeUpstream(t)
+	srv := NewServer(Config{NodeID: "node-2", ICEServers: []webrtc.ICEServer{}}).(*defaultServer)
+	rl, err := dialRelay(srv, upstream, "room", srv.getRouter("room"))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(rl.Close)
+	conn := acceptRelay(t, conns)
+
+	// Stand in for the upstream node, offering on the relay's subscribing connection
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create a peer connection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("failed to add a transceiver: %v", err)
+	}
+	candidates := make(chan *webrtc.ICECandidate, 16)
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) { candidates <- c })
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("failed to create an offer: %v", err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("failed to set the offer: %v", err)
+	}
+	send := func(msgType signaling.SignalMessageType, payload any) {
+		data, _ := json.Marshal(payload)
+		if err := conn.WriteJSON(signaling.SignalMessage{Type: msgType, ClientID: rl.subId, RoomID: "room", Payload: data}); err != nil {
+			t.Fatalf("failed to send %s: %v", msgType, err)
+		}
+	}
+	// The offer itself carries no candidates, the relay can only connect through the ones trickled ahead of it
+	for c := range candidates {
+		send(signaling.SignalMessageTypeCandidate, signaling.NewIceCandidate(c))
+		if c == nil {
+			break
+		}
+	}
+	send(signaling.SignalMessageTypeOffer, signaling.SdpOffer{SDP: offer.SDP})
+
+	connected := make(chan struct{})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	// Answer and trickle back until the connection is up
+	go func() {
+		for {
+			var msg signaling.SignalMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.ClientID != rl.subId {
+				continue
+			}
+			switch msg.Type {
+			case signaling.SignalMessageTypeAnswer:
+				var answer signaling.SdpAnswer
+				json.Unmarshal(msg.Payload, &answer)
+				if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+					t.Errorf("failed to set the answer: %v", err)
+				}
+			case signaling.SignalMessageTypeCandidate:
+				var candidate signaling.IceCandidate
+				json.Unmarshal(msg.Payload, &candidate)
+				if err := pc.AddICECandidate(candidate.ICECandidateInit()); err != nil {
+					t.Errorf("failed to add the relay's candidate: %v", err)
+				}
+			}
+		}
+	}()
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the relay's connection never came up")
+	}
+	// Dropped candidates would still connect through peer reflexive ones learned from the connectivity checks
+	for _, stat := range rl.subPc.GetStats() {
+		if candidate, ok := stat.(webrtc.ICECandidateStats); ok && candidate.Type == webrtc.StatsTypeRemoteCandidate &&
+			candidate.CandidateType == webrtc.ICECandidateTypeHost {
+			return
+		}
+	}
+	t.Fatal("the relay has none of the candidates trickled ahead of the offer")
+}
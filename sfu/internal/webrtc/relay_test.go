@@ -0,0 +1,171 @@
+package webrtc
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sfu/internal/auth"
+	"sfu/pkg/signaling"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeUpstream stands in for an upstream node, the test speaks for it on the connections it accepts
+func fakeUpstream(t *testing.T) (string, chan *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade connection: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(upstream.Close)
+	return "ws" + strings.TrimPrefix(upstream.URL, "http") + "/ws", conns
+}
+
+func acceptRelay(t *testing.T, conns chan *websocket.Conn) *websocket.Conn {
+	t.Helper()
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay never connected")
+		return nil
+	}
+}
+
+func TestIntegrationRelay(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	_, downstream := h.addNode("node-2")
+
+	a := h.join("a", peerOptions{})
+	// b's node relays the room to a's node when b joins
+	b := h.join("b", peerOptions{url: downstream})
+	b.waitForMedia(t, "a", 50)
+	a.waitForMedia(t, "b", 50)
+
+	// A third peer on the downstream node gets the upstream media from the same relay
+	c := h.join("c", peerOptions{url: downstream})
+	c.waitForMedia(t, "a", 50)
+	c.waitForMedia(t, "b", 50)
+
+	b.Close()
+	a.waitForPeerExit(t, "b", 10*time.Second)
+	c.waitForPeerExit(t, "b", 10*time.Second)
+}
+
+func TestIntegrationRelayAuthorization(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Tokens = auth.NewVerifier(testSecret)
+	a := h.join("a", peerOptions{token: signToken(t, auth.Claims{UserID: "a", RoomID: "room"})})
+
+	// Neither no token nor a client's token lets a connection subscribe to the room as a relay
+	for _, token := range []string{"", signToken(t, auth.Claims{UserID: "x", RoomID: "room"})} {
+		conn := h.dial()
+		sendSignal(t, conn, signaling.SignalMessageTypeRelayJoin, "relay-x", signaling.RelayJoin{
+			NodeID:    "x",
+			Direction: signaling.RelayDirectionSubscribe,
+			Token:     token,
+		})
+		if readSignal(conn, signaling.SignalMessageTypeJoinRejected, 5*time.Second) == nil {
+			t.Fatalf("relay join with token %q wasn't rejected", token)
+		}
+	}
+	if pc := h.srv.getRouter("room").GetPeerConnection("relay-x"); pc != nil {
+		t.Fatal("a rejected relay was added to the room")
+	}
+
+	// A node that signs its own token relays
+	_, downstream := h.startNode(h.nextHost(), Config{NodeID: "node-2", RelayURL: h.url, Signer: auth.NewSigner(testSecret)})
+	b := h.join("b", peerOptions{url: downstream})
+	a.waitForMedia(t, "b", 50)
+	b.waitForMedia(t, "a", 50)
+
+	// Only the relay that published b can report that b left
+	conn := h.dial()
+	sendSignal(t, conn, signaling.SignalMessageTypePeerExit, "relay-node-2-publish", signaling.PeerExit{PeerID: "b"})
+	before := a.received("b", webrtc.RTPCodecTypeVideo)
+	eventually(t, 5*time.Second, "a still receiving b", func() bool {
+		return a.received("b", webrtc.RTPCodecTypeVideo) >= before+20
+	})
+	a.mu.Lock()
+	for _, msg := range a.messages {
+		if msg.Type == signaling.SignalMessageTypePeerExit {
+			t.Errorf("a was told of a peer exit: %s", msg.Payload)
+		}
+	}
+	a.mu.Unlock()
+
+	b.Close()
+	a.waitForPeerExit(t, "b", 10*time.Second)
+}
+
+func TestRelayClosedWhenRoomEmptiedWhileDialing(t *testing.T) {
+	upstream, conns := fakeUpstream(t)
+	srv := NewServer(Config{RelayURL: upstream, ICEServers: []webrtc.ICEServer{}}).(*defaultServer)
+	// Nobody is in the room by the time the dial completes
+	srv.startRelay("room", srv.getRouter("room"))
+	conn := acceptRelay(t, conns)
+
+	// The relay joins, then hangs up
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatal("the relay of the empty room wasn't closed")
+		}
+		if err != nil {
+			break
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, exists := srv.relays["room"]; exists {
+		t.Fatal("the relay of the empty room is still registered")
+	}
+}
+
+func TestRelayJoinDuplicateNode(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	first := h.dial()
+	join := signaling.RelayJoin{NodeID: "x", Direction: signaling.RelayDirectionSubscribe}
+	sendSignal(t, first, signaling.SignalMessageTypeRelayJoin, "relay-x", join)
+	eventually(t, 5*time.Second, "the first relay joining", func() bool {
+		return h.srv.getRouter("room").GetPeerConnection("relay-x") != nil
+	})
+	pc := h.srv.getRouter("room").GetPeerConnection("relay-x")
+	h.srv.mu.Lock()
+	writer := h.srv.writers["relay-x"]
+	h.srv.mu.Unlock()
+
+	// Another node with the same id doesn't take over the first one's connection or messages
+	second := h.dial()
+	sendSignal(t, second, signaling.SignalMessageTypeRelayJoin, "relay-x", join)
+	time.Sleep(500 * time.Millisecond)
+	if got := h.srv.getRouter("room").GetPeerConnection("relay-x"); got != pc {
+		t.Fatal("the second relay replaced the first one's PeerConnection")
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	if h.srv.writers["relay-x"] != writer {
+		t.Fatal("the second relay took the first one's messages")
+	}
+}
+
+func TestRandomNodeID(t *testing.T) {
+	a := NewServer(Config{}).(*defaultServer)
+	b := NewServer(Config{}).(*defaultServer)
+	if a.config.NodeID == "" || a.config.NodeID == b.config.NodeID {
+		t.Fatalf("servers without a node id got %q and %q, want distinct ids", a.config.NodeID, b.config.NodeID)
+	}
+}
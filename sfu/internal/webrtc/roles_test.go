@@ -0,0 +1,39 @@
+package webrtc
+
+import (
+	"sfu/internal/auth"
+	"sfu/internal/sfu"
+	"sfu/pkg/signaling"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIntegrationAttendeeRole(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	m, peers := joinModerated(t, h, "p")
+	p := peers[0]
+	// The attendee publishes like everyone else, the SFU mustn't forward it
+	a := h.join("a", peerOptions{token: signToken(t, auth.Claims{UserID: "a", RoomID: "room", Role: string(sfu.RoleAttendee)})})
+	a.waitForMedia(t, "p", 20)
+	time.Sleep(time.Second)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if got := p.received("a", kind); got != 0 {
+			t.Fatalf("p received %d %s packets of the attendee", got, kind)
+		}
+	}
+
+	// The test client doesn't publish on the transceivers added by a promotion, so only the role is checked
+	router := h.srv.getRouter("room")
+	m.send(t, signaling.SignalMessageTypePromote, signaling.ModeratorAction{PeerID: "a"})
+	a.waitForMessage(t, signaling.SignalMessageTypePromote)
+	if got := router.GetRole("a"); got != sfu.RolePanelist {
+		t.Fatalf("promoted a has role %q", got)
+	}
+	m.send(t, signaling.SignalMessageTypeDemote, signaling.ModeratorAction{PeerID: "a"})
+	a.waitForMessage(t, signaling.SignalMessageTypeDemote)
+	if got := router.GetRole("a"); got != sfu.RoleAttendee {
+		t.Fatalf("demoted a has role %q", got)
+	}
+}
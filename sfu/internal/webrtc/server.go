@@ -1,46 +1,184 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sfu/internal/auth"
 	"sfu/internal/sfu"
-	"sfu/internal/signaling"
+	"sfu/pkg/signaling"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 )
 
+var errNotJoined = errors.New("client has not joined the room")
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// Config holds the deployment-level settings of the signaling server
+type Config struct {
+	// ReconnectDelay is suggested to clients when the server starts draining
+	ReconnectDelay time.Duration
+	// NodeID identifies this SFU to the other nodes it relays rooms with and must be unique among them, a
+	// random id when empty
+	NodeID string
+	// RelayURL is the signaling endpoint of an upstream SFU node, rooms are relayed to it when set
+	RelayURL string
+	// Codecs restricts the codecs negotiated in each room, pion's defaults aren't used
+	Codecs CodecPolicies
+	// Tokens verifies the tokens clients join with, moderator actions are refused for everyone without it
+	Tokens auth.Verifier
+	// Signer mints the tokens playback bots join with, playback is refused without it when Tokens is set
+	Signer auth.Signer
+	// Events limits the size and rate of the events each client relays over its data channel
+	Events EventLimits
+	// Keepalive pings the signaling connections and bounds their reads and writes
+	Keepalive Keepalive
+	// StatsInterval is how often clients are sent the stats of their PeerConnection, never when zero
+	StatsInterval time.Duration
+	// ICEServers are used by every PeerConnection, public STUN servers when nil
+	ICEServers []webrtc.ICEServer
+	// SettingEngine tunes pion's transport, e.g. to run on a virtual network in tests. Pion's defaults when nil.
+	SettingEngine *webrtc.SettingEngine
+	// MediaDir holds the files playback bots play, playback is disabled when empty
+	MediaDir string
+	// PlaybackURL is the signaling endpoint playback bots join through, this server's own
+	PlaybackURL string
+	// AudioTapURL is a websocket endpoint, e.g. of a transcription service, that receives the Opus frames
+	// of every room's participants when set
+	AudioTapURL string
+}
+
+type Server interface {
+	HandleSession(w http.ResponseWriter, r *http.Request)
+	Shutdown(ctx context.Context) error
+	// HandleWriterStats serves the signaling queue metrics of every connected client as JSON to the backend
+	HandleWriterStats(w http.ResponseWriter, r *http.Request)
+	// HandlePlayback starts and stops playback bots for the backend
+	HandlePlayback(w http.ResponseWriter, r *http.Request)
+	// HandleEgress starts and stops streaming rooms to RTMP servers and HLS for the backend
+	HandleEgress(w http.ResponseWriter, r *http.Request)
+	// HandleHLS serves the HLS playlists and segments of the egresses
+	HandleHLS(w http.ResponseWriter, r *http.Request)
+	// HandleThumbnails serves pictures of the participants' cameras, e.g. for room previews
+	HandleThumbnails(w http.ResponseWriter, r *http.Request)
+}
+
+type defaultServer struct {
+	config  Config
+	routers map[string]sfu.Router
+	// Client id -> writer of the connection the client signals through
+	writers  map[string]Writer
+	relays   map[string]*relay
+	sessions map[*session]struct{}
+	// Breakout room id -> id of the room it was opened from
+	breakouts map[string]string
+	// Client id -> the client's events data channel
+	events map[string]*eventChannel
+	// Peer id -> playback bot
+	playbacks map[string]*playback
+	// Room id -> the tap streaming the room's audio
+	taps map[string]*audioTap
+	// Egress id -> egress streaming a room
+	egresses map[string]*roomEgress
+	// Room id -> thumbnails of the room's cameras
+	thumbnails map[string]*roomThumbnails
+	draining   bool
+	mu         sync.Mutex
+}
+
 type session struct {
-	writer                  Writer
-	routers                 map[string]sfu.Router
+	srv    *defaultServer
+	writer Writer
+	// Client id -> room id of the clients signaling through this connection
+	clients map[string]string
+	// Claims of the clients that joined with a valid token
+	claims                  map[string]*auth.Claims
 	screenShareTransceivers map[string]*webrtc.RTPTransceiver
+	// The recvonly transceivers of clients that publish
+	publishTransceivers map[string][]*webrtc.RTPTransceiver
+	// Client id -> the negotiator of the client's PeerConnection
+	negotiators map[string]*negotiator
+	// Clients that declared they roll back their offers when they collide with the SFU's
+	rollbacks map[string]bool
+	// Client id -> remote candidates that arrived before the client's PeerConnection
+	candidates map[string][]webrtc.ICECandidateInit
+	mu         sync.Mutex
+}
+
+func NewServer(config Config) Server {
+	if config.Events == (EventLimits{}) {
+		config.Events = DefaultEventLimits()
+	}
+	if config.Keepalive == (Keepalive{}) {
+		config.Keepalive = DefaultKeepalive()
+	}
+	if config.NodeID == "" {
+		config.NodeID = randomNodeID()
+	}
+	if config.ICEServers == nil {
+		config.ICEServers = []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+			{
+				URLs: []string{"stun:global.stun.twilio.com:3478"},
+			},
+		}
+	}
+	return &defaultServer{
+		config:     config,
+		routers:    make(map[string]sfu.Router),
+		writers:    make(map[string]Writer),
+		relays:     make(map[string]*relay),
+		sessions:   make(map[*session]struct{}),
+		breakouts:  make(map[string]string),
+		events:     make(map[string]*eventChannel),
+		playbacks:  make(map[string]*playback),
+		taps:       make(map[string]*audioTap),
+		egresses:   make(map[string]*roomEgress),
+		thumbnails: make(map[string]*roomThumbnails),
+	}
 }
 
-func HandleSession(w http.ResponseWriter, r *http.Request) {
+func (srv *defaultServer) HandleSession(w http.ResponseWriter, r *http.Request) {
 	// Upgrade the HTTP connection to a websocket connection
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		panic(fmt.Sprintln("failed to upgrade connection:", err))
 	}
 
-	// Create writer
-	writer := CreateWriter(conn)
-	defer writer.Close()
+	// Create writer, it pings the client so that dead connections are noticed
+	writer := CreateWriter(conn, srv.config.Keepalive)
+	srv.config.Keepalive.watch(conn)
 
 	// Handle the signaling session
-	sess := createSession(writer)
+	sess := createSession(srv, writer)
+	srv.addSession(sess)
+	defer srv.removeSession(sess)
+	// Close the writer before the session is torn down, nobody is left to read the exit messages
+	defer writer.Close()
+	if srv.config.StatsInterval > 0 {
+		stopStats := make(chan struct{})
+		defer close(stopStats)
+		go sess.sendStats(srv.config.StatsInterval, stopStats)
+	}
 	for {
 		var msg signaling.SignalMessage
 		if err = conn.ReadJSON(&msg); err != nil {
+			// Also a dead client, the read deadline passed without a message or pong
 			fmt.Println("read:", err)
 			break
 		}
+		srv.config.Keepalive.alive(conn)
 
 		if msg.ClientID == "" {
 			panic("Client ID is empty")
@@ -49,13 +187,23 @@ func HandleSession(w http.ResponseWriter, r *http.Request) {
 			panic("Room ID is empty")
 		}
 
-		// Get the router for the room, create one if it doesn't exist
-		roomRouter, exists := sess.routers[msg.RoomID]
-		if !exists {
-			roomRouter = sfu.NewRouter()
-			sess.routers[msg.RoomID] = roomRouter
+		// Clients that were moved into a breakout keep signaling with the room they joined
+		if msg.Type != signaling.SignalMessageTypeJoin && msg.Type != signaling.SignalMessageTypeRelayJoin {
+			msg.RoomID = sess.roomOf(msg.ClientID, msg.RoomID)
+		}
+
+		// Don't accept new joins, tell the client where it stands instead. This comes before the router so
+		// that a draining server doesn't open empty rooms.
+		isJoin := msg.Type == signaling.SignalMessageTypeJoin || msg.Type == signaling.SignalMessageTypeRelayJoin
+		if isJoin && srv.isDraining() {
+			log.Printf("Refusing %s of %s for room %s, the server is draining", msg.Type, msg.ClientID, msg.RoomID)
+			sess.sendServerDraining(msg.ClientID, srv.config.ReconnectDelay)
+			continue
 		}
 
+		// Get the router for the room, create one if it doesn't exist
+		roomRouter := srv.getRouter(msg.RoomID)
+
 		fmt.Println("Received message type:", msg.Type)
 
 		switch msg.Type {
@@ -67,17 +215,77 @@ func HandleSession(w http.ResponseWriter, r *http.Request) {
 				log.Printf("Failed to unmarshal join payload: %v", err)
 				continue
 			}
-			pc, err := sess.handleJoin(writer, msg.RoomID, msg.ClientID)
+			claims, err := srv.verifyJoin(msg.RoomID, &join)
+			if err != nil {
+				log.Printf("Rejecting join of %s: %v", msg.ClientID, err)
+				sess.sendJoinRejected(msg.ClientID, signaling.JoinRejectedInvalidToken)
+				continue
+			}
+			role, err := srv.joinRole(claims)
+			if err != nil {
+				log.Printf("Rejecting join of %s: %v", msg.ClientID, err)
+				sess.sendJoinRejected(msg.ClientID, signaling.JoinRejectedInvalidToken)
+				continue
+			}
+			moderator := moderates(claims)
+			if roomRouter.IsLocked() && !moderator {
+				log.Printf("Room %s is locked, rejecting join of %s", msg.RoomID, msg.ClientID)
+				sess.sendJoinRejected(msg.ClientID, signaling.JoinRejectedRoomLocked)
+				continue
+			}
+			if len(join.VideoCodecs) > 0 || len(join.AudioCodecs) > 0 {
+				roomRouter.SetCodecs(msg.ClientID, joinCodecs(&join))
+			}
+			sess.setRollback(msg.ClientID, join.Rollback)
+			pc, err := sess.handleJoin(writer, msg.RoomID, msg.ClientID, role)
 			if err != nil {
 				panic(fmt.Sprintf("failed to handle join: %v", err))
 			}
 
 			// Register the PeerConnection with the router
 			log.Println("name: " + join.Name)
-			err = roomRouter.AddPeerConnection(msg.ClientID, join.Name, pc)
+			sess.bind(msg.ClientID, msg.RoomID)
+			sess.setClaims(msg.ClientID, claims)
+			waiting := roomRouter.WaitingRoomEnabled() && !moderator
+			if waiting {
+				err = roomRouter.AddWaitingPeer(msg.ClientID, join.Name, pc)
+			} else {
+				err = roomRouter.AddPeerConnection(msg.ClientID, join.Name, pc)
+			}
 			if err != nil {
 				panic(fmt.Sprintf("failed to add PeerConnection to router: %v", err))
 			}
+			if err := roomRouter.SetRole(msg.ClientID, role); err != nil {
+				log.Printf("Failed to set role of %s: %v", msg.ClientID, err)
+			}
+			if waiting {
+				log.Printf("Client %s is waiting to be admitted to room %s", msg.ClientID, msg.RoomID)
+				srv.sendAdmission(msg.ClientID, signaling.AdmissionWaiting)
+				srv.sendAdmissionRequest(msg.RoomID, "", msg.ClientID, join.Name)
+			} else if moderator {
+				// Catch the moderator up on the peers that are already waiting
+				for _, id := range roomRouter.GetWaitingPeerIDs() {
+					srv.sendAdmissionRequest(msg.RoomID, msg.ClientID, id, roomRouter.GetName(id))
+				}
+			}
+			srv.startRelay(msg.RoomID, roomRouter)
+			srv.startTap(msg.RoomID, roomRouter)
+
+		case signaling.SignalMessageTypeRelayJoin:
+			log.Printf("Received relay join from %s for room %s", msg.ClientID, msg.RoomID)
+			var relayJoin signaling.RelayJoin
+			if err := json.Unmarshal(msg.Payload, &relayJoin); err != nil {
+				log.Printf("Failed to unmarshal relay join payload: %v", err)
+				continue
+			}
+			if err := srv.verifyRelayJoin(msg.RoomID, &relayJoin); err != nil {
+				log.Printf("Rejecting relay join of %s: %v", msg.ClientID, err)
+				sess.sendJoinRejected(msg.ClientID, signaling.JoinRejectedInvalidToken)
+				continue
+			}
+			if err := sess.handleRelayJoin(msg.ClientID, msg.RoomID, &relayJoin); err != nil {
+				log.Printf("Failed to handle relay join: %v", err)
+			}
 
 		case signaling.SignalMessageTypeExit:
 			fmt.Println("Message type exit receiver")
@@ -90,21 +298,32 @@ func HandleSession(w http.ResponseWriter, r *http.Request) {
 			// TODO: Handle room-based exits, return error to client??
 			sess.handleExit(msg.ClientID, msg.RoomID, exit.PeerName)
 
+		case signaling.SignalMessageTypePeerExit:
+			// Only relays report peers, a peer of the other node left the room. The relay must have joined
+			// through this connection and published the source.
+			var peerExit signaling.PeerExit
+			if err := json.Unmarshal(msg.Payload, &peerExit); err != nil {
+				log.Printf("Failed to unmarshal peerExit payload: %v", err)
+				continue
+			}
+			if !sess.joined(msg.ClientID) {
+				log.Printf("Ignoring peerExit from %s, it didn't join through this connection", msg.ClientID)
+				continue
+			}
+			err := roomRouter.RemoveRelaySource(msg.ClientID, peerExit.PeerID, srv.peerExitNotifier(peerExit.PeerID, peerExit.PeerName))
+			if err != nil {
+				log.Printf("Failed to remove relayed peer %s: %v", peerExit.PeerID, err)
+			}
+
 		case signaling.SignalMessageTypeOffer:
 			var offer signaling.SdpOffer
 			if err := json.Unmarshal(msg.Payload, &offer); err != nil {
 				panic(fmt.Sprintf("failed to unmarshal offer: %s, %v", msg.Payload, err))
 			}
-			pc, isNew, err := sess.handleOffer(writer, msg.ClientID, msg.RoomID, &offer)
-			if err != nil {
-				panic(fmt.Sprintf("failed to handle offer: %v", err))
-			}
-			// Register the PeerConnection with the router
-			if isNew {
-				// This shouldn't happen, the only time client would offer first is when renegotiating an existing PeerConnection
-				err = roomRouter.AddPeerConnection(msg.ClientID, "UNKNOWN", pc)
-				if err != nil {
-					panic(fmt.Sprintf("failed to add PeerConnection to router: %v", err))
+			if err := sess.handleOffer(writer, msg.ClientID, msg.RoomID, &offer); err != nil {
+				log.Printf("Refusing offer of %s: %v", msg.ClientID, err)
+				if errors.Is(err, errNotJoined) {
+					sess.sendJoinRejected(msg.ClientID, signaling.JoinRejectedNotJoined)
 				}
 			}
 
@@ -134,128 +353,515 @@ func HandleSession(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Received PLI request from client %s", msg.ClientID)
 			roomRouter.RequestKeyFrames(msg.ClientID)
 
+		case signaling.SignalMessageTypeSubscriberMode:
+			var mode signaling.SubscriberMode
+			if err := json.Unmarshal(msg.Payload, &mode); err != nil {
+				log.Printf("Failed to unmarshal subscriberMode payload: %v", err)
+				continue
+			}
+			log.Printf("Client %s switches to subscriber mode %s", msg.ClientID, mode.Mode)
+			if err := roomRouter.SetSubscriberMode(msg.ClientID, sfu.SubscriberMode(mode.Mode)); err != nil {
+				log.Printf("Failed to set subscriber mode: %v", err)
+			}
+
+		case signaling.SignalMessageTypeMuteParticipant, signaling.SignalMessageTypeMuteAll,
+			signaling.SignalMessageTypeStopVideo, signaling.SignalMessageTypeStopScreenShare,
+			signaling.SignalMessageTypeRemoveParticipant, signaling.SignalMessageTypeLockRoom,
+			signaling.SignalMessageTypeWaitingRoom, signaling.SignalMessageTypeAdmit, signaling.SignalMessageTypeDeny,
+			signaling.SignalMessageTypePromote, signaling.SignalMessageTypeDemote,
+			signaling.SignalMessageTypeMoveParticipant, signaling.SignalMessageTypeCloseBreakouts,
+			signaling.SignalMessageTypeStartPlayback, signaling.SignalMessageTypeStopPlayback:
+			if err := sess.handleModeratorAction(&msg, roomRouter); err != nil {
+				log.Printf("Failed to handle %s from %s: %v", msg.Type, msg.ClientID, err)
+			}
+
 		default:
 			// TODO: handle other message types
 		}
 	}
 }
 
-func createSession(writer Writer) *session {
+func (srv *defaultServer) addSession(sess *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.sessions[sess] = struct{}{}
+}
+
+func (srv *defaultServer) removeSession(sess *session) {
+	srv.mu.Lock()
+	delete(srv.sessions, sess)
+	srv.mu.Unlock()
+
+	// The signaling connection is gone, nobody can renegotiate these PeerConnections anymore
+	sess.closeAll()
+}
+
+// getRouter returns the router for the room, creating one if it doesn't exist
+func (srv *defaultServer) getRouter(roomId string) sfu.Router {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	router, exists := srv.routers[roomId]
+	if !exists {
+		router = sfu.NewRouter()
+		router.OnCodecMismatch(srv.sendCodecMismatch)
+		srv.routers[roomId] = router
+	}
+	return router
+}
+
+func (srv *defaultServer) getRouters() map[string]sfu.Router {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	routers := make(map[string]sfu.Router, len(srv.routers))
+	for roomId, router := range srv.routers {
+		routers[roomId] = router
+	}
+	return routers
+}
+
+func (srv *defaultServer) setWriter(id string, writer Writer) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.writers[id] = writer
+}
+
+func (srv *defaultServer) removeWriter(id string, writer Writer) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// The client may have rebound to another connection in the meantime
+	if srv.writers[id] == writer {
+		delete(srv.writers, id)
+	}
+}
+
+// writeTo sends the message through the connection the client is bound to
+func (srv *defaultServer) writeTo(id string, msg signaling.SignalMessage) {
+	srv.mu.Lock()
+	writer, exists := srv.writers[id]
+	srv.mu.Unlock()
+	if !exists {
+		log.Printf("No signaling connection for client %s, dropping %s message", id, msg.Type)
+		return
+	}
+	writer.WriteJSON(msg)
+}
+
+// peerExitNotifier returns the callback that tells subscribers a peer left. It is called with the router
+// locked, so it must not call back into the router. Only the name of peer id is known up front.
+func (srv *defaultServer) peerExitNotifier(id string, name string) func(peerId, subscriberId string) {
+	return func(peerId, subscriberId string) {
+		peerName := ""
+		if peerId == id {
+			peerName = name
+		}
+		payload, err := json.Marshal(signaling.PeerExit{PeerID: peerId, PeerName: peerName})
+		if err != nil {
+			log.Printf("Error marshaling the PeerExit payload for peer %s", subscriberId)
+		}
+		srv.writeTo(subscriberId, signaling.SignalMessage{
+			Type:     signaling.SignalMessageTypePeerExit,
+			ClientID: subscriberId,
+			Payload:  payload,
+		})
+	}
+}
+
+// sendCodecMismatch tells a subscriber which stream it isn't sent because it can't decode the codec
+func (srv *defaultServer) sendCodecMismatch(subscriberId, peerId, streamId string, codec webrtc.RTPCodecCapability) {
+	payload, err := json.Marshal(signaling.CodecMismatch{PeerID: peerId, StreamID: streamId, MimeType: codec.MimeType})
+	if err != nil {
+		log.Printf("Error marshaling the CodecMismatch payload for peer %s", subscriberId)
+		return
+	}
+	srv.writeTo(subscriberId, signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypeCodecMismatch,
+		ClientID: subscriberId,
+		Payload:  payload,
+	})
+}
+
+func (srv *defaultServer) isDraining() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.draining
+}
+
+func (srv *defaultServer) getSessions() []*session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	sessions := make([]*session, 0, len(srv.sessions))
+	for sess := range srv.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (srv *defaultServer) HandleWriterStats(w http.ResponseWriter, r *http.Request) {
+	// The stats list the clients of every room, only a moderator token that isn't scoped to a room may read them
+	if err := srv.authorizeModerator(r, ""); err != nil {
+		log.Printf("Refusing writer stats request: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	stats := make(map[string]WriterStats)
+	for _, sess := range srv.getSessions() {
+		writerStats := sess.writer.Stats()
+		for _, id := range sess.getClients() {
+			stats[id] = writerStats
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("Failed to write writer stats: %v", err)
+	}
+}
+
+// Shutdown stops accepting joins, tells every connected client that the server is draining and
+// waits for the rooms to empty. Once ctx is done, the remaining PeerConnections and writers are closed.
+func (srv *defaultServer) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.draining = true
+	srv.mu.Unlock()
+	// Bots would keep their rooms open
+	srv.stopPlaybacks()
+
+	for _, sess := range srv.getSessions() {
+		for _, id := range sess.getClients() {
+			sess.sendServerDraining(id, srv.config.ReconnectDelay)
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for !srv.roomsEmpty() {
+		select {
+		case <-ctx.Done():
+			log.Println("Drain deadline reached, closing remaining connections")
+			srv.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	log.Println("All rooms drained")
+	srv.closeSessions()
+	return nil
+}
+
+func (srv *defaultServer) roomsEmpty() bool {
+	for _, router := range srv.getRouters() {
+		if len(router.GetPeerIDs()) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (srv *defaultServer) closeSessions() {
+	srv.mu.Lock()
+	relays := make([]*relay, 0, len(srv.relays))
+	for _, rl := range srv.relays {
+		if rl != nil {
+			relays = append(relays, rl)
+		}
+	}
+	srv.mu.Unlock()
+	for _, rl := range relays {
+		rl.Close()
+	}
+	srv.closeTaps()
+	srv.stopEgresses("")
+
+	for _, sess := range srv.getSessions() {
+		sess.closeAll()
+		sess.writer.Close()
+	}
+}
+
+func createSession(srv *defaultServer, writer Writer) *session {
 	return &session{
+		srv:                     srv,
 		writer:                  writer,
-		routers:                 make(map[string]sfu.Router),
+		clients:                 make(map[string]string),
+		claims:                  make(map[string]*auth.Claims),
 		screenShareTransceivers: make(map[string]*webrtc.RTPTransceiver),
+		publishTransceivers:     make(map[string][]*webrtc.RTPTransceiver),
+		negotiators:             make(map[string]*negotiator),
+		rollbacks:               make(map[string]bool),
+		candidates:              make(map[string][]webrtc.ICECandidateInit),
+	}
+}
+
+// bind routes the messages for the client through this session's connection
+func (s *session) bind(id string, roomId string) {
+	s.mu.Lock()
+	s.clients[id] = roomId
+	s.mu.Unlock()
+	s.srv.setWriter(id, s.writer)
+}
+
+func (s *session) unbind(id string) {
+	s.mu.Lock()
+	delete(s.clients, id)
+	delete(s.claims, id)
+	delete(s.screenShareTransceivers, id)
+	delete(s.publishTransceivers, id)
+	if n, exists := s.negotiators[id]; exists {
+		n.close()
+		delete(s.negotiators, id)
 	}
+	delete(s.rollbacks, id)
+	delete(s.candidates, id)
+	s.mu.Unlock()
+	s.srv.removeWriter(id, s.writer)
 }
 
-func (s *session) handleJoin(writer Writer, roomId string, id string) (*webrtc.PeerConnection, error) {
+// setRollback records whether the client rolls back colliding offers, before its negotiator is created
+func (s *session) setRollback(id string, rollback bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rollback {
+		s.rollbacks[id] = true
+	} else {
+		delete(s.rollbacks, id)
+	}
+}
+
+// joined reports whether the client joined through this session
+func (s *session) joined(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.clients[id]
+	return exists
+}
+
+func (s *session) getClients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// closeAll removes every client of the session from its room
+func (s *session) closeAll() {
+	s.mu.Lock()
+	clients := make(map[string]string, len(s.clients))
+	for id, roomId := range s.clients {
+		clients[id] = roomId
+	}
+	s.mu.Unlock()
+	for id, roomId := range clients {
+		s.handleExit(id, roomId, "")
+	}
+}
+
+func (s *session) sendServerDraining(id string, reconnectDelay time.Duration) {
+	payload, err := json.Marshal(signaling.ServerDraining{ReconnectDelayMs: reconnectDelay.Milliseconds()})
+	if err != nil {
+		log.Printf("Error marshaling the ServerDraining payload for peer %s", id)
+		return
+	}
+	s.writer.WriteJSON(signaling.SignalMessage{
+		Type:     signaling.SignalMessageTypeServerDraining,
+		ClientID: id,
+		Payload:  payload,
+	})
+}
+
+func (srv *defaultServer) newPeerConnection(roomId string) (*webrtc.PeerConnection, error) {
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-			{
-				URLs: []string{"stun:global.stun.twilio.com:3478"},
-			},
-		},
+		ICEServers: srv.config.ICEServers,
+	}
+	api, err := newAPI(srv.config.Codecs.forRoom(roomId), srv.config.SettingEngine, srv.getRouter(roomId).ReportInterceptor())
+	if err != nil {
+		return nil, err
 	}
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := api.NewPeerConnection(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create PeerConnection: %w", err)
 	}
+	return pc, nil
+}
+
+func (s *session) handleJoin(writer Writer, roomId string, id string, role sfu.Role) (*webrtc.PeerConnection, error) {
+	pc, err := s.srv.newPeerConnection(roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attendees only subscribe, they get no transceivers to publish on until they are promoted
+	if role.Publishes() {
+		if err := s.addPublishTransceivers(roomId, id, pc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.openEventChannel(id, pc); err != nil {
+		return nil, err
+	}
+
+	s.registerConnectionHandlers(id, roomId, pc)
+
+	return pc, nil
+}
+
+// addPublishTransceivers adds the transceivers the client sends its camera, microphone and screen share on
+func (s *session) addPublishTransceivers(roomId string, id string, pc *webrtc.PeerConnection) error {
+	policy := s.srv.config.Codecs.forRoom(roomId)
+
+	// Offer the client only the video codecs every current peer can decode, so its video can be forwarded to all of them
+	codecs, err := policy.videoCodecs()
+	if err != nil {
+		return err
+	}
+	codecs = append(s.srv.getRouter(roomId).FilterCodecs(codecs), policy.fecCodecs()...)
 
 	// Add the transceivers to receive audio and video from the client
-	pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+	tCamera, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
 	})
-	pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+	if err != nil {
+		return fmt.Errorf("failed to add video transceiver: %w", err)
+	}
+	if err := setCodecPreferences(pc, tCamera, codecs); err != nil {
+		return fmt.Errorf("failed to set video codec preferences: %w", err)
+	}
+	tAudio, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
 	})
+	if err != nil {
+		return fmt.Errorf("failed to add audio transceiver: %w", err)
+	}
 
 	// Pre-allocate transceivers for screen sharing from the client
 	tVideo, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to add video transceiver for screen share: %w", err)
+		return fmt.Errorf("failed to add video transceiver for screen share: %w", err)
 	}
-	s.screenShareTransceivers[id] = tVideo
-	pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+	if err := setCodecPreferences(pc, tVideo, codecs); err != nil {
+		return fmt.Errorf("failed to set screen share codec preferences: %w", err)
+	}
+	tScreenAudio, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
 	})
+	if err != nil {
+		return fmt.Errorf("failed to add audio transceiver for screen share: %w", err)
+	}
 
-	s.registerConnectionHandlers(id, roomId, pc)
+	s.mu.Lock()
+	s.screenShareTransceivers[id] = tVideo
+	s.publishTransceivers[id] = []*webrtc.RTPTransceiver{tCamera, tAudio, tVideo, tScreenAudio}
+	s.mu.Unlock()
+	return nil
+}
 
-	return pc, nil
+// setCodecPreferences restricts the codecs of the transceiver. Once the PeerConnection is negotiated pion only
+// knows the codecs negotiated so far, which are already narrowed down, so ones missing from them are let go.
+func setCodecPreferences(pc *webrtc.PeerConnection, transceiver *webrtc.RTPTransceiver, codecs []webrtc.RTPCodecParameters) error {
+	err := transceiver.SetCodecPreferences(codecs)
+	if err != nil && pc.RemoteDescription() != nil {
+		log.Printf("Keeping the negotiated codecs of a renegotiated transceiver: %v", err)
+		return nil
+	}
+	return err
+}
+
+// stopPublishTransceivers stops receiving from the client and renegotiates, so that it stops sending
+func (s *session) stopPublishTransceivers(id string, pc *webrtc.PeerConnection) {
+	s.mu.Lock()
+	transceivers := s.publishTransceivers[id]
+	delete(s.publishTransceivers, id)
+	delete(s.screenShareTransceivers, id)
+	s.mu.Unlock()
+	for _, transceiver := range transceivers {
+		if err := transceiver.Stop(); err != nil {
+			log.Printf("Failed to stop transceiver of %s: %v", id, err)
+		}
+	}
+	// Stopping a transceiver doesn't make pion fire negotiation needed
+	if len(transceivers) > 0 {
+		s.negotiatorFor(id, pc).negotiate()
+	}
+}
+
+// handleRelayJoin connects another SFU node to the room. A subscribing relay receives the local sources
+// and is offered to like any client, a publishing relay offers the sources of its own peers.
+func (s *session) handleRelayJoin(id string, roomId string, relayJoin *signaling.RelayJoin) error {
+	// Binding a second node with the same id would take the first one's messages
+	if s.srv.getRouter(roomId).GetPeerConnection(id) != nil {
+		return fmt.Errorf("relay %s is already in room %s, node %s isn't unique", id, roomId, relayJoin.NodeID)
+	}
+	pc, err := s.srv.newPeerConnection(roomId)
+	if err != nil {
+		return err
+	}
+	s.registerConnectionHandlers(id, roomId, pc)
+	s.bind(id, roomId)
+
+	router := s.srv.getRouter(roomId)
+	switch relayJoin.Direction {
+	case signaling.RelayDirectionSubscribe:
+		err = router.AddRelaySubscriber(id, pc)
+	case signaling.RelayDirectionPublish:
+		err = router.AddRelayPublisher(id, pc)
+	default:
+		err = fmt.Errorf("unknown relay direction %q", relayJoin.Direction)
+	}
+	if err != nil {
+		pc.Close()
+		s.unbind(id)
+		return err
+	}
+	log.Printf("Relay %s from node %s joined room %s", id, relayJoin.NodeID, roomId)
+	return nil
 }
 
 func (s *session) handleExit(id, roomId, name string) {
 
 	// TODO: implement specific close messages, not a generic without specifying who to close
+	router := s.srv.getRouter(roomId)
 	if name == "" {
 		// No provided name in exit message (or abrupt disconnect), get name from router
-		name = s.routers[roomId].GetName(id)
-	}
-	closeSubscriber := func(peerId string) {
-		payload, err := json.Marshal(signaling.PeerExit{PeerID: id, PeerName: name})
-		if err != nil {
-			log.Printf("Error marshaling the PeerExit payload for peer %s", peerId)
-		}
-		s.writer.WriteJSON(signaling.SignalMessage{
-			Type:     signaling.SignalMessageTypePeerExit,
-			ClientID: peerId,
-			Payload:  payload,
-		})
+		name = router.GetName(id)
 	}
 
-	err := s.routers[roomId].RemovePeerConnection(id, closeSubscriber)
+	err := router.RemovePeerConnection(id, s.srv.peerExitNotifier(id, name))
 	if err != nil {
 		fmt.Printf("Error removing connection %s: %v\n", id, err)
 	} else {
 		fmt.Printf("Connection %s removed successfully\n", id)
 	}
-}
-
-func (s *session) handleOffer(writer Writer, id string, roomId string, offer *signaling.SdpOffer) (*webrtc.PeerConnection, bool, error) {
-	// Create a new PeerConnection if one does not exist for the user
-	isNew := false
-	pc := s.routers[roomId].GetPeerConnection(id)
-	if pc == nil {
-		isNew = true
-		config := webrtc.Configuration{}
-		newPc, err := webrtc.NewPeerConnection(config)
-		if err != nil {
-			return nil, isNew, fmt.Errorf("failed to create PeerConnection: %w", err)
-		}
-		pc = newPc
-	}
-
-	// Set the remote description using the provided SDP offer
-	sessionDescription := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  offer.SDP,
-	}
-	err := pc.SetRemoteDescription(sessionDescription)
-	if err != nil {
-		return nil, isNew, fmt.Errorf("failed to set remote description: %w", err)
-	}
-
-	// Create an answer
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		return nil, isNew, fmt.Errorf("failed to create answer: %w", err)
+	s.unbind(id)
+
+	// Nobody is left to serve on this node, stop relaying and tapping the room
+	if len(router.GetPeerIDs()) == 0 {
+		s.srv.closeRelay(roomId)
+		s.srv.closeTap(roomId)
+		s.srv.closeThumbnails(roomId)
+		s.srv.stopEgresses(roomId)
 	}
+}
 
-	// Set the local description
-	err = pc.SetLocalDescription(answer)
-	if err != nil {
-		return nil, isNew, fmt.Errorf("failed to set local description: %w", err)
+// handleOffer answers an offer of a client that joined through this session. PeerConnections are only
+// created by the join, which verifies the client and applies the room's lock, waiting room and roles.
+func (s *session) handleOffer(writer Writer, id string, roomId string, offer *signaling.SdpOffer) error {
+	router := s.srv.getRouter(roomId)
+	pc := router.GetPeerConnection(id)
+	if pc == nil || !s.joined(id) {
+		return errNotJoined
 	}
 
-	// Register connection handlers only if PeerConnection is new
-	if isNew {
-		s.registerConnectionHandlers(id, roomId, pc)
+	// The offer may collide with one of ours, the negotiator resolves that
+	answer, err := s.negotiatorFor(id, pc).answer(offer.SDP)
+	if err != nil || answer == nil {
+		return err
 	}
+	router.SetCodecs(id, remoteCodecs(pc))
 
 	// Send the answer back to the client
 	payload, _ := json.Marshal(signaling.SdpAnswer{SDP: answer.SDP})
@@ -264,57 +870,35 @@ func (s *session) handleOffer(writer Writer, id string, roomId string, offer *si
 		ClientID: id,
 		Payload:  payload,
 	})
-
-	return pc, isNew, nil
+	return nil
 }
 
 func (s *session) handleAnswer(id string, roomId string, answer *signaling.SdpAnswer) error {
-	pc := s.routers[roomId].GetPeerConnection(id)
+	router := s.srv.getRouter(roomId)
+	pc := router.GetPeerConnection(id)
 	if pc == nil {
 		return fmt.Errorf("PeerConnection with id %s does not exist", id)
 	}
 
-	// Set the remote description
-	sessionDescription := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  answer.SDP,
-	}
-	err := pc.SetRemoteDescription(sessionDescription)
-	if err != nil {
-		return fmt.Errorf("failed to set remote description: %w", err)
+	if err := s.negotiatorFor(id, pc).accept(answer.SDP); err != nil {
+		return err
 	}
+	// The answer only keeps the offered codecs the client can decode
+	router.SetCodecs(id, remoteCodecs(pc))
 	return nil
 }
 
 func (s *session) registerConnectionHandlers(id string, roomId string, pc *webrtc.PeerConnection) {
 	// Register negotiation needed
+	negotiator := s.negotiatorFor(id, pc)
 	pc.OnNegotiationNeeded(func() {
 		fmt.Println("Negotiation needed for client " + id)
-		offer, err := pc.CreateOffer(nil)
-		if err != nil {
-			fmt.Printf("Failed to create offer: %v\n", err)
-			return
-		}
-
-		err = pc.SetLocalDescription(offer)
-		if err != nil {
-			fmt.Printf("Failed to set local description: %v\n", err)
-			return
-		}
-
-		payload, _ := json.Marshal(signaling.SdpOffer{SDP: offer.SDP})
-		s.writer.WriteJSON(signaling.SignalMessage{
-			Type:     signaling.SignalMessageTypeOffer,
-			ClientID: id,
-			Payload:  payload,
-		})
+		negotiator.negotiate()
 	})
 
 	// Register the ICE candidate handler
+	// A nil candidate ends the gathering, the client is told so as well
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
-			return
-		}
 		s.handleLocalCandidate(id, c)
 	})
 
@@ -338,22 +922,31 @@ func (s *session) registerConnectionHandlers(id string, roomId string, pc *webrt
 			// Set the track handler
 			pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 				fmt.Printf("New incoming track: kind=%s, ssrc=%d\n", track.Kind(), track.SSRC())
+				// The client may have been moved into another room since it joined
+				roomId := s.roomOf(id, roomId)
+				if role := s.srv.getRouter(roomId).GetRole(id); !role.Publishes() {
+					log.Printf("Ignoring %s track of %s, %ss don't publish", track.Kind(), id, role)
+					return
+				}
 
 				isScreenShare := false
-				if receiver.RTPTransceiver() == s.screenShareTransceivers[id] {
+				s.mu.Lock()
+				screenShareTransceiver := s.screenShareTransceivers[id]
+				s.mu.Unlock()
+				if screenShareTransceiver != nil && receiver.RTPTransceiver() == screenShareTransceiver {
 					fmt.Println("Handling screen share track")
 					isScreenShare = true
 				}
 
 				if track.Kind() == webrtc.RTPCodecTypeVideo {
 					// Forward video track to all other clients
-					err := s.routers[roomId].ForwardVideoTrack(id, track, isScreenShare)
+					err := s.srv.getRouter(roomId).ForwardVideoTrack(id, track, isScreenShare)
 					if err != nil {
 						panic(fmt.Sprintf("failed to forward video track: %v", err))
 					}
 				} else if track.Kind() == webrtc.RTPCodecTypeAudio {
 					// Forward audio track to all other clients
-					err := s.routers[roomId].ForwardAudioTrack(id, track, isScreenShare)
+					err := s.srv.getRouter(roomId).ForwardAudioTrack(id, track, isScreenShare)
 					if err != nil {
 						panic(fmt.Sprintf("failed to forward audio track: %v", err))
 					}
@@ -365,7 +958,7 @@ func (s *session) registerConnectionHandlers(id string, roomId string, pc *webrt
 
 		case webrtc.PeerConnectionStateFailed:
 			// send a peerExit to all peers
-			s.handleExit(id, roomId, "")
+			s.handleExit(id, s.roomOf(id, roomId), "")
 
 		default:
 			// TODO: handle PeerConnection failure
@@ -376,17 +969,8 @@ func (s *session) registerConnectionHandlers(id string, roomId string, pc *webrt
 
 func (s *session) handleLocalCandidate(id string, candidate *webrtc.ICECandidate) {
 	// This function can be used to handle local ICE candidates, e.g., send them to the remote peer via signaling
-	jsonCandidate := candidate.ToJSON()
-	newCandidate := signaling.IceCandidate{Candidate: jsonCandidate.Candidate}
-	if jsonCandidate.SDPMid != nil {
-		newCandidate.SdpMid = *jsonCandidate.SDPMid
-	}
-	if jsonCandidate.SDPMLineIndex != nil {
-		newCandidate.SdpMLineIndex = int(*jsonCandidate.SDPMLineIndex)
-	}
-
-	payload, _ := json.Marshal(newCandidate)
-	pbCandidate := &signaling.SignalMessage{
+	payload, _ := json.Marshal(signaling.NewIceCandidate(candidate))
+	pbCandidate := signaling.SignalMessage{
 		Type:     signaling.SignalMessageTypeCandidate,
 		ClientID: id,
 		Payload:  payload,
@@ -397,14 +981,14 @@ func (s *session) handleLocalCandidate(id string, candidate *webrtc.ICECandidate
 
 func (s *session) handleRemoteCandidate(id string, roomId string, candidate *signaling.IceCandidate) error {
 	// Add the ICE candidate to the PeerConnection
-	iceCandidate := webrtc.ICECandidateInit{
-		Candidate: candidate.Candidate,
-	}
-	clientPC := s.routers[roomId].GetPeerConnection(id)
+	iceCandidate := candidate.ICECandidateInit()
+	clientPC := s.srv.getRouter(roomId).GetPeerConnection(id)
 	if clientPC == nil {
-		return fmt.Errorf("PeerConnection with id %s does not exist", id)
+		// Trickled ahead of the SDP, it's added once the PeerConnection exists
+		s.queueCandidate(id, iceCandidate)
+		return nil
 	}
-	err := clientPC.AddICECandidate(iceCandidate)
+	err := s.negotiatorFor(id, clientPC).addCandidate(iceCandidate)
 	if err != nil {
 		return fmt.Errorf("failed to add ICE candidate: %w", err)
 	}
@@ -0,0 +1,70 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"sfu/pkg/signaling"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// sendStats sends each client of the session the stats of its PeerConnection every interval until stop is
+// closed. They are telemetry, the writer coalesces or drops them when the connection falls behind.
+func (s *session) sendStats(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, id := range s.getClients() {
+			roomId := s.roomOf(id, "")
+			if roomId == "" {
+				// Left since
+				continue
+			}
+			pc := s.srv.getRouter(roomId).GetPeerConnection(id)
+			if pc == nil {
+				continue
+			}
+			stats, ok := connectionStats(pc)
+			if !ok {
+				continue
+			}
+			payload, err := json.Marshal(stats)
+			if err != nil {
+				log.Printf("Error marshaling the Stats payload for peer %s", id)
+				continue
+			}
+			s.writer.WriteJSON(signaling.SignalMessage{
+				Type:     signaling.SignalMessageTypeStats,
+				ClientID: id,
+				Payload:  payload,
+			})
+		}
+	}
+}
+
+// connectionStats reads the round trip time of the candidate pair the PeerConnection uses and the bytes
+// of its ICE transport, it reports false until ICE selected a pair
+func connectionStats(pc *webrtc.PeerConnection) (signaling.Stats, bool) {
+	var stats signaling.Stats
+	var selected, nominated bool
+	for _, stat := range pc.GetStats() {
+		switch stat := stat.(type) {
+		case webrtc.ICECandidatePairStats:
+			if stat.State != webrtc.StatsICECandidatePairStateSucceeded || nominated {
+				continue
+			}
+			stats.RoundTripTimeMs = stat.CurrentRoundTripTime * 1000
+			selected, nominated = true, stat.Nominated
+		case webrtc.TransportStats:
+			stats.BytesSent = stat.BytesSent
+			stats.BytesReceived = stat.BytesReceived
+		}
+	}
+	return stats, selected
+}
@@ -0,0 +1,255 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"expvar"
+	"log"
+	"sfu/internal/sfu"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+)
+
+// Frames of the audio taps, sent or dropped because the endpoint couldn't keep up
+var tapFrames = expvar.NewMap("sfu_audio_tap_frames")
+
+const (
+	// tapQueueSize is how many frames wait for the endpoint, about a second of audio for a room of 20
+	tapQueueSize      = 1024
+	tapWriteTimeout   = 5 * time.Second
+	tapMinReconnect   = time.Second
+	tapMaxReconnect   = 30 * time.Second
+	tapOpusClockRate  = 48000
+	tapOpusChannels   = 2
+	tapMessageStart   = "start"
+	tapMessagePeer    = "peer"
+	tapMessageDropped = "dropped"
+)
+
+// tapMessage is a text message of the tap protocol. A connection starts with a start message for the
+// room, each participant is labelled by a peer message before its first frame.
+type tapMessage struct {
+	Type      string `json:"type"`
+	RoomID    string `json:"roomId"`
+	PeerID    string `json:"peerId,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Codec     string `json:"codec,omitempty"`
+	ClockRate int    `json:"clockRate,omitempty"`
+	Channels  int    `json:"channels,omitempty"`
+	// Frames dropped since the last dropped message
+	Frames uint64 `json:"frames,omitempty"`
+}
+
+// tapFrame is an Opus frame of a participant. On the wire it is a binary message: the length of the peer
+// id in one byte, the peer id, the RTP sequence number (2 bytes), the RTP timestamp (4 bytes), the time it
+// arrived at the SFU in unix milliseconds (8 bytes), all big endian, and the Opus frame.
+type tapFrame struct {
+	peerId    string
+	sequence  uint16
+	timestamp uint32
+	arrival   time.Time
+	payload   []byte
+}
+
+func (f *tapFrame) marshal() []byte {
+	id := f.peerId[:min(len(f.peerId), 255)]
+	data := make([]byte, 0, 1+len(id)+14+len(f.payload))
+	data = append(data, byte(len(id)))
+	data = append(data, id...)
+	data = binary.BigEndian.AppendUint16(data, f.sequence)
+	data = binary.BigEndian.AppendUint32(data, f.timestamp)
+	data = binary.BigEndian.AppendUint64(data, uint64(f.arrival.UnixMilli()))
+	return append(data, f.payload...)
+}
+
+// audioTap streams the Opus frames of a room's participants to the configured endpoint, e.g. a
+// transcription service. Frames are forwarded as they arrive rather than decoded, the service gets the
+// RTP timestamps to order and time them. It reconnects until the room closes, frames are dropped while
+// the endpoint is unreachable or too slow.
+type audioTap struct {
+	url    string
+	roomId string
+	router sfu.Router
+	frames chan tapFrame
+	// Frames dropped since the endpoint was last told
+	dropped uint64
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+// startTap taps the room's audio unless it is tapped already
+func (srv *defaultServer) startTap(roomId string, router sfu.Router) {
+	if srv.config.AudioTapURL == "" {
+		return
+	}
+	srv.mu.Lock()
+	if _, exists := srv.taps[roomId]; exists {
+		srv.mu.Unlock()
+		return
+	}
+	t := &audioTap{
+		url:    srv.config.AudioTapURL,
+		roomId: roomId,
+		router: router,
+		frames: make(chan tapFrame, tapQueueSize),
+		done:   make(chan struct{}),
+	}
+	srv.taps[roomId] = t
+	srv.mu.Unlock()
+
+	router.SetAudioTap(t)
+	go t.run()
+}
+
+func (srv *defaultServer) closeTap(roomId string) {
+	srv.mu.Lock()
+	t := srv.taps[roomId]
+	delete(srv.taps, roomId)
+	srv.mu.Unlock()
+	if t != nil {
+		t.router.SetAudioTap(nil)
+		t.Close()
+	}
+}
+
+func (srv *defaultServer) closeTaps() {
+	srv.mu.Lock()
+	taps := make([]*audioTap, 0, len(srv.taps))
+	for roomId, t := range srv.taps {
+		taps = append(taps, t)
+		delete(srv.taps, roomId)
+	}
+	srv.mu.Unlock()
+	for _, t := range taps {
+		t.router.SetAudioTap(nil)
+		t.Close()
+	}
+}
+
+// WriteAudio queues a frame for the endpoint, it is dropped when the queue is full
+func (t *audioTap) WriteAudio(peerId string, packet *rtp.Packet) {
+	frame := tapFrame{
+		peerId:    peerId,
+		sequence:  packet.SequenceNumber,
+		timestamp: packet.Timestamp,
+		arrival:   time.Now(),
+		payload:   append([]byte(nil), packet.Payload...),
+	}
+	select {
+	case t.frames <- frame:
+	default:
+		tapFrames.Add("dropped", 1)
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+func (t *audioTap) Close() {
+	t.once.Do(func() { close(t.done) })
+}
+
+func (t *audioTap) closed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// run connects to the endpoint and streams the frames, reconnecting with backoff until the tap is closed
+func (t *audioTap) run() {
+	delay := tapMinReconnect
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(t.url, nil)
+		if err == nil {
+			log.Printf("Audio tap of room %s connected to %s", t.roomId, t.url)
+			delay = tapMinReconnect
+			err = t.stream(conn)
+			conn.Close()
+		}
+		if t.closed() {
+			log.Printf("Audio tap of room %s closed", t.roomId)
+			return
+		}
+		log.Printf("Audio tap of room %s lost %s, reconnecting in %v: %v", t.roomId, t.url, delay, err)
+		select {
+		case <-t.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, tapMaxReconnect)
+	}
+}
+
+// stream writes the frames to one connection until it fails or the tap is closed
+func (t *audioTap) stream(conn *websocket.Conn) error {
+	// The endpoint isn't expected to send anything, reading handles its pings and notices when it closes
+	lost := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				lost <- err
+				return
+			}
+		}
+	}()
+
+	write := func(messageType int, data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(tapWriteTimeout))
+		return conn.WriteMessage(messageType, data)
+	}
+	writeJSON := func(msg tapMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(tapWriteTimeout))
+		return conn.WriteJSON(msg)
+	}
+
+	err := writeJSON(tapMessage{
+		Type:      tapMessageStart,
+		RoomID:    t.roomId,
+		Codec:     "opus",
+		ClockRate: tapOpusClockRate,
+		Channels:  tapOpusChannels,
+	})
+	if err != nil {
+		return err
+	}
+	// Peers are labelled again on every connection, the endpoint may have restarted
+	labelled := make(map[string]bool)
+	for {
+		var frame tapFrame
+		select {
+		case <-t.done:
+			conn.SetWriteDeadline(time.Now().Add(tapWriteTimeout))
+			return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		case err := <-lost:
+			return err
+		case frame = <-t.frames:
+		}
+
+		t.mu.Lock()
+		dropped := t.dropped
+		t.dropped = 0
+		t.mu.Unlock()
+		if dropped > 0 {
+			if err := writeJSON(tapMessage{Type: tapMessageDropped, RoomID: t.roomId, Frames: dropped}); err != nil {
+				return err
+			}
+		}
+		if !labelled[frame.peerId] {
+			msg := tapMessage{Type: tapMessagePeer, RoomID: t.roomId, PeerID: frame.peerId, Name: t.router.GetName(frame.peerId)}
+			if err := writeJSON(msg); err != nil {
+				return err
+			}
+			labelled[frame.peerId] = true
+		}
+		if err := write(websocket.BinaryMessage, frame.marshal()); err != nil {
+			return err
+		}
+		tapFrames.Add("sent", 1)
+	}
+}
@@ -0,0 +1,145 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tapEndpoint records what the audio taps send, one connection after the other
+type tapEndpoint struct {
+	url string
+	// Text messages of every connection, in order
+	messages []tapMessage
+	// Peer id -> frames received
+	frames map[string]int
+	// Room id -> the room's current connection, closing it makes the tap reconnect
+	conns map[string]*websocket.Conn
+	mu    sync.Mutex
+}
+
+func newTapEndpoint(t *testing.T) *tapEndpoint {
+	e := &tapEndpoint{frames: make(map[string]int), conns: make(map[string]*websocket.Conn)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			e.record(t, conn, messageType, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	e.url = "ws" + strings.TrimPrefix(server.URL, "http")
+	return e
+}
+
+func (e *tapEndpoint) record(t *testing.T, conn *websocket.Conn, messageType int, data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if messageType == websocket.TextMessage {
+		var msg tapMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Errorf("invalid tap message %s: %v", data, err)
+			return
+		}
+		e.messages = append(e.messages, msg)
+		if msg.Type == tapMessageStart {
+			e.conns[msg.RoomID] = conn
+		}
+		return
+	}
+	if len(data) == 0 || len(data) < 1+int(data[0])+14 {
+		t.Errorf("frame of %d bytes is too short", len(data))
+		return
+	}
+	peerId := string(data[1 : 1+data[0]])
+	arrival := time.UnixMilli(int64(binary.BigEndian.Uint64(data[1+len(peerId)+6:])))
+	if time.Since(arrival) > time.Minute || len(data) == 1+len(peerId)+14 {
+		t.Errorf("frame of %s has no payload or a wrong arrival time %v", peerId, arrival)
+	}
+	// Frames must follow the label of their peer
+	for _, msg := range e.messages {
+		if msg.Type == tapMessagePeer && msg.PeerID == peerId {
+			e.frames[peerId]++
+			return
+		}
+	}
+	t.Errorf("frame of %s arrived before its label", peerId)
+}
+
+func (e *tapEndpoint) received(peerId string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.frames[peerId]
+}
+
+func (e *tapEndpoint) count(roomId string, messageType string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	count := 0
+	for _, msg := range e.messages {
+		if msg.RoomID == roomId && msg.Type == messageType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestIntegrationAudioTap(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	endpoint := newTapEndpoint(t)
+	h.srv.config.AudioTapURL = endpoint.url
+
+	h.join("a", peerOptions{})
+	h.join("b", peerOptions{})
+	// Only the audio of the room's own participants is tapped
+	h.join("c", peerOptions{roomId: "other", noMedia: true})
+	for _, id := range []string{"a", "b"} {
+		eventually(t, 15*time.Second, "frames of "+id+" reaching the tap", func() bool {
+			return endpoint.received(id) >= 50
+		})
+	}
+
+	endpoint.mu.Lock()
+	var start tapMessage
+	names := map[string]string{}
+	for _, msg := range endpoint.messages {
+		switch {
+		case msg.RoomID != "room":
+		case msg.Type == tapMessageStart:
+			start = msg
+		case msg.Type == tapMessagePeer:
+			names[msg.PeerID] = msg.Name
+		}
+	}
+	endpoint.mu.Unlock()
+	if start.Codec != "opus" || start.ClockRate != 48000 || start.Channels != 2 {
+		t.Fatalf("tap started with %+v", start)
+	}
+	if len(names) != 2 || names["a"] != "a" || names["b"] != "b" {
+		t.Fatalf("tap labelled %v, want a and b", names)
+	}
+
+	// The tap reconnects and labels the peers again
+	endpoint.mu.Lock()
+	endpoint.conns["room"].Close()
+	endpoint.mu.Unlock()
+	eventually(t, 10*time.Second, "the tap reconnecting", func() bool {
+		return endpoint.count("room", tapMessageStart) == 2 && endpoint.count("room", tapMessagePeer) == 4
+	})
+	if endpoint.count("other", tapMessagePeer) != 0 {
+		t.Fatal("a peer without audio was labelled")
+	}
+}
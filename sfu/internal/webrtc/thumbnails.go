@@ -0,0 +1,263 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"math"
+	"net/http"
+	"sfu/internal/sfu"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/vp8"
+)
+
+// Keyframes decoded into thumbnails, or skipped because they couldn't be
+var thumbnailDecodes = expvar.NewMap("sfu_thumbnails")
+
+const (
+	// A room's thumbnails are refreshed at most this often, when they are requested
+	thumbnailRefresh = 5 * time.Second
+	thumbnailWidth   = 320
+	thumbnailHeight  = 180
+	thumbnailQuality = 75
+	// The composite shows at most this many participants, the ones with their camera on first
+	maxCompositeTiles = 16
+)
+
+// Background of the composite's tiles, participants without a picture are shown as an empty tile
+var thumbnailBackground = color.Gray{Y: 0x20}
+
+// thumbnail is the picture of a participant's camera
+type thumbnail struct {
+	image *image.RGBA
+	jpeg  []byte
+	// The keyframe it was decoded from, it isn't decoded again while it stays the latest
+	ssrc      uint32
+	timestamp uint32
+}
+
+// roomThumbnails are the thumbnails of a room's participants and their composite
+type roomThumbnails struct {
+	// Peer id -> the participant's thumbnail
+	peers     map[string]*thumbnail
+	composite []byte
+	updated   time.Time
+	mu        sync.Mutex
+}
+
+// thumbnailsOf returns the room's thumbnails, refreshed from the latest keyframes when they are older
+// than thumbnailRefresh. Nothing is decoded for rooms nobody looks at.
+func (srv *defaultServer) thumbnailsOf(roomId string, router sfu.Router) *roomThumbnails {
+	srv.mu.Lock()
+	room, exists := srv.thumbnails[roomId]
+	if !exists {
+		room = &roomThumbnails{peers: make(map[string]*thumbnail)}
+		srv.thumbnails[roomId] = room
+	}
+	srv.mu.Unlock()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if time.Since(room.updated) >= thumbnailRefresh {
+		room.refresh(router)
+	}
+	return room
+}
+
+// closeThumbnails forgets the room's thumbnails once nobody is left in it
+func (srv *defaultServer) closeThumbnails(roomId string) {
+	srv.mu.Lock()
+	delete(srv.thumbnails, roomId)
+	srv.mu.Unlock()
+}
+
+// refresh decodes the new keyframes of the room's cameras and composes them. room.mu must be held.
+func (room *roomThumbnails) refresh(router sfu.Router) {
+	peers := router.GetPeerIDs()
+	waiting := router.GetWaitingPeerIDs()
+	sort.Strings(peers)
+	for id := range room.peers {
+		if !slices.Contains(peers, id) {
+			delete(room.peers, id)
+		}
+	}
+
+	var withPicture, withoutPicture []string
+	for _, id := range peers {
+		if slices.Contains(waiting, id) {
+			continue
+		}
+		if room.refreshPeer(id, router.LatestKeyframe(id, thumbnailRefresh)) {
+			withPicture = append(withPicture, id)
+		} else {
+			withoutPicture = append(withoutPicture, id)
+		}
+	}
+
+	room.composite = nil
+	tiles := append(withPicture, withoutPicture...)
+	if len(tiles) > 0 {
+		composite, err := room.compose(tiles[:min(len(tiles), maxCompositeTiles)])
+		if err != nil {
+			log.Printf("Failed to compose thumbnails: %v", err)
+		}
+		room.composite = composite
+	}
+	room.updated = time.Now()
+}
+
+// refreshPeer decodes the keyframe unless the thumbnail already shows it, it reports whether the
+// participant has a thumbnail
+func (room *roomThumbnails) refreshPeer(id string, keyframe *sfu.Keyframe) bool {
+	if keyframe == nil {
+		delete(room.peers, id)
+		return false
+	}
+	first := keyframe.Packets[0]
+	if t, exists := room.peers[id]; exists && t.ssrc == first.SSRC && t.timestamp == first.Timestamp {
+		return true
+	}
+	t, err := decodeThumbnail(keyframe)
+	if err != nil {
+		thumbnailDecodes.Add("failed", 1)
+		// The previous picture is older but still better than none
+		_, exists := room.peers[id]
+		return exists
+	}
+	thumbnailDecodes.Add("decoded", 1)
+	room.peers[id] = t
+	return true
+}
+
+// compose lays the participants' thumbnails out in a grid, each fitted into a tile
+func (room *roomThumbnails) compose(ids []string) ([]byte, error) {
+	columns := int(math.Ceil(math.Sqrt(float64(len(ids)))))
+	rows := (len(ids) + columns - 1) / columns
+	canvas := image.NewRGBA(image.Rect(0, 0, columns*thumbnailWidth, rows*thumbnailHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(thumbnailBackground), image.Point{}, draw.Src)
+	for i, id := range ids {
+		t, exists := room.peers[id]
+		if !exists {
+			continue
+		}
+		tile := image.Rect(0, 0, thumbnailWidth, thumbnailHeight).Add(image.Pt(i%columns*thumbnailWidth, i/columns*thumbnailHeight))
+		size := t.image.Bounds().Size()
+		// Thumbnails are fitted already, center them in their tile
+		at := tile.Min.Add(image.Pt((thumbnailWidth-size.X)/2, (thumbnailHeight-size.Y)/2))
+		draw.Draw(canvas, image.Rectangle{Min: at, Max: at.Add(size)}, t.image, image.Point{}, draw.Src)
+	}
+	return encodeJPEG(canvas)
+}
+
+// decodeThumbnail decodes a VP8 keyframe into a thumbnail. Other codecs would need a decoder the SFU
+// doesn't have, their participants are shown without a picture.
+func decodeThumbnail(keyframe *sfu.Keyframe) (*thumbnail, error) {
+	if !strings.EqualFold(keyframe.Codec.MimeType, webrtc.MimeTypeVP8) {
+		return nil, fmt.Errorf("can't decode %s", keyframe.Codec.MimeType)
+	}
+	var frame []byte
+	for i, packet := range keyframe.Packets {
+		if i > 0 && packet.SequenceNumber != keyframe.Packets[i-1].SequenceNumber+1 {
+			return nil, errors.New("keyframe is incomplete")
+		}
+		var vp8Packet codecs.VP8Packet
+		payload, err := vp8Packet.Unmarshal(packet.Payload)
+		if err != nil {
+			return nil, err
+		}
+		frame = append(frame, payload...)
+	}
+	if last := keyframe.Packets[len(keyframe.Packets)-1]; !last.Marker {
+		return nil, errors.New("keyframe is incomplete")
+	}
+
+	decoder := vp8.NewDecoder()
+	decoder.Init(bytes.NewReader(frame), len(frame))
+	if _, err := decoder.DecodeFrameHeader(); err != nil {
+		return nil, err
+	}
+	picture, err := decoder.DecodeFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fit the picture into a tile, keeping its aspect ratio
+	size := picture.Bounds().Size()
+	scale := min(float64(thumbnailWidth)/float64(size.X), float64(thumbnailHeight)/float64(size.Y))
+	scaled := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(size.X)*scale)), max(1, int(float64(size.Y)*scale))))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), picture, picture.Bounds(), draw.Src, nil)
+	data, err := encodeJPEG(scaled)
+	if err != nil {
+		return nil, err
+	}
+	first := keyframe.Packets[0]
+	return &thumbnail{image: scaled, jpeg: data, ssrc: first.SSRC, timestamp: first.Timestamp}, nil
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HandleThumbnails serves JPEG thumbnails of the cameras in a room: GET /thumbnails/<roomId> a composite
+// of everyone, /thumbnails/<roomId>/<peerId> one participant. The request needs a bearer token valid for
+// the room, so that only users who could join it see inside.
+func (srv *defaultServer) HandleThumbnails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	roomId, peerId, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/thumbnails/"), "/")
+	if roomId == "" {
+		http.Error(w, "roomId is missing", http.StatusBadRequest)
+		return
+	}
+	if _, err := srv.authorize(r, roomId); err != nil {
+		log.Printf("Refusing thumbnail request for room %s: %v", roomId, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Looking at a room mustn't open it
+	srv.mu.Lock()
+	router, exists := srv.routers[roomId]
+	srv.mu.Unlock()
+	if !exists || len(router.GetPeerIDs()) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	room := srv.thumbnailsOf(roomId, router)
+	room.mu.Lock()
+	data := room.composite
+	if peerId != "" {
+		data = nil
+		if t, exists := room.peers[peerId]; exists {
+			data = t.jpeg
+		}
+	}
+	room.mu.Unlock()
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(thumbnailRefresh.Seconds())))
+	w.Write(data)
+}
@@ -0,0 +1,113 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"sfu/internal/auth"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("thumbnail-test-secret")
+
+// signToken signs the claims the way the backend does
+func signToken(t *testing.T, claims auth.Claims) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to encode claims: %v", err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode(payload)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+func TestIntegrationThumbnails(t *testing.T) {
+	h := newHarness(t, linkConditions{})
+	h.srv.config.Tokens = auth.NewVerifier(testSecret)
+	a := h.join("a", peerOptions{token: signToken(t, auth.Claims{UserID: "a", RoomID: "room"})})
+	b := h.join("b", peerOptions{token: signToken(t, auth.Claims{UserID: "b", RoomID: "room"})})
+	b.waitForMedia(t, "a", 50)
+
+	get := func(path string, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		h.srv.HandleThumbnails(recorder, request)
+		return recorder
+	}
+	token := signToken(t, auth.Claims{UserID: "viewer", RoomID: "room"})
+	if code := get("/thumbnails/room", "").Code; code != http.StatusForbidden {
+		t.Fatalf("request without a token returned %d", code)
+	}
+	if code := get("/thumbnails/room", signToken(t, auth.Claims{UserID: "viewer", RoomID: "other"})).Code; code != http.StatusForbidden {
+		t.Fatalf("request with a token for another room returned %d", code)
+	}
+	if code := get("/thumbnails/nowhere", signToken(t, auth.Claims{UserID: "viewer"})).Code; code != http.StatusNotFound {
+		t.Fatalf("thumbnails of a room that isn't open returned %d", code)
+	}
+
+	decode := func(recorder *httptest.ResponseRecorder) image.Image {
+		if recorder.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("thumbnail has content type %q", recorder.Header().Get("Content-Type"))
+		}
+		img, err := jpeg.Decode(bytes.NewReader(recorder.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("invalid thumbnail: %v", err)
+		}
+		return img
+	}
+	// The first refresh may come before the keyframes, it is cached until the next
+	var peer *httptest.ResponseRecorder
+	eventually(t, 15*time.Second, "a thumbnail of a", func() bool {
+		peer = get("/thumbnails/room/a", token)
+		return peer.Code == http.StatusOK
+	})
+	// The generated 320x240 picture is fitted into 320x180
+	img := decode(peer)
+	if size := img.Bounds().Size(); size != image.Pt(240, 180) {
+		t.Fatalf("thumbnail of a is %v, want 240x180", size)
+	}
+	if y, _, _, _ := img.At(120, 90).RGBA(); y>>8 < 100 || y>>8 > 160 {
+		t.Fatalf("thumbnail of a isn't the gray picture: %d", y>>8)
+	}
+
+	composite := get("/thumbnails/room", token)
+	if composite.Code != http.StatusOK {
+		t.Fatalf("composite returned %d", composite.Code)
+	}
+	if size := decode(composite).Bounds().Size(); size != image.Pt(2*thumbnailWidth, thumbnailHeight) {
+		t.Fatalf("composite of two participants is %v", size)
+	}
+	if code := get("/thumbnails/room/nobody", token).Code; code != http.StatusNotFound {
+		t.Fatalf("thumbnail of a participant who isn't there returned %d", code)
+	}
+
+	// The thumbnails are dropped with the room and looking at the empty room doesn't bring them back
+	a.Close()
+	b.Close()
+	eventually(t, 5*time.Second, "the room's thumbnails to be dropped", func() bool {
+		h.srv.mu.Lock()
+		defer h.srv.mu.Unlock()
+		_, exists := h.srv.thumbnails["room"]
+		return !exists
+	})
+	if code := get("/thumbnails/room", token).Code; code != http.StatusNotFound {
+		t.Fatalf("composite of an empty room returned %d", code)
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	if _, exists := h.srv.thumbnails["room"]; exists {
+		t.Fatal("looking at the empty room kept its thumbnails")
+	}
+}
@@ -2,27 +2,112 @@ package webrtc
 
 import (
 	"fmt"
+	"log"
+	"sfu/pkg/signaling"
 	"sync"
+	"time"
 
 	websocket "github.com/gorilla/websocket"
 )
 
 type Writer interface {
 	Close()
+	// WriteJSON queues the message and never blocks, the callers are often pion callbacks
 	WriteJSON(msg any)
+	Stats() WriterStats
+}
+
+// Priority orders the queued messages of a connection, lower values are written first
+type Priority int
+
+const (
+	// Errors, SDP and everything else that changes the client's state
+	PriorityControl Priority = iota
+	PriorityCandidate
+	// Stats and telemetry, coalesced and dropped under pressure
+	PriorityTelemetry
+	priorityCount
+)
+
+const (
+	// Past this many queued messages telemetry is coalesced, or dropped when there's nothing to coalesce with
+	writerSoftLimit = 64
+	// Past this many queued messages the peer isn't keeping up and the connection is dropped
+	writerHardLimit = 1024
+)
+
+// signalMessage returns the message queued as a value or a pointer if it is a signaling message
+func signalMessage(msg any) (signaling.SignalMessage, bool) {
+	switch signalMsg := msg.(type) {
+	case signaling.SignalMessage:
+		return signalMsg, true
+	case *signaling.SignalMessage:
+		if signalMsg != nil {
+			return *signalMsg, true
+		}
+	}
+	return signaling.SignalMessage{}, false
+}
+
+func priorityOf(msg any) Priority {
+	signalMsg, ok := signalMessage(msg)
+	if !ok {
+		return PriorityControl
+	}
+	switch signalMsg.Type {
+	case signaling.SignalMessageTypeCandidate:
+		return PriorityCandidate
+	case signaling.SignalMessageTypeStats:
+		return PriorityTelemetry
+	}
+	return PriorityControl
+}
+
+// coalesceKey identifies the telemetry a newer message supersedes
+func coalesceKey(msg any) string {
+	if signalMsg, ok := signalMessage(msg); ok {
+		return string(signalMsg.Type) + "/" + signalMsg.ClientID
+	}
+	return ""
+}
+
+// WriterStats are the queue metrics of a signaling connection
+type WriterStats struct {
+	QueuedControl    int    `json:"queuedControl"`
+	QueuedCandidates int    `json:"queuedCandidates"`
+	QueuedTelemetry  int    `json:"queuedTelemetry"`
+	MaxQueued        int    `json:"maxQueued"`
+	Sent             uint64 `json:"sent"`
+	Coalesced        uint64 `json:"coalesced"`
+	Dropped          uint64 `json:"dropped"`
+	// False once the hard limit was hit or a write failed
+	Healthy bool `json:"healthy"`
 }
 
 type defaultWriter struct {
-	conn  *websocket.Conn
-	queue chan any
+	conn      *websocket.Conn
+	keepalive Keepalive
+	queues    [priorityCount][]any
+	queued    int
+	stats     WriterStats
+	// Signals the write loop that a message was queued
+	ready chan struct{}
 	close chan struct{}
-	wg    sync.WaitGroup
+	// Closed when the write loop exits, on Close or on a failed write
+	done chan struct{}
+	mu   sync.Mutex
+	once sync.Once
+	wg   sync.WaitGroup
 }
 
-func CreateWriter(conn *websocket.Conn) Writer {
+func CreateWriter(conn *websocket.Conn, keepalive Keepalive) Writer {
 	w := &defaultWriter{
-		conn:  conn,
-		queue: make(chan any, 10),
+		conn:      conn,
+		keepalive: keepalive,
+		stats:     WriterStats{Healthy: true},
+		ready:     make(chan struct{}, 1),
+		close:     make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 
 	w.wg.Add(1)
@@ -33,11 +118,39 @@ func CreateWriter(conn *websocket.Conn) Writer {
 
 func (w *defaultWriter) writeLoop() {
 	defer w.wg.Done()
+	defer close(w.done)
+
+	var ping <-chan time.Time
+	if w.keepalive.PingInterval > 0 {
+		ticker := time.NewTicker(w.keepalive.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
 	for {
 		select {
-		case msg := <-w.queue:
-			if err := w.conn.WriteJSON(msg); err != nil {
-				fmt.Println("websocket write error:", err)
+		case <-w.ready:
+			for msg, ok := w.next(); ok; msg, ok = w.next() {
+				w.conn.SetWriteDeadline(w.keepalive.writeDeadline())
+				if err := w.conn.WriteJSON(msg); err != nil {
+					fmt.Println("websocket write error:", err)
+					w.fail()
+					return
+				}
+				w.mu.Lock()
+				w.stats.Sent++
+				w.mu.Unlock()
+				// Don't let a long queue starve the pings or Close
+				select {
+				case <-w.close:
+					return
+				default:
+				}
+			}
+		case <-ping:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, w.keepalive.writeDeadline()); err != nil {
+				fmt.Println("websocket ping error:", err)
+				w.fail()
 				return
 			}
 		case <-w.close:
@@ -46,21 +159,103 @@ func (w *defaultWriter) writeLoop() {
 	}
 }
 
-func (w *defaultWriter) Close() {
-	select {
-	case <-w.close:
-		return
-	default:
-		close(w.close)
+// next pops the oldest message of the highest priority
+func (w *defaultWriter) next() (any, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for p := range w.queues {
+		if len(w.queues[p]) > 0 {
+			msg := w.queues[p][0]
+			w.queues[p][0] = nil
+			w.queues[p] = w.queues[p][1:]
+			w.queued--
+			return msg, true
+		}
 	}
-	w.wg.Wait()
+	return nil, false
+}
+
+// fail closes the connection, so that the read loop errors out and the clients bound to the connection
+// are cleaned up
+func (w *defaultWriter) fail() {
+	w.mu.Lock()
+	w.stats.Healthy = false
+	w.mu.Unlock()
 	w.conn.Close()
 }
 
+func (w *defaultWriter) Close() {
+	w.once.Do(func() {
+		close(w.close)
+		w.wg.Wait()
+		w.conn.Close()
+	})
+}
+
 func (w *defaultWriter) WriteJSON(msg any) {
 	select {
-	case w.queue <- msg:
 	case <-w.close:
 		// Writer is closed
+		return
+	case <-w.done:
+		// Connection is dead, nobody will drain the queue
+		return
+	default:
+	}
+
+	priority := priorityOf(msg)
+	w.mu.Lock()
+	if !w.stats.Healthy {
+		w.stats.Dropped++
+		w.mu.Unlock()
+		return
+	}
+	if priority == PriorityTelemetry && w.queued >= writerSoftLimit {
+		w.coalesce(msg)
+		w.mu.Unlock()
+		return
 	}
+	if w.queued >= writerHardLimit {
+		w.stats.Dropped++
+		w.mu.Unlock()
+		log.Printf("Signaling queue passed %d messages, dropping the connection", writerHardLimit)
+		w.fail()
+		return
+	}
+	w.queues[priority] = append(w.queues[priority], msg)
+	w.queued++
+	if w.queued > w.stats.MaxQueued {
+		w.stats.MaxQueued = w.queued
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.ready <- struct{}{}:
+	default:
+		// The write loop was already signaled
+	}
+}
+
+// coalesce replaces queued telemetry the message supersedes, or drops the message. w.mu must be held.
+func (w *defaultWriter) coalesce(msg any) {
+	key := coalesceKey(msg)
+	queue := w.queues[PriorityTelemetry]
+	for i := range queue {
+		if coalesceKey(queue[i]) == key {
+			queue[i] = msg
+			w.stats.Coalesced++
+			return
+		}
+	}
+	w.stats.Dropped++
+}
+
+func (w *defaultWriter) Stats() WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	stats := w.stats
+	stats.QueuedControl = len(w.queues[PriorityControl])
+	stats.QueuedCandidates = len(w.queues[PriorityCandidate])
+	stats.QueuedTelemetry = len(w.queues[PriorityTelemetry])
+	return stats
 }
@@ -0,0 +1,309 @@
+package webrtc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sfu/internal/auth"
+	"sfu/pkg/signaling"
+	"strings"
+	"testing"
+	"time"
+
+	websocket "github.com/gorilla/websocket"
+)
+
+// connPair returns the server and client ends of a websocket connection
+func connPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade connection: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn, client
+	case <-time.After(time.Second):
+		t.Fatal("server never accepted the connection")
+	}
+	return nil, nil
+}
+
+// within fails the test if f doesn't return in time
+func within(t *testing.T, timeout time.Duration, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("%s blocked for more than %v", what, timeout)
+	}
+}
+
+func TestWriterCloseTwice(t *testing.T) {
+	conn, _ := connPair(t)
+	w := CreateWriter(conn, Keepalive{})
+	within(t, time.Second, "Close", func() {
+		w.Close()
+		w.Close()
+	})
+}
+
+func TestWriterWriteAfterClose(t *testing.T) {
+	conn, _ := connPair(t)
+	w := CreateWriter(conn, Keepalive{})
+	w.Close()
+	// More messages than the queue holds, none of them may block
+	within(t, time.Second, "WriteJSON after Close", func() {
+		for i := 0; i < 100; i++ {
+			w.WriteJSON(map[string]int{"i": i})
+		}
+	})
+}
+
+func TestWriterDeliversBeforeClose(t *testing.T) {
+	conn, client := connPair(t)
+	w := CreateWriter(conn, Keepalive{})
+	w.WriteJSON(map[string]string{"type": "offer"})
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var msg map[string]string
+	if err := client.ReadJSON(&msg); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if msg["type"] != "offer" {
+		t.Fatalf("got message type %q, want offer", msg["type"])
+	}
+	within(t, time.Second, "Close", w.Close)
+}
+
+func TestWriterWriteAfterConnectionLost(t *testing.T) {
+	conn, _ := connPair(t)
+	w := CreateWriter(conn, Keepalive{})
+	conn.Close()
+	// The first write fails and stops the write loop, the rest must not wait for it
+	within(t, time.Second, "WriteJSON on a dead connection", func() {
+		for i := 0; i < 100; i++ {
+			w.WriteJSON(map[string]int{"i": i})
+		}
+	})
+	within(t, time.Second, "Close", w.Close)
+}
+
+func TestWriterDropsPeerThatStopsReading(t *testing.T) {
+	conn, _ := connPair(t)
+	w := CreateWriter(conn, Keepalive{WriteTimeout: 100 * time.Millisecond})
+	// The client never reads, so the socket buffers fill up and a write times out
+	payload := strings.Repeat("x", 1<<20)
+	within(t, 10*time.Second, "WriteJSON to a peer that stopped reading", func() {
+		for i := 0; i < 100; i++ {
+			w.WriteJSON(map[string]string{"payload": payload})
+		}
+	})
+	within(t, time.Second, "Close", w.Close)
+}
+
+func TestKeepaliveDetectsSilentPeer(t *testing.T) {
+	conn, _ := connPair(t)
+	keepalive := Keepalive{PingInterval: 50 * time.Millisecond, PongTimeout: 200 * time.Millisecond}
+	w := CreateWriter(conn, keepalive)
+	defer w.Close()
+	keepalive.watch(conn)
+
+	// The client never reads, so it never answers the pings
+	within(t, 2*time.Second, "read from a silent peer", func() {
+		var msg map[string]any
+		if err := conn.ReadJSON(&msg); err == nil {
+			t.Error("read succeeded, want a timeout")
+		}
+	})
+}
+
+func TestKeepalivePongsKeepConnectionOpen(t *testing.T) {
+	conn, client := connPair(t)
+	keepalive := Keepalive{PingInterval: 50 * time.Millisecond, PongTimeout: 200 * time.Millisecond}
+	w := CreateWriter(conn, keepalive)
+	defer w.Close()
+	keepalive.watch(conn)
+
+	// Reading makes the client answer pings
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	time.AfterFunc(time.Second, func() {
+		client.WriteJSON(map[string]string{"type": "exit"})
+	})
+
+	var msg map[string]string
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("connection was dropped while the peer answered pings: %v", err)
+	}
+	if msg["type"] != "exit" {
+		t.Fatalf("got message type %q, want exit", msg["type"])
+	}
+}
+
+// stalledWriter returns a writer whose write loop isn't running, so that its queue only grows
+func stalledWriter(conn *websocket.Conn) *defaultWriter {
+	return &defaultWriter{
+		conn:  conn,
+		stats: WriterStats{Healthy: true},
+		ready: make(chan struct{}, 1),
+		close: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func message(t signaling.SignalMessageType, clientId string) signaling.SignalMessage {
+	return signaling.SignalMessage{Type: t, ClientID: clientId}
+}
+
+func TestWriterWritesByPriority(t *testing.T) {
+	w := stalledWriter(nil)
+	w.WriteJSON(message(signaling.SignalMessageTypeStats, "a"))
+	w.WriteJSON(message(signaling.SignalMessageTypeCandidate, "a"))
+	w.WriteJSON(message(signaling.SignalMessageTypeOffer, "a"))
+	w.WriteJSON(message(signaling.SignalMessageTypeCandidate, "b"))
+	w.WriteJSON(message(signaling.SignalMessageTypePeerExit, "a"))
+
+	want := []signaling.SignalMessage{
+		message(signaling.SignalMessageTypeOffer, "a"),
+		message(signaling.SignalMessageTypePeerExit, "a"),
+		message(signaling.SignalMessageTypeCandidate, "a"),
+		message(signaling.SignalMessageTypeCandidate, "b"),
+		message(signaling.SignalMessageTypeStats, "a"),
+	}
+	for i, expected := range want {
+		msg, ok := w.next()
+		if !ok {
+			t.Fatalf("queue ran out after %d messages", i)
+		}
+		if got := msg.(signaling.SignalMessage); got.Type != expected.Type || got.ClientID != expected.ClientID {
+			t.Fatalf("message %d is %s for %s, want %s for %s", i, got.Type, got.ClientID, expected.Type, expected.ClientID)
+		}
+	}
+	if _, ok := w.next(); ok {
+		t.Fatal("queue has more messages than were written")
+	}
+}
+
+func TestWriterCoalescesTelemetryUnderPressure(t *testing.T) {
+	w := stalledWriter(nil)
+	w.WriteJSON(signaling.SignalMessage{Type: signaling.SignalMessageTypeStats, ClientID: "a", RoomID: "old"})
+	for i := 1; i < writerSoftLimit; i++ {
+		w.WriteJSON(message(signaling.SignalMessageTypeCandidate, "a"))
+	}
+	w.WriteJSON(signaling.SignalMessage{Type: signaling.SignalMessageTypeStats, ClientID: "a", RoomID: "new"})
+	// Nothing to coalesce with
+	w.WriteJSON(message(signaling.SignalMessageTypeStats, "b"))
+
+	stats := w.Stats()
+	if stats.QueuedTelemetry != 1 || stats.Coalesced != 1 || stats.Dropped != 1 {
+		t.Fatalf("got %d queued telemetry, %d coalesced and %d dropped, want 1 of each",
+			stats.QueuedTelemetry, stats.Coalesced, stats.Dropped)
+	}
+	if roomId := w.queues[PriorityTelemetry][0].(signaling.SignalMessage).RoomID; roomId != "new" {
+		t.Fatalf("queued telemetry is from %q, want the newest", roomId)
+	}
+	// Control messages are still queued
+	w.WriteJSON(message(signaling.SignalMessageTypeOffer, "a"))
+	if stats := w.Stats(); stats.QueuedControl != 1 {
+		t.Fatalf("got %d queued control messages, want 1", stats.QueuedControl)
+	}
+}
+
+func TestWriterHardLimitDropsConnection(t *testing.T) {
+	conn, client := connPair(t)
+	w := stalledWriter(conn)
+	within(t, time.Second, "WriteJSON past the hard limit", func() {
+		for i := 0; i <= writerHardLimit; i++ {
+			w.WriteJSON(message(signaling.SignalMessageTypeOffer, "a"))
+		}
+	})
+
+	stats := w.Stats()
+	if stats.Healthy {
+		t.Fatal("writer is healthy past the hard limit")
+	}
+	if stats.MaxQueued != writerHardLimit || stats.Dropped != 1 {
+		t.Fatalf("got %d max queued and %d dropped, want %d and 1", stats.MaxQueued, stats.Dropped, writerHardLimit)
+	}
+	// The client sees the connection go away
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("connection is still open past the hard limit")
+	}
+}
+
+func TestLocalCandidatesQueuedAsCandidates(t *testing.T) {
+	w := stalledWriter(nil)
+	s := &session{writer: w}
+	s.handleLocalCandidate("a", nil)
+	w.WriteJSON(message(signaling.SignalMessageTypeOffer, "a"))
+	// Pointers to messages are queued by their type as well
+	w.WriteJSON(&signaling.SignalMessage{Type: signaling.SignalMessageTypeCandidate, ClientID: "b"})
+
+	if stats := w.Stats(); stats.QueuedCandidates != 2 || stats.QueuedControl != 1 {
+		t.Fatalf("got %d queued candidates and %d control messages, want 2 and 1", stats.QueuedCandidates, stats.QueuedControl)
+	}
+	msg, _ := w.next()
+	if got := msg.(signaling.SignalMessage); got.Type != signaling.SignalMessageTypeOffer {
+		t.Fatalf("first message is %s, want the offer ahead of the candidates", got.Type)
+	}
+	msg, _ = w.next()
+	if got := msg.(signaling.SignalMessage); got.Type != signaling.SignalMessageTypeCandidate || got.ClientID != "a" {
+		t.Fatalf("second message is %s for %s, want the local candidate of a", got.Type, got.ClientID)
+	}
+}
+
+func TestHandleWriterStatsAuthorization(t *testing.T) {
+	srv := NewServer(Config{Tokens: auth.NewVerifier(testSecret)}).(*defaultServer)
+	sess := createSession(srv, stalledWriter(nil))
+	sess.bind("a", "room")
+	srv.addSession(sess)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusForbidden},
+		{"participant", signToken(t, auth.Claims{UserID: "a"}), http.StatusForbidden},
+		{"moderator of a room", signToken(t, auth.Claims{UserID: "a", RoomID: "room", Moderator: true}), http.StatusForbidden},
+		{"backend", signToken(t, auth.Claims{UserID: "backend", Moderator: true}), http.StatusOK},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/debug/writers", nil)
+		if tt.token != "" {
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		recorder := httptest.NewRecorder()
+		srv.HandleWriterStats(recorder, request)
+		if recorder.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, recorder.Code, tt.want)
+		}
+		if recorder.Code == http.StatusOK && !strings.Contains(recorder.Body.String(), `"a"`) {
+			t.Errorf("%s: stats don't list the client: %s", tt.name, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,447 @@
+// Package client speaks the SFU's signaling protocol, so that tests, load tools and bots share one
+// implementation of what the Electron app's RoomConnectionManager does.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sfu/pkg/signaling"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrNotJoined = errors.New("client hasn't joined")
+	ErrClosed    = errors.New("client is closed")
+)
+
+// JoinRejectedError is returned by Join when the SFU refuses the client, e.g. because the room is locked
+type JoinRejectedError struct {
+	Reason string
+}
+
+func (e *JoinRejectedError) Error() string {
+	return "join rejected: " + e.Reason
+}
+
+type Config struct {
+	// URL is the SFU's signaling endpoint, e.g. ws://localhost:50051/ws
+	URL      string
+	RoomID   string
+	ClientID string
+	Name     string
+	// Token issued by the backend, optional when the SFU has no JWT secret
+	Token string
+	// Codecs the client announces it can decode, the SFU only sends those
+	VideoCodecs []signaling.CodecCapability
+	AudioCodecs []signaling.CodecCapability
+	// API builds the PeerConnection, pion's default codecs and interceptors when nil
+	API        *webrtc.API
+	ICEServers []webrtc.ICEServer
+}
+
+// RemoteTrack is a track the SFU forwards from another participant
+type RemoteTrack struct {
+	// PeerID is the participant that publishes the track
+	PeerID      string
+	ScreenShare bool
+	Track       *webrtc.TrackRemote
+	Receiver    *webrtc.RTPReceiver
+}
+
+type Client interface {
+	// Publish adds a local track, it must be called before Join. Tracks are matched to the SFU's camera,
+	// microphone, screen share and screen share audio transceivers in the order they are published.
+	Publish(track webrtc.TrackLocal) error
+	// Join connects to the SFU and returns once the PeerConnection is connected
+	Join(ctx context.Context) error
+	// Send sends a signaling message, e.g. a moderator action or a subscriber mode
+	Send(msgType signaling.SignalMessageType, payload any) error
+	// SendEvent relays an event to the room over the events data channel
+	SendEvent(event signaling.Event) error
+	// RequestKeyFrames asks every publisher in the room for a key frame
+	RequestKeyFrames() error
+	OnTrack(f func(track *RemoteTrack))
+	// OnMessage receives the signaling messages the client doesn't handle itself, e.g. peerExit
+	OnMessage(f func(msg signaling.SignalMessage))
+	OnEvent(f func(event signaling.Event))
+	PeerConnection() *webrtc.PeerConnection
+	// Done is closed once the signaling connection is gone
+	Done() <-chan struct{}
+	// Close exits the room and closes the connections
+	Close() error
+}
+
+type defaultClient struct {
+	config Config
+	tracks []webrtc.TrackLocal
+	conn   *websocket.Conn
+	pc     *webrtc.PeerConnection
+	events *webrtc.DataChannel
+	// Remote candidates that arrived before the offer
+	candidates []webrtc.ICECandidateInit
+	onTrack    func(track *RemoteTrack)
+	onMessage  func(msg signaling.SignalMessage)
+	onEvent    func(event signaling.Event)
+	// Receives the join outcome, nil once connected
+	joined    chan error
+	done      chan struct{}
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	closeOnce sync.Once
+}
+
+func NewClient(config Config) Client {
+	return &defaultClient{
+		config: config,
+		joined: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *defaultClient) Publish(track webrtc.TrackLocal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pc != nil {
+		return errors.New("tracks must be published before joining")
+	}
+	c.tracks = append(c.tracks, track)
+	return nil
+}
+
+func (c *defaultClient) OnTrack(f func(track *RemoteTrack)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onTrack = f
+}
+
+func (c *defaultClient) OnMessage(f func(msg signaling.SignalMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = f
+}
+
+func (c *defaultClient) OnEvent(f func(event signaling.Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvent = f
+}
+
+func (c *defaultClient) PeerConnection() *webrtc.PeerConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pc
+}
+
+func (c *defaultClient) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *defaultClient) Join(ctx context.Context) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.config.URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to dial SFU: %w", err)
+	}
+	pc, err := c.newPeerConnection()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.pc = pc
+	tracks := c.tracks
+	c.mu.Unlock()
+
+	for _, track := range tracks {
+		if _, err := pc.AddTrack(track); err != nil {
+			c.Close()
+			return fmt.Errorf("failed to publish track %s: %w", track.ID(), err)
+		}
+	}
+	if err := c.openEvents(pc); err != nil {
+		c.Close()
+		return err
+	}
+	c.registerHandlers(pc)
+	go c.readLoop()
+
+	join := signaling.Join{
+		Name:        c.config.Name,
+		Token:       c.config.Token,
+		VideoCodecs: c.config.VideoCodecs,
+		AudioCodecs: c.config.AudioCodecs,
+	}
+	if err := c.Send(signaling.SignalMessageTypeJoin, join); err != nil {
+		c.Close()
+		return err
+	}
+
+	select {
+	case err := <-c.joined:
+		if err != nil {
+			c.Close()
+		}
+		return err
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+func (c *defaultClient) newPeerConnection() (*webrtc.PeerConnection, error) {
+	config := webrtc.Configuration{ICEServers: c.config.ICEServers}
+	var pc *webrtc.PeerConnection
+	var err error
+	if c.config.API != nil {
+		pc, err = c.config.API.NewPeerConnection(config)
+	} else {
+		pc, err = webrtc.NewPeerConnection(config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PeerConnection: %w", err)
+	}
+	return pc, nil
+}
+
+func (c *defaultClient) openEvents(pc *webrtc.PeerConnection) error {
+	negotiated := true
+	channelId := signaling.EventChannelID
+	dc, err := pc.CreateDataChannel(signaling.EventChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &channelId,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create events channel: %w", err)
+	}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var event signaling.Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			log.Printf("Failed to unmarshal event: %v", err)
+			return
+		}
+		c.mu.Lock()
+		onEvent := c.onEvent
+		c.mu.Unlock()
+		if onEvent != nil {
+			onEvent(event)
+		}
+	})
+	c.mu.Lock()
+	c.events = dc
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *defaultClient) registerHandlers(pc *webrtc.PeerConnection) {
+	// A nil candidate ends the gathering, the SFU is told so as well
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if err := c.Send(signaling.SignalMessageTypeCandidate, signaling.NewIceCandidate(candidate)); err != nil {
+			log.Printf("Failed to send candidate: %v", err)
+		}
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			c.joinDone(nil)
+		case webrtc.PeerConnectionStateFailed:
+			c.joinDone(errors.New("PeerConnection failed"))
+		}
+	})
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		peerId := strings.TrimSuffix(track.StreamID(), "-screen")
+		remote := &RemoteTrack{
+			PeerID:      peerId,
+			ScreenShare: peerId != track.StreamID(),
+			Track:       track,
+			Receiver:    receiver,
+		}
+		c.mu.Lock()
+		onTrack := c.onTrack
+		c.mu.Unlock()
+		if onTrack != nil {
+			onTrack(remote)
+		}
+		// Decoding starts at a key frame
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			if err := c.RequestKeyFrames(); err != nil {
+				log.Printf("Failed to request key frames: %v", err)
+			}
+		}
+	})
+}
+
+// joinDone reports the outcome of Join, only the first one counts
+func (c *defaultClient) joinDone(err error) {
+	select {
+	case c.joined <- err:
+	default:
+	}
+}
+
+func (c *defaultClient) readLoop() {
+	defer close(c.done)
+	for {
+		var msg signaling.SignalMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.joinDone(fmt.Errorf("signaling connection closed: %w", err))
+			return
+		}
+		if err := c.handleMessage(msg); err != nil {
+			log.Printf("Failed to handle %s: %v", msg.Type, err)
+		}
+	}
+}
+
+func (c *defaultClient) handleMessage(msg signaling.SignalMessage) error {
+	switch msg.Type {
+	case signaling.SignalMessageTypeOffer:
+		var offer signaling.SdpOffer
+		if err := json.Unmarshal(msg.Payload, &offer); err != nil {
+			return err
+		}
+		return c.handleOffer(offer.SDP)
+
+	case signaling.SignalMessageTypeAnswer:
+		var answer signaling.SdpAnswer
+		if err := json.Unmarshal(msg.Payload, &answer); err != nil {
+			return err
+		}
+		return c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP})
+
+	case signaling.SignalMessageTypeCandidate:
+		var candidate signaling.IceCandidate
+		if err := json.Unmarshal(msg.Payload, &candidate); err != nil {
+			return err
+		}
+		return c.addCandidate(candidate.ICECandidateInit())
+
+	case signaling.SignalMessageTypeJoinRejected:
+		var rejected signaling.JoinRejected
+		if err := json.Unmarshal(msg.Payload, &rejected); err != nil {
+			return err
+		}
+		c.joinDone(&JoinRejectedError{Reason: string(rejected.Reason)})
+	}
+
+	c.mu.Lock()
+	onMessage := c.onMessage
+	c.mu.Unlock()
+	if onMessage != nil {
+		onMessage(msg)
+	}
+	return nil
+}
+
+// handleOffer answers the SFU. The client never offers itself, it publishes on the transceivers the SFU
+// offers, so the two sides can't collide.
+func (c *defaultClient) handleOffer(sdp string) error {
+	if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+	c.mu.Lock()
+	candidates := c.candidates
+	c.candidates = nil
+	c.mu.Unlock()
+	for _, candidate := range candidates {
+		if err := c.pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Failed to add queued candidate: %v", err)
+		}
+	}
+
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	return c.Send(signaling.SignalMessageTypeAnswer, signaling.SdpAnswer{SDP: answer.SDP})
+}
+
+// addCandidate adds the SFU's candidate, candidates trickled ahead of the offer wait for it
+func (c *defaultClient) addCandidate(candidate webrtc.ICECandidateInit) error {
+	c.mu.Lock()
+	if c.pc.RemoteDescription() == nil {
+		c.candidates = append(c.candidates, candidate)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	return c.pc.AddICECandidate(candidate)
+}
+
+func (c *defaultClient) Send(msgType signaling.SignalMessageType, payload any) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotJoined
+	}
+	msg := signaling.SignalMessage{
+		Type:     msgType,
+		ClientID: c.config.ClientID,
+		RoomID:   c.config.RoomID,
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s payload: %w", msgType, err)
+		}
+		msg.Payload = data
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return conn.WriteJSON(msg)
+}
+
+func (c *defaultClient) SendEvent(event signaling.Event) error {
+	c.mu.Lock()
+	dc := c.events
+	c.mu.Unlock()
+	if dc == nil {
+		return ErrNotJoined
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return dc.Send(data)
+}
+
+func (c *defaultClient) RequestKeyFrames() error {
+	return c.Send(signaling.SignalMessageTypePLI, struct{}{})
+}
+
+func (c *defaultClient) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		conn := c.conn
+		pc := c.pc
+		c.mu.Unlock()
+		if conn != nil {
+			if sendErr := c.Send(signaling.SignalMessageTypeExit, signaling.Exit{PeerName: c.config.Name}); sendErr != nil {
+				log.Printf("Failed to send exit: %v", sendErr)
+			}
+		}
+		if pc != nil {
+			err = pc.Close()
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	})
+	return err
+}
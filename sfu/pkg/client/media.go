@@ -0,0 +1,259 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// Source writes samples to a local track in real time, publish its track before joining and run it after
+type Source interface {
+	Track() webrtc.TrackLocal
+	// Run writes samples until ctx is done or the source runs out, then closes the source
+	Run(ctx context.Context) error
+	// Close releases a source that never runs
+	Close() error
+}
+
+type sampleSource struct {
+	track *webrtc.TrackLocalStaticSample
+	// next returns io.EOF once the source ran out
+	next func() (media.Sample, error)
+	// rewind starts the source over, nil when it doesn't loop
+	rewind func() error
+	close  func() error
+}
+
+func (s *sampleSource) Track() webrtc.TrackLocal {
+	return s.track
+}
+
+func (s *sampleSource) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	closeFile := s.close
+	s.close = nil
+	return closeFile()
+}
+
+func (s *sampleSource) Run(ctx context.Context) error {
+	defer s.Close()
+	// Pace against the start, so that slow writes don't add up
+	due := time.Now()
+	for {
+		sample, err := s.next()
+		if errors.Is(err, io.EOF) && s.rewind != nil {
+			if err := s.rewind(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.track.WriteSample(sample); err != nil {
+			return err
+		}
+
+		due = due.Add(sample.Duration)
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// NewIVFSource plays a VP8, VP9 or AV1 IVF file, from the start again when loop is set
+func NewIVFSource(path string, trackId string, streamId string, loop bool) (Source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read IVF header: %w", err)
+	}
+
+	var mimeType string
+	switch header.FourCC {
+	case "VP80":
+		mimeType = webrtc.MimeTypeVP8
+	case "VP90":
+		mimeType = webrtc.MimeTypeVP9
+	case "AV01":
+		mimeType = webrtc.MimeTypeAV1
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unsupported IVF codec %q", header.FourCC)
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, trackId, streamId)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	frameDuration := time.Duration(float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator) * float64(time.Second))
+	source := &sampleSource{
+		track: track,
+		next: func() (media.Sample, error) {
+			frame, _, err := reader.ParseNextFrame()
+			if err != nil {
+				return media.Sample{}, err
+			}
+			return media.Sample{Data: frame, Duration: frameDuration}, nil
+		},
+		close: file.Close,
+	}
+	if loop {
+		source.rewind = func() error {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			reader, _, err = ivfreader.NewWith(file)
+			return err
+		}
+	}
+	return source, nil
+}
+
+// NewOggSource plays an Ogg Opus file, from the start again when loop is set
+func NewOggSource(path string, trackId string, streamId string, loop bool) (Source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := oggreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read Ogg header: %w", err)
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, trackId, streamId)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var lastGranule uint64
+	source := &sampleSource{
+		track: track,
+		next: func() (media.Sample, error) {
+			page, header, err := reader.ParseNextPage()
+			if err != nil {
+				return media.Sample{}, err
+			}
+			// The granule position counts 48 kHz samples
+			samples := header.GranulePosition - lastGranule
+			lastGranule = header.GranulePosition
+			return media.Sample{Data: page, Duration: time.Duration(samples) * time.Second / 48000}, nil
+		},
+		close: file.Close,
+	}
+	if loop {
+		source.rewind = func() error {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			lastGranule = 0
+			reader, _, err = oggreader.NewWith(file)
+			return err
+		}
+	}
+	return source, nil
+}
+
+// NewGeneratedVideo sends VP8 frames at fps with a key frame every keyFrameInterval. Key frames decode
+// to a gray picture, the frames between them carry valid frame tags, which is all the SFU forwarding
+// looks at, but no decodable picture.
+func NewGeneratedVideo(trackId string, streamId string, fps int, keyFrameInterval time.Duration) (Source, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, trackId, streamId)
+	if err != nil {
+		return nil, err
+	}
+	frameDuration := time.Second / time.Duration(fps)
+	keyFrameEvery := int(keyFrameInterval / frameDuration)
+	if keyFrameEvery < 1 {
+		keyFrameEvery = 1
+	}
+	frame := 0
+	return &sampleSource{
+		track: track,
+		next: func() (media.Sample, error) {
+			// Frame tag: bit 0 clear marks a key frame, bit 4 is show_frame
+			data := []byte{0x11, 0x00, 0x00}
+			if frame%keyFrameEvery == 0 {
+				// Key frame of a 320x240 picture. Its partitions are zeros, which decode as every flag off
+				// and every macroblock predicted from the gray edges without residuals.
+				const partitionSize = 256
+				tag := 0x10 | partitionSize<<5
+				data = []byte{byte(tag), byte(tag >> 8), byte(tag >> 16), 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00}
+				data = append(data, make([]byte, 2*partitionSize)...)
+			}
+			frame++
+			return media.Sample{Data: data, Duration: frameDuration}, nil
+		},
+	}, nil
+}
+
+// NewGeneratedAudio sends Opus silence in 20ms frames
+func NewGeneratedAudio(trackId string, streamId string) (Source, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, trackId, streamId)
+	if err != nil {
+		return nil, err
+	}
+	return &sampleSource{
+		track: track,
+		next: func() (media.Sample, error) {
+			return media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond}, nil
+		},
+	}, nil
+}
+
+// NewGeneratedH264 sends H.264 access units at fps with an IDR picture every keyFrameInterval. Key
+// frames carry an SPS and PPS of a 320x240 constrained baseline stream, the slices are no decodable picture.
+func NewGeneratedH264(trackId string, streamId string, fps int, keyFrameInterval time.Duration) (Source, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, trackId, streamId)
+	if err != nil {
+		return nil, err
+	}
+	frameDuration := time.Second / time.Duration(fps)
+	keyFrameEvery := int(keyFrameInterval / frameDuration)
+	if keyFrameEvery < 1 {
+		keyFrameEvery = 1
+	}
+	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+	frame := 0
+	return &sampleSource{
+		track: track,
+		next: func() (media.Sample, error) {
+			var data []byte
+			if frame%keyFrameEvery == 0 {
+				sps := []byte{0x67, 0x42, 0xe0, 0x1f, 0xda, 0x05, 0x07, 0xe8}
+				pps := []byte{0x68, 0xce, 0x3c, 0x80}
+				data = append(data, startCode...)
+				data = append(data, sps...)
+				data = append(data, startCode...)
+				data = append(data, pps...)
+				data = append(data, startCode...)
+				data = append(data, 0x65, 0x88, 0x84, 0x00, 0x33, 0xff)
+			} else {
+				data = append(data, startCode...)
+				data = append(data, 0x41, 0x9a, 0x02, 0x0c, 0x0f)
+			}
+			frame++
+			return media.Sample{Data: data, Duration: frameDuration}, nil
+		},
+	}, nil
+}
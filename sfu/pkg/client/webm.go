@@ -0,0 +1,348 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// Matroska element ids, only the ones needed to find the frames of a WebM file
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDTracks        = 0x1654AE6B
+	ebmlIDTrackEntry    = 0xAE
+	ebmlIDTrackNumber   = 0xD7
+	ebmlIDCodecID       = 0x86
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecode      = 0xE7
+	ebmlIDBlockGroup    = 0xA0
+	ebmlIDBlock         = 0xA1
+	ebmlIDSimpleBlock   = 0xA3
+)
+
+// An element size with every bit set means the size is unknown, live recordings write clusters like that
+const ebmlUnknownSize = -1
+
+// webmTrack is a track of a WebM file that can be published
+type webmTrack struct {
+	number   uint64
+	mimeType string
+}
+
+type webmFrame struct {
+	track     uint64
+	timestamp time.Duration
+	data      []byte
+}
+
+// webmReader reads the frames of a WebM file in file order. Container elements are entered rather than
+// read whole, so files with clusters of unknown size stream as well.
+type webmReader struct {
+	r             *bufio.Reader
+	timecodeScale uint64
+	clusterTime   uint64
+	tracks        []webmTrack
+	// The track entry being read
+	entry *webmTrack
+}
+
+func newWebMReader(r io.Reader) (*webmReader, error) {
+	w := &webmReader{r: bufio.NewReader(r), timecodeScale: 1000000}
+	id, size, err := w.readElementHeader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EBML header: %w", err)
+	}
+	if id != ebmlIDHeader || size == ebmlUnknownSize {
+		return nil, errors.New("not a WebM file")
+	}
+	if _, err := w.r.Discard(int(size)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// readTracks reads up to the first frame and returns the tracks that can be published
+func (w *webmReader) readTracks() ([]webmTrack, error) {
+	if _, err := w.nextFrame(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	w.finishEntry()
+	return w.tracks, nil
+}
+
+func (w *webmReader) nextFrame() (*webmFrame, error) {
+	for {
+		id, size, err := w.readElementHeader()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case ebmlIDSegment, ebmlIDInfo, ebmlIDTracks, ebmlIDCluster, ebmlIDBlockGroup:
+			// Their children are read in the next iterations
+			continue
+		case ebmlIDTrackEntry:
+			w.finishEntry()
+			w.entry = &webmTrack{}
+			continue
+		}
+		if size == ebmlUnknownSize {
+			return nil, fmt.Errorf("element %x has an unknown size", id)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(w.r, data); err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case ebmlIDTimecodeScale:
+			w.timecodeScale = readUint(data)
+		case ebmlIDTrackNumber:
+			if w.entry != nil {
+				w.entry.number = readUint(data)
+			}
+		case ebmlIDCodecID:
+			if w.entry != nil {
+				w.entry.mimeType = webmMimeType(string(data))
+			}
+		case ebmlIDTimecode:
+			w.clusterTime = readUint(data)
+		case ebmlIDSimpleBlock, ebmlIDBlock:
+			w.finishEntry()
+			return w.parseBlock(data)
+		}
+	}
+}
+
+// finishEntry keeps the track entry that was read if it can be published
+func (w *webmReader) finishEntry() {
+	if w.entry != nil && w.entry.number != 0 && w.entry.mimeType != "" {
+		w.tracks = append(w.tracks, *w.entry)
+	}
+	w.entry = nil
+}
+
+func (w *webmReader) parseBlock(data []byte) (*webmFrame, error) {
+	track, n := parseVint(data)
+	if n == 0 || len(data) < n+3 {
+		return nil, errors.New("malformed block")
+	}
+	relative := int16(binary.BigEndian.Uint16(data[n:]))
+	flags := data[n+2]
+	if flags&0x06 != 0 {
+		return nil, errors.New("laced blocks aren't supported")
+	}
+	timecode := int64(w.clusterTime) + int64(relative)
+	return &webmFrame{
+		track:     track,
+		timestamp: time.Duration(timecode * int64(w.timecodeScale)),
+		data:      data[n+3:],
+	}, nil
+}
+
+// readElementHeader reads an element's id, which keeps its length marker, and its size
+func (w *webmReader) readElementHeader() (uint64, int64, error) {
+	id, _, err := w.readVint()
+	if err != nil {
+		return 0, 0, err
+	}
+	size, length, err := w.readVint()
+	if err != nil {
+		return 0, 0, err
+	}
+	value, _ := parseVint(size)
+	if value == 1<<(7*length)-1 {
+		return readUint(id), ebmlUnknownSize, nil
+	}
+	return readUint(id), int64(value), nil
+}
+
+// readVint reads the bytes of an EBML variable length integer
+func (w *webmReader) readVint() ([]byte, int, error) {
+	first, err := w.r.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	length := vintLength(first)
+	if length == 0 {
+		return nil, 0, errors.New("malformed EBML integer")
+	}
+	buf := make([]byte, length)
+	buf[0] = first
+	if _, err := io.ReadFull(w.r, buf[1:]); err != nil {
+		return nil, 0, err
+	}
+	return buf, length, nil
+}
+
+// vintLength returns the length of the integer its first byte announces, 0 when it is malformed
+func vintLength(first byte) int {
+	for length := 1; length <= 8; length++ {
+		if first&(0x80>>(length-1)) != 0 {
+			return length
+		}
+	}
+	return 0
+}
+
+// parseVint returns the value of the variable length integer at the start of data without its length
+// marker, and how many bytes it took
+func parseVint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	length := vintLength(data[0])
+	if length == 0 || len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0] & (0xff >> length))
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+func readUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// webmMimeType maps a Matroska codec id to the codecs the SFU forwards, empty for the others
+func webmMimeType(codecId string) string {
+	switch codecId {
+	case "V_VP8":
+		return webrtc.MimeTypeVP8
+	case "V_VP9":
+		return webrtc.MimeTypeVP9
+	case "V_AV1":
+		return webrtc.MimeTypeAV1
+	case "A_OPUS":
+		return webrtc.MimeTypeOpus
+	}
+	return ""
+}
+
+// NewWebMSources plays the VP8, VP9, AV1 and Opus tracks of a WebM file, one source per track with track
+// ids video and audio. Each track reads the file on its own, from the start again when loop is set.
+func NewWebMSources(path string, streamId string, loop bool) ([]Source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newWebMReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	tracks, err := reader.readTracks()
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WebM tracks: %w", err)
+	}
+
+	var sources []Source
+	seen := map[string]bool{}
+	for _, track := range tracks {
+		trackId := "audio"
+		if track.mimeType != webrtc.MimeTypeOpus {
+			trackId = "video"
+		}
+		// A participant publishes one camera and one microphone
+		if seen[trackId] {
+			continue
+		}
+		seen[trackId] = true
+		source, err := newWebMTrackSource(path, track, trackId, streamId, loop)
+		if err != nil {
+			for _, source := range sources {
+				source.Close()
+			}
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("WebM file has no VP8, VP9, AV1 or Opus track")
+	}
+	return sources, nil
+}
+
+func newWebMTrackSource(path string, track webmTrack, trackId string, streamId string, loop bool) (*sampleSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newWebMReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	local, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: track.mimeType}, trackId, streamId)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// A frame lasts until the next one of its track, the last one as long as the one before it
+	var pending *webmFrame
+	var lastDuration time.Duration
+	nextOfTrack := func() (*webmFrame, error) {
+		for {
+			frame, err := reader.nextFrame()
+			if err != nil {
+				return nil, err
+			}
+			if frame.track == track.number {
+				return frame, nil
+			}
+		}
+	}
+	source := &sampleSource{
+		track: local,
+		next: func() (media.Sample, error) {
+			if pending == nil {
+				frame, err := nextOfTrack()
+				if err != nil {
+					return media.Sample{}, err
+				}
+				pending = frame
+			}
+			frame := pending
+			following, err := nextOfTrack()
+			switch {
+			case err == nil:
+				lastDuration = following.timestamp - frame.timestamp
+				pending = following
+			case errors.Is(err, io.EOF):
+				pending = nil
+			default:
+				return media.Sample{}, err
+			}
+			return media.Sample{Data: frame.data, Duration: max(lastDuration, 0)}, nil
+		},
+		close: file.Close,
+	}
+	if loop {
+		source.rewind = func() error {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			pending = nil
+			reader, err = newWebMReader(file)
+			return err
+		}
+	}
+	return source, nil
+}
@@ -0,0 +1,38 @@
+package signaling
+
+import "github.com/pion/webrtc/v3"
+
+// NewIceCandidate converts a local candidate for the other side, nil marks the end of candidates
+func NewIceCandidate(candidate *webrtc.ICECandidate) IceCandidate {
+	if candidate == nil {
+		return IceCandidate{}
+	}
+	jsonCandidate := candidate.ToJSON()
+	newCandidate := IceCandidate{Candidate: jsonCandidate.Candidate}
+	if jsonCandidate.SDPMid != nil {
+		newCandidate.SdpMid = *jsonCandidate.SDPMid
+	}
+	if jsonCandidate.SDPMLineIndex != nil {
+		newCandidate.SdpMLineIndex = int(*jsonCandidate.SDPMLineIndex)
+	}
+	if jsonCandidate.UsernameFragment != nil {
+		newCandidate.UsernameFragment = *jsonCandidate.UsernameFragment
+	}
+	return newCandidate
+}
+
+// ICECandidateInit keeps every field the other side sent, an empty candidate marks the end of candidates
+func (c *IceCandidate) ICECandidateInit() webrtc.ICECandidateInit {
+	sdpMLineIndex := uint16(c.SdpMLineIndex)
+	init := webrtc.ICECandidateInit{
+		Candidate:     c.Candidate,
+		SDPMLineIndex: &sdpMLineIndex,
+	}
+	if c.SdpMid != "" {
+		init.SDPMid = &c.SdpMid
+	}
+	if c.UsernameFragment != "" {
+		init.UsernameFragment = &c.UsernameFragment
+	}
+	return init
+}
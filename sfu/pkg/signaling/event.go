@@ -0,0 +1,37 @@
+package signaling
+
+import "encoding/json"
+
+// The SFU and its clients each create the events data channel with this id, so it needs no signaling of its own
+const (
+	EventChannelLabel        = "events"
+	EventChannelID    uint16 = 1
+)
+
+// Event is a small in-call message clients exchange over their events data channel, the SFU relays it to
+// the room, or only to To when set
+type Event struct {
+	Type EventType `json:"type"`
+	// Set by the SFU to the sender, whatever the sender put there
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type EventType string
+
+const (
+	EventTypeReaction  EventType = "reaction"
+	EventTypeHandRaise EventType = "handRaise"
+	EventTypeTyping    EventType = "typing"
+	// Pointer positions over a screen share
+	EventTypePointer EventType = "pointer"
+)
+
+func (t EventType) Valid() bool {
+	switch t {
+	case EventTypeReaction, EventTypeHandRaise, EventTypeTyping, EventTypePointer:
+		return true
+	}
+	return false
+}
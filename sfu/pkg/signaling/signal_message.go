@@ -0,0 +1,237 @@
+package signaling
+
+import "encoding/json"
+
+type SignalMessage struct {
+	Type     SignalMessageType `json:"type"`
+	ClientID string            `json:"clientId,omitempty"`
+	RoomID   string            `json:"roomId,omitempty"`
+	Payload  json.RawMessage   `json:"payload,omitempty"`
+}
+
+type SignalMessageType string
+
+const (
+	SignalMessageTypeJoin        SignalMessageType = "join"
+	SignalMessageTypeExit        SignalMessageType = "exit"
+	SignalMessageTypePeerExit    SignalMessageType = "peerExit"
+	SignalMessageTypeOffer       SignalMessageType = "offer"
+	SignalMessageTypeAnswer      SignalMessageType = "answer"
+	SignalMessageTypeCandidate   SignalMessageType = "candidate"
+	SignalMessageTypeSubscribe   SignalMessageType = "subscribe"
+	SignalMessageTypeUnsubscribe SignalMessageType = "unsubscribe"
+	SignalMessageTypePLI         SignalMessageType = "pli"
+
+	SignalMessageTypeServerDraining SignalMessageType = "serverDraining"
+	SignalMessageTypeRelayJoin      SignalMessageType = "relayJoin"
+	SignalMessageTypeCodecMismatch  SignalMessageType = "codecMismatch"
+	SignalMessageTypeSubscriberMode SignalMessageType = "subscriberMode"
+	SignalMessageTypeJoinRejected   SignalMessageType = "joinRejected"
+	// Telemetry for the client, the signaling writer coalesces or drops it when the connection falls behind
+	SignalMessageTypeStats SignalMessageType = "stats"
+
+	// Moderator actions, the target receives the same type when it is applied to them
+	SignalMessageTypeMuteParticipant   SignalMessageType = "muteParticipant"
+	SignalMessageTypeMuteAll           SignalMessageType = "muteAll"
+	SignalMessageTypeStopVideo         SignalMessageType = "stopVideo"
+	SignalMessageTypeStopScreenShare   SignalMessageType = "stopScreenShare"
+	SignalMessageTypeRemoveParticipant SignalMessageType = "removeParticipant"
+	SignalMessageTypeLockRoom          SignalMessageType = "lockRoom"
+	SignalMessageTypeWaitingRoom       SignalMessageType = "waitingRoom"
+	SignalMessageTypeAdmit             SignalMessageType = "admit"
+	SignalMessageTypeDeny              SignalMessageType = "deny"
+	// Moves an attendee onto the stage as a panelist, or back off it
+	SignalMessageTypePromote SignalMessageType = "promote"
+	SignalMessageTypeDemote  SignalMessageType = "demote"
+	// Breakout rooms, participants are moved between rooms without rejoining
+	SignalMessageTypeMoveParticipant SignalMessageType = "moveParticipant"
+	SignalMessageTypeCloseBreakouts  SignalMessageType = "closeBreakouts"
+	SignalMessageTypeRoomState       SignalMessageType = "roomState"
+	// Playback bots, virtual participants that play media files into the room
+	SignalMessageTypeStartPlayback SignalMessageType = "startPlayback"
+	SignalMessageTypeStopPlayback  SignalMessageType = "stopPlayback"
+	SignalMessageTypePlayback      SignalMessageType = "playback"
+
+	// Admission events, the joiner receives its admission status and the moderators the requests
+	SignalMessageTypeAdmission        SignalMessageType = "admission"
+	SignalMessageTypeAdmissionRequest SignalMessageType = "admissionRequest"
+)
+
+type SdpOffer struct {
+	SDP string `json:"sdp"`
+}
+
+type SdpAnswer struct {
+	SDP string `json:"sdp"`
+}
+
+// IceCandidate is trickled both ways, an empty Candidate marks the end of candidates
+type IceCandidate struct {
+	Candidate        string `json:"candidate"`
+	SdpMid           string `json:"sdpMid"`
+	SdpMLineIndex    int    `json:"sdpMLineIndex"`
+	UsernameFragment string `json:"usernameFragment"`
+}
+
+type Exit struct {
+	PeerName string `json:"peerName"`
+}
+
+type PeerExit struct {
+	PeerID   string `json:"peerId"`
+	PeerName string `json:"peerName"`
+}
+
+type Join struct {
+	Name string `json:"name"`
+	// Token issued by the backend, its claims carry the client's rights in the room
+	Token string `json:"token,omitempty"`
+	// Video codecs the client can decode, as returned by RTCRtpReceiver.getCapabilities("video")
+	VideoCodecs []CodecCapability `json:"videoCodecs,omitempty"`
+	AudioCodecs []CodecCapability `json:"audioCodecs,omitempty"`
+	// The client rolls back its own offer when the SFU's collides with it, explicitly or by setting the
+	// SFU's offer as its remote description. The SFU yields to the offers of clients that don't.
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+type CodecCapability struct {
+	MimeType    string `json:"mimeType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    uint16 `json:"channels,omitempty"`
+	SDPFmtpLine string `json:"sdpFmtpLine,omitempty"`
+}
+
+// CodecMismatch tells a subscriber that a stream isn't sent because it can't decode its codec
+type CodecMismatch struct {
+	PeerID   string `json:"peerId"`
+	StreamID string `json:"streamId"`
+	MimeType string `json:"mimeType"`
+}
+
+// Stats describe the client's PeerConnection as the SFU sees it, they are sent periodically
+type Stats struct {
+	// Latest round trip time of the candidate pair in use
+	RoundTripTimeMs float64 `json:"roundTripTimeMs"`
+	// Bytes the SFU sent to and received from the client over the ICE transport
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+}
+
+type JoinRejectedReason string
+
+const (
+	JoinRejectedRoomLocked   JoinRejectedReason = "roomLocked"
+	JoinRejectedInvalidToken JoinRejectedReason = "invalidToken"
+	// The client offered without joining through this connection first
+	JoinRejectedNotJoined JoinRejectedReason = "notJoined"
+)
+
+type JoinRejected struct {
+	Reason JoinRejectedReason `json:"reason"`
+}
+
+// ModeratorAction targets a participant. The SFU passes it on to the target with By set to the moderator.
+type ModeratorAction struct {
+	PeerID string `json:"peerId,omitempty"`
+	By     string `json:"by,omitempty"`
+	// Lifts a mute or stop again
+	Release bool `json:"release,omitempty"`
+}
+
+type LockRoom struct {
+	Locked bool `json:"locked"`
+}
+
+// WaitingRoom enables or disables the room's waiting room. Waiting peers preview the streams of the lobby peer.
+type WaitingRoom struct {
+	Enabled     bool   `json:"enabled"`
+	LobbyPeerID string `json:"lobbyPeerId,omitempty"`
+}
+
+type AdmissionStatus string
+
+const (
+	AdmissionWaiting  AdmissionStatus = "waiting"
+	AdmissionAdmitted AdmissionStatus = "admitted"
+	AdmissionDenied   AdmissionStatus = "denied"
+)
+
+type Admission struct {
+	Status AdmissionStatus `json:"status"`
+}
+
+// AdmissionRequest tells the moderators that a peer is waiting to be admitted
+type AdmissionRequest struct {
+	PeerID   string `json:"peerId"`
+	PeerName string `json:"peerName"`
+}
+
+// MoveParticipant moves a peer into another room, a room that doesn't exist yet is opened as a breakout
+type MoveParticipant struct {
+	PeerID string `json:"peerId"`
+	RoomID string `json:"roomId"`
+}
+
+// RoomState tells a moved client which room it is in now and who else is there
+type RoomState struct {
+	RoomID string     `json:"roomId"`
+	Peers  []RoomPeer `json:"peers"`
+}
+
+type RoomPeer struct {
+	PeerID   string `json:"peerId"`
+	PeerName string `json:"peerName"`
+}
+
+// StartPlayback joins a bot that plays media files into the room. The files are relative to the SFU's media
+// directory, at most one video and one audio stream: .ivf, .ogg or .opus, and .webm with either or both.
+type StartPlayback struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+	// Plays the files again once they ended, the bot leaves after one pass otherwise
+	Loop bool `json:"loop,omitempty"`
+}
+
+type StopPlayback struct {
+	PeerID string `json:"peerId"`
+}
+
+type PlaybackState string
+
+const (
+	PlaybackStarted PlaybackState = "started"
+	PlaybackEnded   PlaybackState = "ended"
+	PlaybackFailed  PlaybackState = "failed"
+)
+
+// Playback tells the moderator that started a bot what became of it
+type Playback struct {
+	PeerID string        `json:"peerId,omitempty"`
+	State  PlaybackState `json:"state"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// SubscriberMode limits the video a client receives, one of default, audioOnly, lowData or screenPriority
+type SubscriberMode struct {
+	Mode string `json:"mode"`
+}
+
+type ServerDraining struct {
+	ReconnectDelayMs int64 `json:"reconnectDelayMs"`
+}
+
+type RelayDirection string
+
+const (
+	// The relay receives the sources of the room's local peers
+	RelayDirectionSubscribe RelayDirection = "subscribe"
+	// The relay sends the sources of its own node's peers into the room
+	RelayDirectionPublish RelayDirection = "publish"
+)
+
+type RelayJoin struct {
+	NodeID    string         `json:"nodeId"`
+	Direction RelayDirection `json:"direction"`
+	// Signed by the joining node for itself, required when the SFU requires join tokens
+	Token string `json:"token,omitempty"`
+}